@@ -8,8 +8,18 @@ package api
 // agent in the pipeline does not have to distinguish between measurement
 // data bundles and index bundles.  In other words, as far as the pipeline
 // is concerned, index1 is just another datatype.
+//
+// Line, Offset, RawOffset, RawSize, and FileSize locate the file in the
+// data bundle so it can be extracted exactly as the measurement service
+// wrote it without parsing the bundle.  They are zero in index bundles
+// created before they were added.
 type IndexV1 struct {
 	Filename  string // full pathname to the measurement data file
-	Size      int    // size of the measurement data file
+	Size      int    // size of the line (row) of the file in the data bundle
 	TimeAdded string // when measurement data file was added to data bundle
+	Line      int    // line number of the row in the data bundle starting at 1
+	Offset    int    // byte offset of the row in the uncompressed data bundle
+	RawOffset int    // byte offset of the file's contents (raw) in the row
+	RawSize   int    // size of the file's contents in the row
+	FileSize  int    // size of the measurement data file
 }
@@ -2,9 +2,21 @@
 package api
 
 import (
+	"time"
+
+	"cloud.google.com/go/bigquery"
 	"cloud.google.com/go/civil"
 )
 
+// Versions of standard columns that can be selected per datatype.
+const (
+	StdColsV0 = "v0"
+	StdColsV1 = "v1"
+)
+
+// StdColsVersions lists all supported versions of standard columns.
+var StdColsVersions = []string{StdColsV0, StdColsV1}
+
 // StandardColumnsV0 defines version 0 of the standard columns included
 // in every line (row) along with the raw data from the measurement service.
 //
@@ -27,3 +39,47 @@ type ArchiverV0 struct {
 	ArchiveURL string `bigquery:"ArchiveURL"` // GCS object name of the bundle
 	Filename   string `bigquery:"Filename"`   // pathname of the file in the bundle
 }
+
+// StandardColumnsV1 defines version 1 of the standard columns.  It is a
+// superset of version 0 so tables created with version 0 standard
+// columns can migrate to version 1 by adding fields.
+type StandardColumnsV1 struct {
+	Date     civil.Date `bigquery:"date"`     // yyyy-mm-dd pathname component of measurement data
+	Archiver ArchiverV1 `bigquery:"archiver"` // archiver details
+	Raw      string     `bigquery:"raw"`      // measurement data (file contents) in JSON format
+}
+
+// ArchiverV1 defines version 1 of archiver details that includes, in
+// addition to version 0 details, which node archived the file, its
+// experiment and datatype, and when it was modified and bundled.
+//
+// Fields added in version 1 are nullable because BigQuery only allows
+// adding nullable fields to existing tables.
+type ArchiverV1 struct {
+	Version    string                 `bigquery:"Version"`    // running version of this program
+	GitCommit  string                 `bigquery:"GitCommit"`  // git commit sha1 of this program
+	ArchiveURL string                 `bigquery:"ArchiveURL"` // GCS object name of the bundle
+	Filename   string                 `bigquery:"Filename"`   // pathname of the file in the bundle
+	Node       bigquery.NullString    `bigquery:"Node"`       // node name (e.g., mlab1-lga01.mlab-sandbox.measurement-lab.org)
+	Machine    bigquery.NullString    `bigquery:"Machine"`    // machine part of node name (e.g., mlab1)
+	Site       bigquery.NullString    `bigquery:"Site"`       // site part of node name (e.g., lga01)
+	Project    bigquery.NullString    `bigquery:"Project"`    // project part of node name (e.g., mlab-sandbox)
+	Experiment bigquery.NullString    `bigquery:"Experiment"` // experiment name
+	Datatype   bigquery.NullString    `bigquery:"Datatype"`   // datatype name
+	FileMTime  bigquery.NullTimestamp `bigquery:"FileMTime"`  // modification time of the file
+	BundleTime bigquery.NullTimestamp `bigquery:"BundleTime"` // when the file was added to the bundle
+}
+
+// PromotedColumns defines standard columns whose values are promoted
+// (i.e., copied) from fields of the measurement data in raw so tables
+// can be joined and filtered like other M-Lab tables.  They are only
+// included in lines of datatypes that are configured to promote them.
+type PromotedColumns struct {
+	ID string   `bigquery:"id" json:"id,omitempty"` // unique identifier of the measurement (e.g., UUID)
+	A  *Summary `bigquery:"a" json:"a,omitempty"`   // summary of the measurement
+}
+
+// Summary defines the "a" record of promoted columns.
+type Summary struct {
+	TestTime time.Time `bigquery:"TestTime"` // start time of the measurement
+}
@@ -0,0 +1,143 @@
+// Package main implements jostler.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/m-lab/jostler/internal/spoollock"
+	"github.com/m-lab/jostler/internal/uploadbundle"
+	"github.com/m-lab/jostler/internal/watchdir"
+)
+
+// Flags related to the backfill subcommand.
+var backfillFormat string
+
+var errBackfill = errors.New("failed to backfill")
+
+// backfillCmd implements "jostler backfill" which bundles all existing
+// files of each datatype regardless of their age, uploads the bundles,
+// waits for the uploads to finish, and prints a summary.  It exits
+// with an error if any file could not be bundled or any bundle could
+// not be uploaded.
+//
+// Files are bundled and uploaded exactly as in the daemon mode so
+// backfill refuses to run while the daemon is running for the same
+// datatypes (see the spoollock package).
+func backfillCmd(args []string) error {
+	fs := newFlagSet("backfill")
+	addGCSFlags(fs)
+	addDatatypeFlags(fs)
+	addBundleFlags(fs)
+	fs.StringVar(&backfillFormat, "format", "text", "output format (text or json)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if backfillFormat != "text" && backfillFormat != "json" {
+		return fmt.Errorf("%v: %w", backfillFormat, errFormat)
+	}
+	if err := validateDaemonFlags(); err != nil {
+		return err
+	}
+	configureSchema()
+
+	ctx := context.Background()
+	stClient, err := newStorageClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create storage client: %w", err)
+	}
+	if err = validateAndUploadSchemas(stClient); err != nil {
+		return err
+	}
+
+	summaries := make([]uploadbundle.BackfillSummary, 0, len(datatypes))
+	for _, datatype := range datatypes {
+		summary, err := backfillDatatype(ctx, stClient, datatype)
+		if err != nil {
+			return err
+		}
+		summaries = append(summaries, summary)
+	}
+	if backfillFormat == "json" {
+		if err := writeJSON(stdout, summaries); err != nil {
+			return err
+		}
+	} else {
+		for _, summary := range summaries {
+			writeBackfillText(stdout, summary)
+		}
+	}
+	for _, summary := range summaries {
+		if !summary.OK() {
+			return errBackfill
+		}
+	}
+	return nil
+}
+
+// addBundleFlags adds flags related to bundles and their GCS object
+// names to the given flag set.
+func addBundleFlags(fs *flag.FlagSet) {
+	fs.Var(&mlabNodeName, "mlab-node-name", "required - node name, specified directly or via @file or via MLAB_NODE_NAME env variable")
+	fs.BoolVar(&uploadSchema, "upload-schema", uploadSchema, "upload the local table schema if necessary")
+	fs.StringVar(&dataObjTemplate, "data-object-template", dataObjTemplate, "template of GCS object names of data bundles relative to gcs-data-dir")
+	fs.StringVar(&indexObjTemplate, "index-object-template", indexObjTemplate, "template of GCS object names of index bundles relative to gcs-data-dir")
+	fs.UintVar(&bundleSizeMax, "bundle-size-max", bundleSizeMax, "maximum bundle size in bytes before it is uploaded")
+	fs.DurationVar(&bundleAgeMax, "bundle-age-max", bundleAgeMax, "maximum bundle age before it is uploaded")
+	fs.UintVar(&bundleRowsMax, "bundle-rows-max", bundleRowsMax, "maximum number of rows in a bundle before it is uploaded (0 for no limit)")
+	fs.UintVar(&bundleCompressedSizeMax, "bundle-compressed-size-max", bundleCompressedSizeMax, "maximum estimated compressed bundle size in bytes before it is uploaded (0 for no limit)")
+	fs.Var(&dateSources, "date-source", "source of the date of files for each datatype in the format <datatype>:<source> (dir, mtime, or field:<field>, default dir)")
+	fs.Var(&layouts, "layout", "layout of files for each datatype in the format <datatype>:<template> (e.g., foo1:{yyyy}-{mm}-{dd}/{name}, default {yyyy}/{mm}/{dd}/{name})")
+	fs.Var(&partitions, "partition", "partition of bundles for each datatype in the format <datatype>:<partition> (day, hour, or a duration that evenly divides a day such as 15m, default day)")
+	fs.Var(&extensions, "extensions", "filename extensions to bundle within <data-dir>/<experiment> (default .json)")
+}
+
+// backfillDatatype bundles and uploads all existing files of the given
+// datatype via the given storage client.
+func backfillDatatype(ctx context.Context, stClient storageClient, datatype string) (uploadbundle.BackfillSummary, error) {
+	// The flags were validated already.
+	dateSource, dateField, _ := datatypeDateSource(datatype)
+	dtLayout, _ := datatypeLayout(datatype, dateSource)
+	dataDir := filepath.Join(localDataDir, experiment, datatype)
+	if _, err := os.Stat(dataDir); err != nil {
+		return uploadbundle.BackfillSummary{}, fmt.Errorf("%v: %w", datatype, err)
+	}
+	// Refuse to run while the daemon (or another backfill) bundles
+	// files of this datatype.
+	lock, err := spoollock.New(dataDir)
+	if err != nil {
+		return uploadbundle.BackfillSummary{}, fmt.Errorf("%v: %w", datatype, err)
+	}
+	defer func() {
+		_ = lock.Unlock()
+	}()
+	// The directory watcher is only used to find files and is never
+	// started.
+	wdClient, err := watchdir.New(dataDir, extensions, dtLayout, nil, 0, 0)
+	if err != nil {
+		return uploadbundle.BackfillSummary{}, fmt.Errorf("failed to instantiate watcher: %w", err)
+	}
+	fullPaths, err := wdClient.Files()
+	if err != nil {
+		return uploadbundle.BackfillSummary{}, fmt.Errorf("%v: %w", datatype, err)
+	}
+	ubClient, err := newUploader(ctx, stClient, datatype, dateSource, dateField, dtLayout, wdClient, nil, nil)
+	if err != nil {
+		return uploadbundle.BackfillSummary{}, err
+	}
+	return ubClient.Backfill(ctx, fullPaths), nil
+}
+
+// writeBackfillText writes the summary of a backfill in text format.
+func writeBackfillText(w io.Writer, summary uploadbundle.BackfillSummary) {
+	fmt.Fprintf(w, "%v: %d file(s) in %d bundle(s): %d uploaded, %d failed, %d bad file(s), %d skipped file(s)\n",
+		summary.Datatype, summary.Files, summary.Bundles, summary.Uploaded, summary.Failed, summary.BadFiles, summary.Skipped)
+	for _, e := range summary.Errors {
+		fmt.Fprintf(w, "  error: %v\n", e)
+	}
+}
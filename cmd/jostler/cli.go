@@ -5,13 +5,21 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"regexp"
 	"strings"
 	"time"
 
 	"github.com/m-lab/go/flagx"
 	"github.com/m-lab/go/host"
+	"github.com/m-lab/jostler/api"
+	"github.com/m-lab/jostler/internal/compact"
+	"github.com/m-lab/jostler/internal/diskpressure"
 	"github.com/m-lab/jostler/internal/gcs"
+	"github.com/m-lab/jostler/internal/layout"
+	"github.com/m-lab/jostler/internal/naming"
+	"github.com/m-lab/jostler/internal/outbox"
+	"github.com/m-lab/jostler/internal/retention"
 	"github.com/m-lab/jostler/internal/schema"
 	"github.com/m-lab/jostler/internal/testhelper"
 	"github.com/m-lab/jostler/internal/uploadbundle"
@@ -26,10 +34,43 @@ var (
 	organization string
 	uploadSchema bool = true
 
+	// Flags related to GCS object names.
+	dataObjTemplate   string
+	indexObjTemplate  string
+	schemaObjTemplate string
+
 	// Flags related to bundles.
-	dtSchemaFiles flagx.StringArray
-	bundleSizeMax uint
-	bundleAgeMax  time.Duration
+	dtSchemaFiles           flagx.StringArray
+	stdColsVersions         flagx.StringArray
+	idFields                flagx.StringArray
+	testTimeFields          flagx.StringArray
+	dateSources             flagx.StringArray
+	layouts                 flagx.StringArray
+	partitions              flagx.StringArray
+	bundleSizeMax           uint
+	bundleAgeMax            time.Duration
+	bundleRowsMax           uint
+	bundleCompressedSizeMax uint
+
+	// Flags related to the outbox of bundles that cannot be uploaded.
+	outboxDir           string
+	outboxSizeMax       uint
+	outboxPolicy        string
+	outboxRetryInterval time.Duration
+
+	// Flags related to pressure on the spool filesystem.
+	spoolCheckInterval    time.Duration
+	spoolSoftThreshold    float64
+	spoolHardThreshold    float64
+	spoolMarkerFile       string
+	pressureBundleSizeMax uint
+	pressureBundleAgeMax  time.Duration
+
+	// Flags related to retention of uploaded files.
+	retentionDir           string
+	retentionAgeMax        time.Duration
+	retentionSizeMax       uint
+	retentionPruneInterval time.Duration
 
 	// Flags related to where to watch for data (inotify events).
 	localDataDir   string
@@ -44,6 +85,15 @@ var (
 	verbose      bool
 	gcsLocalDisk bool
 	testInterval time.Duration
+	adminAddress string
+	statusSocket string
+
+	// Subcommand specified on the command line (if any).
+	subcommand *command
+
+	// Parsed templates of GCS object names of bundles.
+	dataTemplate  *naming.Template
+	indexTemplate *naming.Template
 
 	// Errors related to command line parsing and validation.
 	errExtraArgs           = errors.New("extra arguments on the command line")
@@ -54,10 +104,19 @@ var (
 	errSchemaNums          = errors.New("more schema files than datatypes")
 	errSchemaNoMatch       = errors.New("does not match any specified datatypes")
 	errSchemaFilename      = errors.New("is not in <datatype>:<pathname> format")
+	errStdColsVersion      = errors.New("unsupported standard columns version")
+	errDateSource          = errors.New("is not dir, mtime, or field:<field>")
+	errLayoutNoDate        = errors.New("layout has no date but date source is dir")
+	errPartition           = errors.New("is not day, hour, or a duration that evenly divides a day")
 	errValidate            = errors.New("failed to validate")
 	errAutoloadOrgRequired = errors.New("organization is required if not using autoload/v1 conventions")
 	errAutoloadOrgInvalid  = errors.New("organization is not valid for autoload/v1 conventions")
 	errOrgName             = errors.New("organization name must only contain lower case letters and numbers")
+	errOutbox              = errors.New("invalid outbox configuration")
+	errSpoolThresholds     = errors.New("spool thresholds must be 0 < soft <= hard <= 100")
+	errRetention           = errors.New("invalid retention configuration")
+	errAdminAddress        = errors.New("admin address must be a loopback address")
+	errSocketInUse         = errors.New("status socket is in use by another process")
 
 	// orgNameRegex matches valid organization names (a-z0-9, no spaces or capitals).
 	orgNameRegex = regexp.MustCompile(`^[a-z0-9]+$`)
@@ -71,10 +130,43 @@ func initFlags() {
 	flag.StringVar(&organization, "organization", "", "the organization name; required for autoload/v2 conventions")
 	flag.BoolVar(&uploadSchema, "upload-schema", true, "upload the local table schema if necessary")
 
+	// Flags related to GCS object names.
+	flag.StringVar(&dataObjTemplate, "data-object-template", naming.DefaultData, "template of GCS object names of data bundles relative to gcs-data-dir")
+	flag.StringVar(&indexObjTemplate, "index-object-template", naming.DefaultIndex, "template of GCS object names of index bundles relative to gcs-data-dir")
+	flag.StringVar(&schemaObjTemplate, "schema-object-template", naming.DefaultSchema, "template of GCS object names of table schemas relative to gcs-data-dir")
+
 	// Flags related to bundles.
 	dtSchemaFiles = flagx.StringArray{}
+	stdColsVersions = flagx.StringArray{}
+	idFields = flagx.StringArray{}
+	testTimeFields = flagx.StringArray{}
+	dateSources = flagx.StringArray{}
+	layouts = flagx.StringArray{}
+	partitions = flagx.StringArray{}
 	flag.UintVar(&bundleSizeMax, "bundle-size-max", 20*1024*1024, "maximum bundle size in bytes before it is uploaded")
 	flag.DurationVar(&bundleAgeMax, "bundle-age-max", 1*time.Hour, "maximum bundle age before it is uploaded")
+	flag.UintVar(&bundleRowsMax, "bundle-rows-max", 0, "maximum number of rows in a bundle before it is uploaded (0 for no limit)")
+	flag.UintVar(&bundleCompressedSizeMax, "bundle-compressed-size-max", 0, "maximum estimated compressed bundle size in bytes before it is uploaded (0 for no limit)")
+
+	// Flags related to the outbox of bundles that cannot be uploaded.
+	flag.StringVar(&outboxDir, "outbox-dir", "", "directory pathname of the outbox where bundles that fail to upload are queued (disabled if empty)")
+	flag.UintVar(&outboxSizeMax, "outbox-size-max", 1024*1024*1024, "maximum total size in bytes of the bundles in the outbox")
+	flag.StringVar(&outboxPolicy, "outbox-policy", outbox.PolicyOldestFirst, "what to do when the outbox is full (oldest-first to evict the oldest bundles or refuse-new to keep new bundles in the spool)")
+	flag.DurationVar(&outboxRetryInterval, "outbox-retry-interval", time.Minute, "time interval between attempts to upload the bundles in the outbox")
+
+	// Flags related to pressure on the spool filesystem.
+	flag.DurationVar(&spoolCheckInterval, "spool-check-interval", 0, "time interval between checks of free bytes and inodes on the filesystem of local-data-dir (0 to disable)")
+	flag.Float64Var(&spoolSoftThreshold, "spool-soft-threshold", 80, "percentage of bytes or inodes in use on the spool filesystem above which bundles are flushed aggressively")
+	flag.Float64Var(&spoolHardThreshold, "spool-hard-threshold", 95, "percentage of bytes or inodes in use on the spool filesystem above which spool-marker-file is created")
+	flag.StringVar(&spoolMarkerFile, "spool-marker-file", "", "pathname of the marker file that exists while the spool filesystem is above spool-hard-threshold (disabled if empty)")
+	flag.UintVar(&pressureBundleSizeMax, "pressure-bundle-size-max", 1024*1024, "maximum bundle size in bytes before it is uploaded while the spool filesystem is above spool-soft-threshold")
+	flag.DurationVar(&pressureBundleAgeMax, "pressure-bundle-age-max", time.Minute, "maximum bundle age before it is uploaded while the spool filesystem is above spool-soft-threshold")
+
+	// Flags related to retention of uploaded files.
+	flag.StringVar(&retentionDir, "retention-dir", "", "directory pathname where uploaded files are moved in the layout of local-data-dir instead of being removed (disabled if empty)")
+	flag.DurationVar(&retentionAgeMax, "retention-age-max", 6*time.Hour, "maximum duration uploaded files are retained (0 for no limit)")
+	flag.UintVar(&retentionSizeMax, "retention-size-max", 1024*1024*1024, "maximum total size in bytes of retained files (0 for no limit)")
+	flag.DurationVar(&retentionPruneInterval, "retention-prune-interval", 5*time.Minute, "time interval between prunings of retention-dir")
 
 	// Flags related to where to watch for data (inotify events).
 	flag.StringVar(&localDataDir, "local-data-dir", "/var/spool", "directory pathname under which measurement data is created")
@@ -89,8 +181,16 @@ func initFlags() {
 	flag.BoolVar(&verbose, "verbose", false, "enable verbose mode")
 	flag.BoolVar(&gcsLocalDisk, "gcs-local-disk", false, "use local disk storage instead of cloud storage (for test purposes only)")
 	flag.DurationVar(&testInterval, "test-interval", 0, "time interval to stop running (for test purposes only)")
+	flag.StringVar(&adminAddress, "admin-address", "", "loopback address of the admin HTTP API to inspect and control uploads (e.g., localhost:9991, disabled if empty)")
+	flag.StringVar(&statusSocket, "status-socket", "", "pathname of the Unix socket that serves the admin HTTP API for \"jostler status\" (disabled if empty)")
 
 	flag.Var(&dtSchemaFiles, "datatype-schema-file", "schema for each datatype in the format <datatype>:<pathname>")
+	flag.Var(&stdColsVersions, "standard-columns", "standard columns version for each datatype in the format <datatype>:<version> (v0 or v1, default v0)")
+	flag.Var(&idFields, "id-field", "field promoted to the id standard column for each datatype in the format <datatype>:<field> (e.g., foo1:UUID)")
+	flag.Var(&testTimeFields, "test-time-field", "field promoted to the a.TestTime standard column for each datatype in the format <datatype>:<field>")
+	flag.Var(&dateSources, "date-source", "source of the date of files for each datatype in the format <datatype>:<source> (dir, mtime, or field:<field>, default dir)")
+	flag.Var(&layouts, "layout", "layout of files for each datatype in the format <datatype>:<template> (e.g., foo1:{yyyy}-{mm}-{dd}/{name}, default {yyyy}/{mm}/{dd}/{name})")
+	flag.Var(&partitions, "partition", "partition of bundles for each datatype in the format <datatype>:<partition> (day, hour, or a duration that evenly divides a day such as 15m, default day)")
 	flag.Var(&extensions, "extensions", "filename extensions to watch within <data-dir>/<experiment>")
 	flag.Var(&datatypes, "datatype", "required - datatype(s) to watch within <data-dir>/<experiment>")
 }
@@ -106,7 +206,11 @@ func parseAndValidateCLI() error {
 	extensions = nil
 	flag.Parse()
 	if flag.NArg() != 0 {
-		return errExtraArgs
+		// Subcommands parse and validate their own flags.
+		if subcommand = findCommand(commands, flag.Arg(0)); subcommand == nil {
+			return errExtraArgs
+		}
+		return nil
 	}
 
 	// Now, check if some flags were set in the environment instead
@@ -117,13 +221,13 @@ func parseAndValidateCLI() error {
 
 	// Enable verbose mode in all packages as soon as the flags are
 	// parsed because they may be called for during argument validation.
-	if verbose {
-		gcs.Verbose(testhelper.VLogf)
-		schema.Verbose(testhelper.VLogf)
-		watchdir.Verbose(testhelper.VLogf)
-		uploadbundle.Verbose(testhelper.VLogf)
-	}
+	enableVerbose()
+	return validateDaemonFlags()
+}
 
+// validateDaemonFlags validates the flags of the local and daemon modes,
+// which are also the flags of the backfill subcommand.
+func validateDaemonFlags() error {
 	if extensions == nil {
 		extensions = []string{".json"}
 	}
@@ -153,6 +257,12 @@ func parseAndValidateCLI() error {
 	if err := validateSchemaFlags(); err != nil {
 		return err
 	}
+	if err := validateStdColsFlags(); err != nil {
+		return err
+	}
+	if err := validateLayoutFlags(); err != nil {
+		return err
+	}
 	if !strings.Contains(gcsDataDir, "autoload/v1") && organization == "" {
 		return errAutoloadOrgRequired
 	}
@@ -162,16 +272,256 @@ func parseAndValidateCLI() error {
 	if organization != "" && !orgNameRegex.MatchString(organization) {
 		return errOrgName
 	}
+	if err := validateNamingFlags(); err != nil {
+		return err
+	}
+	if err := validateOutboxFlags(); err != nil {
+		return err
+	}
+	if err := validateAdminAddress(); err != nil {
+		return err
+	}
+	if retentionDir != "" && (retentionAgeMax < 0 || retentionPruneInterval <= 0) {
+		return fmt.Errorf("%w: age must not be negative and prune interval must be positive", errRetention)
+	}
+	if spoolCheckInterval > 0 && (spoolSoftThreshold <= 0 || spoolSoftThreshold > spoolHardThreshold || spoolHardThreshold > 100) {
+		return fmt.Errorf("%v and %v: %w", spoolSoftThreshold, spoolHardThreshold, errSpoolThresholds)
+	}
 	return validateSchemaFiles()
 }
 
+// validateOutboxFlags validates the flags of the outbox if it's enabled.
+func validateOutboxFlags() error {
+	if outboxDir == "" {
+		return nil
+	}
+	if outboxPolicy != outbox.PolicyOldestFirst && outboxPolicy != outbox.PolicyRefuseNew {
+		return fmt.Errorf("%w: policy %v is not %v or %v", errOutbox, outboxPolicy, outbox.PolicyOldestFirst, outbox.PolicyRefuseNew)
+	}
+	if outboxSizeMax == 0 {
+		return fmt.Errorf("%w: size must be positive", errOutbox)
+	}
+	if outboxRetryInterval <= 0 {
+		return fmt.Errorf("%w: retry interval must be positive", errOutbox)
+	}
+	return nil
+}
+
+// validateAdminAddress makes sure the admin API, which is not
+// authenticated, is only served on a loopback address (if enabled).
+func validateAdminAddress() error {
+	if adminAddress == "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(adminAddress)
+	if err != nil {
+		return fmt.Errorf("%v: %w", adminAddress, errAdminAddress)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("%v: %w", adminAddress, errAdminAddress)
+	}
+	return nil
+}
+
+// enableVerbose enables verbose mode in all packages if the verbose
+// flag was specified.
+func enableVerbose() {
+	if verbose {
+		gcs.Verbose(testhelper.VLogf)
+		schema.Verbose(testhelper.VLogf)
+		watchdir.Verbose(testhelper.VLogf)
+		uploadbundle.Verbose(testhelper.VLogf)
+		compact.Verbose(testhelper.VLogf)
+		outbox.Verbose(testhelper.VLogf)
+		diskpressure.Verbose(testhelper.VLogf)
+		retention.Verbose(testhelper.VLogf)
+	}
+}
+
 // validateSchemaFlags validate that for each schema file, its corresponding
 // datatype has been specified.
 func validateSchemaFlags() error {
-	if len(dtSchemaFiles) > len(datatypes) {
+	return validateDatatypePaths(dtSchemaFiles)
+}
+
+// validateStdColsFlags validates that for each standard columns version
+// and promoted field, its corresponding datatype has been specified and
+// the version is supported.  It then configures the schema package with
+// the versions and promoted fields.
+func validateStdColsFlags() error {
+	versions, err := datatypeValues(stdColsVersions)
+	if err != nil {
+		return err
+	}
+	for datatype, version := range versions {
+		supported := false
+		for _, v := range api.StdColsVersions {
+			if version == v {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return fmt.Errorf("%v:%v: %w", datatype, version, errStdColsVersion)
+		}
+	}
+	idFieldsMap, err := datatypeValues(idFields)
+	if err != nil {
+		return err
+	}
+	testTimeFieldsMap, err := datatypeValues(testTimeFields)
+	if err != nil {
+		return err
+	}
+	schema.StdColsVersions = versions
+	schema.IDFields = idFieldsMap
+	schema.TestTimeFields = testTimeFieldsMap
+	return nil
+}
+
+// validateNamingFlags validates that the templates of GCS object names
+// of data and index bundles guarantee unique names for every bundle of
+// every node.  It then validates the template of table schemas.
+func validateNamingFlags() error {
+	var err error
+	if dataTemplate, err = naming.Parse(dataObjTemplate); err != nil {
+		return err
+	}
+	if indexTemplate, err = naming.Parse(indexObjTemplate); err != nil {
+		return err
+	}
+	if err = naming.ValidateBundles(dataTemplate, indexTemplate); err != nil {
+		return err
+	}
+	return validateSchemaTemplateFlag()
+}
+
+// validateSchemaTemplateFlag validates that the template of GCS object
+// names of table schemas guarantees unique names for every datatype.
+// It then configures the schema package with the template.
+func validateSchemaTemplateFlag() error {
+	tableTemplate, err := naming.Parse(schemaObjTemplate)
+	if err != nil {
+		return err
+	}
+	if err := naming.ValidateSchema(tableTemplate); err != nil {
+		return err
+	}
+	schema.TableTemplate = tableTemplate
+	schema.Organization = organization
+	return nil
+}
+
+// validateLayoutFlags validates the date source, the layout of files,
+// and the partition of bundles of each datatype.
+func validateLayoutFlags() error {
+	for _, datatype := range datatypes {
+		dateSource, _, err := datatypeDateSource(datatype)
+		if err != nil {
+			return err
+		}
+		if _, err := datatypeLayout(datatype, dateSource); err != nil {
+			return err
+		}
+		if _, err := datatypePartition(datatype); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// datatypePartition returns the partition of bundles of the given
+// datatype.  Whether the date source, layout, and naming templates can
+// tell partitions apart is validated by the uploader.
+func datatypePartition(datatype string) (time.Duration, error) {
+	values, err := datatypeValues(partitions)
+	if err != nil {
+		return 0, err
+	}
+	value, ok := values[datatype]
+	switch {
+	case !ok || value == "day":
+		return uploadbundle.PartitionDay, nil
+	case value == "hour":
+		return uploadbundle.PartitionHour, nil
+	}
+	partition, err := time.ParseDuration(value)
+	if err != nil || partition < time.Minute || partition%time.Minute != 0 || uploadbundle.PartitionDay%partition != 0 {
+		return 0, fmt.Errorf("%v:%v: %w", datatype, value, errPartition)
+	}
+	return partition, nil
+}
+
+// datatypeDateSource returns the date source and date field (if any) of
+// files of the given datatype.
+func datatypeDateSource(datatype string) (string, string, error) {
+	sources, err := datatypeValues(dateSources)
+	if err != nil {
+		return "", "", err
+	}
+	source, ok := sources[datatype]
+	switch {
+	case !ok:
+		return uploadbundle.DateFromDir, "", nil
+	case source == uploadbundle.DateFromDir || source == uploadbundle.DateFromMTime:
+		return source, "", nil
+	case strings.HasPrefix(source, uploadbundle.DateFromField+":") && len(source) > len(uploadbundle.DateFromField)+1:
+		return uploadbundle.DateFromField, source[len(uploadbundle.DateFromField)+1:], nil
+	}
+	return "", "", fmt.Errorf("%v:%v: %w", datatype, source, errDateSource)
+}
+
+// datatypeLayout returns the layout of files of the given datatype with
+// the given date source.  If no layout was specified, files should be in
+// date subdirectories if their date comes from their pathnames and can
+// be anywhere (i.e., nil layout) otherwise.
+func datatypeLayout(datatype, dateSource string) (*layout.Layout, error) {
+	templates, err := datatypeValues(layouts)
+	if err != nil {
+		return nil, err
+	}
+	template, ok := templates[datatype]
+	if !ok {
+		if dateSource != uploadbundle.DateFromDir {
+			return nil, nil
+		}
+		template = layout.DefaultTemplate
+	}
+	dtLayout, err := layout.Parse(template)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", datatype, err)
+	}
+	if dateSource == uploadbundle.DateFromDir && !dtLayout.HasDate() {
+		return nil, fmt.Errorf("%v:%v: %w", datatype, template, errLayoutNoDate)
+	}
+	return dtLayout, nil
+}
+
+// datatypeValues validates the given values in the <datatype>:<value>
+// format and returns them as a map from datatypes to values.
+func datatypeValues(values []string) (map[string]string, error) {
+	if err := validateDatatypePaths(values); err != nil {
+		return nil, err
+	}
+	m := make(map[string]string, len(values))
+	for _, value := range values {
+		idx := strings.Index(value, ":")
+		m[value[:idx]] = value[idx+1:]
+	}
+	return m, nil
+}
+
+// validateDatatypePaths validates that for each pathname in the
+// <datatype>:<pathname> format, its corresponding datatype has been
+// specified.
+func validateDatatypePaths(schemaFiles []string) error {
+	if len(schemaFiles) > len(datatypes) {
 		return errSchemaNums
 	}
-	for _, schemaFile := range dtSchemaFiles {
+	for _, schemaFile := range schemaFiles {
 		idx := strings.Index(schemaFile, ":")
 		if idx == -1 {
 			return fmt.Errorf("%v: %w", schemaFile, errSchemaFilename)
@@ -0,0 +1,244 @@
+// Package main implements jostler.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/civil"
+	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/go/host"
+	"github.com/m-lab/jostler/internal/naming"
+	"github.com/m-lab/jostler/internal/schema"
+)
+
+// command defines a jostler subcommand.  Subcommands are invoked as
+// "jostler [flags] <command> [<subcommand>] [flags]" and each parses its
+// own flags.  Flags that subcommands share with the daemon mode are bound
+// to the same global variables.
+type command struct {
+	name     string               // name of the command on the command line
+	synopsis string               // one line description for usage messages
+	run      func([]string) error // runs the command with its arguments
+	subcmds  []*command           // subcommands of this command (if any)
+}
+
+var (
+	// commands lists all subcommands of jostler.  When no subcommand
+	// is specified, jostler runs in the local or the daemon mode.
+	commands = []*command{
+		{name: "validate", synopsis: "validate datatype schemas against table schemas without uploading", run: validateCmd},
+		{name: "status", synopsis: "show what the running daemon is doing or where a file is", run: statusCmd},
+		{name: "backfill", synopsis: "bundle and upload all existing files and exit", run: backfillCmd},
+		{name: "verify", synopsis: "verify data and index bundles in storage", run: verifyCmd},
+		{name: "find", synopsis: "find the data bundles that contain measurement data files", run: findCmd},
+		{name: "extract", synopsis: "extract a measurement data file from a data bundle in storage", run: extractCmd},
+		{name: "compact", synopsis: "merge small data and index bundles in storage into larger ones", run: compactCmd},
+		{
+			name:     "schema",
+			synopsis: "examine datatype and table schemas",
+			subcmds: []*command{
+				{name: "diff", synopsis: "show differences between the table schema in storage and a datatype schema", run: schemaDiff},
+				{name: "infer", synopsis: "infer a datatype schema from sample measurement files", run: schemaInfer},
+				{
+					name:     "history",
+					synopsis: "list and fetch historical versions of table schemas",
+					subcmds: []*command{
+						{name: "list", synopsis: "list versions of the table schema of each datatype", run: schemaHistoryList},
+						{name: "fetch", synopsis: "fetch a version of the table schema of a datatype", run: schemaHistoryFetch},
+					},
+				},
+			},
+		},
+	}
+
+	// Subcommands write their output to stdout.  Test code changes it
+	// to capture the output.
+	stdout io.Writer = os.Stdout
+
+	// Flags of subcommands that operate on a range of partitions.
+	fromDate string
+	toDate   string
+
+	// Errors related to subcommands.
+	errNoSubcommand      = errors.New("must specify a subcommand")
+	errUnknownSubcommand = errors.New("unknown subcommand")
+	errFormat            = errors.New("format must be text or json")
+	errNoSampleDir       = errors.New("must specify sample directory")
+	errConflicts         = errors.New("conflict(s) between samples")
+	errOneDatatype       = errors.New("must specify exactly one datatype")
+	errNoFromDate        = errors.New("must specify from date")
+	errDate              = errors.New("is not a date in yyyy-mm-dd format")
+	errDateRange         = errors.New("to date is before from date")
+)
+
+// findCommand returns the command with the given name in the given list
+// of commands or nil if there is no such command.
+func findCommand(cmds []*command, name string) *command {
+	for _, cmd := range cmds {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// runCommand runs the given command with the given arguments.  If the
+// command has subcommands, the first argument selects the subcommand.
+func runCommand(cmd *command, args []string) error {
+	if len(cmd.subcmds) == 0 {
+		return cmd.run(args)
+	}
+	if len(args) == 0 {
+		printSubcommands(cmd)
+		return fmt.Errorf("%v: %w", cmd.name, errNoSubcommand)
+	}
+	subcmd := findCommand(cmd.subcmds, args[0])
+	if subcmd == nil {
+		printSubcommands(cmd)
+		return fmt.Errorf("%v %v: %w", cmd.name, args[0], errUnknownSubcommand)
+	}
+	return runCommand(subcmd, args[1:])
+}
+
+// printSubcommands prints the subcommands of the given command.
+func printSubcommands(cmd *command) {
+	fmt.Fprintf(os.Stderr, "usage: jostler %v <subcommand> [flags]\n", cmd.name)
+	for _, subcmd := range cmd.subcmds {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", subcmd.name, subcmd.synopsis)
+	}
+}
+
+// newFlagSet returns a new flag set for the given subcommand with flags
+// that are common to all subcommands.
+//
+// Because flags of subcommands are bound to the same variables as the
+// global flags, their default values are the current values of the
+// variables.  This way, global flags specified before the subcommand
+// (e.g., "jostler -verbose schema diff") are not reset.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("jostler "+name, flag.ContinueOnError)
+	fs.BoolVar(&verbose, "verbose", verbose, "enable verbose mode")
+	fs.BoolVar(&gcsLocalDisk, "gcs-local-disk", gcsLocalDisk, "use local disk storage instead of cloud storage (for test purposes only)")
+	return fs
+}
+
+// addGCSFlags adds flags related to GCS to the given flag set.
+func addGCSFlags(fs *flag.FlagSet) {
+	fs.StringVar(&bucket, "gcs-bucket", bucket, "required - GCS bucket name")
+	fs.StringVar(&gcsDataDir, "gcs-data-dir", gcsDataDir, "home directory in GCS bucket under which bundles will be uploaded")
+	fs.StringVar(&organization, "organization", organization, "the organization name; required for autoload/v2 conventions")
+	fs.StringVar(&schemaObjTemplate, "schema-object-template", schemaObjTemplate, "template of GCS object names of table schemas relative to gcs-data-dir")
+}
+
+// addExperimentFlags adds flags related to the experiment and its
+// datatypes to the given flag set.
+func addExperimentFlags(fs *flag.FlagSet) {
+	fs.StringVar(&experiment, "experiment", experiment, "required - name of the experiment (e.g., ndt)")
+	fs.Var(&datatypes, "datatype", "required - datatype(s) to watch within <data-dir>/<experiment>")
+}
+
+// addDatatypeFlags adds flags related to datatypes and their schemas to
+// the given flag set.
+func addDatatypeFlags(fs *flag.FlagSet) {
+	fs.StringVar(&localDataDir, "local-data-dir", localDataDir, "directory pathname under which measurement data is created")
+	addExperimentFlags(fs)
+	fs.Var(&dtSchemaFiles, "datatype-schema-file", "schema for each datatype in the format <datatype>:<pathname>")
+	fs.Var(&stdColsVersions, "standard-columns", "standard columns version for each datatype in the format <datatype>:<version> (v0 or v1, default v0)")
+	fs.Var(&idFields, "id-field", "field promoted to the id standard column for each datatype in the format <datatype>:<field> (e.g., foo1:UUID)")
+	fs.Var(&testTimeFields, "test-time-field", "field promoted to the a.TestTime standard column for each datatype in the format <datatype>:<field>")
+}
+
+// addDateRangeFlags adds flags that specify a range of partitions to the
+// given flag set of the given subcommand.
+func addDateRangeFlags(fs *flag.FlagSet, name string) {
+	fs.StringVar(&fromDate, "from", "", "required - date of the first partition to "+name+" (yyyy-mm-dd)")
+	fs.StringVar(&toDate, "to", "", "date of the last partition to "+name+" (yyyy-mm-dd, default from)")
+}
+
+// parseFlags parses the command line of a subcommand, checks if some
+// flags were set in the environment, and configures packages.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("%v: %w", strings.Join(fs.Args(), " "), errExtraArgs)
+	}
+	if err := flagx.ArgsFromEnv(fs); err != nil {
+		return fmt.Errorf("failed to get args from the environment: %w", err)
+	}
+	enableVerbose()
+	schema.LocalDataDir = localDataDir
+	schema.GCSDataDir = gcsDataDir
+	return validateSchemaTemplateFlag()
+}
+
+// validateExperimentFlags validates the experiment and datatypes
+// specified on the command line.
+func validateExperimentFlags() error {
+	if experiment == "" {
+		return errNoExperiment
+	}
+	if len(datatypes) == 0 {
+		return errNoDatatype
+	}
+	return nil
+}
+
+// validateDatatypeFlags validates the experiment, datatypes, and
+// datatype schema files specified on the command line.
+func validateDatatypeFlags() error {
+	if err := validateExperimentFlags(); err != nil {
+		return err
+	}
+	if err := validateSchemaFlags(); err != nil {
+		return err
+	}
+	if err := validateStdColsFlags(); err != nil {
+		return err
+	}
+	return validateSchemaFiles()
+}
+
+// dateRange returns the dates of the first and last partitions that the
+// date range flags specify.
+func dateRange() (civil.Date, civil.Date, error) {
+	if fromDate == "" {
+		return civil.Date{}, civil.Date{}, errNoFromDate
+	}
+	from, err := civil.ParseDate(fromDate)
+	if err != nil {
+		return civil.Date{}, civil.Date{}, fmt.Errorf("%v: %w", fromDate, errDate)
+	}
+	if toDate == "" {
+		return from, from, nil
+	}
+	to, err := civil.ParseDate(toDate)
+	if err != nil {
+		return civil.Date{}, civil.Date{}, fmt.Errorf("%v: %w", toDate, errDate)
+	}
+	if to.Before(from) {
+		return civil.Date{}, civil.Date{}, errDateRange
+	}
+	return from, to, nil
+}
+
+// nodeVars returns the given variables of object names with the node,
+// machine, site, and project of the given node name (if any) so only the
+// bundles of the node match.
+func nodeVars(vars naming.Vars, node string) (naming.Vars, error) {
+	if node == "" {
+		return vars, nil
+	}
+	nameParts, err := host.Parse(node)
+	if err != nil {
+		return naming.Vars{}, fmt.Errorf("%v: %w", node, err)
+	}
+	vars.Node, vars.Machine, vars.Site, vars.Project = node, nameParts.Machine, nameParts.Site, nameParts.Project
+	return vars, nil
+}
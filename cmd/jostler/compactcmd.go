@@ -0,0 +1,136 @@
+// Package main implements jostler.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"cloud.google.com/go/civil"
+	"github.com/m-lab/jostler/internal/compact"
+	"github.com/m-lab/jostler/internal/naming"
+)
+
+// Flags related to the compact subcommand.
+var (
+	compactDate   string
+	compactNode   string
+	compactDryRun bool
+	compactFormat string
+)
+
+var (
+	errNoDate  = errors.New("must specify date")
+	errCompact = errors.New("failed to compact some bundles")
+)
+
+// compactCmd implements "jostler compact" which merges the small data
+// bundles (and their index bundles) of each datatype in the partitions
+// of a date into larger ones and deletes the originals.  It exits with
+// an error if some bundles could not be compacted.
+func compactCmd(args []string) error {
+	fs := newFlagSet("compact")
+	addGCSFlags(fs)
+	addExperimentFlags(fs)
+	fs.StringVar(&dataObjTemplate, "data-object-template", dataObjTemplate, "template of GCS object names of data bundles relative to gcs-data-dir")
+	fs.StringVar(&indexObjTemplate, "index-object-template", indexObjTemplate, "template of GCS object names of index bundles relative to gcs-data-dir")
+	fs.UintVar(&bundleSizeMax, "bundle-size-max", bundleSizeMax, "maximum size in bytes of compacted bundles")
+	fs.UintVar(&bundleRowsMax, "bundle-rows-max", bundleRowsMax, "maximum number of rows of compacted bundles (0 for no limit)")
+	fs.StringVar(&compactDate, "date", "", "required - date of the partitions to compact (yyyy-mm-dd)")
+	fs.StringVar(&compactNode, "node", "", "node name of bundles to compact (default all)")
+	fs.BoolVar(&compactDryRun, "dry-run", false, "only show what would be compacted")
+	fs.StringVar(&compactFormat, "format", "text", "output format (text or json)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	conf, err := compactConfig()
+	if err != nil {
+		return err
+	}
+
+	stClient, err := newStorageClient(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to create storage client: %w", err)
+	}
+	results := make([]*compact.Result, 0, len(datatypes))
+	for _, datatype := range datatypes {
+		conf.Vars.Datatype = datatype
+		result, err := compact.Compact(context.Background(), stClient, conf)
+		if result != nil {
+			results = append(results, result)
+		}
+		if err != nil {
+			// Report what was compacted before the error.
+			_ = writeCompactResults(stdout, results)
+			return fmt.Errorf("%v: %w", datatype, err)
+		}
+	}
+	if err := writeCompactResults(stdout, results); err != nil {
+		return err
+	}
+	for _, result := range results {
+		if len(result.Skipped) != 0 {
+			return errCompact
+		}
+	}
+	return nil
+}
+
+// compactConfig validates the flags of the compact subcommand and
+// returns the configuration of compaction without a datatype.
+func compactConfig() (compact.Config, error) {
+	if bucket == "" {
+		return compact.Config{}, errNoBucket
+	}
+	if err := validateExperimentFlags(); err != nil {
+		return compact.Config{}, err
+	}
+	if err := validateNamingFlags(); err != nil {
+		return compact.Config{}, err
+	}
+	if compactDate == "" {
+		return compact.Config{}, errNoDate
+	}
+	date, err := civil.ParseDate(compactDate)
+	if err != nil {
+		return compact.Config{}, fmt.Errorf("%v: %w", compactDate, errDate)
+	}
+	if compactFormat != "text" && compactFormat != "json" {
+		return compact.Config{}, fmt.Errorf("%v: %w", compactFormat, errFormat)
+	}
+	vars, err := nodeVars(naming.Vars{Experiment: experiment, Organization: organization}, compactNode)
+	if err != nil {
+		return compact.Config{}, err
+	}
+	return compact.Config{
+		Bucket:        bucket,
+		HomeDir:       gcsDataDir,
+		DataTemplate:  dataTemplate,
+		IndexTemplate: indexTemplate,
+		Vars:          vars,
+		Date:          date,
+		SizeMax:       int(bundleSizeMax),
+		RowsMax:       int(bundleRowsMax),
+		DryRun:        compactDryRun,
+	}, nil
+}
+
+// writeCompactResults writes the results of compacting datatypes in the
+// configured format.
+func writeCompactResults(w io.Writer, results []*compact.Result) error {
+	if compactFormat == "json" {
+		return writeJSON(w, results)
+	}
+	for _, result := range results {
+		fmt.Fprintf(w, "%v: %d bundle(s), %d small bundle(s), %d merge(s), %d skipped\n",
+			result.Datatype, result.Bundles, result.Small, len(result.Merges), len(result.Skipped))
+		for _, merge := range result.Merges {
+			fmt.Fprintf(w, "  %v: %d bundle(s), %d row(s), %d byte(s)\n", merge.DataObject, len(merge.Sources), merge.Rows, merge.Size)
+		}
+		for _, skipped := range result.Skipped {
+			fmt.Fprintf(w, "  skipped %v\n", skipped)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// Package main implements jostler.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/m-lab/jostler/internal/extract"
+	"github.com/m-lab/jostler/internal/naming"
+)
+
+// Flags related to the extract subcommand.
+var (
+	extractObject string
+	extractFile   string
+	extractLine   int
+	extractOutput string
+)
+
+var (
+	errNoObject      = errors.New("must specify data bundle object")
+	errObjectBucket  = errors.New("object is not in bucket")
+	errNotDataBundle = errors.New("object name does not match data object template")
+	errFileOrLine    = errors.New("must specify exactly one of file or line")
+	errLine          = errors.New("line must be positive")
+)
+
+// extractCmd implements "jostler extract" which extracts a measurement
+// data file from a data bundle in GCS exactly as the measurement service
+// wrote it.  The file is specified by its pathname or by its row (line
+// number) in the data bundle and is located through the data bundle's
+// index bundle.
+func extractCmd(args []string) error {
+	fs := newFlagSet("extract")
+	addGCSFlags(fs)
+	fs.StringVar(&dataObjTemplate, "data-object-template", dataObjTemplate, "template of GCS object names of data bundles relative to gcs-data-dir")
+	fs.StringVar(&indexObjTemplate, "index-object-template", indexObjTemplate, "template of GCS object names of index bundles relative to gcs-data-dir")
+	fs.StringVar(&extractObject, "object", "", "required - object name or gs:// URL of the data bundle")
+	fs.StringVar(&extractFile, "file", "", "pathname of the measurement data file to extract")
+	fs.IntVar(&extractLine, "line", 0, "row (line number starting at 1) of the measurement data file to extract")
+	fs.StringVar(&extractOutput, "output", "", "pathname to write the file to (default stdout)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	dataObj, err := extractObjectName()
+	if err != nil {
+		return err
+	}
+	if (extractFile == "") == (extractLine == 0) {
+		return errFileOrLine
+	}
+	if extractLine < 0 {
+		return fmt.Errorf("%d: %w", extractLine, errLine)
+	}
+	if err := validateNamingFlags(); err != nil {
+		return err
+	}
+	vars, ok := dataTemplate.Matcher(gcsDataDir, naming.Vars{Organization: organization}).Match(dataObj)
+	if !ok {
+		return fmt.Errorf("%v: %w", dataObj, errNotDataBundle)
+	}
+	indexObj := indexTemplate.Join(gcsDataDir, vars)
+
+	stClient, err := newStorageClient(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to create storage client: %w", err)
+	}
+	entry, err := extract.Entry(context.Background(), stClient, indexObj, extractFile, extractLine)
+	if err != nil {
+		return err
+	}
+	contents, err := extract.File(context.Background(), stClient, dataObj, entry)
+	if err != nil {
+		return err
+	}
+	if extractOutput != "" {
+		return os.WriteFile(extractOutput, contents, 0o666)
+	}
+	_, err = stdout.Write(contents)
+	return err
+}
+
+// extractObjectName returns the object name of the data bundle to
+// extract from.  If the data bundle was specified as a gs:// URL, the
+// bucket is set from the URL.
+func extractObjectName() (string, error) {
+	if extractObject == "" {
+		return "", errNoObject
+	}
+	objName := extractObject
+	if rest, ok := strings.CutPrefix(extractObject, "gs://"); ok {
+		b, obj, _ := strings.Cut(rest, "/")
+		if bucket != "" && bucket != b {
+			return "", fmt.Errorf("%v: %v: %w", extractObject, bucket, errObjectBucket)
+		}
+		bucket, objName = b, obj
+	}
+	if bucket == "" {
+		return "", errNoBucket
+	}
+	return objName, nil
+}
@@ -0,0 +1,125 @@
+// Package main implements jostler.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/m-lab/jostler/internal/find"
+	"github.com/m-lab/jostler/internal/naming"
+)
+
+// Flags related to the find subcommand.
+var (
+	findPattern  string
+	findNode     string
+	findParallel int
+	findFormat   string
+)
+
+var (
+	errNoPattern = errors.New("must specify filename or pattern")
+	errParallel  = errors.New("parallel must be positive")
+	errNotFound  = errors.New("no matching files found")
+)
+
+// findCmd implements "jostler find" which searches the index bundles of
+// an experiment in a date range for measurement data files and prints
+// the data bundles and rows that contain them.  It exits with an error
+// if no files were found.
+func findCmd(args []string) error {
+	fs := newFlagSet("find")
+	addGCSFlags(fs)
+	fs.StringVar(&experiment, "experiment", experiment, "required - name of the experiment (e.g., ndt)")
+	fs.Var(&datatypes, "datatype", "datatype(s) to search (default all)")
+	fs.StringVar(&dataObjTemplate, "data-object-template", dataObjTemplate, "template of GCS object names of data bundles relative to gcs-data-dir")
+	fs.StringVar(&indexObjTemplate, "index-object-template", indexObjTemplate, "template of GCS object names of index bundles relative to gcs-data-dir")
+	addDateRangeFlags(fs, "search")
+	fs.StringVar(&findPattern, "file", "", "required - pathname or pattern of files to find (base name if it has no slash)")
+	fs.StringVar(&findNode, "node", "", "node name of bundles to search (default all)")
+	fs.IntVar(&findParallel, "parallel", 8, "maximum number of concurrent downloads")
+	fs.StringVar(&findFormat, "format", "text", "output format (text or json)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if bucket == "" {
+		return errNoBucket
+	}
+	if experiment == "" {
+		return errNoExperiment
+	}
+	if findPattern == "" {
+		return errNoPattern
+	}
+	if findParallel < 1 {
+		return fmt.Errorf("%d: %w", findParallel, errParallel)
+	}
+	if findFormat != "text" && findFormat != "json" {
+		return fmt.Errorf("%v: %w", findFormat, errFormat)
+	}
+	if err := validateNamingFlags(); err != nil {
+		return err
+	}
+	from, to, err := dateRange()
+	if err != nil {
+		return err
+	}
+	vars, err := nodeVars(naming.Vars{Experiment: experiment, Organization: organization}, findNode)
+	if err != nil {
+		return err
+	}
+
+	stClient, err := newStorageClient(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to create storage client: %w", err)
+	}
+	conf := find.Config{
+		HomeDir:       gcsDataDir,
+		DataTemplate:  dataTemplate,
+		IndexTemplate: indexTemplate,
+		From:          from,
+		To:            to,
+		Pattern:       findPattern,
+		Parallel:      findParallel,
+	}
+	// Without datatypes, the index bundles of all datatypes of the
+	// experiment are searched.
+	searchDatatypes := []string(datatypes)
+	if len(searchDatatypes) == 0 {
+		searchDatatypes = []string{""}
+	}
+	var bundles []find.IndexBundle
+	for _, datatype := range searchDatatypes {
+		conf.Vars = vars
+		conf.Vars.Datatype = datatype
+		b, err := find.IndexBundles(context.Background(), stClient, conf)
+		if err != nil {
+			return err
+		}
+		bundles = append(bundles, b...)
+	}
+	matches, err := find.Search(context.Background(), stClient, conf, bundles)
+	if err != nil {
+		return err
+	}
+	if findFormat == "json" {
+		if err := writeJSON(stdout, matches); err != nil {
+			return err
+		}
+	} else {
+		writeMatchesText(stdout, matches)
+	}
+	if len(matches) == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// writeMatchesText writes the files that were found in text format.
+func writeMatchesText(w io.Writer, matches []find.Match) {
+	for _, m := range matches {
+		fmt.Fprintf(w, "%v: %v line %d\n", m.Filename, m.DataObject, m.Line)
+	}
+}
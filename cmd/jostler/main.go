@@ -5,18 +5,30 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/rjeczalik/notify"
 
 	"github.com/m-lab/go/host"
 	"github.com/m-lab/go/prometheusx"
+	"github.com/m-lab/jostler/internal/admin"
+	"github.com/m-lab/jostler/internal/diskpressure"
 	"github.com/m-lab/jostler/internal/gcs"
+	"github.com/m-lab/jostler/internal/jsonlbundle"
+	"github.com/m-lab/jostler/internal/layout"
+	"github.com/m-lab/jostler/internal/naming"
+	"github.com/m-lab/jostler/internal/outbox"
+	"github.com/m-lab/jostler/internal/retention"
 	"github.com/m-lab/jostler/internal/schema"
+	"github.com/m-lab/jostler/internal/spoollock"
 	"github.com/m-lab/jostler/internal/testhelper"
 	"github.com/m-lab/jostler/internal/uploadbundle"
 	"github.com/m-lab/jostler/internal/watchdir"
@@ -41,8 +53,16 @@ func main() {
 	if err := parseAndValidateCLI(); err != nil {
 		fatal(err)
 	}
-	schema.LocalDataDir = localDataDir
-	schema.GCSDataDir = gcsDataDir
+	if subcommand != nil {
+		// Subcommands write their output to stdout so log messages
+		// should not be mixed with it.
+		log.SetOutput(os.Stderr)
+		if err := runCommand(subcommand, flag.Args()[1:]); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	configureSchema()
 
 	if local {
 		if err := localMode(); err != nil {
@@ -55,6 +75,16 @@ func main() {
 	}
 }
 
+// configureSchema configures the schema package with the flags and
+// build information.
+func configureSchema() {
+	schema.LocalDataDir = localDataDir
+	schema.GCSDataDir = gcsDataDir
+	schema.Node = mlabNodeName.Value
+	schema.Version = Version
+	schema.GitCommit = GitCommit
+}
+
 // localMode creates table schemas with standard columns for each datatype
 // and saves them as <datatype>-table.json files in the current directory
 // so they can be easily examined by the user.
@@ -87,29 +117,31 @@ func daemonMode() error {
 	}()
 
 	// Create a storage client.
-	// The gcsLocalDisk flag is meant for e2e testing where we want to read
-	// from and write to the local disk storage instead of cloud storage.
-	var stClient schema.DownloaderUploader
-	var err error
-	if gcsLocalDisk {
-		stClient, err = testhelper.NewClient(mainCtx, bucket)
-	} else {
-		stClient, err = gcs.NewClient(mainCtx, bucket)
-	}
+	stClient, err := newStorageClient(mainCtx)
 	if err != nil {
 		mainCancel()
 		return fmt.Errorf("failed to create storage client: %w", err)
 	}
 
-	// Validate table schemas are backward compatible and upload the
-	// ones are a superset of the previous table.
-	for _, datatype := range datatypes {
-		dtSchemaFile := schema.PathForDatatype(datatype, dtSchemaFiles)
-		err := schema.ValidateAndUpload(stClient, bucket, experiment, datatype, dtSchemaFile, uploadSchema)
-		if err != nil {
-			mainCancel()
-			return fmt.Errorf("%v: %w", datatype, err)
-		}
+	if err = validateAndUploadSchemas(stClient); err != nil {
+		mainCancel()
+		return err
+	}
+
+	// Start draining the outbox (if enabled) which the bundle
+	// uploaders of all datatypes share.
+	ob, err := startOutbox(mainCtx, stClient)
+	if err != nil {
+		mainCancel()
+		return err
+	}
+
+	// Start pruning the retention directory (if enabled) where the
+	// bundle uploaders of all datatypes move uploaded files.
+	retainer, err := startRetention(mainCtx)
+	if err != nil {
+		mainCancel()
+		return err
 	}
 
 	// For each datatype, start a directory watcher and a bundle
@@ -117,15 +149,57 @@ func daemonMode() error {
 	watchEvents := []notify.Event{notify.InCloseWrite, notify.InMovedTo}
 	watcherStatus := make(chan error)
 	uploaderStatus := make(chan error)
+	adminDatatypes := make(map[string]admin.Datatype, len(datatypes))
+	uploaders := make([]*uploadbundle.UploadBundle, 0, len(datatypes))
 	for _, datatype := range datatypes {
+		// Parse the layout once and use it for both watching and
+		// bundling.  The flags were validated already.
+		dateSource, dateField, _ := datatypeDateSource(datatype)
+		dtLayout, _ := datatypeLayout(datatype, dateSource)
+		// Make sure no other process (e.g., "jostler backfill")
+		// bundles files of this datatype while we do.
+		var lock *spoollock.Lock
+		if lock, err = lockSpoolDir(datatype); err != nil {
+			mainCancel()
+			return err
+		}
+		defer func() {
+			_ = lock.Unlock()
+		}()
 		var wdClient *watchdir.WatchDir
-		wdClient, err = startWatcher(mainCtx, mainCancel, watcherStatus, datatype, watchEvents)
+		wdClient, err = startWatcher(mainCtx, mainCancel, watcherStatus, datatype, dtLayout, watchEvents)
 		if err != nil {
 			return err
 		}
-		if _, err = startUploader(mainCtx, mainCancel, uploaderStatus, datatype, wdClient); err != nil {
+		var ubClient *uploadbundle.UploadBundle
+		ubClient, err = startUploader(mainCtx, mainCancel, uploaderStatus, stClient, datatype, dateSource, dateField, dtLayout, wdClient, ob, retainer)
+		if err != nil {
 			return err
 		}
+		adminDatatypes[datatype] = admin.Datatype{Uploader: ubClient, Watcher: wdClient}
+		uploaders = append(uploaders, ubClient)
+	}
+	if err = startWatchdog(mainCtx, uploaders); err != nil {
+		mainCancel()
+		return err
+	}
+	// Serve the admin API on a TCP address and/or a Unix socket (for
+	// "jostler status").
+	adminHandler := admin.New(adminDatatypes).Handler()
+	for _, listen := range []struct{ network, address string }{{"tcp", adminAddress}, {"unix", statusSocket}} {
+		if listen.address == "" {
+			continue
+		}
+		adminSrv, err := startAdminServer(listen.network, listen.address, adminHandler)
+		if err != nil {
+			mainCancel()
+			return err
+		}
+		defer func() {
+			if err := adminSrv.Shutdown(context.Background()); err != nil {
+				log.Printf("failed to shut down admin server (error: %v)", err)
+			}
+		}()
 	}
 
 	// When testing, we set testInterval to a non-zero value (e.g.,
@@ -148,16 +222,107 @@ func daemonMode() error {
 	return err
 }
 
+// validateAndUploadSchemas validates table schemas are backward
+// compatible and uploads the ones that are a superset of the previous
+// table.
+func validateAndUploadSchemas(stClient storageClient) error {
+	for _, datatype := range datatypes {
+		dtSchemaFile := schema.PathForDatatype(datatype, dtSchemaFiles)
+		err := schema.ValidateAndUpload(stClient, bucket, experiment, datatype, dtSchemaFile, uploadSchema)
+		if err != nil {
+			return fmt.Errorf("%v: %w", datatype, err)
+		}
+	}
+	return nil
+}
+
+// removeStaleSocket removes the given Unix socket if it was left behind
+// by a previous run that wasn't shut down gracefully (i.e., nothing
+// accepts connections on it).  It fails if another process (e.g.,
+// another instance of jostler) is still serving on the socket.
+func removeStaleSocket(address string) error {
+	fi, err := os.Lstat(address)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	conn, err := net.DialTimeout("unix", address, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%v: %w", address, errSocketInUse)
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		_ = os.Remove(address)
+	}
+	return nil
+}
+
+// startAdminServer starts an admin HTTP API server on the given network
+// ("tcp" or "unix") and address.
+func startAdminServer(network, address string, handler http.Handler) (*http.Server, error) {
+	if network == "unix" {
+		if err := removeStaleSocket(address); err != nil {
+			return nil, err
+		}
+	}
+	// Listen first so an unusable address is reported right away.
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for admin API: %w", err)
+	}
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("admin server failed (error: %v)", err)
+		}
+	}()
+	log.Printf("serving admin API on %v\n", listener.Addr())
+	return srv, nil
+}
+
+// storageClient is implemented by the gcs and testhelper storage clients.
+type storageClient interface {
+	schema.DownloaderUploader
+	schema.Lister
+	Delete(context.Context, string) error
+}
+
+// newStorageClient creates a storage client for the configured bucket.
+// The gcsLocalDisk flag is meant for e2e testing where we want to read
+// from and write to the local disk storage instead of cloud storage.
+func newStorageClient(ctx context.Context) (storageClient, error) {
+	if gcsLocalDisk {
+		return testhelper.NewClient(ctx, bucket)
+	}
+	return gcs.NewClient(ctx, bucket)
+}
+
+// lockSpoolDir creates the spool directory of the given datatype if it
+// doesn't already exist and locks it.
+func lockSpoolDir(datatype string) (*spoollock.Lock, error) {
+	dir := filepath.Join(localDataDir, experiment, datatype)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	lock, err := spoollock.New(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", datatype, err)
+	}
+	return lock, nil
+}
+
 // startWatcher starts a directory watcher goroutine that watches the
 // specified directory and notifies its client of new (and potentially
 // missed) files.
-func startWatcher(mainCtx context.Context, mainCancel context.CancelFunc, status chan<- error, datatype string, watchEvents []notify.Event) (*watchdir.WatchDir, error) {
+func startWatcher(mainCtx context.Context, mainCancel context.CancelFunc, status chan<- error, datatype string, dtLayout *layout.Layout, watchEvents []notify.Event) (*watchdir.WatchDir, error) {
 	watchDir := filepath.Join(localDataDir, experiment, datatype)
 	// Create the directory to watch if it doesn't already exist.
 	if err := os.MkdirAll(watchDir, 0o755); err != nil {
 		return nil, fmt.Errorf("failed to create directory: %w", err)
 	}
-	wdClient, err := watchdir.New(watchDir, extensions, watchEvents, missedAge, missedInterval)
+	wdClient, err := watchdir.New(watchDir, extensions, dtLayout, watchEvents, missedAge, missedInterval)
 	if err != nil {
 		return nil, fmt.Errorf("failed to instantiate watcher: %w", err)
 	}
@@ -169,32 +334,129 @@ func startWatcher(mainCtx context.Context, mainCancel context.CancelFunc, status
 	return wdClient, nil
 }
 
+// startOutbox starts a goroutine that uploads the bundles queued in the
+// outbox via the given storage client.  It returns nil if the outbox is
+// not enabled.
+func startOutbox(mainCtx context.Context, stClient storageClient) (uploadbundle.Outbox, error) {
+	if outboxDir == "" {
+		return nil, nil
+	}
+	conf := outbox.Config{
+		Dir:           outboxDir,
+		SizeMax:       int64(outboxSizeMax),
+		Policy:        outboxPolicy,
+		RetryInterval: outboxRetryInterval,
+	}
+	ob, err := outbox.New(conf, stClient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create outbox: %w", err)
+	}
+	go func() {
+		// Drain() runs forever unless the context is canceled.
+		_ = ob.Drain(mainCtx)
+	}()
+	return ob, nil
+}
+
+// startRetention starts a goroutine that prunes the retention directory
+// of uploaded files.  It returns nil if retention is not enabled.
+func startRetention(mainCtx context.Context) (uploadbundle.Retainer, error) {
+	if retentionDir == "" {
+		return nil, nil
+	}
+	conf := retention.Config{
+		Dir:      retentionDir,
+		SpoolDir: localDataDir,
+		AgeMax:   retentionAgeMax,
+		SizeMax:  int64(retentionSizeMax),
+		Interval: retentionPruneInterval,
+	}
+	r, err := retention.New(conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create retention directory: %w", err)
+	}
+	go func() {
+		// Run() runs forever unless the context is canceled.
+		_ = r.Run(mainCtx)
+	}()
+	return r, nil
+}
+
+// startWatchdog starts a goroutine that watches for pressure on the
+// filesystem of the spool directory (if enabled) and tells the given
+// uploaders when it starts and ends.
+func startWatchdog(mainCtx context.Context, uploaders []*uploadbundle.UploadBundle) error {
+	if spoolCheckInterval <= 0 {
+		return nil
+	}
+	conf := diskpressure.Config{
+		Dir:        localDataDir,
+		Interval:   spoolCheckInterval,
+		Soft:       spoolSoftThreshold,
+		Hard:       spoolHardThreshold,
+		MarkerFile: spoolMarkerFile,
+	}
+	watchdog, err := diskpressure.New(conf)
+	if err != nil {
+		return fmt.Errorf("failed to create spool watchdog: %w", err)
+	}
+	go func() {
+		// Watch() runs forever unless the context is canceled.
+		_ = watchdog.Watch(mainCtx, func(level diskpressure.Level) {
+			for _, ubClient := range uploaders {
+				ubClient.SetPressure(level >= diskpressure.LevelSoft)
+			}
+		})
+	}()
+	return nil
+}
+
 // startUploader start a bundle uploader goroutine that bundles
 // individual JSON files into JSONL bundle and uploads it to GCS.
-func startUploader(mainCtx context.Context, mainCancel context.CancelFunc, status chan<- error, datatype string, wdClient *watchdir.WatchDir) (*uploadbundle.UploadBundle, error) {
-	nameParts, err := host.Parse(mlabNodeName.Value)
+func startUploader(mainCtx context.Context, mainCancel context.CancelFunc, status chan<- error, stClient storageClient, datatype, dateSource, dateField string, dtLayout *layout.Layout, wdClient *watchdir.WatchDir, ob uploadbundle.Outbox, retainer uploadbundle.Retainer) (*uploadbundle.UploadBundle, error) {
+	ubClient, err := newUploader(mainCtx, stClient, datatype, dateSource, dateField, dtLayout, wdClient, ob, retainer)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse hostname: %w", err)
+		return nil, err
 	}
 
-	// Create a storage client.
-	// The gcsLocalDisk flag is meant for e2e testing where we want to read
-	// from and write to the local disk storage instead of cloud storage.
-	var stClient uploadbundle.Uploader
-	if gcsLocalDisk {
-		stClient, err = testhelper.NewClient(mainCtx, bucket)
-	} else {
-		stClient, err = gcs.NewClient(mainCtx, bucket)
+	go func(ubClient *uploadbundle.UploadBundle, status chan<- error) {
+		defer mainCancel()
+		// BundleAndUpload() runs forever unless somehow the
+		// context is canceled or the channels it uses are closed.
+		status <- ubClient.BundleAndUpload(mainCtx)
+	}(ubClient, status)
+	return ubClient, nil
+}
+
+// newUploader returns a new bundle uploader of the given datatype
+// configured by the flags that uploads bundles via the given storage
+// client, queues bundles that fail to upload in the given outbox, and
+// hands uploaded files to the given retainer (if not nil).
+func newUploader(ctx context.Context, stClient storageClient, datatype, dateSource, dateField string, dtLayout *layout.Layout, wdClient *watchdir.WatchDir, ob uploadbundle.Outbox, retainer uploadbundle.Retainer) (*uploadbundle.UploadBundle, error) {
+	nameParts, err := host.Parse(mlabNodeName.Value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse hostname: %w", err)
 	}
+	partition, err := datatypePartition(datatype)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create storage client: %w", err)
+		return nil, err
 	}
+
 	gcsConf := uploadbundle.GCSConfig{
-		GCSClient: stClient,
-		Bucket:    bucket,
-		DataDir:   filepath.Join(gcsDataDir, organization, experiment, datatype),
-		IndexDir:  filepath.Join(gcsDataDir, organization, experiment, "index1"),
-		BaseID:    fmt.Sprintf("%s-%s-%s-%s", datatype, nameParts.Machine, nameParts.Site, experiment),
+		GCSClient:     stClient,
+		Bucket:        bucket,
+		DataDir:       gcsDataDir,
+		DataTemplate:  dataTemplate,
+		IndexTemplate: indexTemplate,
+		Vars: naming.Vars{
+			Node:         mlabNodeName.Value,
+			Machine:      nameParts.Machine,
+			Site:         nameParts.Site,
+			Project:      nameParts.Project,
+			Experiment:   experiment,
+			Organization: organization,
+		},
+		Outbox: ob,
 	}
 	bundleConf := uploadbundle.BundleConfig{
 		Version:   Version,
@@ -203,17 +465,34 @@ func startUploader(mainCtx context.Context, mainCancel context.CancelFunc, statu
 		SpoolDir:  filepath.Join(localDataDir, experiment, datatype),
 		SizeMax:   bundleSizeMax,
 		AgeMax:    bundleAgeMax,
+
+		RowsMax:           bundleRowsMax,
+		CompressedSizeMax: bundleCompressedSizeMax,
+
+		StdCols: jsonlbundle.StdColsConfig{
+			Version:    schema.StdColsVersion(datatype),
+			Node:       mlabNodeName.Value,
+			Machine:    nameParts.Machine,
+			Site:       nameParts.Site,
+			Project:    nameParts.Project,
+			Experiment: experiment,
+
+			IDField:       schema.IDFields[datatype],
+			TestTimeField: schema.TestTimeFields[datatype],
+		},
+		DateSource: dateSource,
+		DateField:  dateField,
+		Layout:     dtLayout,
+		Partition:  partition,
+
+		PressureSizeMax: pressureBundleSizeMax,
+		PressureAgeMax:  pressureBundleAgeMax,
+
+		Retainer: retainer,
 	}
-	ubClient, err := uploadbundle.New(mainCtx, wdClient, gcsConf, bundleConf)
+	ubClient, err := uploadbundle.New(ctx, wdClient, gcsConf, bundleConf)
 	if err != nil {
 		return nil, fmt.Errorf("failed to instantiate uploader: %w", err)
 	}
-
-	go func(ubClient *uploadbundle.UploadBundle, status chan<- error) {
-		defer mainCancel()
-		// BundleAndUpload() runs forever unless somehow the
-		// context is canceled or the channels it uses are closed.
-		status <- ubClient.BundleAndUpload(mainCtx)
-	}(ubClient, status)
 	return ubClient, nil
 }
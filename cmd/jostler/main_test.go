@@ -2,18 +2,29 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/m-lab/go/flagx"
 	"github.com/m-lab/go/prometheusx"
+	"github.com/m-lab/jostler/internal/admin"
+	"github.com/m-lab/jostler/internal/extract"
+	"github.com/m-lab/jostler/internal/layout"
+	"github.com/m-lab/jostler/internal/naming"
 	"github.com/m-lab/jostler/internal/schema"
+	"github.com/m-lab/jostler/internal/spoollock"
 	"github.com/m-lab/jostler/internal/testhelper"
+	"github.com/m-lab/jostler/internal/uploadbundle"
 )
 
 const (
@@ -82,6 +93,27 @@ func TestCLI(t *testing.T) {
 			"local: valid foo1", false, "",
 			[]string{"-local", "-experiment", testExperiment, "-datatype", "foo1", "-datatype-schema-file", "foo1:testdata/datatypes/foo1-valid.json"},
 		},
+		{
+			"local: valid foo1 with version 1 standard columns", false, "",
+			[]string{
+				"-local", "-experiment", testExperiment, "-datatype", "foo1", "-datatype-schema-file", "foo1:testdata/datatypes/foo1-valid.json",
+				"-standard-columns", "foo1:v1",
+			},
+		},
+		{
+			"local: valid foo1 with promoted id", false, "",
+			[]string{
+				"-local", "-experiment", testExperiment, "-datatype", "foo1", "-datatype-schema-file", "foo1:testdata/datatypes/foo1-valid.json",
+				"-id-field", "foo1:UUID",
+			},
+		},
+		{
+			"local: invalid promoted test time", false, schema.ErrPromotedField.Error(),
+			[]string{
+				"-local", "-experiment", testExperiment, "-datatype", "foo1", "-datatype-schema-file", "foo1:testdata/datatypes/foo1-valid.json",
+				"-test-time-field", "foo1:UUID",
+			},
+		},
 		// Invalid daemon mode command lines.
 		{
 			"daemon: no node", false, errNoNode.Error(),
@@ -117,6 +149,105 @@ func TestCLI(t *testing.T) {
 				"-datatype-schema-file", "bar1:testdata/datatypes/foo1-valid.json",
 			},
 		},
+		{
+			"daemon: mismatch between datatype and standard columns", false, errSchemaNoMatch.Error(),
+			[]string{
+				"-gcs-bucket", testBucket, "-mlab-node-name", testNode, "-experiment", testExperiment, "-datatype", testDatatype,
+				"-standard-columns", "bar1:v1",
+			},
+		},
+		{
+			"daemon: unsupported standard columns version", false, errStdColsVersion.Error(),
+			[]string{
+				"-gcs-bucket", testBucket, "-mlab-node-name", testNode, "-experiment", testExperiment, "-datatype", testDatatype,
+				"-standard-columns", "foo1:v99",
+			},
+		},
+		{
+			"daemon: invalid date source", false, errDateSource.Error(),
+			[]string{
+				"-gcs-bucket", testBucket, "-mlab-node-name", testNode, "-experiment", testExperiment, "-datatype", testDatatype,
+				"-date-source", "foo1:field:",
+			},
+		},
+		{
+			"daemon: invalid layout", false, layout.ErrTemplate.Error(),
+			[]string{
+				"-gcs-bucket", testBucket, "-mlab-node-name", testNode, "-experiment", testExperiment, "-datatype", testDatatype,
+				"-layout", "foo1:{yyyy}/{mm}/{dd}",
+			},
+		},
+		{
+			"daemon: flat layout with dates from directories", false, errLayoutNoDate.Error(),
+			[]string{
+				"-gcs-bucket", testBucket, "-mlab-node-name", testNode, "-experiment", testExperiment, "-datatype", testDatatype,
+				"-layout", "foo1:{name}",
+			},
+		},
+		{
+			"daemon: invalid partition", false, errPartition.Error(),
+			[]string{
+				"-gcs-bucket", testBucket, "-mlab-node-name", testNode, "-experiment", testExperiment, "-datatype", testDatatype,
+				"-partition", "foo1:7h",
+			},
+		},
+		{
+			"daemon: invalid outbox policy", false, errOutbox.Error(),
+			[]string{
+				"-gcs-bucket", testBucket, "-mlab-node-name", testNode, "-experiment", testExperiment, "-datatype", testDatatype,
+				"-outbox-dir", "testdata/outbox", "-outbox-policy", "newest-first",
+			},
+		},
+		{
+			"daemon: zero outbox size", false, errOutbox.Error(),
+			[]string{
+				"-gcs-bucket", testBucket, "-mlab-node-name", testNode, "-experiment", testExperiment, "-datatype", testDatatype,
+				"-outbox-dir", "testdata/outbox", "-outbox-size-max", "0",
+			},
+		},
+		{
+			"daemon: soft spool threshold above hard", false, errSpoolThresholds.Error(),
+			[]string{
+				"-gcs-bucket", testBucket, "-mlab-node-name", testNode, "-experiment", testExperiment, "-datatype", testDatatype,
+				"-spool-check-interval", "1m", "-spool-soft-threshold", "90", "-spool-hard-threshold", "85",
+			},
+		},
+		{
+			"daemon: invalid retention prune interval", false, errRetention.Error(),
+			[]string{
+				"-gcs-bucket", testBucket, "-mlab-node-name", testNode, "-experiment", testExperiment, "-datatype", testDatatype,
+				"-retention-dir", "testdata/retained", "-retention-prune-interval", "0s",
+			},
+		},
+		{
+			"daemon: invalid data object template", false, naming.ErrTemplate.Error(),
+			[]string{
+				"-gcs-bucket", testBucket, "-mlab-node-name", testNode, "-experiment", testExperiment, "-datatype", testDatatype,
+				"-data-object-template", "{experiment}/{datatype}/{date}/{timestamp}-{node}.jsonl.gz",
+			},
+		},
+		{
+			"daemon: data object template without node", false, naming.ErrNotUnique.Error(),
+			[]string{
+				"-gcs-bucket", testBucket, "-mlab-node-name", testNode, "-experiment", testExperiment, "-datatype", testDatatype,
+				"-data-object-template", "{experiment}/{datatype}/{yyyy}/{mm}/{dd}/{timestamp}.jsonl.gz",
+			},
+		},
+		{
+			"daemon: same data and index object templates", false, naming.ErrNotUnique.Error(),
+			[]string{
+				"-gcs-bucket", testBucket, "-mlab-node-name", testNode, "-experiment", testExperiment, "-datatype", testDatatype,
+				"-data-object-template", "{experiment}/{datatype}/{timestamp}-{node}.jsonl.gz",
+				"-index-object-template", "{experiment}/{datatype}/{timestamp}-{node}.jsonl.gz",
+			},
+		},
+		{
+			"daemon: schema object template without datatype", false, naming.ErrNotUnique.Error(),
+			[]string{
+				"-gcs-bucket", testBucket, "-mlab-node-name", testNode, "-experiment", testExperiment, "-datatype", testDatatype,
+				"-schema-object-template", "tables/{experiment}.table.json",
+			},
+		},
 		{
 			"daemon: non-existent default datatype schema file", false, schema.ErrReadSchema.Error(),
 			[]string{"-gcs-bucket", testBucket, "-mlab-node-name", testNode, "-experiment", testExperiment, "-datatype", testDatatype},
@@ -311,10 +442,57 @@ func TestCLI(t *testing.T) {
 				"-upload-schema=false",
 			},
 		},
+		{
+			"valid: admin API", false, "",
+			[]string{
+				"-gcs-bucket", "newclient,download,upload",
+				"-mlab-node-name", testNode,
+				"-local-data-dir", testLocalDataDir,
+				"-experiment", testExperiment,
+				"-datatype", "foo1",
+				"-datatype-schema-file", "foo1:testdata/datatypes/foo1-valid.json",
+				"-gcs-data-dir=testdata/autoload/v2",
+				"-organization=foo1org",
+				"-upload-schema=false",
+				"-admin-address", "localhost:0",
+				"-status-socket", filepath.Join(t.TempDir(), "jostler.sock"),
+			},
+		},
+		{
+			"invalid: admin API address", false, "failed to listen for admin API",
+			[]string{
+				"-gcs-bucket", "newclient,download,upload",
+				"-mlab-node-name", testNode,
+				"-local-data-dir", testLocalDataDir,
+				"-experiment", testExperiment,
+				"-datatype", "foo1",
+				"-datatype-schema-file", "foo1:testdata/datatypes/foo1-valid.json",
+				"-gcs-data-dir=testdata/autoload/v2",
+				"-organization=foo1org",
+				"-upload-schema=false",
+				"-admin-address", "localhost:invalid",
+			},
+		},
+		{
+			"invalid: non-loopback admin API address", false, errAdminAddress.Error(),
+			[]string{
+				"-gcs-bucket", "newclient,download,upload",
+				"-mlab-node-name", testNode,
+				"-local-data-dir", testLocalDataDir,
+				"-experiment", testExperiment,
+				"-datatype", "foo1",
+				"-datatype-schema-file", "foo1:testdata/datatypes/foo1-valid.json",
+				"-gcs-data-dir=testdata/autoload/v2",
+				"-organization=foo1org",
+				"-upload-schema=false",
+				"-admin-address", ":9991",
+			},
+		},
 	}
 	defer func() {
 		os.RemoveAll("foo1.json")
 		os.RemoveAll("testdata/autoload")
+		os.Remove(filepath.Join(testLocalDataDir, testExperiment, testDatatype, spoollock.Name))
 	}()
 	for i, test := range tests {
 		t.Logf("name: %s", test.name)
@@ -340,6 +518,1010 @@ func TestCLI(t *testing.T) {
 	}
 }
 
+// TestSchemaDiff tests the "schema diff" subcommand.
+func TestSchemaDiff(t *testing.T) {
+	tblSchemaFile := "testdata/autoload/v1/tables/jostler/foo1.table.json"
+	tblSchemaJSON, err := schema.CreateTableSchemaJSON(testDatatype, "testdata/datatypes/foo1-valid.json")
+	if err != nil {
+		t.Fatalf("schema.CreateTableSchemaJSON() = %v, want nil", err)
+	}
+	if err = os.MkdirAll("testdata/autoload/v1/tables/jostler", 0o755); err != nil {
+		t.Fatalf("os.MkdirAll() = %v, want nil", err)
+	}
+	defer os.RemoveAll("testdata/autoload")
+	diffArgs := []string{
+		"-gcs-local-disk",
+		"-gcs-bucket", "newclient,download",
+		"-gcs-data-dir=testdata/autoload/v1",
+		"-experiment", testExperiment,
+		"-datatype", testDatatype,
+	}
+	tests := []struct {
+		name            string   // name of the test
+		rmTblSchemaFile bool     // if true, remove table schema file before running the test
+		wantErrStr      string   // error message
+		wantOut         []string // strings expected in the output
+		args            []string // flags and arguments
+	}{
+		{
+			"no subcommand", false, errNoSubcommand.Error(), nil,
+			[]string{"schema"},
+		},
+		{
+			"unknown subcommand", false, errUnknownSubcommand.Error(), nil,
+			[]string{"schema", "foo"},
+		},
+		{
+			"no bucket", false, errNoBucket.Error(), nil,
+			[]string{"schema", "diff", "-experiment", testExperiment, "-datatype", testDatatype},
+		},
+		{
+			"invalid format", false, errFormat.Error(), nil,
+			append([]string{"schema", "diff", "-format", "yaml"}, diffArgs...),
+		},
+		{
+			"extra args", false, errExtraArgs.Error(), nil,
+			append([]string{"schema", "diff"}, append(diffArgs, "extra-arg")...),
+		},
+		{
+			"non-existent table schema", true, schema.ErrDownload.Error(), nil,
+			append([]string{"schema", "diff", "-datatype-schema-file", "foo1:testdata/datatypes/foo1-valid.json"}, diffArgs...),
+		},
+		{
+			"no differences", false, "", []string{"no differences"},
+			append([]string{"schema", "diff", "-datatype-schema-file", "foo1:testdata/datatypes/foo1-valid.json"}, diffArgs...),
+		},
+		{
+			"superset in text", false, "", []string{"added:", "raw.Field3 STRING NULLABLE"},
+			append([]string{"schema", "diff", "-datatype-schema-file", "foo1:testdata/datatypes/foo1-valid-superset.json"}, diffArgs...),
+		},
+		{
+			"superset in json", false, "", []string{`"datatype": "foo1"`, `"name": "raw.Field3"`, `"newType": "STRING"`, `"removed": []`},
+			append([]string{"schema", "diff", "-format", "json", "-datatype-schema-file", "foo1:testdata/datatypes/foo1-valid-superset.json"}, diffArgs...),
+		},
+	}
+	saveStdout := stdout
+	defer func() {
+		stdout = saveStdout
+	}()
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		os.RemoveAll(tblSchemaFile)
+		if !test.rmTblSchemaFile {
+			if err := os.WriteFile(tblSchemaFile, tblSchemaJSON, 0o666); err != nil {
+				t.Fatalf("os.WriteFile() = %v, want nil", err)
+			}
+		}
+		var out bytes.Buffer
+		stdout = &out
+		callMain(t, test.args, test.wantErrStr)
+		for _, want := range test.wantOut {
+			if !strings.Contains(out.String(), want) {
+				t.Fatalf("output = %v, want %v", out.String(), want)
+			}
+		}
+	}
+}
+
+func TestSchemaInfer(t *testing.T) {
+	sampleDir := t.TempDir()
+	conflictDir := t.TempDir()
+	dtSchemaFile := filepath.Join(t.TempDir(), "foo1.json")
+	samples := map[string]string{
+		filepath.Join(sampleDir, "s1.json"):        `{"UUID": "a", "RTT": 1, "Tags": ["x"], "Server": {"Site": "lga01"}}`,
+		filepath.Join(sampleDir, "sub", "s2.json"): `{"UUID": "b", "RTT": 1.5, "Server": {"Site": "lga02", "Machine": "mlab1"}}`,
+		filepath.Join(sampleDir, "ignored.txt"):    `not json`,
+		filepath.Join(conflictDir, "s1.json"):      `{"UUID": "a", "RTT": 1}`,
+		filepath.Join(conflictDir, "s2.json"):      `{"UUID": "b", "RTT": "1ms"}`,
+	}
+	for name, contents := range samples {
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatalf("os.MkdirAll() = %v, want nil", err)
+		}
+		if err := os.WriteFile(name, []byte(contents), 0o666); err != nil {
+			t.Fatalf("os.WriteFile() = %v, want nil", err)
+		}
+	}
+	tests := []struct {
+		name       string   // name of the test
+		wantErrStr string   // error message
+		wantOut    []string // strings expected in the output
+		args       []string // flags and arguments
+	}{
+		{
+			"no sample directory", errNoSampleDir.Error(), nil,
+			[]string{"schema", "infer"},
+		},
+		{
+			"non-existent sample directory", "failed to walk", nil,
+			[]string{"schema", "infer", "-sample-dir", "testdata/non-existent"},
+		},
+		{
+			"no sample files", schema.ErrNoSamples.Error(), nil,
+			[]string{"schema", "infer", "-sample-dir", sampleDir, "-extensions", ".jsonl"},
+		},
+		{
+			"conflicts", errConflicts.Error(), nil,
+			[]string{"schema", "infer", "-sample-dir", conflictDir},
+		},
+		{
+			"stdout", "", []string{`"name": "RTT"`, `"type": "FLOAT"`, `"mode": "REPEATED"`, `"name": "Machine"`},
+			[]string{"schema", "infer", "-sample-dir", sampleDir},
+		},
+		{
+			"output file", "", nil,
+			[]string{"schema", "infer", "-sample-dir", sampleDir, "-output", dtSchemaFile},
+		},
+	}
+	saveStdout := stdout
+	defer func() {
+		stdout = saveStdout
+	}()
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		var out bytes.Buffer
+		stdout = &out
+		callMain(t, test.args, test.wantErrStr)
+		for _, want := range test.wantOut {
+			if !strings.Contains(out.String(), want) {
+				t.Fatalf("output = %v, want %v", out.String(), want)
+			}
+		}
+	}
+	// The inferred datatype schema should be usable.
+	if _, err := schema.CreateTableSchemaJSON(testDatatype, dtSchemaFile); err != nil {
+		t.Fatalf("schema.CreateTableSchemaJSON() = %v, want nil", err)
+	}
+}
+
+func TestSchemaHistory(t *testing.T) {
+	saveGCSDataDir := schema.GCSDataDir
+	defer func() {
+		schema.GCSDataDir = saveGCSDataDir
+		os.RemoveAll("testdata/autoload")
+	}()
+	// Upload two versions of the table schema to create its history.
+	schema.GCSDataDir = "testdata/autoload/v1"
+	stClient, err := testhelper.NewClient(context.Background(), "newclient,download,upload")
+	if err != nil {
+		t.Fatalf("testhelper.NewClient() = %v, want nil", err)
+	}
+	os.RemoveAll("testdata/autoload")
+	for _, dtSchemaFile := range []string{"testdata/datatypes/foo1-valid.json", "testdata/datatypes/foo1-valid-superset.json"} {
+		if err := schema.ValidateAndUpload(stClient, "", testExperiment, testDatatype, dtSchemaFile, true); err != nil {
+			t.Fatalf("schema.ValidateAndUpload() = %v, want nil", err)
+		}
+	}
+	historyArgs := []string{
+		"-gcs-local-disk",
+		"-gcs-bucket", "newclient,download,list",
+		"-gcs-data-dir=testdata/autoload/v1",
+		"-experiment", testExperiment,
+		"-datatype", testDatatype,
+	}
+	tests := []struct {
+		name       string   // name of the test
+		wantErrStr string   // error message
+		wantOut    []string // strings expected in the output
+		args       []string // flags and arguments
+	}{
+		{
+			"no history subcommand", errNoSubcommand.Error(), nil,
+			[]string{"schema", "history"},
+		},
+		{
+			"list: no experiment", errNoExperiment.Error(), nil,
+			[]string{"schema", "history", "list", "-gcs-bucket", "newclient"},
+		},
+		{
+			"list: empty history", "", []string{"no versions"},
+			append([]string{"schema", "history", "list"}, append(historyArgs, "-experiment", "nonexistent")...),
+		},
+		{
+			"list in text", "", []string{"new table schema", "1 added"},
+			append([]string{"schema", "history", "list"}, historyArgs...),
+		},
+		{
+			"list in json", "", []string{`"datatype": "foo1"`, `"summary": "1 added"`, `"newType": "STRING"`},
+			append([]string{"schema", "history", "list", "-format", "json"}, historyArgs...),
+		},
+		{
+			"fetch: more than one datatype", errOneDatatype.Error(), nil,
+			append([]string{"schema", "history", "fetch", "-datatype", "bar1"}, historyArgs...),
+		},
+		{
+			"fetch: non-existent version", schema.ErrDownload.Error(), nil,
+			append([]string{"schema", "history", "fetch", "-version", "20000101T000000.000000Z"}, historyArgs...),
+		},
+		{
+			"fetch: latest", "", []string{`"name": "Field3"`},
+			append([]string{"schema", "history", "fetch"}, historyArgs...),
+		},
+		{
+			"fetch: latest with metadata", "", []string{`"summary": "1 added"`, `"schema": [`},
+			append([]string{"schema", "history", "fetch", "-metadata"}, historyArgs...),
+		},
+	}
+	saveStdout := stdout
+	defer func() {
+		stdout = saveStdout
+	}()
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		var out bytes.Buffer
+		stdout = &out
+		callMain(t, test.args, test.wantErrStr)
+		for _, want := range test.wantOut {
+			if !strings.Contains(out.String(), want) {
+				t.Fatalf("output = %v, want %v", out.String(), want)
+			}
+		}
+	}
+}
+
+// statusDatatype implements the admin.Uploader and admin.Watcher
+// interfaces for testing the status subcommand.
+type statusDatatype struct {
+	bundles []uploadbundle.BundleInfo
+	pending string
+}
+
+func (d *statusDatatype) Bundles() []uploadbundle.BundleInfo  { return d.bundles }
+func (d *statusDatatype) Flush()                              {}
+func (d *statusDatatype) Pause()                              {}
+func (d *statusDatatype) Resume()                             {}
+func (d *statusDatatype) Paused() bool                        { return false }
+func (d *statusDatatype) Uploads() uploadbundle.UploadSummary { return uploadbundle.UploadSummary{} }
+func (d *statusDatatype) Scan()                               {}
+func (d *statusDatatype) Pending() int                        { return 1 }
+func (d *statusDatatype) IsPending(fullPath string) bool      { return fullPath == d.pending }
+
+func (d *statusDatatype) FindFile(fullPath string) (uploadbundle.BundleInfo, bool) {
+	if fullPath == "/spool/foo1/uploaded.json" {
+		return d.bundles[0], true
+	}
+	return uploadbundle.BundleInfo{}, false
+}
+
+// TestStatus tests the "status" subcommand.
+func TestStatus(t *testing.T) {
+	foo1 := &statusDatatype{
+		bundles: []uploadbundle.BundleInfo{
+			{Datatype: "foo1", Timestamp: "20230405T154435.729707Z", State: uploadbundle.StateUploaded, Bucket: "some-bucket", DataObject: "autoload/v1/foo1-data.jsonl.gz"},
+			{Datatype: "foo1", Timestamp: "20230405T164435.729707Z", State: uploadbundle.StateActive, Files: 3, Size: 300},
+		},
+		pending: "/spool/foo1/pending.json",
+	}
+	socket := filepath.Join(t.TempDir(), "jostler.sock")
+	srv, err := startAdminServer("unix", socket, admin.New(map[string]admin.Datatype{"foo1": {Uploader: foo1, Watcher: foo1}}).Handler())
+	if err != nil {
+		t.Fatalf("startAdminServer() = %v, want nil", err)
+	}
+	defer srv.Close()
+	// The socket of a running server is not removed.
+	if _, err := startAdminServer("unix", socket, http.NotFoundHandler()); !errors.Is(err, errSocketInUse) {
+		t.Fatalf("startAdminServer() = %v, want %v", err, errSocketInUse)
+	}
+	// The socket of a previous run that wasn't shut down gracefully is.
+	staleSocket := filepath.Join(t.TempDir(), "stale.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: staleSocket, Net: "unix"})
+	if err != nil {
+		t.Fatalf("net.ListenUnix() = %v, want nil", err)
+	}
+	listener.SetUnlinkOnClose(false)
+	listener.Close()
+	staleSrv, err := startAdminServer("unix", staleSocket, http.NotFoundHandler())
+	if err != nil {
+		t.Fatalf("startAdminServer() = %v, want nil", err)
+	}
+	staleSrv.Close()
+
+	tests := []struct {
+		name       string   // name of the test
+		wantErrStr string   // error message
+		wantOut    []string // strings expected in the output
+		args       []string // flags and arguments
+	}{
+		{
+			"no socket", errNoStatusSocket.Error(), nil,
+			[]string{"status"},
+		},
+		{
+			"invalid format", errFormat.Error(), nil,
+			[]string{"status", "-status-socket", socket, "-format", "yaml"},
+		},
+		{
+			"daemon not running", errDaemon.Error(), nil,
+			[]string{"status", "-status-socket", filepath.Join(t.TempDir(), "jostler.sock")},
+		},
+		{
+			"unknown datatype", admin.ErrDatatype.Error(), nil,
+			[]string{"status", "-status-socket", socket, "-datatype", "foo2"},
+		},
+		{
+			"summary in text", "", []string{"foo1: 1 active bundle(s), 0 in flight, 1 pending file(s)", "active 20230405T164435.729707Z: 3 file(s), 300 bytes", "last upload: never", "last error: none"},
+			[]string{"status", "-status-socket", socket},
+		},
+		{
+			"summary in json", "", []string{`"datatype": "foo1"`, `"pending": 1`, `"files": 3`},
+			[]string{"status", "-status-socket", socket, "-datatype", "foo1", "-format", "json"},
+		},
+		{
+			"uploaded file", "", []string{"/spool/foo1/uploaded.json: uploaded (foo1) in bundle 20230405T154435.729707Z to gs://some-bucket/autoload/v1/foo1-data.jsonl.gz"},
+			[]string{"status", "-status-socket", socket, "-file", "/spool/foo1/uploaded.json"},
+		},
+		{
+			"pending file", "", []string{"/spool/foo1/pending.json: pending (foo1)"},
+			[]string{"status", "-status-socket", socket, "-file", "/spool/foo1/../foo1/pending.json"},
+		},
+		{
+			"unknown file in json", "", []string{`"state": "unknown"`},
+			[]string{"status", "-status-socket", socket, "-file", "/spool/foo1/unknown.json", "-format", "json"},
+		},
+	}
+	saveStdout := stdout
+	defer func() {
+		stdout = saveStdout
+	}()
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		var out bytes.Buffer
+		stdout = &out
+		callMain(t, test.args, test.wantErrStr)
+		for _, want := range test.wantOut {
+			if !strings.Contains(out.String(), want) {
+				t.Fatalf("output = %v, want %v", out.String(), want)
+			}
+		}
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	defer os.RemoveAll("testdata/autoload")
+	backfillArgs := func(localDataDir string, extra ...string) []string {
+		return append([]string{
+			"backfill",
+			"-gcs-local-disk",
+			"-gcs-bucket", "newclient,download,upload",
+			"-gcs-data-dir=testdata/autoload/v1",
+			"-mlab-node-name", testNode,
+			"-local-data-dir", localDataDir,
+			"-experiment", testExperiment,
+			"-datatype", testDatatype,
+			"-datatype-schema-file", "foo1:testdata/datatypes/foo1-valid.json",
+			"-bundle-rows-max", "2",
+		}, extra...)
+	}
+	tests := []struct {
+		name       string            // name of the test
+		files      map[string]string // files to create under the datatype directory
+		extraArgs  []string          // flags in addition to the common ones
+		wantErrStr string            // error message
+		wantOut    string            // string expected in the output
+		wantLeft   []string          // files expected to be left behind
+		locked     bool              // if true, lock the datatype directory as the daemon would
+	}{
+		{
+			name:       "no node",
+			extraArgs:  []string{"-mlab-node-name", ""},
+			wantErrStr: errNoNode.Error(),
+		},
+		{
+			name:       "invalid format",
+			extraArgs:  []string{"-format", "yaml"},
+			wantErrStr: errFormat.Error(),
+		},
+		{
+			name:       "no datatype directory",
+			wantErrStr: "no such file or directory",
+		},
+		{
+			name: "uploaded",
+			files: map[string]string{
+				"2022/11/09/1.json": `{"Field1": 1}`,
+				"2022/11/09/2.json": `{"Field1": 2}`,
+				"2022/11/10/3.json": `{"Field1": 3}`,
+				"2022/11/10/4.txt":  `not a measurement file`,
+			},
+			wantOut:  "foo1: 3 file(s) in 2 bundle(s): 2 uploaded, 0 failed, 0 bad file(s), 0 skipped file(s)",
+			wantLeft: []string{"2022/11/10/4.txt"},
+		},
+		{
+			name: "uploaded json",
+			files: map[string]string{
+				"2022/11/09/1.json": `{"Field1": 1}`,
+			},
+			extraArgs: []string{"-format", "json"},
+			wantOut:   `"uploaded": 1`,
+		},
+		{
+			name: "bad file",
+			files: map[string]string{
+				"2022/11/09/1.json":   `{"Field1": 1}`,
+				"2022/11/09/bad.json": `{"Field1": `,
+			},
+			wantErrStr: errBackfill.Error(),
+			wantOut:    "foo1: 1 file(s) in 1 bundle(s): 1 uploaded, 0 failed, 1 bad file(s), 0 skipped file(s)",
+		},
+		{
+			name: "daemon running",
+			files: map[string]string{
+				"2022/11/09/1.json": `{"Field1": 1}`,
+			},
+			locked:     true,
+			wantErrStr: spoollock.ErrLocked.Error(),
+			wantLeft:   []string{"2022/11/09/1.json"},
+		},
+	}
+	saveStdout := stdout
+	defer func() { stdout = saveStdout }()
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		localDataDir := t.TempDir()
+		dtDir := filepath.Join(localDataDir, testExperiment, testDatatype)
+		for name, contents := range test.files {
+			f := filepath.Join(dtDir, name)
+			if err := os.MkdirAll(filepath.Dir(f), 0o755); err != nil {
+				t.Fatalf("os.MkdirAll() = %v, want nil", err)
+			}
+			if err := os.WriteFile(f, []byte(contents), 0o666); err != nil {
+				t.Fatalf("os.WriteFile() = %v, want nil", err)
+			}
+		}
+		var lock *spoollock.Lock
+		if test.locked {
+			var err error
+			if lock, err = spoollock.New(dtDir); err != nil {
+				t.Fatalf("spoollock.New() = %v, want nil", err)
+			}
+		}
+		var out bytes.Buffer
+		stdout = &out
+		callMain(t, backfillArgs(localDataDir, test.extraArgs...), test.wantErrStr)
+		if lock != nil {
+			_ = lock.Unlock()
+		}
+		if !strings.Contains(out.String(), test.wantOut) {
+			t.Fatalf("output = %v, want %v", out.String(), test.wantOut)
+		}
+		// Files that were uploaded are removed and so are bad files
+		// (as in the daemon mode).
+		for name := range test.files {
+			wantLeft := false
+			for _, left := range test.wantLeft {
+				wantLeft = wantLeft || left == name
+			}
+			if _, err := os.Stat(filepath.Join(dtDir, name)); os.IsNotExist(err) == wantLeft {
+				t.Fatalf("os.Stat(%v) = %v, want left %v", name, err, wantLeft)
+			}
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	defer os.RemoveAll("testdata/autoload")
+	// Backfill a few files to create bundles to verify.  Bundles
+	// should be verified with the bucket they were uploaded to.
+	gcsBucket := "newclient,download,upload,list"
+	localDataDir := t.TempDir()
+	for i, date := range []string{"2022/11/09", "2022/11/09", "2022/11/10"} {
+		f := filepath.Join(localDataDir, testExperiment, testDatatype, date, fmt.Sprintf("%d.json", i))
+		if err := os.MkdirAll(filepath.Dir(f), 0o755); err != nil {
+			t.Fatalf("os.MkdirAll() = %v, want nil", err)
+		}
+		if err := os.WriteFile(f, []byte(fmt.Sprintf(`{"Field1": %d}`, i)), 0o666); err != nil {
+			t.Fatalf("os.WriteFile() = %v, want nil", err)
+		}
+	}
+	saveStdout := stdout
+	defer func() { stdout = saveStdout }()
+	stdout = &bytes.Buffer{}
+	callMain(t, []string{
+		"backfill",
+		"-gcs-local-disk",
+		"-gcs-bucket", gcsBucket,
+		"-gcs-data-dir=testdata/autoload/v1",
+		"-mlab-node-name", testNode,
+		"-local-data-dir", localDataDir,
+		"-experiment", testExperiment,
+		"-datatype", testDatatype,
+		"-datatype-schema-file", "foo1:testdata/datatypes/foo1-valid.json",
+	}, "")
+	indexBundles, err := filepath.Glob("testdata/autoload/v1/jostler/index1/2022/11/10/*")
+	if err != nil || len(indexBundles) != 1 {
+		t.Fatalf("filepath.Glob() = %v, %v, want 1 index bundle", indexBundles, err)
+	}
+
+	verifyArgs := []string{
+		"verify",
+		"-gcs-local-disk",
+		"-gcs-bucket", gcsBucket,
+		"-gcs-data-dir=testdata/autoload/v1",
+		"-experiment", testExperiment,
+		"-datatype", testDatatype,
+	}
+	tests := []struct {
+		name       string   // name of the test
+		rmIndex    bool     // if true, remove an index bundle before running the test
+		wantErrStr string   // error message
+		wantOut    string   // string expected in the output
+		args       []string // flags and arguments
+	}{
+		{
+			"no from date", false, errNoFromDate.Error(), "",
+			verifyArgs,
+		},
+		{
+			"invalid date", false, errDate.Error(), "",
+			append(verifyArgs, "-from", "2022/11/09"),
+		},
+		{
+			"invalid date range", false, errDateRange.Error(), "",
+			append(verifyArgs, "-from", "2022-11-10", "-to", "2022-11-09"),
+		},
+		{
+			"ok", false, "", "foo1: 2 data bundle(s), 2 index bundle(s), 3 row(s), 0 problem(s)",
+			append(verifyArgs, "-from", "2022-11-09", "-to", "2022-11-10"),
+		},
+		{
+			"ok one day json", false, "", `"rows": 2`,
+			append(verifyArgs, "-from", "2022-11-09", "-format", "json"),
+		},
+		{
+			"orphaned data bundle", true, errVerify.Error(), "orphaned-data testdata/autoload/v1/jostler/foo1/2022/11/10/",
+			append(verifyArgs, "-from", "2022-11-09", "-to", "2022-11-10"),
+		},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		if test.rmIndex {
+			if err := os.Remove(indexBundles[0]); err != nil {
+				t.Fatalf("os.Remove() = %v, want nil", err)
+			}
+		}
+		var out bytes.Buffer
+		stdout = &out
+		callMain(t, test.args, test.wantErrStr)
+		if !strings.Contains(out.String(), test.wantOut) {
+			t.Fatalf("output = %v, want %v", out.String(), test.wantOut)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	defer os.RemoveAll("testdata/autoload")
+	// Backfill a few files to create bundles to search.
+	gcsBucket := "newclient,download,upload,list"
+	localDataDir := t.TempDir()
+	for i, date := range []string{"2022/11/09", "2022/11/09", "2022/11/10"} {
+		f := filepath.Join(localDataDir, testExperiment, testDatatype, date, fmt.Sprintf("%d.json", i))
+		if err := os.MkdirAll(filepath.Dir(f), 0o755); err != nil {
+			t.Fatalf("os.MkdirAll() = %v, want nil", err)
+		}
+		if err := os.WriteFile(f, []byte(fmt.Sprintf(`{"Field1": %d}`, i)), 0o666); err != nil {
+			t.Fatalf("os.WriteFile() = %v, want nil", err)
+		}
+	}
+	saveStdout := stdout
+	defer func() { stdout = saveStdout }()
+	stdout = &bytes.Buffer{}
+	callMain(t, []string{
+		"backfill",
+		"-gcs-local-disk",
+		"-gcs-bucket", gcsBucket,
+		"-gcs-data-dir=testdata/autoload/v1",
+		"-mlab-node-name", testNode,
+		"-local-data-dir", localDataDir,
+		"-experiment", testExperiment,
+		"-datatype", testDatatype,
+		"-datatype-schema-file", "foo1:testdata/datatypes/foo1-valid.json",
+	}, "")
+
+	findArgs := []string{
+		"find",
+		"-gcs-local-disk",
+		"-gcs-bucket", gcsBucket,
+		"-gcs-data-dir=testdata/autoload/v1",
+		"-experiment", testExperiment,
+	}
+	tests := []struct {
+		name       string   // name of the test
+		wantErrStr string   // error message
+		wantOut    string   // string expected in the output
+		args       []string // flags and arguments
+	}{
+		{
+			"no pattern", errNoPattern.Error(), "",
+			append(findArgs, "-from", "2022-11-09"),
+		},
+		{
+			"no from date", errNoFromDate.Error(), "",
+			append(findArgs, "-file", "1.json"),
+		},
+		{
+			"invalid parallel", errParallel.Error(), "",
+			append(findArgs, "-from", "2022-11-09", "-file", "1.json", "-parallel", "0"),
+		},
+		{
+			"invalid node", "invalid hostname", "",
+			append(findArgs, "-from", "2022-11-09", "-file", "1.json", "-node", "node"),
+		},
+		{
+			"not found in date range", errNotFound.Error(), "",
+			append(findArgs, "-from", "2022-11-10", "-file", "1.json"),
+		},
+		{
+			"not found on node", errNotFound.Error(), "",
+			append(findArgs, "-from", "2022-11-09", "-file", "1.json", "-node", "mlab2-lga01.mlab-sandbox.measurement-lab.org"),
+		},
+		{
+			"found", "", "/1.json: testdata/autoload/v1/jostler/foo1/2022/11/09/",
+			append(findArgs, "-from", "2022-11-09", "-to", "2022-11-10", "-file", "1.json", "-datatype", testDatatype, "-node", testNode),
+		},
+		{
+			"found pattern json", "", `"line": 2`,
+			append(findArgs, "-from", "2022-11-09", "-file", "[12].json", "-format", "json"),
+		},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		var out bytes.Buffer
+		stdout = &out
+		callMain(t, test.args, test.wantErrStr)
+		if !strings.Contains(out.String(), test.wantOut) {
+			t.Fatalf("output = %v, want %v", out.String(), test.wantOut)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	defer os.RemoveAll("testdata/autoload")
+	// Backfill files into bundles of one row each to create small
+	// bundles to compact.
+	gcsBucket := "newclient,download,upload,list,delete"
+	localDataDir := t.TempDir()
+	for i := 0; i < 3; i++ {
+		f := filepath.Join(localDataDir, testExperiment, testDatatype, "2022/11/09", fmt.Sprintf("%d.json", i))
+		if err := os.MkdirAll(filepath.Dir(f), 0o755); err != nil {
+			t.Fatalf("os.MkdirAll() = %v, want nil", err)
+		}
+		if err := os.WriteFile(f, []byte(fmt.Sprintf(`{"Field1": %d}`, i)), 0o666); err != nil {
+			t.Fatalf("os.WriteFile() = %v, want nil", err)
+		}
+	}
+	saveStdout := stdout
+	defer func() { stdout = saveStdout }()
+	stdout = &bytes.Buffer{}
+	callMain(t, []string{
+		"backfill",
+		"-gcs-local-disk",
+		"-gcs-bucket", gcsBucket,
+		"-gcs-data-dir=testdata/autoload/v1",
+		"-mlab-node-name", testNode,
+		"-local-data-dir", localDataDir,
+		"-experiment", testExperiment,
+		"-datatype", testDatatype,
+		"-datatype-schema-file", "foo1:testdata/datatypes/foo1-valid.json",
+		"-bundle-rows-max", "1",
+	}, "")
+	dataBundles, err := filepath.Glob("testdata/autoload/v1/jostler/foo1/2022/11/09/*")
+	if err != nil || len(dataBundles) != 3 {
+		t.Fatalf("filepath.Glob() = %v, %v, want 3 data bundles", dataBundles, err)
+	}
+
+	compactArgs := []string{
+		"compact",
+		"-gcs-local-disk",
+		"-gcs-bucket", gcsBucket,
+		"-gcs-data-dir=testdata/autoload/v1",
+		"-experiment", testExperiment,
+		"-datatype", testDatatype,
+	}
+	tests := []struct {
+		name        string   // name of the test
+		wantErrStr  string   // error message
+		wantOut     string   // string expected in the output
+		wantBundles int      // data bundles after the test
+		args        []string // flags and arguments
+	}{
+		{
+			"no date", errNoDate.Error(), "", 3,
+			compactArgs,
+		},
+		{
+			"invalid date", errDate.Error(), "", 3,
+			append(compactArgs, "-date", "2022/11/09"),
+		},
+		{
+			"invalid format", errFormat.Error(), "", 3,
+			append(compactArgs, "-date", "2022-11-09", "-format", "xml"),
+		},
+		{
+			"dry run", "", "foo1: 3 bundle(s), 3 small bundle(s), 1 merge(s), 0 skipped", 3,
+			append(compactArgs, "-date", "2022-11-09", "-dry-run"),
+		},
+		{
+			"other node", "", "foo1: 0 bundle(s), 0 small bundle(s), 0 merge(s), 0 skipped", 3,
+			append(compactArgs, "-date", "2022-11-09", "-node", "mlab2-lga01.mlab-sandbox.measurement-lab.org"),
+		},
+		{
+			"compact", "", ": 3 bundle(s), 3 row(s)", 1,
+			append(compactArgs, "-date", "2022-11-09", "-node", testNode),
+		},
+		{
+			"nothing to compact", "", `"merges": []`, 1,
+			append(compactArgs, "-date", "2022-11-09", "-format", "json"),
+		},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		var out bytes.Buffer
+		stdout = &out
+		callMain(t, test.args, test.wantErrStr)
+		if !strings.Contains(out.String(), test.wantOut) {
+			t.Fatalf("output = %v, want %v", out.String(), test.wantOut)
+		}
+		dataBundles, err := filepath.Glob("testdata/autoload/v1/jostler/foo1/2022/11/09/*")
+		if err != nil || len(dataBundles) != test.wantBundles {
+			t.Fatalf("filepath.Glob() = %v, %v, want %d data bundle(s)", dataBundles, err, test.wantBundles)
+		}
+	}
+
+	// The compacted bundles should verify.
+	stdout = &bytes.Buffer{}
+	callMain(t, []string{
+		"verify",
+		"-gcs-local-disk",
+		"-gcs-bucket", gcsBucket,
+		"-gcs-data-dir=testdata/autoload/v1",
+		"-experiment", testExperiment,
+		"-datatype", testDatatype,
+		"-from", "2022-11-09",
+	}, "")
+}
+
+func TestExtract(t *testing.T) {
+	defer os.RemoveAll("testdata/autoload")
+	// Backfill files with and without trailing newlines to create a
+	// bundle to extract them from.
+	gcsBucket := "newclient,download,upload"
+	localDataDir := t.TempDir()
+	files := []string{"{\"Field1\": 1}\n", ` {"Field1":  2} `}
+	pathnames := make([]string, len(files))
+	for i, contents := range files {
+		pathnames[i] = filepath.Join(localDataDir, testExperiment, testDatatype, "2022/11/09", fmt.Sprintf("%d.json", i))
+		if err := os.MkdirAll(filepath.Dir(pathnames[i]), 0o755); err != nil {
+			t.Fatalf("os.MkdirAll() = %v, want nil", err)
+		}
+		if err := os.WriteFile(pathnames[i], []byte(contents), 0o666); err != nil {
+			t.Fatalf("os.WriteFile() = %v, want nil", err)
+		}
+	}
+	saveStdout := stdout
+	defer func() { stdout = saveStdout }()
+	stdout = &bytes.Buffer{}
+	callMain(t, []string{
+		"backfill",
+		"-gcs-local-disk",
+		"-gcs-bucket", gcsBucket,
+		"-gcs-data-dir=testdata/autoload/v1",
+		"-mlab-node-name", testNode,
+		"-local-data-dir", localDataDir,
+		"-experiment", testExperiment,
+		"-datatype", testDatatype,
+		"-datatype-schema-file", "foo1:testdata/datatypes/foo1-valid.json",
+	}, "")
+	dataBundles, err := filepath.Glob("testdata/autoload/v1/jostler/foo1/2022/11/09/*")
+	if err != nil || len(dataBundles) != 1 {
+		t.Fatalf("filepath.Glob() = %v, %v, want 1 data bundle", dataBundles, err)
+	}
+	output := filepath.Join(t.TempDir(), "extracted.json")
+
+	extractArgs := []string{
+		"extract",
+		"-gcs-local-disk",
+		"-gcs-data-dir=testdata/autoload/v1",
+	}
+	tests := []struct {
+		name       string   // name of the test
+		wantErrStr string   // error message
+		wantOut    string   // expected output
+		args       []string // flags and arguments
+	}{
+		{
+			"no object", errNoObject.Error(), "",
+			append(extractArgs, "-gcs-bucket", gcsBucket, "-file", pathnames[0]),
+		},
+		{
+			"no bucket", errNoBucket.Error(), "",
+			append(extractArgs, "-object", dataBundles[0], "-file", pathnames[0]),
+		},
+		{
+			"other bucket", errObjectBucket.Error(), "",
+			append(extractArgs, "-gcs-bucket", gcsBucket, "-object", "gs://other/"+dataBundles[0], "-file", pathnames[0]),
+		},
+		{
+			"no file or line", errFileOrLine.Error(), "",
+			append(extractArgs, "-gcs-bucket", gcsBucket, "-object", dataBundles[0]),
+		},
+		{
+			"file and line", errFileOrLine.Error(), "",
+			append(extractArgs, "-gcs-bucket", gcsBucket, "-object", dataBundles[0], "-file", pathnames[0], "-line", "1"),
+		},
+		{
+			"not a data bundle", errNotDataBundle.Error(), "",
+			append(extractArgs, "-gcs-bucket", gcsBucket, "-object", "testdata/autoload/v1/foo", "-file", pathnames[0]),
+		},
+		{
+			"file not found", extract.ErrNotFound.Error(), "",
+			append(extractArgs, "-gcs-bucket", gcsBucket, "-object", dataBundles[0], "-file", "/no/such/file.json"),
+		},
+		{
+			"file", "", files[0],
+			append(extractArgs, "-gcs-bucket", gcsBucket, "-object", dataBundles[0], "-file", pathnames[0]),
+		},
+		{
+			"line of gs:// URL", "", files[1],
+			append(extractArgs, "-object", "gs://"+gcsBucket+"/"+dataBundles[0], "-line", "2"),
+		},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		var out bytes.Buffer
+		stdout = &out
+		callMain(t, test.args, test.wantErrStr)
+		if out.String() != test.wantOut {
+			t.Fatalf("output = %q, want %q", out.String(), test.wantOut)
+		}
+	}
+
+	callMain(t, append(extractArgs, "-gcs-bucket", gcsBucket, "-object", dataBundles[0], "-line", "2", "-output", output), "")
+	got, err := os.ReadFile(output)
+	if err != nil || string(got) != files[1] {
+		t.Fatalf("os.ReadFile() = %q, %v, want %q, nil", got, err, files[1])
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tblSchemaFile := "testdata/autoload/v1/tables/jostler/foo1.table.json"
+	tblSchemaJSON, err := schema.CreateTableSchemaJSON(testDatatype, "testdata/datatypes/foo1-valid.json")
+	if err != nil {
+		t.Fatalf("schema.CreateTableSchemaJSON() = %v, want nil", err)
+	}
+	if err = os.MkdirAll("testdata/autoload/v1/tables/jostler", 0o755); err != nil {
+		t.Fatalf("os.MkdirAll() = %v, want nil", err)
+	}
+	defer os.RemoveAll("testdata/autoload")
+	// A local table schema that is a superset and a datatype schema
+	// that is incompatible with foo1-valid.json.
+	supersetTblSchemaFile := filepath.Join(t.TempDir(), "foo1.table.json")
+	supersetTblSchemaJSON, err := schema.CreateTableSchemaJSON(testDatatype, "testdata/datatypes/foo1-valid-superset.json")
+	if err != nil {
+		t.Fatalf("schema.CreateTableSchemaJSON() = %v, want nil", err)
+	}
+	if err = os.WriteFile(supersetTblSchemaFile, supersetTblSchemaJSON, 0o666); err != nil {
+		t.Fatalf("os.WriteFile() = %v, want nil", err)
+	}
+	// A datatype schema that adds Field3 and removes UUID.
+	addedRemovedFile := filepath.Join(t.TempDir(), "foo1-added-removed.json")
+	if err = os.WriteFile(addedRemovedFile, []byte(`[{"name": "Field1", "type": "INTEGER"}, {"name": "Field2", "type": "FLOAT"}, {"name": "NMSVersion", "type": "STRING"}, {"name": "Field3", "type": "STRING"}]`), 0o666); err != nil {
+		t.Fatalf("os.WriteFile() = %v, want nil", err)
+	}
+	// A local table schema in which Field1 is required, and a datatype
+	// schema that relaxes Field1 and removes UUID.
+	requiredDtSchemaFile := filepath.Join(t.TempDir(), "foo1-required.json")
+	if err = os.WriteFile(requiredDtSchemaFile, []byte(`[{"name": "Field1", "type": "INTEGER", "mode": "REQUIRED"}, {"name": "Field2", "type": "FLOAT"}, {"name": "NMSVersion", "type": "STRING"}, {"name": "UUID", "type": "STRING"}]`), 0o666); err != nil {
+		t.Fatalf("os.WriteFile() = %v, want nil", err)
+	}
+	requiredTblSchemaFile := filepath.Join(t.TempDir(), "foo1-required.table.json")
+	requiredTblSchemaJSON, err := schema.CreateTableSchemaJSON(testDatatype, requiredDtSchemaFile)
+	if err != nil {
+		t.Fatalf("schema.CreateTableSchemaJSON() = %v, want nil", err)
+	}
+	if err = os.WriteFile(requiredTblSchemaFile, requiredTblSchemaJSON, 0o666); err != nil {
+		t.Fatalf("os.WriteFile() = %v, want nil", err)
+	}
+	relaxedRemovedFile := filepath.Join(t.TempDir(), "foo1-relaxed-removed.json")
+	if err = os.WriteFile(relaxedRemovedFile, []byte(`[{"name": "Field1", "type": "INTEGER"}, {"name": "Field2", "type": "FLOAT"}, {"name": "NMSVersion", "type": "STRING"}]`), 0o666); err != nil {
+		t.Fatalf("os.WriteFile() = %v, want nil", err)
+	}
+	// A datatype schema that describes Field1 and removes UUID.
+	describedRemovedFile := filepath.Join(t.TempDir(), "foo1-described-removed.json")
+	if err = os.WriteFile(describedRemovedFile, []byte(`[{"name": "Field1", "type": "INTEGER", "description": "first field"}, {"name": "Field2", "type": "FLOAT"}, {"name": "NMSVersion", "type": "STRING"}]`), 0o666); err != nil {
+		t.Fatalf("os.WriteFile() = %v, want nil", err)
+	}
+	incompatibleFile := filepath.Join(t.TempDir(), "foo1-incompatible.json")
+	if err = os.WriteFile(incompatibleFile, []byte(`[{"name": "Field1", "type": "STRING"}]`), 0o666); err != nil {
+		t.Fatalf("os.WriteFile() = %v, want nil", err)
+	}
+
+	validateArgs := []string{
+		"validate",
+		"-gcs-local-disk",
+		"-gcs-data-dir=testdata/autoload/v1",
+		"-experiment", testExperiment,
+		"-datatype", testDatatype,
+	}
+	gcsArgs := append([]string{"-gcs-bucket", "newclient,download"}, validateArgs...)
+	tests := []struct {
+		name            string   // name of the test
+		rmTblSchemaFile bool     // if true, remove table schema file before running the test
+		wantErrStr      string   // error message
+		wantCode        int      // exit code
+		wantOut         string   // string expected in the output
+		args            []string // flags and arguments
+	}{
+		{
+			"no bucket or table schema file", false, errNoBucket.Error(), exitMatch, "",
+			validateArgs,
+		},
+		{
+			"invalid table schema file flag", false, errSchemaFilename.Error(), exitMatch, "",
+			append(validateArgs, "-table-schema-file", supersetTblSchemaFile),
+		},
+		{
+			"invalid datatype schema file", false, schema.ErrUnmarshal.Error(), exitMatch, "",
+			append(gcsArgs, "-datatype-schema-file", "foo1:testdata/datatypes/foo1-invalid.json"),
+		},
+		{
+			"match", false, "", exitMatch, "foo1: match",
+			append(gcsArgs, "-datatype-schema-file", "foo1:testdata/datatypes/foo1-valid.json"),
+		},
+		{
+			"non-existent table schema", true, "", exitSuperset, "foo1: superset (new table schema)",
+			append(gcsArgs, "-datatype-schema-file", "foo1:testdata/datatypes/foo1-valid.json"),
+		},
+		{
+			"superset", false, "", exitSuperset, "foo1: superset (1 added)",
+			append(gcsArgs, "-datatype-schema-file", "foo1:testdata/datatypes/foo1-valid-superset.json"),
+		},
+		{
+			"backward compatible with local table schema", false, "", exitBackward, "foo1: backward compatible (1 removed)",
+			append(validateArgs, "-table-schema-file", "foo1:"+supersetTblSchemaFile, "-datatype-schema-file", "foo1:testdata/datatypes/foo1-valid.json"),
+		},
+		{
+			"added and removed fields", false, "", exitBackward, "foo1: backward compatible (1 added, 1 removed)",
+			append(gcsArgs, "-datatype-schema-file", "foo1:"+addedRemovedFile),
+		},
+		{
+			"relaxed mode and removed field", false, "", exitBackward, "foo1: backward compatible (1 removed, 1 mode changed)",
+			append(validateArgs, "-table-schema-file", "foo1:"+requiredTblSchemaFile, "-datatype-schema-file", "foo1:"+relaxedRemovedFile),
+		},
+		{
+			"description changed and removed field", false, "", exitBackward, "foo1: backward compatible (1 removed, 1 description changed)",
+			append(gcsArgs, "-datatype-schema-file", "foo1:"+describedRemovedFile),
+		},
+		{
+			"incompatible", false, "", exitIncompatible, "foo1: incompatible",
+			append(gcsArgs, "-datatype-schema-file", "foo1:"+incompatibleFile),
+		},
+	}
+	saveStdout, saveExit := stdout, exit
+	defer func() {
+		stdout, exit = saveStdout, saveExit
+	}()
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		os.RemoveAll(tblSchemaFile)
+		if !test.rmTblSchemaFile {
+			if err := os.WriteFile(tblSchemaFile, tblSchemaJSON, 0o666); err != nil {
+				t.Fatalf("os.WriteFile() = %v, want nil", err)
+			}
+		}
+		var out bytes.Buffer
+		stdout = &out
+		gotCode := exitMatch
+		exit = func(code int) { gotCode = code }
+		callMain(t, test.args, test.wantErrStr)
+		if gotCode != test.wantCode {
+			t.Fatalf("exit code = %v, want %v", gotCode, test.wantCode)
+		}
+		if !strings.Contains(out.String(), test.wantOut) {
+			t.Fatalf("output = %v, want %v", out.String(), test.wantOut)
+		}
+	}
+}
+
 // callMain calls main() with the given command line in osArgs, expecting
 // an error that will include the given string in wantErrStr (which could
 // be the empty string "").
@@ -372,6 +1554,7 @@ func callMain(t *testing.T, osArgs []string, wantErrStr string) {
 	}()
 	// Reset flags with global state.
 	mlabNodeName = flagx.StringFile{}
+	subcommand = nil
 
 	os.Args = []string{"jostler-test", "-test-interval", "2s"}
 	os.Args = append(os.Args, osArgs...)
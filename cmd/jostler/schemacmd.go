@@ -0,0 +1,301 @@
+// Package main implements jostler.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/m-lab/jostler/internal/schema"
+)
+
+// datatypeDiff is what "jostler schema diff" outputs for each datatype.
+type datatypeDiff struct {
+	Datatype string `json:"datatype"` // datatype name
+	Table    string `json:"table"`    // GCS object name of the table schema
+	*schema.Diff
+}
+
+// datatypeHistory is what "jostler schema history list" outputs for
+// each datatype.
+type datatypeHistory struct {
+	Datatype string          `json:"datatype"` // datatype name
+	History  string          `json:"history"`  // GCS prefix of the schema history
+	Versions []schemaVersion `json:"versions"` // versions in chronological order
+}
+
+// schemaVersion is a version of a table schema without the table schema
+// itself.
+type schemaVersion struct {
+	Name string `json:"name"` // name of the version
+	*schema.SchemaVersion
+}
+
+// Flags related to schema subcommands.
+var (
+	diffFormat     string
+	sampleDir      string
+	outputFile     string
+	historyFormat  string
+	historyVersion string
+	historyMeta    bool
+)
+
+// schemaDiff implements "jostler schema diff" which downloads the table
+// schema of each datatype from GCS, compares it against the table schema
+// created from the local datatype schema, and prints their differences.
+func schemaDiff(args []string) error {
+	fs := newFlagSet("schema diff")
+	addGCSFlags(fs)
+	addDatatypeFlags(fs)
+	fs.StringVar(&diffFormat, "format", "text", "output format (text or json)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if bucket == "" {
+		return errNoBucket
+	}
+	if diffFormat != "text" && diffFormat != "json" {
+		return fmt.Errorf("%v: %w", diffFormat, errFormat)
+	}
+	if err := validateDatatypeFlags(); err != nil {
+		return err
+	}
+
+	stClient, err := newStorageClient(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to create storage client: %w", err)
+	}
+	diffs := make([]datatypeDiff, 0, len(datatypes))
+	for _, datatype := range datatypes {
+		dtSchemaFile := schema.PathForDatatype(datatype, dtSchemaFiles)
+		diff, err := schema.DiffTableSchemas(stClient, bucket, experiment, datatype, dtSchemaFile)
+		if err != nil {
+			return fmt.Errorf("%v: %w", datatype, err)
+		}
+		diffs = append(diffs, datatypeDiff{
+			Datatype: datatype,
+			Table:    fmt.Sprintf("gs://%s/%s", bucket, schema.TablePath(experiment, datatype)),
+			Diff:     diff,
+		})
+	}
+	if diffFormat == "json" {
+		return writeJSON(stdout, diffs)
+	}
+	for _, diff := range diffs {
+		writeDiffText(stdout, diff)
+	}
+	return nil
+}
+
+// schemaInfer implements "jostler schema infer" which infers a datatype
+// schema from sample measurement files, reports fields that samples
+// disagree on, and writes the datatype schema to the output file (or
+// stdout) so it can be used with -datatype-schema-file.
+func schemaInfer(args []string) error {
+	fs := newFlagSet("schema infer")
+	fs.StringVar(&sampleDir, "sample-dir", "", "required - directory pathname of sample measurement files")
+	fs.Var(&extensions, "extensions", "filename extensions of sample measurement files (default .json)")
+	fs.StringVar(&outputFile, "output", "", "pathname of the datatype schema file to write (default stdout)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if sampleDir == "" {
+		return errNoSampleDir
+	}
+	if len(extensions) == 0 {
+		extensions = []string{".json"}
+	}
+
+	sampleFiles, err := findSampleFiles(sampleDir)
+	if err != nil {
+		return err
+	}
+	fields, conflicts, err := schema.InferFields(sampleFiles)
+	if err != nil {
+		return fmt.Errorf("%v: %w", sampleDir, err)
+	}
+	if len(conflicts) != 0 {
+		for _, conflict := range conflicts {
+			fmt.Fprintf(os.Stderr, "conflict: %v\n", conflict)
+		}
+		return fmt.Errorf("%v: %d %w", sampleDir, len(conflicts), errConflicts)
+	}
+	if outputFile == "" {
+		return writeJSON(stdout, fields)
+	}
+	dtSchemaJSON, err := json.MarshalIndent(fields, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal: %w", err)
+	}
+	if err := os.WriteFile(outputFile, append(dtSchemaJSON, '\n'), 0o666); err != nil {
+		return fmt.Errorf("%v: %w", errWrite, err)
+	}
+	log.Printf("saved %v\n", outputFile)
+	return nil
+}
+
+// findSampleFiles returns the pathnames of all files in the given
+// directory tree whose extensions are among the specified extensions.
+func findSampleFiles(dir string) ([]string, error) {
+	var sampleFiles []string
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() && hasExtension(path) {
+			sampleFiles = append(sampleFiles, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk %v: %w", dir, err)
+	}
+	return sampleFiles, nil
+}
+
+// hasExtension returns true if the given pathname has one of the
+// specified extensions.
+func hasExtension(path string) bool {
+	for _, ext := range extensions {
+		if filepath.Ext(path) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// schemaHistoryList implements "jostler schema history list" which lists
+// the historical versions of the table schema of each datatype.
+func schemaHistoryList(args []string) error {
+	fs := newFlagSet("schema history list")
+	addGCSFlags(fs)
+	addExperimentFlags(fs)
+	fs.StringVar(&historyFormat, "format", "text", "output format (text or json)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if bucket == "" {
+		return errNoBucket
+	}
+	if historyFormat != "text" && historyFormat != "json" {
+		return fmt.Errorf("%v: %w", historyFormat, errFormat)
+	}
+	if err := validateExperimentFlags(); err != nil {
+		return err
+	}
+
+	stClient, err := newStorageClient(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to create storage client: %w", err)
+	}
+	histories := make([]datatypeHistory, 0, len(datatypes))
+	for _, datatype := range datatypes {
+		versions, err := schema.ListHistory(stClient, experiment, datatype)
+		if err != nil {
+			return fmt.Errorf("%v: %w", datatype, err)
+		}
+		history := datatypeHistory{
+			Datatype: datatype,
+			History:  fmt.Sprintf("gs://%s/%s", bucket, schema.HistoryPath(experiment, datatype)),
+			Versions: make([]schemaVersion, 0, len(versions)),
+		}
+		for _, version := range versions {
+			sv, err := schema.FetchHistory(stClient, experiment, datatype, version)
+			if err != nil {
+				return fmt.Errorf("%v: %w", datatype, err)
+			}
+			sv.Schema = nil
+			history.Versions = append(history.Versions, schemaVersion{Name: version, SchemaVersion: sv})
+		}
+		histories = append(histories, history)
+	}
+	if historyFormat == "json" {
+		return writeJSON(stdout, histories)
+	}
+	for _, history := range histories {
+		fmt.Fprintf(stdout, "%v: %v\n", history.Datatype, history.History)
+		if len(history.Versions) == 0 {
+			fmt.Fprintf(stdout, "  no versions\n")
+		}
+		for _, v := range history.Versions {
+			fmt.Fprintf(stdout, "  %v  %v (%v)  %v\n", v.Name, v.Version, v.GitCommit, v.Summary)
+		}
+	}
+	return nil
+}
+
+// schemaHistoryFetch implements "jostler schema history fetch" which
+// prints a historical version of the table schema of a datatype.
+func schemaHistoryFetch(args []string) error {
+	fs := newFlagSet("schema history fetch")
+	addGCSFlags(fs)
+	addExperimentFlags(fs)
+	fs.StringVar(&historyVersion, "version", "latest", "name of the version as shown by \"schema history list\" or latest")
+	fs.BoolVar(&historyMeta, "metadata", false, "print the metadata of the version together with the table schema")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if bucket == "" {
+		return errNoBucket
+	}
+	if err := validateExperimentFlags(); err != nil {
+		return err
+	}
+	if len(datatypes) != 1 {
+		return errOneDatatype
+	}
+
+	stClient, err := newStorageClient(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to create storage client: %w", err)
+	}
+	sv, err := schema.FetchHistory(stClient, experiment, datatypes[0], historyVersion)
+	if err != nil {
+		return fmt.Errorf("%v: %w", datatypes[0], err)
+	}
+	if historyMeta {
+		return writeJSON(stdout, sv)
+	}
+	return writeJSON(stdout, sv.Schema)
+}
+
+// writeDiffText writes the given diff in human-readable format.
+func writeDiffText(w io.Writer, diff datatypeDiff) {
+	fmt.Fprintf(w, "%v: %v\n", diff.Datatype, diff.Table)
+	if diff.Len() == 0 {
+		fmt.Fprintf(w, "  no differences\n")
+		return
+	}
+	for _, fd := range diff.Added {
+		fmt.Fprintf(w, "  %-14s %v %v %v\n", "added:", fd.Name, fd.NewType, fd.NewMode)
+	}
+	for _, fd := range diff.Removed {
+		fmt.Fprintf(w, "  %-14s %v %v %v\n", "removed:", fd.Name, fd.OldType, fd.OldMode)
+	}
+	for _, fd := range diff.TypeChanged {
+		fmt.Fprintf(w, "  %-14s %v %v -> %v\n", "type changed:", fd.Name, fd.OldType, fd.NewType)
+	}
+	for _, fd := range diff.ModeChanged {
+		fmt.Fprintf(w, "  %-14s %v %v -> %v\n", "mode changed:", fd.Name, fd.OldMode, fd.NewMode)
+	}
+	for _, fd := range diff.DescriptionChanged {
+		fmt.Fprintf(w, "  %-14s %v %q -> %q\n", "description:", fd.Name, fd.OldDescription, fd.NewDescription)
+	}
+}
+
+// writeJSON writes the given value in indented JSON format.
+func writeJSON(w io.Writer, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal: %w", err)
+	}
+	if _, err := fmt.Fprintln(w, string(b)); err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	return nil
+}
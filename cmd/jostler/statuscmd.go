@@ -0,0 +1,164 @@
+// Package main implements jostler.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/m-lab/jostler/internal/admin"
+)
+
+// Flags related to the status subcommand.
+var (
+	statusFile   string
+	statusFormat string
+)
+
+var (
+	// statusTimeout is how long "jostler status" waits for the daemon.
+	statusTimeout = 10 * time.Second
+
+	errNoStatusSocket = errors.New("must specify status socket")
+	errDaemon         = errors.New("failed to get status from daemon")
+)
+
+// statusCmd implements "jostler status" which asks the running daemon
+// over its status socket for a summary of each datatype or, with -file,
+// where a file is in the pipeline.
+func statusCmd(args []string) error {
+	fs := newFlagSet("status")
+	fs.StringVar(&statusSocket, "status-socket", statusSocket, "required - pathname of the Unix socket of the running daemon")
+	fs.Var(&datatypes, "datatype", "datatype(s) to summarize (default all)")
+	fs.StringVar(&statusFile, "file", "", "pathname of a measurement data file to look up")
+	fs.StringVar(&statusFormat, "format", "text", "output format (text or json)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if statusSocket == "" {
+		return errNoStatusSocket
+	}
+	if statusFormat != "text" && statusFormat != "json" {
+		return fmt.Errorf("%v: %w", statusFormat, errFormat)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", statusSocket)
+			},
+		},
+		Timeout: statusTimeout,
+	}
+	if statusFile != "" {
+		fullPath, err := filepath.Abs(statusFile)
+		if err != nil {
+			return fmt.Errorf("%v: %w", statusFile, err)
+		}
+		var fileStatus admin.FileStatus
+		if err := getStatus(client, "/v1/file?path="+url.QueryEscape(fullPath), &fileStatus); err != nil {
+			return err
+		}
+		if statusFormat == "json" {
+			return writeJSON(stdout, fileStatus)
+		}
+		writeFileStatusText(stdout, fileStatus)
+		return nil
+	}
+
+	var statuses []admin.Status
+	if len(datatypes) == 0 {
+		if err := getStatus(client, "/v1/status", &statuses); err != nil {
+			return err
+		}
+	}
+	for _, datatype := range datatypes {
+		var dtStatuses []admin.Status
+		if err := getStatus(client, "/v1/status?datatype="+url.QueryEscape(datatype), &dtStatuses); err != nil {
+			return err
+		}
+		statuses = append(statuses, dtStatuses...)
+	}
+	if statusFormat == "json" {
+		return writeJSON(stdout, statuses)
+	}
+	for _, status := range statuses {
+		writeStatusText(stdout, status)
+	}
+	return nil
+}
+
+// getStatus gets the given path of the admin API from the daemon and
+// decodes its response into v.
+func getStatus(client *http.Client, path string, v any) error {
+	resp, err := client.Get("http://jostler" + path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errDaemon, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+			apiErr.Error = resp.Status
+		}
+		return fmt.Errorf("%w: %v", errDaemon, apiErr.Error)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%w: failed to decode: %v", errDaemon, err)
+	}
+	return nil
+}
+
+// writeStatusText writes the summary of a datatype in text format.
+func writeStatusText(w io.Writer, status admin.Status) {
+	paused := ""
+	if status.Paused {
+		paused = ", uploads paused"
+	}
+	fmt.Fprintf(w, "%v: %d active bundle(s), %d in flight, %d pending file(s)%v\n", status.Datatype, len(status.Active), len(status.InFlight), status.Pending, paused)
+	for _, b := range status.Active {
+		fmt.Fprintf(w, "  active %v: %d file(s), %d bytes, age %v\n", b.Timestamp, b.Files, b.Size, b.Age)
+	}
+	for _, b := range status.InFlight {
+		fmt.Fprintf(w, "  %v %v: %d file(s), %d bytes, age %v\n", b.State, b.Timestamp, b.Files, b.Size, b.Age)
+	}
+	lastUploaded := "never"
+	if !status.LastUploaded.IsZero() {
+		lastUploaded = status.LastUploaded.Format(time.RFC3339)
+	}
+	fmt.Fprintf(w, "  last upload: %v\n", lastUploaded)
+	if !status.LastQueued.IsZero() {
+		fmt.Fprintf(w, "  last queued in outbox: %v\n", status.LastQueued.Format(time.RFC3339))
+	}
+	lastError := "none"
+	if status.LastError != "" {
+		lastError = fmt.Sprintf("%v: %v", status.LastFailed.Format(time.RFC3339), status.LastError)
+	}
+	fmt.Fprintf(w, "  last error: %v\n", lastError)
+}
+
+// writeFileStatusText writes the status of a file in text format.
+func writeFileStatusText(w io.Writer, fileStatus admin.FileStatus) {
+	switch {
+	case fileStatus.Bundle == nil && fileStatus.Datatype == "":
+		fmt.Fprintf(w, "%v: %v\n", fileStatus.Path, fileStatus.State)
+	case fileStatus.Bundle == nil:
+		fmt.Fprintf(w, "%v: %v (%v)\n", fileStatus.Path, fileStatus.State, fileStatus.Datatype)
+	default:
+		b := fileStatus.Bundle
+		fmt.Fprintf(w, "%v: %v (%v) in bundle %v to gs://%v/%v\n", fileStatus.Path, fileStatus.State, fileStatus.Datatype, b.Timestamp, b.Bucket, b.DataObject)
+		if b.Error != "" {
+			fmt.Fprintf(w, "  error: %v\n", b.Error)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Package main implements jostler.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/jostler/internal/schema"
+)
+
+// Exit codes of "jostler validate".  Errors that prevent validation
+// (e.g., invalid flags or a missing datatype schema file) exit with 1.
+const (
+	exitMatch        = 0 // table schemas match
+	exitSuperset     = 3 // new table schema is a superset (would be uploaded)
+	exitBackward     = 4 // new table schema is backward compatible
+	exitIncompatible = 5 // new table schema is incompatible
+)
+
+var (
+	// Flags related to the validate subcommand.
+	tblSchemaFiles flagx.StringArray
+
+	// Test code changes exit so validate won't exit the process.
+	exit = os.Exit
+)
+
+// validateCmd implements "jostler validate" which validates the datatype
+// schema of each datatype and compares the table schema created from it
+// against the table schema in GCS or in a local file.  It never uploads
+// and exits with the exit code of the least compatible datatype.
+func validateCmd(args []string) error {
+	fs := newFlagSet("validate")
+	addGCSFlags(fs)
+	addDatatypeFlags(fs)
+	tblSchemaFiles = flagx.StringArray{}
+	fs.Var(&tblSchemaFiles, "table-schema-file", "table schema to compare against (instead of GCS) for each datatype in the format <datatype>:<pathname>")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := validateExperimentFlags(); err != nil {
+		return err
+	}
+	if err := validateDatatypePaths(tblSchemaFiles); err != nil {
+		return err
+	}
+	if bucket == "" && len(tblSchemaFiles) != len(datatypes) {
+		return errNoBucket
+	}
+	if err := validateDatatypeFlags(); err != nil {
+		return err
+	}
+
+	var stClient storageClient
+	if bucket != "" {
+		var err error
+		if stClient, err = newStorageClient(context.Background()); err != nil {
+			return fmt.Errorf("failed to create storage client: %w", err)
+		}
+	}
+	code := exitMatch
+	for _, datatype := range datatypes {
+		oldTblSchemaJSON, err := oldTableSchema(stClient, datatype)
+		if err != nil {
+			return fmt.Errorf("%v: %w", datatype, err)
+		}
+		dtSchemaFile := schema.PathForDatatype(datatype, dtSchemaFiles)
+		diff, err := schema.ValidateTableSchema(oldTblSchemaJSON, datatype, dtSchemaFile)
+		dtCode, result := validateResult(diff, err)
+		if dtCode == -1 {
+			return fmt.Errorf("%v: %w", datatype, err)
+		}
+		fmt.Fprintf(stdout, "%v: %v (%v)\n", datatype, result, diff.Summary())
+		if dtCode > code {
+			code = dtCode
+		}
+	}
+	if code != exitMatch {
+		exit(code)
+	}
+	return nil
+}
+
+// oldTableSchema returns the table schema of the given datatype from the
+// local table schema file if specified or from GCS otherwise.  It returns
+// nil if the table schema does not exist in GCS.
+func oldTableSchema(stClient storageClient, datatype string) ([]byte, error) {
+	for _, tblSchemaFile := range tblSchemaFiles {
+		if strings.HasPrefix(tblSchemaFile, datatype+":") {
+			contents, err := os.ReadFile(tblSchemaFile[len(datatype)+1:])
+			if err != nil {
+				return nil, fmt.Errorf("%v: %w", schema.ErrReadSchema, err)
+			}
+			return contents, nil
+		}
+	}
+	contents, err := stClient.Download(context.Background(), schema.TablePath(experiment, datatype))
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%v: %w", schema.ErrDownload, err)
+	}
+	return contents, nil
+}
+
+// validateResult returns the exit code and a description of the result
+// of validating a table schema or -1 if validation failed.  A table
+// schema is only a superset if no fields were removed from it.
+func validateResult(diff *schema.Diff, err error) (int, string) {
+	switch {
+	case errors.Is(err, schema.ErrSchemaMatch):
+		return exitMatch, "match"
+	case errors.Is(err, schema.ErrTypeMismatch),
+		errors.Is(err, schema.ErrModeMismatch):
+		return exitIncompatible, "incompatible: " + err.Error()
+	case errors.Is(err, schema.ErrOnlyInOld),
+		diff != nil && len(diff.Removed) != 0:
+		return exitBackward, "backward compatible"
+	case errors.Is(err, schema.ErrSchemaNotFound),
+		errors.Is(err, schema.ErrNewFields),
+		errors.Is(err, schema.ErrModeRelaxed),
+		errors.Is(err, schema.ErrDescriptions):
+		return exitSuperset, "superset"
+	}
+	return -1, ""
+}
@@ -0,0 +1,120 @@
+// Package main implements jostler.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/jostler/internal/naming"
+	"github.com/m-lab/jostler/internal/schema"
+	"github.com/m-lab/jostler/internal/verify"
+)
+
+// Flags related to the verify subcommand.
+var verifyFormat string
+
+var errVerify = errors.New("found problems with bundles")
+
+// verifyCmd implements "jostler verify" which audits the data and index
+// bundles of each datatype in GCS in a date range and reports orphaned,
+// mismatched, and corrupt bundles and invalid rows.  It exits with an
+// error if it found any problems.
+func verifyCmd(args []string) error {
+	fs := newFlagSet("verify")
+	addGCSFlags(fs)
+	addExperimentFlags(fs)
+	tblSchemaFiles = flagx.StringArray{}
+	fs.StringVar(&dataObjTemplate, "data-object-template", dataObjTemplate, "template of GCS object names of data bundles relative to gcs-data-dir")
+	fs.StringVar(&indexObjTemplate, "index-object-template", indexObjTemplate, "template of GCS object names of index bundles relative to gcs-data-dir")
+	fs.Var(&tblSchemaFiles, "table-schema-file", "table schema to validate rows against (instead of GCS) for each datatype in the format <datatype>:<pathname>")
+	addDateRangeFlags(fs, "verify")
+	fs.StringVar(&verifyFormat, "format", "text", "output format (text or json)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if bucket == "" {
+		return errNoBucket
+	}
+	if err := validateExperimentFlags(); err != nil {
+		return err
+	}
+	if err := validateDatatypePaths(tblSchemaFiles); err != nil {
+		return err
+	}
+	if err := validateNamingFlags(); err != nil {
+		return err
+	}
+	from, to, err := dateRange()
+	if err != nil {
+		return err
+	}
+	if verifyFormat != "text" && verifyFormat != "json" {
+		return fmt.Errorf("%v: %w", verifyFormat, errFormat)
+	}
+
+	stClient, err := newStorageClient(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to create storage client: %w", err)
+	}
+	reports := make([]*verify.Report, 0, len(datatypes))
+	for _, datatype := range datatypes {
+		tblSchemaJSON, err := oldTableSchema(stClient, datatype)
+		if err != nil {
+			return fmt.Errorf("%v: %w", datatype, err)
+		}
+		var fields schema.Fields
+		if tblSchemaJSON == nil {
+			log.Printf("%v: no table schema, rows are only validated against standard columns\n", datatype)
+		} else if fields, err = schema.ParseFields(tblSchemaJSON); err != nil {
+			return fmt.Errorf("%v: %w", datatype, err)
+		}
+		conf := verify.Config{
+			Bucket:        bucket,
+			HomeDir:       gcsDataDir,
+			DataTemplate:  dataTemplate,
+			IndexTemplate: indexTemplate,
+			Vars:          naming.Vars{Experiment: experiment, Datatype: datatype, Organization: organization},
+			From:          from,
+			To:            to,
+			Fields:        fields,
+		}
+		report, err := verify.Verify(context.Background(), stClient, conf)
+		if err != nil {
+			return fmt.Errorf("%v: %w", datatype, err)
+		}
+		reports = append(reports, report)
+	}
+	if verifyFormat == "json" {
+		if err := writeJSON(stdout, reports); err != nil {
+			return err
+		}
+	} else {
+		for _, report := range reports {
+			writeReportText(stdout, report)
+		}
+	}
+	for _, report := range reports {
+		if !report.OK() {
+			return errVerify
+		}
+	}
+	return nil
+}
+
+// writeReportText writes the report of verifying a datatype in text
+// format.
+func writeReportText(w io.Writer, report *verify.Report) {
+	fmt.Fprintf(w, "%v: %d data bundle(s), %d index bundle(s), %d row(s), %d problem(s)\n",
+		report.Datatype, report.DataBundles, report.IndexBundles, report.Rows, len(report.Problems))
+	for _, p := range report.Problems {
+		object := p.Object
+		if p.Line != 0 {
+			object = fmt.Sprintf("%v:%d", p.Object, p.Line)
+		}
+		fmt.Fprintf(w, "  %v %v: %v\n", p.Kind, object, p.Detail)
+	}
+}
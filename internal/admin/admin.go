@@ -0,0 +1,255 @@
+// Package admin implements an HTTP API to inspect and control the bundle
+// uploaders and directory watchers of a running jostler.
+//
+// The API has the following endpoints, all of which except /v1/file
+// accept an optional datatype query parameter to select a single
+// datatype (all datatypes otherwise):
+//
+//	GET  /v1/status  active and in-flight bundles and uploads of each datatype
+//	GET  /v1/file    where a file is in the pipeline (path query parameter)
+//	POST /v1/flush   seal and upload active bundles right away
+//	POST /v1/pause   pause uploads of sealed bundles
+//	POST /v1/resume  resume uploads of sealed bundles
+//	POST /v1/scan    scan the spool directory for missed files right away
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/m-lab/jostler/internal/uploadbundle"
+)
+
+// Uploader defines the interface of a bundle uploader.
+type Uploader interface {
+	Bundles() []uploadbundle.BundleInfo
+	Flush()
+	Pause()
+	Resume()
+	Paused() bool
+	Uploads() uploadbundle.UploadSummary
+	FindFile(string) (uploadbundle.BundleInfo, bool)
+}
+
+// Watcher defines the interface of a directory watcher.
+type Watcher interface {
+	Scan()
+	Pending() int
+	IsPending(string) bool
+}
+
+// Datatype defines the uploader and the directory watcher of a datatype.
+type Datatype struct {
+	Uploader Uploader
+	Watcher  Watcher
+}
+
+// Bundle describes a bundle and its age.
+type Bundle struct {
+	uploadbundle.BundleInfo
+	Age string `json:"age"` // time since the bundle was created
+}
+
+// Status describes the bundles and uploads of a datatype.
+type Status struct {
+	Datatype string   `json:"datatype"`
+	Paused   bool     `json:"paused"`   // whether uploads are paused
+	Active   []Bundle `json:"active"`   // bundles that files are being added to
+	InFlight []Bundle `json:"inFlight"` // bundles that are sealed or being uploaded
+	Pending  int      `json:"pending"`  // files notified by the watcher but not uploaded yet
+	uploadbundle.UploadSummary
+}
+
+// States of files (see FileStatus).
+const (
+	FilePending   = "pending"   // notified by the watcher but not in a bundle yet
+	FileBundled   = "bundled"   // in a bundle that is active or sealed
+	FileUploading = "uploading" // in a bundle that is being uploaded
+	FileUploaded  = "uploaded"  // in a bundle that was uploaded
+	FileQueued    = "queued"    // in a bundle that was queued in the outbox to be uploaded later
+	FileFailed    = "failed"    // in a bundle that failed to upload
+	FileUnknown   = "unknown"   // not known to any datatype
+)
+
+// FileStatus describes where a file is in the pipeline.
+type FileStatus struct {
+	Path     string                   `json:"path"`
+	Datatype string                   `json:"datatype,omitempty"`
+	State    string                   `json:"state"`
+	Bundle   *uploadbundle.BundleInfo `json:"bundle,omitempty"` // bundle the file is in (if any)
+}
+
+// Server serves the admin API.
+type Server struct {
+	datatypes map[string]Datatype
+	names     []string // sorted names of datatypes
+}
+
+// Exported errors.
+var (
+	ErrDatatype = errors.New("unknown datatype")
+	ErrMethod   = errors.New("method not allowed")
+	ErrPath     = errors.New("is not an absolute pathname")
+)
+
+// New returns a new Server instance for the given datatypes.
+func New(datatypes map[string]Datatype) *Server {
+	s := &Server{datatypes: datatypes}
+	for name := range datatypes {
+		s.names = append(s.names, name)
+	}
+	sort.Strings(s.names)
+	return s
+}
+
+// Handler returns the HTTP handler of the admin API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status", s.handleStatus)
+	mux.HandleFunc("/v1/file", s.handleFile)
+	mux.HandleFunc("/v1/flush", s.handleAction("flush", func(dt Datatype) { dt.Uploader.Flush() }))
+	mux.HandleFunc("/v1/pause", s.handleAction("pause", func(dt Datatype) { dt.Uploader.Pause() }))
+	mux.HandleFunc("/v1/resume", s.handleAction("resume", func(dt Datatype) { dt.Uploader.Resume() }))
+	mux.HandleFunc("/v1/scan", s.handleAction("scan", func(dt Datatype) { dt.Watcher.Scan() }))
+	return mux
+}
+
+// handleStatus reports the active and in-flight bundles, pending files,
+// and uploads of the selected datatypes.
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%v: %w", r.Method, ErrMethod))
+		return
+	}
+	names, err := s.selected(r)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	now := time.Now().UTC()
+	statuses := make([]Status, 0, len(names))
+	for _, name := range names {
+		dt := s.datatypes[name]
+		status := Status{
+			Datatype:      name,
+			Paused:        dt.Uploader.Paused(),
+			Active:        []Bundle{},
+			InFlight:      []Bundle{},
+			Pending:       dt.Watcher.Pending(),
+			UploadSummary: dt.Uploader.Uploads(),
+		}
+		for _, info := range dt.Uploader.Bundles() {
+			b := Bundle{BundleInfo: info, Age: now.Sub(info.Created).Truncate(time.Second).String()}
+			switch info.State {
+			case uploadbundle.StateActive:
+				status.Active = append(status.Active, b)
+			case uploadbundle.StateSealed, uploadbundle.StateUploading:
+				status.InFlight = append(status.InFlight, b)
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// handleFile reports where the file in the path query parameter is in
+// the pipeline.
+func (s *Server) handleFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%v: %w", r.Method, ErrMethod))
+		return
+	}
+	fullPath := r.URL.Query().Get("path")
+	if !filepath.IsAbs(fullPath) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%q: %w", fullPath, ErrPath))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.findFile(filepath.Clean(fullPath)))
+}
+
+// findFile returns the status of the given file.  Bundles are checked
+// before watchers because files stay pending until their bundle is
+// uploaded.
+func (s *Server) findFile(fullPath string) FileStatus {
+	for _, name := range s.names {
+		info, ok := s.datatypes[name].Uploader.FindFile(fullPath)
+		if !ok {
+			continue
+		}
+		fs := FileStatus{Path: fullPath, Datatype: name, Bundle: &info}
+		switch info.State {
+		case uploadbundle.StateActive, uploadbundle.StateSealed:
+			fs.State = FileBundled
+		case uploadbundle.StateUploading:
+			fs.State = FileUploading
+		case uploadbundle.StateUploaded:
+			fs.State = FileUploaded
+		case uploadbundle.StateQueued:
+			fs.State = FileQueued
+		case uploadbundle.StateFailed:
+			fs.State = FileFailed
+		}
+		return fs
+	}
+	for _, name := range s.names {
+		if s.datatypes[name].Watcher.IsPending(fullPath) {
+			return FileStatus{Path: fullPath, Datatype: name, State: FilePending}
+		}
+	}
+	return FileStatus{Path: fullPath, State: FileUnknown}
+}
+
+// handleAction returns a handler that applies the given action to the
+// selected datatypes.
+func (s *Server) handleAction(action string, apply func(Datatype)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%v: %w", r.Method, ErrMethod))
+			return
+		}
+		names, err := s.selected(r)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		for _, name := range names {
+			log.Printf("admin: %v %v\n", action, name)
+			apply(s.datatypes[name])
+		}
+		writeJSON(w, http.StatusAccepted, map[string][]string{"datatypes": names})
+	}
+}
+
+// selected returns the names of the datatypes selected by the request.
+func (s *Server) selected(r *http.Request) ([]string, error) {
+	name := r.URL.Query().Get("datatype")
+	if name == "" {
+		return s.names, nil
+	}
+	if _, ok := s.datatypes[name]; !ok {
+		return nil, fmt.Errorf("%v: %w", name, ErrDatatype)
+	}
+	return []string{name}, nil
+}
+
+// writeError writes the given error as a JSON object.
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// writeJSON writes the given value in JSON format.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("ERROR: failed to write response: %v\n", err)
+	}
+}
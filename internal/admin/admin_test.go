@@ -0,0 +1,241 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/jostler/internal/admin"
+	"github.com/m-lab/jostler/internal/testhelper"
+	"github.com/m-lab/jostler/internal/uploadbundle"
+)
+
+// fakeDatatype implements the admin.Uploader and admin.Watcher
+// interfaces and records the actions applied to it.
+type fakeDatatype struct {
+	bundles []uploadbundle.BundleInfo
+	paused  bool
+	actions []string
+	pending map[string]struct{}
+	summary uploadbundle.UploadSummary
+}
+
+func (f *fakeDatatype) Bundles() []uploadbundle.BundleInfo  { return f.bundles }
+func (f *fakeDatatype) Flush()                              { f.actions = append(f.actions, "flush") }
+func (f *fakeDatatype) Pause()                              { f.actions = append(f.actions, "pause"); f.paused = true }
+func (f *fakeDatatype) Resume()                             { f.actions = append(f.actions, "resume"); f.paused = false }
+func (f *fakeDatatype) Paused() bool                        { return f.paused }
+func (f *fakeDatatype) Scan()                               { f.actions = append(f.actions, "scan") }
+func (f *fakeDatatype) Pending() int                        { return len(f.pending) }
+func (f *fakeDatatype) Uploads() uploadbundle.UploadSummary { return f.summary }
+
+func (f *fakeDatatype) IsPending(fullPath string) bool {
+	_, ok := f.pending[fullPath]
+	return ok
+}
+
+// FindFile pretends that each bundle has a file named after its
+// timestamp.
+func (f *fakeDatatype) FindFile(fullPath string) (uploadbundle.BundleInfo, bool) {
+	for _, info := range f.bundles {
+		if fullPath == "/"+info.Timestamp+".json" {
+			return info, true
+		}
+	}
+	return uploadbundle.BundleInfo{}, false
+}
+
+func TestStatus(t *testing.T) {
+	created := time.Now().UTC().Add(-time.Minute)
+	foo1 := &fakeDatatype{bundles: []uploadbundle.BundleInfo{
+		{Datatype: "foo1", Timestamp: "t1", Created: created, State: uploadbundle.StateUploaded, Files: 10},
+		{Datatype: "foo1", Timestamp: "t2", Created: created, State: uploadbundle.StateUploading, Files: 20},
+		{Datatype: "foo1", Timestamp: "t3", Created: created, State: uploadbundle.StateActive, Files: 3, Size: 300},
+	}}
+	foo1.pending = map[string]struct{}{"/a.json": {}, "/b.json": {}}
+	foo1.summary = uploadbundle.UploadSummary{LastUploaded: created, LastFailed: created, LastError: "failed to upload"}
+	foo2 := &fakeDatatype{paused: true}
+	srv := httptest.NewServer(admin.New(map[string]admin.Datatype{
+		"foo1": {Uploader: foo1, Watcher: foo1},
+		"foo2": {Uploader: foo2, Watcher: foo2},
+	}).Handler())
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		method     string
+		query      string
+		wantCode   int
+		wantStatus []admin.Status
+	}{
+		{name: "wrong method", method: http.MethodPost, wantCode: http.StatusMethodNotAllowed},
+		{name: "unknown datatype", method: http.MethodGet, query: "?datatype=foo3", wantCode: http.StatusNotFound},
+		{
+			name:     "all datatypes",
+			method:   http.MethodGet,
+			wantCode: http.StatusOK,
+			wantStatus: []admin.Status{
+				{Datatype: "foo1", Active: []admin.Bundle{{BundleInfo: foo1.bundles[2]}}, InFlight: []admin.Bundle{{BundleInfo: foo1.bundles[1]}}, Pending: 2, UploadSummary: foo1.summary},
+				{Datatype: "foo2", Paused: true, Active: []admin.Bundle{}, InFlight: []admin.Bundle{}},
+			},
+		},
+		{
+			name:       "one datatype",
+			method:     http.MethodGet,
+			query:      "?datatype=foo2",
+			wantCode:   http.StatusOK,
+			wantStatus: []admin.Status{{Datatype: "foo2", Paused: true, Active: []admin.Bundle{}, InFlight: []admin.Bundle{}}},
+		},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		var statuses []admin.Status
+		if code := request(t, test.method, srv.URL+"/v1/status"+test.query, &statuses); code != test.wantCode {
+			t.Fatalf("status code = %v, want %v", code, test.wantCode)
+		}
+		if test.wantCode != http.StatusOK {
+			continue
+		}
+		if len(statuses) != len(test.wantStatus) {
+			t.Fatalf("status = %+v, want %+v", statuses, test.wantStatus)
+		}
+		for j, got := range statuses {
+			want := test.wantStatus[j]
+			if got.Datatype != want.Datatype || got.Paused != want.Paused || !sameBundles(got.Active, want.Active) || !sameBundles(got.InFlight, want.InFlight) ||
+				got.Pending != want.Pending || !got.LastUploaded.Equal(want.LastUploaded) || got.LastError != want.LastError {
+				t.Fatalf("status = %+v, want %+v", got, want)
+			}
+			for _, b := range got.Active {
+				if b.Age != "1m0s" {
+					t.Fatalf("age = %v, want 1m0s", b.Age)
+				}
+			}
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	foo1 := &fakeDatatype{
+		bundles: []uploadbundle.BundleInfo{
+			{Datatype: "foo1", Timestamp: "t1", State: uploadbundle.StateUploaded, DataObject: "autoload/v1/t1-data.jsonl.gz"},
+			{Datatype: "foo1", Timestamp: "t2", State: uploadbundle.StateSealed},
+		},
+		pending: map[string]struct{}{"/t2.json": {}, "/t3.json": {}},
+	}
+	foo2 := &fakeDatatype{
+		bundles: []uploadbundle.BundleInfo{{Datatype: "foo2", Timestamp: "t4", State: uploadbundle.StateUploading}},
+	}
+	srv := httptest.NewServer(admin.New(map[string]admin.Datatype{
+		"foo1": {Uploader: foo1, Watcher: foo1},
+		"foo2": {Uploader: foo2, Watcher: foo2},
+	}).Handler())
+	defer srv.Close()
+
+	tests := []struct {
+		name         string
+		path         string
+		wantCode     int
+		wantDatatype string
+		wantState    string
+		wantObject   string
+	}{
+		{name: "relative path", path: "t1.json", wantCode: http.StatusBadRequest},
+		{name: "uploaded", path: "/t1.json", wantCode: http.StatusOK, wantDatatype: "foo1", wantState: admin.FileUploaded, wantObject: "autoload/v1/t1-data.jsonl.gz"},
+		{name: "bundled and pending", path: "/t2.json", wantCode: http.StatusOK, wantDatatype: "foo1", wantState: admin.FileBundled},
+		{name: "pending", path: "/t3.json", wantCode: http.StatusOK, wantDatatype: "foo1", wantState: admin.FilePending},
+		{name: "uploading", path: "/x/../t4.json", wantCode: http.StatusOK, wantDatatype: "foo2", wantState: admin.FileUploading},
+		{name: "unknown", path: "/t5.json", wantCode: http.StatusOK, wantState: admin.FileUnknown},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		var fs admin.FileStatus
+		if code := request(t, http.MethodGet, srv.URL+"/v1/file?path="+test.path, &fs); code != test.wantCode {
+			t.Fatalf("status code = %v, want %v", code, test.wantCode)
+		}
+		if test.wantCode != http.StatusOK {
+			continue
+		}
+		if fs.Datatype != test.wantDatatype || fs.State != test.wantState {
+			t.Fatalf("file status = %+v, want %v and %v", fs, test.wantDatatype, test.wantState)
+		}
+		if test.wantObject != "" && (fs.Bundle == nil || fs.Bundle.DataObject != test.wantObject) {
+			t.Fatalf("file status = %+v, want object %v", fs, test.wantObject)
+		}
+	}
+}
+
+func TestActions(t *testing.T) {
+	foo1, foo2 := &fakeDatatype{}, &fakeDatatype{}
+	srv := httptest.NewServer(admin.New(map[string]admin.Datatype{
+		"foo1": {Uploader: foo1, Watcher: foo1},
+		"foo2": {Uploader: foo2, Watcher: foo2},
+	}).Handler())
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		wantCode int
+		want1    string
+		want2    string
+	}{
+		{name: "wrong method", method: http.MethodGet, path: "/v1/flush", wantCode: http.StatusMethodNotAllowed},
+		{name: "unknown datatype", method: http.MethodPost, path: "/v1/flush?datatype=foo3", wantCode: http.StatusNotFound},
+		{name: "unknown action", method: http.MethodPost, path: "/v1/restart", wantCode: http.StatusNotFound},
+		{name: "flush one datatype", method: http.MethodPost, path: "/v1/flush?datatype=foo1", wantCode: http.StatusAccepted, want1: "flush"},
+		{name: "pause all datatypes", method: http.MethodPost, path: "/v1/pause", wantCode: http.StatusAccepted, want1: "flush,pause", want2: "pause"},
+		{name: "resume one datatype", method: http.MethodPost, path: "/v1/resume?datatype=foo2", wantCode: http.StatusAccepted, want1: "flush,pause", want2: "pause,resume"},
+		{name: "scan all datatypes", method: http.MethodPost, path: "/v1/scan", wantCode: http.StatusAccepted, want1: "flush,pause,scan", want2: "pause,resume,scan"},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		if code := request(t, test.method, srv.URL+test.path, nil); code != test.wantCode {
+			t.Fatalf("status code = %v, want %v", code, test.wantCode)
+		}
+		if got1, got2 := strings.Join(foo1.actions, ","), strings.Join(foo2.actions, ","); got1 != test.want1 || got2 != test.want2 {
+			t.Fatalf("actions = %q and %q, want %q and %q", got1, got2, test.want1, test.want2)
+		}
+	}
+	if !foo1.Paused() || foo2.Paused() {
+		t.Fatalf("Paused() = %v and %v, want true and false", foo1.Paused(), foo2.Paused())
+	}
+}
+
+// request sends a request and decodes its JSON response into v (if not
+// nil and the request was successful).  It returns the status code.
+func request(t *testing.T, method, url string, v interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest() = %v, want nil", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("http.DefaultClient.Do() = %v, want nil", err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("json.Decode() = %v, want nil", err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// sameBundles returns true if the given bundles have the same
+// timestamps.
+func sameBundles(got, want []admin.Bundle) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i].Timestamp != want[i].Timestamp {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+// Package bundleio implements listing and reading data and index bundles
+// that were uploaded to GCS (e.g., to verify, search, compact, or
+// extract files from them).
+package bundleio
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/civil"
+
+	"github.com/m-lab/jostler/internal/naming"
+	"github.com/m-lab/jostler/internal/schema"
+)
+
+// Exported errors.
+var (
+	ErrDownload = errors.New("failed to download bundle")
+	ErrCorrupt  = errors.New("corrupt bundle")
+)
+
+// Object is a bundle whose object name matches a naming template.
+type Object struct {
+	Name string      // object name
+	Vars naming.Vars // values of the variables in the object name
+}
+
+// List returns the bundles whose object names the given matcher matches
+// and whose dates are between from and to (inclusive) sorted by their
+// object names.  A bundle's date is the date of its start time or, if
+// the template has no start time, the date of its timestamp.
+func List(ctx context.Context, client schema.Lister, m *naming.Matcher, from, to civil.Date) ([]Object, error) {
+	objNames, err := client.List(ctx, m.Prefix())
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(objNames)
+	var objs []Object
+	for _, objName := range objNames {
+		vars, ok := m.Match(objName)
+		if !ok {
+			continue
+		}
+		t := vars.Start
+		if t.IsZero() {
+			t = vars.Timestamp
+		}
+		date := civil.DateOf(t)
+		if date.Before(from) || date.After(to) {
+			continue
+		}
+		objs = append(objs, Object{Name: objName, Vars: vars})
+	}
+	return objs, nil
+}
+
+// Open downloads the given bundle and returns a reader of its
+// decompressed contents.
+func Open(ctx context.Context, client schema.Downloader, objName string) (io.Reader, error) {
+	contents, err := client.Download(ctx, objName)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w: %w", objName, err, ErrDownload)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(contents))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v: %w", objName, err, ErrCorrupt)
+	}
+	return r, nil
+}
+
+// ReadLines downloads the given bundle and returns its lines.  Lines are
+// separated by newlines so a bundle that ends with a newline has an
+// empty last line.
+func ReadLines(ctx context.Context, client schema.Downloader, objName string) ([]string, error) {
+	r, err := Open(ctx, client, objName)
+	if err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v: %w", objName, err, ErrCorrupt)
+	}
+	if len(b) == 0 {
+		return nil, nil
+	}
+	return strings.Split(string(b), "\n"), nil
+}
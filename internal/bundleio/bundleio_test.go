@@ -0,0 +1,144 @@
+package bundleio_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/civil"
+
+	"github.com/m-lab/jostler/internal/bundleio"
+	"github.com/m-lab/jostler/internal/naming"
+	"github.com/m-lab/jostler/internal/testhelper"
+	"github.com/m-lab/jostler/internal/testhelper/testbundles"
+	"github.com/m-lab/jostler/internal/testhelper/testfiles"
+)
+
+func TestList(t *testing.T) {
+	tests := []struct {
+		name    string
+		bucket  string
+		from    civil.Date
+		to      civil.Date
+		wantErr bool
+		want    []string // timestamps of the listed bundles
+	}{
+		{
+			name:   "one day",
+			bucket: "newclient,list",
+			from:   civil.Date{Year: 2023, Month: time.April, Day: 5},
+			to:     civil.Date{Year: 2023, Month: time.April, Day: 5},
+			want:   []string{"20230405T101010.000000Z"},
+		},
+		{
+			name:   "all days",
+			bucket: "newclient,list",
+			from:   civil.Date{Year: 2023, Month: time.April, Day: 4},
+			to:     civil.Date{Year: 2023, Month: time.April, Day: 6},
+			want:   []string{"20230404T101010.000000Z", "20230404T111111.000000Z", "20230405T101010.000000Z", "20230406T101010.000000Z"},
+		},
+		{
+			name:    "list fails",
+			bucket:  "newclient,faillist",
+			wantErr: true,
+		},
+	}
+	conf := testbundles.Config{
+		Bucket:        "bucket",
+		HomeDir:       filepath.Join(t.TempDir(), "autoload/v1"),
+		DataTemplate:  naming.MustParse(naming.DefaultData),
+		IndexTemplate: naming.MustParse(naming.DefaultIndex),
+		Vars:          naming.Vars{Experiment: "jostler", Datatype: "foo1"},
+		SpoolDir:      t.TempDir(),
+	}
+	for _, ts := range []string{"20230406T101010.000000Z", "20230404T111111.000000Z", "20230405T101010.000000Z", "20230404T101010.000000Z"} {
+		testbundles.Write(t, testbundles.New(t, conf, testbundles.Bundle{Timestamp: ts, Files: []string{ts + ".json"}}))
+	}
+	// An object that does not match the template is not listed.
+	testfiles.WriteFile(t, filepath.Join(conf.HomeDir, "jostler/index1/2023/04/05/README"), nil)
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		client, err := testhelper.NewClient(context.Background(), test.bucket)
+		if err != nil {
+			t.Fatalf("testhelper.NewClient() = %v, want nil", err)
+		}
+		m := conf.IndexTemplate.Matcher(conf.HomeDir, conf.Vars)
+		objs, err := bundleio.List(context.Background(), client, m, test.from, test.to)
+		if (err != nil) != test.wantErr {
+			t.Fatalf("List() = %v, want error %v", err, test.wantErr)
+		}
+		got := []string{}
+		for _, obj := range objs {
+			got = append(got, obj.Vars.Timestamp.Format(naming.TimestampFormat))
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Fatalf("List() = %v, want %v", got, test.want)
+		}
+	}
+}
+
+func TestReadLines(t *testing.T) {
+	tests := []struct {
+		name       string
+		bucket     string
+		contents   string
+		compressed bool
+		missing    bool
+		wantErr    error
+		want       []string
+	}{
+		{
+			name:       "lines",
+			bucket:     "newclient,download",
+			contents:   "a\nb\nc",
+			compressed: true,
+			want:       []string{"a", "b", "c"},
+		},
+		{
+			name:       "empty",
+			bucket:     "newclient,download",
+			compressed: true,
+		},
+		{
+			name:     "corrupt",
+			bucket:   "newclient,download",
+			contents: "a\nb\nc",
+			wantErr:  bundleio.ErrCorrupt,
+		},
+		{
+			name:    "missing",
+			bucket:  "newclient,download",
+			missing: true,
+			wantErr: bundleio.ErrDownload,
+		},
+		{
+			name:       "download fails",
+			bucket:     "newclient,faildownload",
+			compressed: true,
+			wantErr:    bundleio.ErrDownload,
+		},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		objName := filepath.Join(t.TempDir(), "bundle.jsonl.gz")
+		if test.compressed {
+			testfiles.WriteGzip(t, objName, []byte(test.contents))
+		} else if !test.missing {
+			testfiles.WriteFile(t, objName, []byte(test.contents))
+		}
+		client, err := testhelper.NewClient(context.Background(), test.bucket)
+		if err != nil {
+			t.Fatalf("testhelper.NewClient() = %v, want nil", err)
+		}
+		got, err := bundleio.ReadLines(context.Background(), client, objName)
+		if !errors.Is(err, test.wantErr) {
+			t.Fatalf("ReadLines() = %v, want %v", err, test.wantErr)
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Fatalf("ReadLines() = %v, want %v", got, test.want)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+// Package compact implements the compaction of small data bundles (and
+// their index bundles) that jostler uploaded to GCS into larger ones.
+//
+// For the bundles of a datatype in the partitions of a date, compaction:
+//
+//  1. Finds small data bundles by the sizes in their index bundles so
+//     large data bundles are not downloaded.
+//  2. Groups them by the values of their object names' variables except
+//     the timestamp (e.g., the node and the partition) and merges each
+//     group in timestamp order into bundles that do not exceed the
+//     configured limits.
+//  3. Rewrites archiver.ArchiveURL in the standard columns of every row
+//     to the new data bundle and updates the index entries accordingly.
+//  4. Uploads the new data and index bundles and verifies them.
+//  5. Only then deletes the original index bundles and then their data
+//     bundles.  Data bundles without index bundles are not compacted so
+//     if a delete fails, the original bundles that are left are not
+//     merged again by the next compaction.
+package compact
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/civil"
+	"cloud.google.com/go/storage"
+
+	"github.com/m-lab/jostler/api"
+	"github.com/m-lab/jostler/internal/bundleio"
+	"github.com/m-lab/jostler/internal/naming"
+	"github.com/m-lab/jostler/internal/schema"
+	"github.com/m-lab/jostler/internal/verify"
+)
+
+// Client is the storage client that compaction needs.
+type Client interface {
+	schema.DownloaderLister
+	UploadIfGeneration(context.Context, string, []byte, int64) error
+	Delete(context.Context, string) error
+}
+
+// Config defines which bundles to compact and how.
+type Config struct {
+	Bucket        string           // GCS bucket of the bundles
+	HomeDir       string           // home directory in the bucket (e.g., autoload/v1)
+	DataTemplate  *naming.Template // template of object names of data bundles
+	IndexTemplate *naming.Template // template of object names of index bundles
+	Vars          naming.Vars      // experiment, datatype, organization (and node, if any) of the bundles
+	Date          civil.Date       // date of the partitions to compact
+	SizeMax       int              // maximum size of compacted data bundles (uncompressed)
+	RowsMax       int              // maximum number of rows of compacted data bundles (0 for no limit)
+	DryRun        bool             // if true, only report what would be compacted
+}
+
+// Merge describes data bundles merged into a new data bundle.
+type Merge struct {
+	DataObject  string   `json:"dataObject"`
+	IndexObject string   `json:"indexObject"`
+	Sources     []string `json:"sources"` // object names of the merged data bundles
+	Rows        int      `json:"rows"`
+	Size        int      `json:"size"` // size of the new data bundle (uncompressed)
+}
+
+// Result is the outcome of compacting the bundles of a datatype.
+type Result struct {
+	Datatype string   `json:"datatype"`
+	Bundles  int      `json:"bundles"` // data bundles in the partitions of the date
+	Small    int      `json:"small"`   // data bundles that are smaller than the limits
+	Merges   []Merge  `json:"merges"`
+	Skipped  []string `json:"skipped"` // data bundles that could not be compacted and why
+}
+
+// Exported errors.
+var (
+	ErrList     = errors.New("failed to list bundles")
+	ErrDownload = bundleio.ErrDownload
+	ErrUpload   = errors.New("failed to upload bundle")
+	ErrVerify   = errors.New("failed to verify compacted bundle")
+	ErrDelete   = errors.New("failed to delete bundle")
+)
+
+// bundle is a data bundle that can be compacted.
+type bundle struct {
+	dataObj  string
+	indexObj string
+	vars     naming.Vars
+	index    []api.IndexV1
+	size     int // size of the data bundle (uncompressed)
+}
+
+// Testing and debugging support.
+var (
+	timeNow = time.Now
+	verbose = func(fmt string, args ...interface{}) {}
+)
+
+// Verbose provides a convenient way for the caller to enable verbose
+// printing and control its format (mostly for debugging).
+func Verbose(v func(string, ...interface{})) {
+	verbose = v
+}
+
+// Compact compacts the small data bundles that the given configuration
+// defines.  It returns an error if bundles cannot be listed, downloaded,
+// uploaded, verified, or deleted, in which case the merges in the
+// result were completed before the error.  The original bundles of a
+// merge are only deleted after the new bundles were verified.
+func Compact(ctx context.Context, client Client, conf Config) (*Result, error) {
+	result := &Result{Datatype: conf.Vars.Datatype, Merges: []Merge{}, Skipped: []string{}}
+	bundles, err := smallBundles(ctx, client, conf, result)
+	if err != nil {
+		return nil, err
+	}
+	merges := plan(conf, bundles)
+	last := time.Time{}
+	for _, sources := range merges {
+		vars := sources[0].vars
+		// Timestamps make object names unique so the bundles of a run
+		// should not share one.
+		vars.Timestamp = timeNow().UTC().Truncate(time.Microsecond)
+		if !vars.Timestamp.After(last) {
+			vars.Timestamp = last.Add(time.Microsecond)
+		}
+		last = vars.Timestamp
+		merge, err := mergeBundles(ctx, client, conf, sources, vars)
+		if err != nil {
+			if errors.Is(err, errInconsistent) {
+				result.Skipped = append(result.Skipped, err.Error())
+				continue
+			}
+			return result, err
+		}
+		result.Merges = append(result.Merges, *merge)
+	}
+	return result, nil
+}
+
+// smallBundles returns the data bundles in the partitions of the
+// configured date that are smaller than the configured limits.
+func smallBundles(ctx context.Context, client Client, conf Config, result *Result) ([]*bundle, error) {
+	objs, err := bundleio.List(ctx, client, conf.DataTemplate.Matcher(conf.HomeDir, conf.Vars), conf.Date, conf.Date)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrList, err)
+	}
+	var bundles []*bundle
+	for _, obj := range objs {
+		objName, vars := obj.Name, obj.Vars
+		result.Bundles++
+		b := &bundle{dataObj: objName, indexObj: conf.IndexTemplate.Join(conf.HomeDir, vars), vars: vars}
+		lines, err := bundleio.ReadLines(ctx, client, b.indexObj)
+		if err != nil {
+			if errors.Is(err, storage.ErrObjectNotExist) {
+				result.Skipped = append(result.Skipped, fmt.Sprintf("%v: no index bundle", objName))
+				continue
+			}
+			if errors.Is(err, ErrDownload) {
+				return nil, err
+			}
+			result.Skipped = append(result.Skipped, fmt.Sprintf("%v: %v", objName, err))
+			continue
+		}
+		if b.index, err = parseIndex(lines); err != nil {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("%v: %v: %v", objName, b.indexObj, err))
+			continue
+		}
+		b.size = len(b.index) - 1
+		for _, entry := range b.index {
+			b.size += entry.Size
+		}
+		if b.size >= conf.SizeMax || (conf.RowsMax > 0 && len(b.index) >= conf.RowsMax) {
+			continue
+		}
+		bundles = append(bundles, b)
+	}
+	result.Small = len(bundles)
+	return bundles, nil
+}
+
+// plan groups the given bundles by the values of their variables except
+// the timestamp and returns the groups of bundles to merge in timestamp
+// order.  Bundles are added to a merge as long as the merged bundle
+// does not exceed the configured limits and merges of a single bundle
+// are dropped.
+func plan(conf Config, bundles []*bundle) [][]*bundle {
+	groups := make(map[naming.Vars][]*bundle)
+	var keys []naming.Vars
+	for _, b := range bundles {
+		key := b.vars
+		key.Timestamp = time.Time{}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], b)
+	}
+	var merges [][]*bundle
+	for _, key := range keys {
+		group := groups[key]
+		sort.SliceStable(group, func(i, j int) bool { return group[i].vars.Timestamp.Before(group[j].vars.Timestamp) })
+		var merge []*bundle
+		size, rows := 0, 0
+		for _, b := range group {
+			newSize := size + b.size
+			if len(merge) != 0 {
+				newSize++ // newline between the bundles
+			}
+			if len(merge) != 0 && (newSize > conf.SizeMax || (conf.RowsMax > 0 && rows+len(b.index) > conf.RowsMax)) {
+				if len(merge) > 1 {
+					merges = append(merges, merge)
+				}
+				merge, newSize, rows = nil, b.size, 0
+			}
+			merge = append(merge, b)
+			size, rows = newSize, rows+len(b.index)
+		}
+		if len(merge) > 1 {
+			merges = append(merges, merge)
+		}
+	}
+	return merges
+}
+
+// errInconsistent means the data bundle and index bundle of a merge do
+// not agree so the merge is skipped.
+var errInconsistent = errors.New("inconsistent data and index bundles")
+
+// row defines the fields of a row of a data bundle that are needed to
+// check it against its index entry.
+type row struct {
+	Archiver struct {
+		ArchiveURL string
+		Filename   string
+	}
+}
+
+// mergeBundles merges the given data bundles into a new data bundle
+// named with the given variables, uploads it with its index bundle,
+// verifies them, and deletes the original bundles.
+func mergeBundles(ctx context.Context, client Client, conf Config, sources []*bundle, vars naming.Vars) (*Merge, error) {
+	merge := &Merge{
+		DataObject:  conf.DataTemplate.Join(conf.HomeDir, vars),
+		IndexObject: conf.IndexTemplate.Join(conf.HomeDir, vars),
+	}
+	newURL, err := json.Marshal(fmt.Sprintf("gs://%v/%v", conf.Bucket, merge.DataObject))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", merge.DataObject, err)
+	}
+	var dataLines []string
+	var index []api.IndexV1
+	offset := 0
+	for _, b := range sources {
+		merge.Sources = append(merge.Sources, b.dataObj)
+		merge.Rows += len(b.index)
+		if conf.DryRun {
+			merge.Size += b.size
+			continue
+		}
+		lines, err := bundleio.ReadLines(ctx, client, b.dataObj)
+		if err != nil {
+			// A data bundle that no longer exists (e.g., it was
+			// compacted concurrently) only skips the merge.
+			if errors.Is(err, ErrDownload) && !errors.Is(err, storage.ErrObjectNotExist) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("%v: %v: %w", b.dataObj, err, errInconsistent)
+		}
+		if len(lines) != len(b.index) {
+			return nil, fmt.Errorf("%v: %d row(s) but %d file(s) in index bundle: %w", b.dataObj, len(lines), len(b.index), errInconsistent)
+		}
+		oldURL, err := json.Marshal(fmt.Sprintf("gs://%v/%v", conf.Bucket, b.dataObj))
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", b.dataObj, err)
+		}
+		for i, line := range lines {
+			entry := b.index[i]
+			newLine, delta, err := rewriteArchiveURL(line, entry, oldURL, newURL)
+			if err != nil {
+				return nil, fmt.Errorf("%v: line %d: %v: %w", b.dataObj, i+1, err, errInconsistent)
+			}
+			entry.Size = len(newLine)
+			// Entries created before the locations of files were
+			// recorded stay that way.
+			if entry.Line != 0 {
+				entry.Line = len(dataLines) + 1
+				entry.Offset = offset
+				entry.RawOffset += delta
+			}
+			dataLines = append(dataLines, newLine)
+			index = append(index, entry)
+			offset += len(newLine) + 1
+		}
+	}
+	if conf.DryRun {
+		merge.Size += len(sources) - 1
+		return merge, nil
+	}
+	merge.Size = offset - 1
+
+	if err := upload(ctx, client, conf, merge, dataLines, index); err != nil {
+		return nil, err
+	}
+	// Deleting the index bundles first hides the original bundles
+	// from later compactions (see smallBundles).
+	for _, b := range sources {
+		verbose("deleting %v", b.indexObj)
+		if err := client.Delete(ctx, b.indexObj); err != nil {
+			return nil, fmt.Errorf("%v: %v: %w", b.indexObj, err, ErrDelete)
+		}
+	}
+	for _, b := range sources {
+		verbose("deleting %v", b.dataObj)
+		if err := client.Delete(ctx, b.dataObj); err != nil {
+			return nil, fmt.Errorf("%v: %v: %w", b.dataObj, err, ErrDelete)
+		}
+	}
+	return merge, nil
+}
+
+// rewriteArchiveURL returns the given row of the file of the given index
+// entry with its archiver.ArchiveURL changed from oldURL to newURL (both
+// JSON strings) and by how many bytes the row changed.  The rest of the
+// row is not changed so the contents of the file stay intact.
+func rewriteArchiveURL(line string, entry api.IndexV1, oldURL, newURL []byte) (string, int, error) {
+	var r row
+	if err := json.Unmarshal([]byte(line), &r); err != nil {
+		return "", 0, err
+	}
+	if r.Archiver.Filename != entry.Filename {
+		return "", 0, fmt.Errorf("file %v but %v in index bundle", r.Archiver.Filename, entry.Filename)
+	}
+	// Standard columns are before the file's contents (raw) so only
+	// they are searched.
+	stdCols := line
+	if entry.RawSize != 0 && entry.RawOffset <= len(line) {
+		stdCols = line[:entry.RawOffset]
+	}
+	old := `"ArchiveURL":` + string(oldURL)
+	idx := strings.Index(stdCols, old)
+	if idx == -1 {
+		return "", 0, fmt.Errorf("archiver.ArchiveURL is not %s", oldURL)
+	}
+	newLine := line[:idx] + `"ArchiveURL":` + string(newURL) + line[idx+len(old):]
+	return newLine, len(newLine) - len(line), nil
+}
+
+// upload uploads the data and index bundles of the given merge and
+// verifies them.  If the new bundles do not verify, they are deleted.
+func upload(ctx context.Context, client Client, conf Config, merge *Merge, dataLines []string, index []api.IndexV1) error {
+	indexLines := make([]string, len(index))
+	for i, entry := range index {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("%v: %w", merge.IndexObject, err)
+		}
+		indexLines[i] = string(b)
+	}
+	// Bundles are uploaded only if they do not exist so existing
+	// bundles are never overwritten.
+	verbose("uploading %v and %v", merge.DataObject, merge.IndexObject)
+	if err := client.UploadIfGeneration(ctx, merge.DataObject, gzipLines(dataLines), 0); err != nil {
+		return fmt.Errorf("%v: %v: %w", merge.DataObject, err, ErrUpload)
+	}
+	if err := client.UploadIfGeneration(ctx, merge.IndexObject, gzipLines(indexLines), 0); err != nil {
+		_ = client.Delete(ctx, merge.DataObject)
+		return fmt.Errorf("%v: %v: %w", merge.IndexObject, err, ErrUpload)
+	}
+	vconf := verify.Config{
+		Bucket:        conf.Bucket,
+		HomeDir:       conf.HomeDir,
+		DataTemplate:  conf.DataTemplate,
+		IndexTemplate: conf.IndexTemplate,
+		Vars:          conf.Vars,
+	}
+	report, err := verify.Bundle(ctx, client, vconf, merge.DataObject)
+	if err == nil && (!report.OK() || report.Rows != merge.Rows) {
+		err = fmt.Errorf("%d row(s) and %d problem(s), want %d row(s)", report.Rows, len(report.Problems), merge.Rows)
+	}
+	if err != nil {
+		_ = client.Delete(ctx, merge.DataObject)
+		_ = client.Delete(ctx, merge.IndexObject)
+		return fmt.Errorf("%v: %v: %w", merge.DataObject, err, ErrVerify)
+	}
+	return nil
+}
+
+// parseIndex parses the given lines of an index bundle.
+func parseIndex(lines []string) ([]api.IndexV1, error) {
+	if len(lines) == 0 {
+		return nil, errors.New("empty index bundle")
+	}
+	index := make([]api.IndexV1, len(lines))
+	for i, line := range lines {
+		if err := json.Unmarshal([]byte(line), &index[i]); err != nil || index[i].Filename == "" {
+			return nil, fmt.Errorf("line %d: invalid index entry", i+1)
+		}
+	}
+	return index, nil
+}
+
+// gzipLines returns the given lines separated by newlines and
+// compressed.
+func gzipLines(lines []string) []byte {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	// Writing to a bytes.Buffer never fails.
+	_, _ = w.Write([]byte(strings.Join(lines, "\n")))
+	_ = w.Close()
+	return b.Bytes()
+}
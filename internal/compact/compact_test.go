@@ -0,0 +1,340 @@
+package compact_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/civil"
+
+	"github.com/m-lab/jostler/api"
+	"github.com/m-lab/jostler/internal/bundleio"
+	"github.com/m-lab/jostler/internal/compact"
+	"github.com/m-lab/jostler/internal/extract"
+	"github.com/m-lab/jostler/internal/naming"
+	"github.com/m-lab/jostler/internal/testhelper"
+	"github.com/m-lab/jostler/internal/testhelper/testbundles"
+	"github.com/m-lab/jostler/internal/verify"
+)
+
+// bundle defines a data bundle and its index bundle to create for tests.
+type bundle struct {
+	timestamp string // timestamp of the bundle in its object names
+	machine   string // machine in the object names
+	files     int    // number of files in the bundle
+	noIndex   bool   // if true, the index bundle is not created
+	oldIndex  bool   // if true, the index bundle does not record locations of files
+	dropIndex bool   // if true, the last file is not in the index bundle
+}
+
+func TestCompact(t *testing.T) {
+	tests := []struct {
+		name        string
+		bucket      string
+		bundles     []bundle
+		sizeMax     int
+		rowsMax     int
+		dryRun      bool
+		wantErr     error
+		wantBundles int
+		wantSmall   int
+		wantMerges  []int // number of sources of each merge
+		wantSkipped int
+	}{
+		{
+			name:   "merge",
+			bucket: "newclient,download,upload,list,delete",
+			bundles: []bundle{
+				{timestamp: "20230404T010000.000000Z", machine: "mlab1", files: 2},
+				{timestamp: "20230404T020000.000000Z", machine: "mlab1", files: 1, oldIndex: true},
+				{timestamp: "20230404T030000.000000Z", machine: "mlab1", files: 3},
+				{timestamp: "20230404T040000.000000Z", machine: "mlab2", files: 1},
+			},
+			sizeMax:     1024 * 1024,
+			wantBundles: 4,
+			wantSmall:   4,
+			wantMerges:  []int{3},
+		},
+		{
+			name:   "limits",
+			bucket: "newclient,download,upload,list,delete",
+			bundles: []bundle{
+				{timestamp: "20230404T010000.000000Z", machine: "mlab1", files: 2},
+				{timestamp: "20230404T020000.000000Z", machine: "mlab1", files: 2},
+				{timestamp: "20230404T030000.000000Z", machine: "mlab1", files: 5},
+				{timestamp: "20230404T040000.000000Z", machine: "mlab1", files: 1},
+				{timestamp: "20230404T050000.000000Z", machine: "mlab1", files: 1},
+			},
+			sizeMax:     1024 * 1024,
+			rowsMax:     4,
+			wantBundles: 5,
+			wantSmall:   4,
+			wantMerges:  []int{2, 2},
+		},
+		{
+			name:   "dry run",
+			bucket: "newclient,download,list",
+			bundles: []bundle{
+				{timestamp: "20230404T010000.000000Z", machine: "mlab1", files: 2},
+				{timestamp: "20230404T020000.000000Z", machine: "mlab1", files: 2},
+			},
+			sizeMax:     1024 * 1024,
+			dryRun:      true,
+			wantBundles: 2,
+			wantSmall:   2,
+			wantMerges:  []int{2},
+		},
+		{
+			name:   "skipped",
+			bucket: "newclient,download,upload,list,delete",
+			bundles: []bundle{
+				{timestamp: "20230404T010000.000000Z", machine: "mlab1", files: 2, noIndex: true},
+				{timestamp: "20230404T020000.000000Z", machine: "mlab1", files: 2, dropIndex: true},
+				{timestamp: "20230404T030000.000000Z", machine: "mlab1", files: 2},
+			},
+			sizeMax:     1024 * 1024,
+			wantBundles: 3,
+			wantSmall:   2,
+			wantMerges:  []int{},
+			wantSkipped: 2,
+		},
+		{
+			name:    "list fails",
+			bucket:  "newclient,download,faillist",
+			sizeMax: 1024 * 1024,
+			wantErr: compact.ErrList,
+		},
+		{
+			name:   "upload fails",
+			bucket: "newclient,download,failupload,list,delete",
+			bundles: []bundle{
+				{timestamp: "20230404T010000.000000Z", machine: "mlab1", files: 1},
+				{timestamp: "20230404T020000.000000Z", machine: "mlab1", files: 1},
+			},
+			sizeMax: 1024 * 1024,
+			wantErr: compact.ErrUpload,
+		},
+		{
+			name:   "delete fails",
+			bucket: "newclient,download,upload,list,faildelete",
+			bundles: []bundle{
+				{timestamp: "20230404T010000.000000Z", machine: "mlab1", files: 1},
+				{timestamp: "20230404T020000.000000Z", machine: "mlab1", files: 1},
+			},
+			sizeMax: 1024 * 1024,
+			wantErr: compact.ErrDelete,
+		},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		conf := compact.Config{
+			Bucket:        "bucket",
+			HomeDir:       filepath.Join(t.TempDir(), "autoload/v1"),
+			DataTemplate:  naming.MustParse(naming.DefaultData),
+			IndexTemplate: naming.MustParse(naming.DefaultIndex),
+			Vars:          naming.Vars{Experiment: "jostler", Datatype: "foo1"},
+			Date:          civil.Date{Year: 2023, Month: time.April, Day: 4},
+			SizeMax:       test.sizeMax,
+			RowsMax:       test.rowsMax,
+			DryRun:        test.dryRun,
+		}
+		// Contents of all files by their pathnames.
+		files := map[string]string{}
+		var dataObjs []string
+		for _, b := range test.bundles {
+			dataObjs = append(dataObjs, writeBundle(t, conf, b, files))
+		}
+		client, err := testhelper.NewClient(context.Background(), test.bucket)
+		if err != nil {
+			t.Fatalf("testhelper.NewClient() = %v, want nil", err)
+		}
+		result, err := compact.Compact(context.Background(), client, conf)
+		if !errors.Is(err, test.wantErr) {
+			t.Fatalf("Compact() = %v, want %v", err, test.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		if result.Bundles != test.wantBundles || result.Small != test.wantSmall || len(result.Skipped) != test.wantSkipped {
+			t.Fatalf("Compact() = %+v, want %v bundles, %v small, %v skipped", result, test.wantBundles, test.wantSmall, test.wantSkipped)
+		}
+		gotMerges := []int{}
+		for _, merge := range result.Merges {
+			gotMerges = append(gotMerges, len(merge.Sources))
+		}
+		if fmt.Sprint(gotMerges) != fmt.Sprint(test.wantMerges) {
+			t.Fatalf("Compact() merges = %v, want %v", gotMerges, test.wantMerges)
+		}
+		checkMerges(t, conf, client, result, dataObjs, files)
+	}
+}
+
+// deleteLimiter is a storage client whose deletes fail after the given
+// number of deletes.
+type deleteLimiter struct {
+	*testhelper.StorageClient
+	deletes int
+}
+
+func (d *deleteLimiter) Delete(ctx context.Context, objPath string) error {
+	if d.deletes == 0 {
+		return testhelper.ErrDelete
+	}
+	d.deletes--
+	return d.StorageClient.Delete(ctx, objPath)
+}
+
+func TestCompactDeleteFails(t *testing.T) {
+	conf := compact.Config{
+		Bucket:        "bucket",
+		HomeDir:       filepath.Join(t.TempDir(), "autoload/v1"),
+		DataTemplate:  naming.MustParse(naming.DefaultData),
+		IndexTemplate: naming.MustParse(naming.DefaultIndex),
+		Vars:          naming.Vars{Experiment: "jostler", Datatype: "foo1"},
+		Date:          civil.Date{Year: 2023, Month: time.April, Day: 4},
+		SizeMax:       1024 * 1024,
+	}
+	files := map[string]string{}
+	for _, ts := range []string{"20230404T010000.000000Z", "20230404T020000.000000Z", "20230404T030000.000000Z"} {
+		writeBundle(t, conf, bundle{timestamp: ts, machine: "mlab1", files: 2}, files)
+	}
+	client, err := testhelper.NewClient(context.Background(), "newclient,download,upload,list,delete")
+	if err != nil {
+		t.Fatalf("testhelper.NewClient() = %v, want nil", err)
+	}
+	// Deleting the data bundle of the second original bundle fails.
+	if _, err = compact.Compact(context.Background(), &deleteLimiter{StorageClient: client, deletes: 4}, conf); !errors.Is(err, compact.ErrDelete) {
+		t.Fatalf("Compact() = %v, want %v", err, compact.ErrDelete)
+	}
+	// The data bundles of the original bundles that were left have
+	// no index bundles so they are skipped instead of merged again.
+	result, err := compact.Compact(context.Background(), client, conf)
+	if err != nil {
+		t.Fatalf("Compact() = %v, want nil", err)
+	}
+	if result.Small != 1 || len(result.Merges) != 0 || len(result.Skipped) != 2 {
+		t.Fatalf("Compact() = %+v, want 1 small bundle, no merges, and 2 skipped", result)
+	}
+	// Every file is in exactly one index bundle.
+	m := conf.IndexTemplate.Matcher(conf.HomeDir, conf.Vars)
+	objs, err := bundleio.List(context.Background(), client, m, conf.Date, conf.Date)
+	if err != nil {
+		t.Fatalf("bundleio.List() = %v, want nil", err)
+	}
+	seen := map[string]bool{}
+	for _, obj := range objs {
+		lines, err := bundleio.ReadLines(context.Background(), client, obj.Name)
+		if err != nil {
+			t.Fatalf("bundleio.ReadLines() = %v, want nil", err)
+		}
+		for _, line := range lines {
+			var entry api.IndexV1
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("json.Unmarshal() = %v, want nil", err)
+			}
+			if seen[entry.Filename] {
+				t.Fatalf("%v is in more than one bundle", entry.Filename)
+			}
+			seen[entry.Filename] = true
+		}
+	}
+	if len(seen) != len(files) {
+		t.Fatalf("%d file(s) in index bundles, want %d", len(seen), len(files))
+	}
+}
+
+// checkMerges checks that the merged bundles were replaced by new
+// bundles that verify and from which all their files can be extracted.
+func checkMerges(t *testing.T, conf compact.Config, client *testhelper.StorageClient, result *compact.Result, dataObjs []string, files map[string]string) {
+	t.Helper()
+	merged := map[string]bool{}
+	for _, merge := range result.Merges {
+		for _, source := range merge.Sources {
+			merged[source] = true
+		}
+		if conf.DryRun {
+			if _, err := os.Stat(merge.DataObject); err == nil {
+				t.Fatalf("os.Stat(%v) = nil, want error in dry run", merge.DataObject)
+			}
+			continue
+		}
+		vconf := verify.Config{
+			Bucket:        conf.Bucket,
+			HomeDir:       conf.HomeDir,
+			DataTemplate:  conf.DataTemplate,
+			IndexTemplate: conf.IndexTemplate,
+			Vars:          conf.Vars,
+		}
+		report, err := verify.Bundle(context.Background(), client, vconf, merge.DataObject)
+		if err != nil || !report.OK() || report.Rows != merge.Rows {
+			t.Fatalf("verify.Bundle() = %+v, %v, want %v rows and no problems", report, err, merge.Rows)
+		}
+		for line := 1; line <= merge.Rows; line++ {
+			entry, err := extract.Entry(context.Background(), client, merge.IndexObject, "", line)
+			if err != nil {
+				t.Fatalf("extract.Entry() = %v, want nil", err)
+			}
+			got, err := extract.File(context.Background(), client, merge.DataObject, entry)
+			want := files[entry.Filename]
+			if entry.RawSize == 0 {
+				want = strings.TrimSpace(want)
+			}
+			if err != nil || string(got) != want {
+				t.Fatalf("extract.File() = %q, %v, want %q, nil", got, err, want)
+			}
+		}
+	}
+	for _, dataObj := range dataObjs {
+		_, err := os.Stat(dataObj)
+		if deleted := err != nil; deleted != (merged[dataObj] && !conf.DryRun) {
+			t.Fatalf("%v deleted = %v, want %v", dataObj, deleted, merged[dataObj])
+		}
+	}
+}
+
+// writeBundle writes the given data and index bundles where the local
+// disk storage client expects them and returns the object name of the
+// data bundle.  The contents of the bundle's files are added to files.
+func writeBundle(t *testing.T, conf compact.Config, b bundle, files map[string]string) string {
+	t.Helper()
+	// The timestamps of all bundles are in conf.Date.
+	tb := testbundles.Bundle{Timestamp: b.timestamp, Machine: b.machine}
+	for i := 0; i < b.files; i++ {
+		contents := fmt.Sprintf(` {"Field1": %d, "Bundle": %q}`, i, b.timestamp)
+		if i%2 == 0 {
+			contents += "\n"
+		}
+		tb.Files = append(tb.Files, fmt.Sprintf("%v-%d.json", b.timestamp, i))
+		tb.Contents = append(tb.Contents, contents)
+	}
+	jb := testbundles.New(t, testbundles.Config{
+		Bucket:        conf.Bucket,
+		HomeDir:       conf.HomeDir,
+		DataTemplate:  conf.DataTemplate,
+		IndexTemplate: conf.IndexTemplate,
+		Vars:          conf.Vars,
+		SpoolDir:      t.TempDir(),
+	}, tb)
+	for i, entry := range jb.Index {
+		files[entry.Filename] = tb.Contents[i]
+	}
+	if b.oldIndex {
+		for i := range jb.Index {
+			jb.Index[i].Line, jb.Index[i].Offset, jb.Index[i].RawOffset, jb.Index[i].RawSize, jb.Index[i].FileSize = 0, 0, 0, 0, 0
+		}
+	}
+	if b.dropIndex {
+		jb.Index = jb.Index[:len(jb.Index)-1]
+	}
+	testbundles.WriteData(t, jb)
+	if !b.noIndex {
+		testbundles.WriteIndex(t, jb)
+	}
+	return testbundles.DataObject(jb)
+}
@@ -0,0 +1,241 @@
+// Package diskpressure implements a watchdog that monitors free space
+// and free inodes on the filesystem of a directory (e.g., the spool
+// directory of measurement data) and reports the level of pressure on
+// the filesystem.
+//
+// The pressure is soft when the percentage of bytes or inodes in use
+// reaches Config.Soft and hard when it reaches Config.Hard.  While the
+// pressure is hard, the watchdog keeps a marker file (if configured) so
+// that other programs (e.g., the measurement service) can notice it
+// without talking to jostler.
+package diskpressure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Level is the level of pressure on a filesystem.
+type Level int
+
+// Pressure levels.
+const (
+	LevelNormal Level = iota // usage is below the soft threshold
+	LevelSoft                // usage is at or above the soft threshold
+	LevelHard                // usage is at or above the hard threshold
+)
+
+// String returns the name of the level.
+func (l Level) String() string {
+	switch l {
+	case LevelNormal:
+		return "normal"
+	case LevelSoft:
+		return "soft"
+	case LevelHard:
+		return "hard"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// Exported errors.
+var (
+	ErrConfig = errors.New("invalid configuration")
+	ErrStatfs = errors.New("failed to get filesystem statistics")
+)
+
+// Config defines watchdog configuration options.
+type Config struct {
+	Dir        string        // directory on the filesystem to monitor
+	Interval   time.Duration // time interval between checks
+	Soft       float64       // percentage of bytes or inodes in use at or above which the pressure is soft
+	Hard       float64       // percentage of bytes or inodes in use at or above which the pressure is hard
+	MarkerFile string        // pathname of the marker file kept while the pressure is hard (disabled if empty)
+}
+
+// Usage describes the usage of a filesystem.
+type Usage struct {
+	Bytes      uint64 `json:"bytes"`      // total size in bytes
+	FreeBytes  uint64 `json:"freeBytes"`  // bytes available to unprivileged users
+	Inodes     uint64 `json:"inodes"`     // total number of inodes
+	FreeInodes uint64 `json:"freeInodes"` // number of free inodes
+}
+
+// Used returns the percentage of bytes or inodes in use, whichever is
+// higher.  Filesystems without a fixed number of inodes report zero
+// inodes, which count as not in use.
+func (u Usage) Used() float64 {
+	used := 0.0
+	if u.Bytes != 0 && u.FreeBytes <= u.Bytes {
+		used = 100 * float64(u.Bytes-u.FreeBytes) / float64(u.Bytes)
+	}
+	if u.Inodes != 0 && u.FreeInodes <= u.Inodes {
+		if inodes := 100 * float64(u.Inodes-u.FreeInodes) / float64(u.Inodes); inodes > used {
+			used = inodes
+		}
+	}
+	return used
+}
+
+// Watchdog monitors the usage of a filesystem.
+type Watchdog struct {
+	conf Config
+
+	mu      sync.Mutex // protects the following fields
+	checked bool       // whether the filesystem was checked at least once
+	level   Level      // level of pressure at the last check
+	usage   Usage      // usage at the last check
+}
+
+var (
+	jostlerSpoolFreeBytes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "jostler_spool_free_bytes",
+			Help: "The number of bytes available on the filesystem of the spool directory",
+		})
+	jostlerSpoolFreeInodes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "jostler_spool_free_inodes",
+			Help: "The number of free inodes on the filesystem of the spool directory",
+		})
+	jostlerSpoolPressure = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "jostler_spool_pressure_level",
+			Help: "The level of pressure on the filesystem of the spool directory (0 normal, 1 soft, 2 hard)",
+		})
+
+	// Testing and debugging support.
+	verbose = func(fmt string, args ...interface{}) {}
+	statfs  = func(dir string) (Usage, error) {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(dir, &st); err != nil {
+			return Usage{}, err
+		}
+		bsize := uint64(st.Bsize)
+		return Usage{
+			Bytes:      st.Blocks * bsize,
+			FreeBytes:  st.Bavail * bsize,
+			Inodes:     st.Files,
+			FreeInodes: st.Ffree,
+		}, nil
+	}
+)
+
+// Verbose provides a convenient way for the caller to enable verbose
+// printing and control its format (mostly for debugging).
+func Verbose(v func(string, ...interface{})) {
+	verbose = v
+}
+
+// New returns a new Watchdog instance.
+func New(conf Config) (*Watchdog, error) {
+	if conf.Dir == "" {
+		return nil, fmt.Errorf("%w: empty directory", ErrConfig)
+	}
+	if conf.Interval <= 0 {
+		return nil, fmt.Errorf("%w: invalid interval: %v", ErrConfig, conf.Interval)
+	}
+	if conf.Soft <= 0 || conf.Soft > conf.Hard || conf.Hard > 100 {
+		return nil, fmt.Errorf("%w: thresholds must be 0 < soft (%v) <= hard (%v) <= 100", ErrConfig, conf.Soft, conf.Hard)
+	}
+	return &Watchdog{conf: conf}, nil
+}
+
+// Watch checks the filesystem right away and then every interval until
+// the given context is canceled.  It calls notify (if not nil) with the
+// new level whenever the level changes, including after the first
+// check.  Failed checks are logged and do not change the level.
+func (w *Watchdog) Watch(ctx context.Context, notify func(Level)) error {
+	ticker := time.NewTicker(w.conf.Interval)
+	defer ticker.Stop()
+	for {
+		level, changed, err := w.Check()
+		if err != nil {
+			log.Printf("ERROR: %v\n", err)
+		} else if changed && notify != nil {
+			notify(level)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check checks the usage of the filesystem and updates the metrics and
+// the marker file.  It returns the level of pressure and whether it
+// changed since the last check.
+func (w *Watchdog) Check() (Level, bool, error) {
+	usage, err := statfs(w.conf.Dir)
+	if err != nil {
+		return LevelNormal, false, fmt.Errorf("%w: %v: %v", ErrStatfs, w.conf.Dir, err)
+	}
+	jostlerSpoolFreeBytes.Set(float64(usage.FreeBytes))
+	jostlerSpoolFreeInodes.Set(float64(usage.FreeInodes))
+	used := usage.Used()
+	level := LevelNormal
+	switch {
+	case used >= w.conf.Hard:
+		level = LevelHard
+	case used >= w.conf.Soft:
+		level = LevelSoft
+	}
+	jostlerSpoolPressure.Set(float64(level))
+	verbose("%v: %.1f%% used, %d bytes and %d inodes free, pressure %v", w.conf.Dir, used, usage.FreeBytes, usage.FreeInodes, level)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	changed := !w.checked || level != w.level
+	if changed {
+		if w.checked {
+			log.Printf("pressure on %v changed from %v to %v (%.1f%% used, %d bytes and %d inodes free)\n",
+				w.conf.Dir, w.level, level, used, usage.FreeBytes, usage.FreeInodes)
+		}
+		w.updateMarker(level, used)
+	}
+	w.checked, w.level, w.usage = true, level, usage
+	return level, changed, nil
+}
+
+// updateMarker creates the marker file if the pressure is hard and
+// removes it otherwise (e.g., a marker file left by a previous
+// instance).  It should be called with w.mu held.
+func (w *Watchdog) updateMarker(level Level, used float64) {
+	if w.conf.MarkerFile == "" {
+		return
+	}
+	if level != LevelHard {
+		if err := os.Remove(w.conf.MarkerFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("ERROR: failed to remove marker file: %v\n", err)
+		}
+		return
+	}
+	contents := fmt.Sprintf("%v is %.1f%% used since %v\n", w.conf.Dir, used, time.Now().UTC().Format(time.RFC3339))
+	if err := os.WriteFile(w.conf.MarkerFile, []byte(contents), 0o644); err != nil {
+		log.Printf("ERROR: failed to create marker file: %v\n", err)
+	}
+}
+
+// Level returns the level of pressure at the last check.
+func (w *Watchdog) Level() Level {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.level
+}
+
+// Usage returns the usage of the filesystem at the last check.
+func (w *Watchdog) Usage() Usage {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.usage
+}
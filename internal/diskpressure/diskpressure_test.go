@@ -0,0 +1,151 @@
+package diskpressure
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/jostler/internal/testhelper"
+)
+
+var errStatfs = errors.New("statfs failed")
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    Config
+		wantErr error
+	}{
+		{name: "empty directory", conf: Config{Interval: time.Second, Soft: 80, Hard: 95}, wantErr: ErrConfig},
+		{name: "invalid interval", conf: Config{Dir: "/", Soft: 80, Hard: 95}, wantErr: ErrConfig},
+		{name: "zero soft", conf: Config{Dir: "/", Interval: time.Second, Hard: 95}, wantErr: ErrConfig},
+		{name: "soft above hard", conf: Config{Dir: "/", Interval: time.Second, Soft: 95, Hard: 80}, wantErr: ErrConfig},
+		{name: "hard above 100", conf: Config{Dir: "/", Interval: time.Second, Soft: 80, Hard: 101}, wantErr: ErrConfig},
+		{name: "valid", conf: Config{Dir: "/", Interval: time.Second, Soft: 80, Hard: 80}},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		if _, err := New(test.conf); !errors.Is(err, test.wantErr) {
+			t.Fatalf("New() = %v, want %v", err, test.wantErr)
+		}
+	}
+}
+
+func TestUsed(t *testing.T) {
+	tests := []struct {
+		name  string
+		usage Usage
+		want  float64
+	}{
+		{name: "empty", usage: Usage{}, want: 0},
+		{name: "bytes", usage: Usage{Bytes: 100, FreeBytes: 20, Inodes: 100, FreeInodes: 90}, want: 80},
+		{name: "inodes", usage: Usage{Bytes: 100, FreeBytes: 90, Inodes: 100, FreeInodes: 5}, want: 95},
+		{name: "no inodes", usage: Usage{Bytes: 100, FreeBytes: 50}, want: 50},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		if got := test.usage.Used(); got != test.want {
+			t.Fatalf("Used() = %v, want %v", got, test.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	saveStatfs := statfs
+	defer func() { statfs = saveStatfs }()
+
+	marker := filepath.Join(t.TempDir(), "jostler-disk-full")
+	// A marker file left behind by a previous instance is removed.
+	if err := os.WriteFile(marker, nil, 0o644); err != nil {
+		t.Fatalf("os.WriteFile() = %v, want nil", err)
+	}
+	w, err := New(Config{Dir: "/spool", Interval: time.Second, Soft: 80, Hard: 95, MarkerFile: marker})
+	if err != nil {
+		t.Fatalf("New() = %v, want nil", err)
+	}
+	tests := []struct {
+		name        string
+		usage       Usage
+		err         error
+		wantLevel   Level
+		wantChanged bool
+		wantErr     error
+	}{
+		{name: "normal", usage: Usage{Bytes: 100, FreeBytes: 50, Inodes: 100, FreeInodes: 50}, wantLevel: LevelNormal, wantChanged: true},
+		{name: "still normal", usage: Usage{Bytes: 100, FreeBytes: 30, Inodes: 100, FreeInodes: 50}, wantLevel: LevelNormal},
+		{name: "soft from inodes", usage: Usage{Bytes: 100, FreeBytes: 50, Inodes: 100, FreeInodes: 10}, wantLevel: LevelSoft, wantChanged: true},
+		{name: "hard", usage: Usage{Bytes: 100, FreeBytes: 2, Inodes: 100, FreeInodes: 10}, wantLevel: LevelHard, wantChanged: true},
+		{name: "statfs fails", err: errStatfs, wantLevel: LevelNormal, wantErr: ErrStatfs},
+		{name: "back to normal", usage: Usage{Bytes: 100, FreeBytes: 50, Inodes: 100, FreeInodes: 50}, wantLevel: LevelNormal, wantChanged: true},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		statfs = func(string) (Usage, error) { return test.usage, test.err }
+		prevLevel := w.Level()
+		level, changed, err := w.Check()
+		if !errors.Is(err, test.wantErr) || level != test.wantLevel || changed != test.wantChanged {
+			t.Fatalf("Check() = %v, %v, %v, want %v, %v, %v", level, changed, err, test.wantLevel, test.wantChanged, test.wantErr)
+		}
+		if err != nil {
+			if w.Level() != prevLevel {
+				t.Fatalf("Level() = %v, want %v after failed check", w.Level(), prevLevel)
+			}
+			continue
+		}
+		if w.Usage() != test.usage {
+			t.Fatalf("Usage() = %+v, want %+v", w.Usage(), test.usage)
+		}
+		_, err = os.Stat(marker)
+		if exists := err == nil; exists != (level == LevelHard) {
+			t.Fatalf("marker file exists = %v, want %v", exists, level == LevelHard)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	saveStatfs := statfs
+	defer func() { statfs = saveStatfs }()
+
+	var mu sync.Mutex
+	usage := Usage{Bytes: 100, FreeBytes: 50}
+	statfs = func(string) (Usage, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return usage, nil
+	}
+	w, err := New(Config{Dir: "/spool", Interval: 10 * time.Millisecond, Soft: 80, Hard: 95})
+	if err != nil {
+		t.Fatalf("New() = %v, want nil", err)
+	}
+	levels := make(chan Level, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- w.Watch(ctx, func(level Level) { levels <- level })
+	}()
+	if level := <-levels; level != LevelNormal {
+		t.Fatalf("notify(%v), want %v", level, LevelNormal)
+	}
+	mu.Lock()
+	usage.FreeBytes = 10
+	mu.Unlock()
+	select {
+	case level := <-levels:
+		if level != LevelSoft {
+			t.Fatalf("notify(%v), want %v", level, LevelSoft)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("notify() not called")
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Watch() = %v, want nil", err)
+	}
+	if len(levels) != 0 {
+		t.Fatalf("notify() called %v more times, want 0", len(levels))
+	}
+}
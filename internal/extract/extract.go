@@ -0,0 +1,138 @@
+// Package extract implements the extraction of measurement data files
+// from the data bundles that jostler uploaded to GCS.
+//
+// The index bundle of a data bundle records where every file is in the
+// uncompressed data bundle (see api.IndexV1).  A file is extracted by
+// decompressing the data bundle up to the file's row without parsing the
+// rows before it and the file's contents are reconstructed exactly as
+// the measurement service wrote them.
+package extract
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/m-lab/jostler/api"
+	"github.com/m-lab/jostler/internal/bundleio"
+	"github.com/m-lab/jostler/internal/schema"
+)
+
+// Exported errors.
+var (
+	ErrDownload = bundleio.ErrDownload
+	ErrCorrupt  = bundleio.ErrCorrupt
+	ErrNotFound = errors.New("not found in bundle")
+)
+
+// row defines the fields of a row of a data bundle that are needed to
+// extract its file.
+type row struct {
+	Archiver struct {
+		Filename string
+	}
+	Raw json.RawMessage
+}
+
+// Entry returns the entry of the given file in the given index bundle
+// or, if filename is empty, the entry at the given line number of the
+// index bundle starting at 1.  Index and data bundles list files in the
+// same order so the line number is also the row's line number in the
+// data bundle.
+func Entry(ctx context.Context, client schema.Downloader, indexObj, filename string, line int) (api.IndexV1, error) {
+	lines, err := bundleio.ReadLines(ctx, client, indexObj)
+	if err != nil {
+		return api.IndexV1{}, err
+	}
+	for i, b := range lines {
+		lineNum := i + 1
+		if filename == "" && lineNum != line {
+			continue
+		}
+		var entry api.IndexV1
+		if err := json.Unmarshal([]byte(b), &entry); err != nil {
+			return api.IndexV1{}, fmt.Errorf("%v: line %d: %v: %w", indexObj, lineNum, err, ErrCorrupt)
+		}
+		if filename == "" || entry.Filename == filename {
+			return entry, nil
+		}
+	}
+	if filename == "" {
+		return api.IndexV1{}, fmt.Errorf("%v: line %d: %w", indexObj, line, ErrNotFound)
+	}
+	return api.IndexV1{}, fmt.Errorf("%v: %v: %w", indexObj, filename, ErrNotFound)
+}
+
+// File returns the contents of the file of the given index entry in the
+// given data bundle exactly as the measurement service wrote it.
+//
+// If the entry does not record where the file is (i.e., the index bundle
+// was created before locations were recorded), the file is found by its
+// filename and its contents are returned without a trailing newline
+// because whether the file had one was not recorded.
+func File(ctx context.Context, client schema.Downloader, dataObj string, entry api.IndexV1) ([]byte, error) {
+	r, err := bundleio.Open(ctx, client, dataObj)
+	if err != nil {
+		return nil, err
+	}
+	if entry.RawSize == 0 {
+		return scanFile(r, dataObj, entry.Filename)
+	}
+	if entry.Offset < 0 || entry.Size < 0 || entry.RawOffset < 0 || entry.RawOffset+entry.RawSize > entry.Size {
+		return nil, fmt.Errorf("%v: line %d: invalid location: %w", dataObj, entry.Line, ErrCorrupt)
+	}
+	if _, err := io.CopyN(io.Discard, r, int64(entry.Offset)); err != nil {
+		return nil, fmt.Errorf("%v: offset %d: %v: %w", dataObj, entry.Offset, err, ErrCorrupt)
+	}
+	line := make([]byte, entry.Size)
+	if _, err := io.ReadFull(r, line); err != nil {
+		return nil, fmt.Errorf("%v: line %d: %v: %w", dataObj, entry.Line, err, ErrCorrupt)
+	}
+	var rw row
+	if err := json.Unmarshal(line, &rw); err != nil || rw.Archiver.Filename != entry.Filename {
+		return nil, fmt.Errorf("%v: line %d is not %v: %w", dataObj, entry.Line, entry.Filename, ErrCorrupt)
+	}
+	contents := line[entry.RawOffset : entry.RawOffset+entry.RawSize]
+	// Only a trailing newline is removed from files when they are
+	// added to bundles.
+	if entry.FileSize == entry.RawSize+1 {
+		contents = append(contents, '\n')
+	}
+	return contents, nil
+}
+
+// scanFile scans the rows of the given decompressed data bundle for the
+// given file and returns its contents.
+func scanFile(r io.Reader, dataObj, filename string) ([]byte, error) {
+	// Rows that do not include the filename as a JSON string cannot
+	// be of the file and are not parsed.
+	quoted, err := json.Marshal(filename)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", filename, err)
+	}
+	br := bufio.NewReader(r)
+	for lineNum := 1; ; lineNum++ {
+		b, err := br.ReadBytes('\n')
+		if len(b) == 0 && errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%v: %v: %w", dataObj, err, ErrCorrupt)
+		}
+		if !bytes.Contains(b, quoted) {
+			continue
+		}
+		var rw row
+		if err := json.Unmarshal(b, &rw); err != nil {
+			return nil, fmt.Errorf("%v: line %d: %v: %w", dataObj, lineNum, err, ErrCorrupt)
+		}
+		if rw.Archiver.Filename == filename {
+			return rw.Raw, nil
+		}
+	}
+	return nil, fmt.Errorf("%v: %v: %w", dataObj, filename, ErrNotFound)
+}
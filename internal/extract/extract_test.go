@@ -0,0 +1,161 @@
+package extract_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/jostler/api"
+	"github.com/m-lab/jostler/internal/extract"
+	"github.com/m-lab/jostler/internal/naming"
+	"github.com/m-lab/jostler/internal/testhelper"
+	"github.com/m-lab/jostler/internal/testhelper/testbundles"
+	"github.com/m-lab/jostler/internal/testhelper/testfiles"
+)
+
+func TestExtract(t *testing.T) {
+	// Measurement data files with and without trailing newlines and
+	// with whitespace that should be preserved.
+	contents := []string{"{\"Field1\": 1}\n", ` {"Field1":  2, "Field2": "x"} `, "[3]\n"}
+	jb := testbundles.New(t, testbundles.Config{
+		Bucket:        "some-bucket",
+		HomeDir:       filepath.Join(t.TempDir(), "autoload/v1"),
+		DataTemplate:  naming.MustParse(naming.DefaultData),
+		IndexTemplate: naming.MustParse(naming.DefaultIndex),
+		Vars:          naming.Vars{Experiment: "jostler", Datatype: "foo1"},
+		SpoolDir:      t.TempDir(),
+	}, testbundles.Bundle{Timestamp: "20230404T101010.000000Z", Files: []string{"1.json", "2.json", "3.json"}, Contents: contents})
+	testbundles.Write(t, jb)
+	names := jb.IndexFilenames()
+	files := map[string]string{}
+	for i, name := range names {
+		files[name] = contents[i]
+	}
+	dataObj := testbundles.DataObject(jb)
+	indexObj := testbundles.IndexObject(jb)
+	// An index bundle created before the locations of files were
+	// recorded.
+	oldIndexObj := filepath.Join(jb.IndexDir, "old-"+jb.IndexName)
+	oldIndex := make([]string, len(jb.Index))
+	for i, entry := range jb.Index {
+		oldIndex[i] = `{"Filename":"` + entry.Filename + `","Size":0,"TimeAdded":""}`
+	}
+	testfiles.WriteGzip(t, oldIndexObj, []byte(strings.Join(oldIndex, "\n")))
+	corruptObj := filepath.Join(jb.BundleDir, "corrupt-"+jb.BundleName)
+	if err := os.WriteFile(corruptObj, []byte("not compressed"), 0o666); err != nil {
+		t.Fatalf("os.WriteFile() = %v, want nil", err)
+	}
+
+	tests := []struct {
+		name         string
+		bucket       string
+		indexObj     string
+		dataObj      string
+		filename     string
+		line         int
+		wantEntryErr error
+		wantErr      error
+		want         string
+	}{
+		{
+			name:     "file with newline",
+			bucket:   "newclient,download",
+			indexObj: indexObj, dataObj: dataObj,
+			filename: names[0],
+			want:     files[names[0]],
+		},
+		{
+			name:     "file without newline",
+			bucket:   "newclient,download",
+			indexObj: indexObj, dataObj: dataObj,
+			filename: names[1],
+			want:     files[names[1]],
+		},
+		{
+			name:     "line",
+			bucket:   "newclient,download",
+			indexObj: indexObj, dataObj: dataObj,
+			line: 3,
+			want: files[names[2]],
+		},
+		{
+			name:     "old index",
+			bucket:   "newclient,download",
+			indexObj: oldIndexObj, dataObj: dataObj,
+			filename: names[1],
+			want:     strings.TrimSpace(files[names[1]]),
+		},
+		{
+			name:     "file not found",
+			bucket:   "newclient,download",
+			indexObj: indexObj, dataObj: dataObj,
+			filename:     filepath.Join(filepath.Dir(names[0]), "4.json"),
+			wantEntryErr: extract.ErrNotFound,
+		},
+		{
+			name:     "line not found",
+			bucket:   "newclient,download",
+			indexObj: indexObj, dataObj: dataObj,
+			line:         4,
+			wantEntryErr: extract.ErrNotFound,
+		},
+		{
+			name:     "corrupt data bundle",
+			bucket:   "newclient,download",
+			indexObj: indexObj, dataObj: corruptObj,
+			filename: names[0],
+			wantErr:  extract.ErrCorrupt,
+		},
+		{
+			name:     "download fails",
+			bucket:   "newclient,faildownload",
+			indexObj: indexObj, dataObj: dataObj,
+			filename:     names[0],
+			wantEntryErr: extract.ErrDownload,
+		},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		client, err := testhelper.NewClient(context.Background(), test.bucket)
+		if err != nil {
+			t.Fatalf("testhelper.NewClient() = %v, want nil", err)
+		}
+		entry, err := extract.Entry(context.Background(), client, test.indexObj, test.filename, test.line)
+		if !errors.Is(err, test.wantEntryErr) {
+			t.Fatalf("Entry() = %v, want %v", err, test.wantEntryErr)
+		}
+		if err != nil {
+			continue
+		}
+		got, err := extract.File(context.Background(), client, test.dataObj, entry)
+		if !errors.Is(err, test.wantErr) {
+			t.Fatalf("File() = %v, want %v", err, test.wantErr)
+		}
+		if err == nil && string(got) != test.want {
+			t.Fatalf("File() = %q, want %q", got, test.want)
+		}
+	}
+}
+
+// TestFileMismatch tests that an index entry that does not locate its
+// file is detected.
+func TestFileMismatch(t *testing.T) {
+	dataObj := filepath.Join(t.TempDir(), "data.jsonl.gz")
+	testfiles.WriteGzip(t, dataObj, []byte(`{"Archiver":{"Filename":"/a.json"},"Raw":{}}`+"\n"+`{"Archiver":{"Filename":"/b.json"},"Raw":{}}`))
+	client, err := testhelper.NewClient(context.Background(), "newclient,download")
+	if err != nil {
+		t.Fatalf("testhelper.NewClient() = %v, want nil", err)
+	}
+	entry := api.IndexV1{Filename: "/b.json", Size: 44, Line: 2, Offset: 0, RawOffset: 41, RawSize: 2, FileSize: 2}
+	if _, err := extract.File(context.Background(), client, dataObj, entry); !errors.Is(err, extract.ErrCorrupt) {
+		t.Fatalf("File() = %v, want %v", err, extract.ErrCorrupt)
+	}
+	entry.Offset = 45
+	got, err := extract.File(context.Background(), client, dataObj, entry)
+	if err != nil || string(got) != "{}" {
+		t.Fatalf("File() = %q, %v, want {}, nil", got, err)
+	}
+}
@@ -0,0 +1,180 @@
+// Package find implements searches of the index bundles that jostler
+// uploaded to GCS for the data bundles that contain given measurement
+// data files.
+//
+// Index bundles in a date range are downloaded in parallel and each
+// entry is matched against a filename pattern.  Since index and data
+// bundles list files in the same order, the line number of a matching
+// entry is also the row of the file in the data bundle.
+package find
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/civil"
+
+	"github.com/m-lab/jostler/api"
+	"github.com/m-lab/jostler/internal/bundleio"
+	"github.com/m-lab/jostler/internal/naming"
+	"github.com/m-lab/jostler/internal/schema"
+)
+
+// Config defines which index bundles to search and what to search for.
+type Config struct {
+	HomeDir       string           // home directory in the bucket (e.g., autoload/v1)
+	DataTemplate  *naming.Template // template of object names of data bundles
+	IndexTemplate *naming.Template // template of object names of index bundles
+	Vars          naming.Vars      // experiment, organization, and optionally datatype and node of the bundles
+	From          civil.Date       // date of the first partition to search
+	To            civil.Date       // date of the last partition to search
+	Pattern       string           // filename or path.Match pattern (of the base name if it has no slash)
+	Parallel      int              // maximum number of concurrent downloads
+}
+
+// Match describes a file found in an index bundle.
+type Match struct {
+	Filename   string `json:"filename"`
+	DataObject string `json:"dataObject"`       // object name of the data bundle of the file
+	Index      string `json:"index"`            // object name of the index bundle
+	Line       int    `json:"line"`             // row of the file in the data bundle starting at 1
+	Offset     int    `json:"offset,omitempty"` // byte offset of the row in the uncompressed data bundle (if recorded)
+	TimeAdded  string `json:"timeAdded"`
+}
+
+// IndexBundle is an index bundle to search.
+type IndexBundle struct {
+	Object string      // object name
+	Vars   naming.Vars // values of the variables in the object name
+}
+
+// Exported errors.
+var (
+	ErrPattern  = errors.New("invalid filename pattern")
+	ErrList     = errors.New("failed to list index bundles")
+	ErrDownload = bundleio.ErrDownload
+	ErrCorrupt  = bundleio.ErrCorrupt
+)
+
+// IndexBundles returns the index bundles that the given configuration
+// defines sorted by their object names.
+func IndexBundles(ctx context.Context, client schema.Lister, conf Config) ([]IndexBundle, error) {
+	objs, err := bundleio.List(ctx, client, conf.IndexTemplate.Matcher(conf.HomeDir, conf.Vars), conf.From, conf.To)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrList, err)
+	}
+	bundles := make([]IndexBundle, 0, len(objs))
+	for _, obj := range objs {
+		bundles = append(bundles, IndexBundle{Object: obj.Name, Vars: obj.Vars})
+	}
+	return bundles, nil
+}
+
+// Search downloads the given index bundles with at most conf.Parallel
+// concurrent downloads and returns the files that match conf.Pattern
+// sorted by index bundle and line number.  It returns an error if an
+// index bundle cannot be downloaded or parsed, in which case the search
+// is incomplete.
+func Search(ctx context.Context, client schema.Downloader, conf Config, bundles []IndexBundle) ([]Match, error) {
+	if _, err := path.Match(conf.Pattern, ""); err != nil || conf.Pattern == "" {
+		return nil, fmt.Errorf("%q: %w", conf.Pattern, ErrPattern)
+	}
+	parallel := conf.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Workers take index bundles from the work channel and store their
+	// matches in the slot of the bundle so the results are in order.
+	results := make([][]Match, len(bundles))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				matches, err := searchBundle(ctx, client, conf, bundles[i])
+				if err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					continue
+				}
+				results[i] = matches
+			}
+		}()
+	}
+	for i := range bundles {
+		select {
+		case work <- i:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(work)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	matches := []Match{}
+	for _, m := range results {
+		matches = append(matches, m...)
+	}
+	return matches, nil
+}
+
+// searchBundle downloads the given index bundle and returns its files
+// that match the configured pattern.
+func searchBundle(ctx context.Context, client schema.Downloader, conf Config, bundle IndexBundle) ([]Match, error) {
+	lines, err := bundleio.ReadLines(ctx, client, bundle.Object)
+	if err != nil {
+		return nil, err
+	}
+	var matches []Match
+	for i, line := range lines {
+		lineNum := i + 1
+		var entry api.IndexV1
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return nil, fmt.Errorf("%v: line %d: %v: %w", bundle.Object, lineNum, err, ErrCorrupt)
+		}
+		if !match(conf.Pattern, entry.Filename) {
+			continue
+		}
+		matches = append(matches, Match{
+			Filename:   entry.Filename,
+			DataObject: conf.DataTemplate.Join(conf.HomeDir, bundle.Vars),
+			Index:      bundle.Object,
+			Line:       lineNum,
+			Offset:     entry.Offset,
+			TimeAdded:  entry.TimeAdded,
+		})
+	}
+	return matches, nil
+}
+
+// match returns true if the given filename matches the given pattern.
+// Patterns without a slash are matched against the base name of the
+// filename.
+func match(pattern, filename string) bool {
+	if !strings.Contains(pattern, "/") {
+		filename = path.Base(filename)
+	}
+	matched, _ := path.Match(pattern, filename)
+	return matched
+}
@@ -0,0 +1,175 @@
+package find_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/civil"
+
+	"github.com/m-lab/jostler/internal/find"
+	"github.com/m-lab/jostler/internal/naming"
+	"github.com/m-lab/jostler/internal/testhelper"
+	"github.com/m-lab/jostler/internal/testhelper/testbundles"
+	"github.com/m-lab/jostler/internal/testhelper/testfiles"
+)
+
+// index defines an index bundle to create for tests.
+type index struct {
+	timestamp string   // timestamp of the bundle in its object name
+	date      string   // date of the bundle's partition in its object name
+	machine   string   // machine in the object name
+	files     []string // files in the index bundle
+	corrupt   bool     // if true, the index bundle is not compressed
+}
+
+func TestFind(t *testing.T) {
+	spoolDir := t.TempDir()
+	indexes := []index{
+		{timestamp: "20230404T101010.000000Z", date: "2023/04/04", machine: "mlab1", files: []string{"a.json", "b.json", "c.json"}},
+		{timestamp: "20230404T111111.000000Z", date: "2023/04/04", machine: "mlab2", files: []string{"b.json"}},
+		{timestamp: "20230405T101010.000000Z", date: "2023/04/05", machine: "mlab1", files: []string{"b.json", "d.json"}},
+		{timestamp: "20230406T101010.000000Z", date: "2023/04/06", machine: "mlab1", files: []string{"b.json"}},
+	}
+	tests := []struct {
+		name     string
+		bucket   string
+		indexes  []index
+		machine  string
+		pattern  string
+		parallel int
+		wantErr  error
+		want     []string // data bundle timestamp and line of each match
+	}{
+		{
+			name:     "filename",
+			bucket:   "newclient,download,list",
+			indexes:  indexes,
+			pattern:  filepath.Join(spoolDir, "2023/04/04/b.json"),
+			parallel: 4,
+			want:     []string{"20230404T101010.000000Z:2", "20230404T111111.000000Z:1"},
+		},
+		{
+			name:     "base name",
+			bucket:   "newclient,download,list",
+			indexes:  indexes,
+			pattern:  "b.json",
+			parallel: 1,
+			want:     []string{"20230404T101010.000000Z:2", "20230404T111111.000000Z:1", "20230405T101010.000000Z:1"},
+		},
+		{
+			name:     "pattern and node",
+			bucket:   "newclient,download,list",
+			indexes:  indexes,
+			machine:  "mlab1",
+			pattern:  "[bd].json",
+			parallel: 2,
+			want:     []string{"20230404T101010.000000Z:2", "20230405T101010.000000Z:1", "20230405T101010.000000Z:2"},
+		},
+		{
+			name:     "no match",
+			bucket:   "newclient,download,list",
+			indexes:  indexes,
+			pattern:  filepath.Join(spoolDir, "2023/04/06/*"),
+			parallel: 2,
+			want:     []string{},
+		},
+		{
+			name:    "invalid pattern",
+			bucket:  "newclient,download,list",
+			indexes: indexes,
+			pattern: "[",
+			wantErr: find.ErrPattern,
+		},
+		{
+			name:     "corrupt",
+			bucket:   "newclient,download,list",
+			indexes:  append([]index{{timestamp: "20230404T121212.000000Z", date: "2023/04/04", machine: "mlab1", corrupt: true}}, indexes...),
+			pattern:  "b.json",
+			parallel: 2,
+			wantErr:  find.ErrCorrupt,
+		},
+		{
+			name:     "download fails",
+			bucket:   "newclient,faildownload,list",
+			indexes:  indexes,
+			pattern:  "b.json",
+			parallel: 2,
+			wantErr:  find.ErrDownload,
+		},
+		{
+			name:    "list fails",
+			bucket:  "newclient,download,faillist",
+			indexes: indexes,
+			pattern: "b.json",
+			wantErr: find.ErrList,
+		},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		conf := find.Config{
+			HomeDir:       filepath.Join(t.TempDir(), "autoload/v1"),
+			DataTemplate:  naming.MustParse(naming.DefaultData),
+			IndexTemplate: naming.MustParse(naming.DefaultIndex),
+			Vars:          naming.Vars{Experiment: "jostler", Machine: test.machine},
+			From:          civil.Date{Year: 2023, Month: time.April, Day: 4},
+			To:            civil.Date{Year: 2023, Month: time.April, Day: 5},
+			Pattern:       test.pattern,
+			Parallel:      test.parallel,
+		}
+		for _, idx := range test.indexes {
+			writeIndex(t, conf, spoolDir, idx)
+		}
+		client, err := testhelper.NewClient(context.Background(), test.bucket)
+		if err != nil {
+			t.Fatalf("testhelper.NewClient() = %v, want nil", err)
+		}
+		bundles, err := find.IndexBundles(context.Background(), client, conf)
+		if err == nil {
+			var matches []find.Match
+			matches, err = find.Search(context.Background(), client, conf, bundles)
+			if err == nil {
+				got := []string{}
+				for _, m := range matches {
+					if !strings.HasPrefix(m.DataObject, conf.HomeDir+"/jostler/foo1/") || !strings.HasSuffix(m.DataObject, "-data.jsonl.gz") {
+						t.Fatalf("Search() data object = %v, want data bundle", m.DataObject)
+					}
+					got = append(got, fmt.Sprintf("%v:%d", strings.SplitN(filepath.Base(m.DataObject), "-", 2)[0], m.Line))
+				}
+				if strings.Join(got, ",") != strings.Join(test.want, ",") {
+					t.Fatalf("Search() = %v, want %v", got, test.want)
+				}
+			}
+		}
+		if !errors.Is(err, test.wantErr) {
+			t.Fatalf("IndexBundles() or Search() = %v, want %v", err, test.wantErr)
+		}
+	}
+}
+
+// writeIndex writes the given index bundle of files in the given spool
+// directory where the local disk storage client expects it.
+func writeIndex(t *testing.T, conf find.Config, spoolDir string, idx index) {
+	t.Helper()
+	jb := testbundles.New(t, testbundles.Config{
+		Bucket:        "bucket",
+		HomeDir:       conf.HomeDir,
+		DataTemplate:  conf.DataTemplate,
+		IndexTemplate: conf.IndexTemplate,
+		Vars:          naming.Vars{Experiment: "jostler", Datatype: "foo1"},
+		SpoolDir:      spoolDir,
+	}, testbundles.Bundle{Timestamp: idx.timestamp, Date: idx.date, Machine: idx.machine, Files: idx.files})
+	if !idx.corrupt {
+		testbundles.WriteIndex(t, jb)
+		return
+	}
+	contents, err := jb.MarshalIndex()
+	if err != nil {
+		t.Fatalf("jb.MarshalIndex() = %v, want nil", err)
+	}
+	testfiles.WriteFile(t, testbundles.IndexObject(jb), contents)
+}
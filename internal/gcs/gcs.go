@@ -10,10 +10,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
 )
 
 // StorageClient contains information needed to download from or
@@ -24,6 +27,10 @@ type StorageClient struct {
 	bucketHandle stiface.BucketHandle
 }
 
+// ErrGenerationMismatch means a conditional upload failed because the
+// object was changed by someone else since it was downloaded.
+var ErrGenerationMismatch = errors.New("object generation does not match")
+
 var (
 	downloadTimeout = 2 * time.Minute
 	uploadTimeout   = time.Hour // same as pusher
@@ -32,6 +39,8 @@ var (
 	errDownloadObject = errors.New("failed to download GCS object")
 	errUploadObject   = errors.New("failed to upload GCS object")
 	errCloseObject    = errors.New("failed to close GCS object")
+	errListObjects    = errors.New("failed to list GCS objects")
+	errDeleteObject   = errors.New("failed to delete GCS object")
 
 	// Testing and debugging support.
 	storageNewClient = storage.NewClient
@@ -69,8 +78,32 @@ func (s *StorageClient) Download(ctx context.Context, objPath string) ([]byte, e
 	verbose("downloading '%v:%v'", s.bucket, objPath)
 	storageCtx, storageCancel := context.WithTimeout(ctx, downloadTimeout)
 	defer storageCancel()
+	return s.read(storageCtx, s.bucketHandle.Object(objPath), objPath)
+}
+
+// DownloadWithGeneration downloads the specified object from GCS and
+// returns its contents and generation.  The generation can be passed to
+// UploadIfGeneration to make sure the object has not changed since it
+// was downloaded.
+func (s *StorageClient) DownloadWithGeneration(ctx context.Context, objPath string) ([]byte, int64, error) {
+	verbose("downloading '%v:%v' with generation", s.bucket, objPath)
+	storageCtx, storageCancel := context.WithTimeout(ctx, downloadTimeout)
+	defer storageCancel()
 	obj := s.bucketHandle.Object(objPath)
-	reader, err := obj.NewReader(storageCtx)
+	attrs, err := obj.Attrs(storageCtx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("'%v:%v': %w", s.bucket, objPath, err)
+	}
+	contents, err := s.read(storageCtx, obj.Generation(attrs.Generation), objPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	return contents, attrs.Generation, nil
+}
+
+// read reads the contents of the specified object.
+func (s *StorageClient) read(ctx context.Context, obj stiface.ObjectHandle, objPath string) ([]byte, error) {
+	reader, err := obj.NewReader(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("'%v:%v': %w", s.bucket, objPath, err)
 	}
@@ -90,20 +123,75 @@ func (s *StorageClient) Download(ctx context.Context, objPath string) ([]byte, e
 // canceled, the client is closed, or a non-transient error is received.
 func (s *StorageClient) Upload(ctx context.Context, objPath string, contents []byte) error {
 	verbose("uploading '%v:%v'", s.bucket, objPath)
-	obj := s.bucketHandle.Object(objPath)
+	return s.write(ctx, s.bucketHandle.Object(objPath), objPath, contents)
+}
+
+// UploadIfGeneration uploads the specified contents to GCS only if the
+// object's generation matches the specified generation.  A generation
+// of 0 means the object must not exist.  If the object has changed (or
+// was created), the upload fails with ErrGenerationMismatch.
+func (s *StorageClient) UploadIfGeneration(ctx context.Context, objPath string, contents []byte, generation int64) error {
+	verbose("uploading '%v:%v' if generation is %v", s.bucket, objPath, generation)
+	conds := storage.Conditions{GenerationMatch: generation}
+	if generation == 0 {
+		conds = storage.Conditions{DoesNotExist: true}
+	}
+	err := s.write(ctx, s.bucketHandle.Object(objPath).If(conds), objPath, contents)
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+		return fmt.Errorf("'%v:%v': %w", s.bucket, objPath, ErrGenerationMismatch)
+	}
+	return err
+}
+
+// write writes the specified contents to the specified object.
+func (s *StorageClient) write(ctx context.Context, obj stiface.ObjectHandle, objPath string, contents []byte) error {
 	storageCtx, storageCancel := context.WithTimeout(ctx, uploadTimeout)
 	defer storageCancel()
 	writer := obj.NewWriter(storageCtx)
 	for written := 0; written < len(contents); {
 		n, err := fmt.Fprint(writer, string(contents[written:]))
 		if err != nil {
-			return fmt.Errorf("%w: %v", errUploadObject, err)
+			return fmt.Errorf("%w: %w", errUploadObject, err)
 		}
 		written += n
 	}
 	if err := writer.Close(); err != nil {
-		return fmt.Errorf("%w: %v", errCloseObject, err)
+		return fmt.Errorf("%w: %w", errCloseObject, err)
 	}
 	verbose("successfully uploaded '%v:%v' to GCS %v bytes", s.bucket, objPath, len(contents))
 	return nil
 }
+
+// List returns the names of all objects in GCS whose names begin with
+// the specified prefix.
+func (s *StorageClient) List(ctx context.Context, prefix string) ([]string, error) {
+	verbose("listing '%v:%v'", s.bucket, prefix)
+	storageCtx, storageCancel := context.WithTimeout(ctx, downloadTimeout)
+	defer storageCancel()
+	it := s.bucketHandle.Objects(storageCtx, &storage.Query{Prefix: prefix})
+	var objPaths []string
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errListObjects, err)
+		}
+		objPaths = append(objPaths, attrs.Name)
+	}
+	verbose("'%v:%v' %v objects", s.bucket, prefix, len(objPaths))
+	return objPaths, nil
+}
+
+// Delete deletes the specified object from GCS.
+func (s *StorageClient) Delete(ctx context.Context, objPath string) error {
+	verbose("deleting '%v:%v'", s.bucket, objPath)
+	storageCtx, storageCancel := context.WithTimeout(ctx, downloadTimeout)
+	defer storageCancel()
+	if err := s.bucketHandle.Object(objPath).Delete(storageCtx); err != nil {
+		return fmt.Errorf("%w: '%v:%v': %w", errDeleteObject, s.bucket, objPath, err)
+	}
+	return nil
+}
@@ -5,11 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
@@ -89,6 +92,71 @@ func TestUploadFail(t *testing.T) {
 	}
 }
 
+func TestDownloadWithGeneration(t *testing.T) {
+	gcsClient := fakeGCSClient()
+	contents, generation, err := gcsClient.DownloadWithGeneration(context.Background(), "should-succeed")
+	if err != nil || string(contents) != "should-succeed" || generation != fakeGeneration {
+		t.Fatalf("DownloadWithGeneration() = %s, %v, %v, want should-succeed, %v, nil", contents, generation, err, fakeGeneration)
+	}
+
+	gcsClient = fakeGCSClient()
+	_, _, err = gcsClient.DownloadWithGeneration(context.Background(), "should-fail-attrs")
+	if !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Fatalf("DownloadWithGeneration() = %v, want %v", err, storage.ErrObjectNotExist)
+	}
+}
+
+func TestUploadIfGeneration(t *testing.T) {
+	tests := []struct {
+		generation int64
+		wantErr    error
+	}{
+		{generation: fakeGeneration, wantErr: nil},
+		{generation: 0, wantErr: nil},
+		{generation: fakeGeneration - 1, wantErr: ErrGenerationMismatch},
+	}
+	for _, test := range tests {
+		gcsClient := fakeGCSClient()
+		err := gcsClient.UploadIfGeneration(context.Background(), "upload-contents", []byte("contents"), test.generation)
+		if !errors.Is(err, test.wantErr) {
+			t.Fatalf("UploadIfGeneration(%v) = %v, want %v", test.generation, err, test.wantErr)
+		}
+	}
+}
+
+func TestListSucceed(t *testing.T) {
+	gcsClient := fakeGCSClient()
+	objPaths, err := gcsClient.List(context.Background(), "prefix/")
+	if err != nil {
+		t.Fatalf("List() = %v, want nil", err)
+	}
+	if len(objPaths) != 2 || objPaths[0] != "prefix/obj1" || objPaths[1] != "prefix/obj2" {
+		t.Fatalf("List() = %v, want [prefix/obj1 prefix/obj2]", objPaths)
+	}
+}
+
+func TestListFail(t *testing.T) {
+	gcsClient := fakeGCSClient()
+	_, err := gcsClient.List(context.Background(), "should-fail")
+	if !errors.Is(err, errListObjects) {
+		t.Fatalf("List() = %v, want %v", err, errListObjects)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	gcsClient := fakeGCSClient()
+	if err := gcsClient.Delete(context.Background(), "delete-object"); err != nil {
+		t.Fatalf("Delete() = %v, want nil", err)
+	}
+	err := gcsClient.Delete(context.Background(), "should-fail-delete")
+	if !errors.Is(err, errDeleteObject) || !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Fatalf("Delete() = %v, want %v", err, errDeleteObject)
+	}
+}
+
+// fakeGeneration is the generation of all objects in the fake bucket.
+const fakeGeneration = 42
+
 type fakeClient struct {
 	stiface.Client
 }
@@ -110,9 +178,52 @@ func (f fakeBucketHandle) Object(name string) stiface.ObjectHandle {
 	return fakeObjectHandle{name: name}
 }
 
+func (f fakeBucketHandle) Objects(ctx context.Context, q *storage.Query) stiface.ObjectIterator {
+	if q.Prefix == "should-fail" {
+		return &fakeObjectIterator{err: io.ErrUnexpectedEOF}
+	}
+	return &fakeObjectIterator{names: []string{q.Prefix + "obj1", q.Prefix + "obj2"}}
+}
+
+// Fake object iterator implementation.
+type fakeObjectIterator struct {
+	stiface.ObjectIterator
+	names []string
+	err   error
+}
+
+func (f *fakeObjectIterator) Next() (*storage.ObjectAttrs, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if len(f.names) == 0 {
+		return nil, iterator.Done
+	}
+	name := f.names[0]
+	f.names = f.names[1:]
+	return &storage.ObjectAttrs{Name: name}, nil
+}
+
 type fakeObjectHandle struct {
 	stiface.ObjectHandle
-	name string
+	name  string
+	conds *storage.Conditions
+}
+
+func (f fakeObjectHandle) Attrs(ctx context.Context) (*storage.ObjectAttrs, error) {
+	if f.name == "should-fail-attrs" {
+		return nil, storage.ErrObjectNotExist
+	}
+	return &storage.ObjectAttrs{Name: f.name, Generation: fakeGeneration}, nil
+}
+
+func (f fakeObjectHandle) Generation(gen int64) stiface.ObjectHandle {
+	return f
+}
+
+func (f fakeObjectHandle) If(conds storage.Conditions) stiface.ObjectHandle {
+	f.conds = &conds
+	return f
 }
 
 func (f fakeObjectHandle) NewReader(ctx context.Context) (stiface.Reader, error) {
@@ -122,8 +233,15 @@ func (f fakeObjectHandle) NewReader(ctx context.Context) (stiface.Reader, error)
 	return &fakeReader{data: []byte(f.name)}, nil
 }
 
+func (f fakeObjectHandle) Delete(ctx context.Context) error {
+	if f.name == "should-fail-delete" {
+		return storage.ErrObjectNotExist
+	}
+	return nil
+}
+
 func (f fakeObjectHandle) NewWriter(ctx context.Context) stiface.Writer {
-	return &fakeWriter{}
+	return &fakeWriter{conds: f.conds}
 }
 
 // Fake reader implementation.
@@ -154,12 +272,16 @@ type fakeWriter struct {
 	stiface.Writer
 	data  []byte
 	index int
+	conds *storage.Conditions
 }
 
 func (f *fakeWriter) Close() error {
 	if string(f.data) == "should-fail-close" {
 		return io.EOF
 	}
+	if f.conds != nil && !f.conds.DoesNotExist && f.conds.GenerationMatch != fakeGeneration {
+		return &googleapi.Error{Code: http.StatusPreconditionFailed}
+	}
 	return nil
 }
 
@@ -2,17 +2,21 @@
 package jsonlbundle
 
 import (
+	"compress/gzip"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path"
 	"strings"
 	"time"
 
+	"cloud.google.com/go/bigquery"
 	"cloud.google.com/go/civil"
 
 	"github.com/m-lab/jostler/api"
+	"github.com/m-lab/jostler/internal/naming"
 )
 
 // JSONLBundle defines a collection of JSON file contents (i.e.,
@@ -26,12 +30,52 @@ type JSONLBundle struct {
 	Timestamp  string        // bundle's in-memory creation time that serves as its identifier
 	Datatype   string        // bundle's datatype
 	Date       civil.Date    // date subdirectory of files in this bundle (yyyy/mm/dd)
+	Start      time.Time     // start time of the partition of files in this bundle
 	bucket     string        // GCS bucket
 	BundleDir  string        // GCS directory to upload this bundle to
 	BundleName string        // GCS object name of this bundle
 	IndexDir   string        // GCS directory to upload this bundle's index to
 	IndexName  string        // GCS object name of this bundle's index
 	Size       uint          // size of this bundle
+	StdCols    StdColsConfig // standard columns of lines in this bundle
+
+	// CompressedSize is an estimate of the size of this bundle after
+	// compression that is updated as files are added by compressing
+	// their lines if EstimateCompressedSize is true (it's zero
+	// otherwise).  The compressor is released when the bundle is
+	// sealed.
+	EstimateCompressedSize bool
+	CompressedSize         uint
+	gzipWriter             *gzip.Writer
+	gzipCounter            *byteCounter
+	gzipUnflushed          uint // bytes written to gzipWriter since it was last flushed
+}
+
+// byteCounter is an io.Writer that counts and discards bytes.
+type byteCounter struct {
+	n uint
+}
+
+// Write implements the io.Writer interface.
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.n += uint(len(p))
+	return len(p), nil
+}
+
+// StdColsConfig defines the version of standard columns of each line in
+// a bundle and the details that are only included in version 1.
+type StdColsConfig struct {
+	Version    string // version of standard columns (api.StdColsV0 if empty)
+	Node       string // node name (e.g., mlab1-lga01.mlab-sandbox.measurement-lab.org)
+	Machine    string // machine part of node name (e.g., mlab1)
+	Site       string // site part of node name (e.g., lga01)
+	Project    string // project part of node name (e.g., mlab-sandbox)
+	Experiment string // experiment name
+
+	// Full names of fields in the measurement data whose values are
+	// promoted to the id and a.TestTime standard columns (if any).
+	IDField       string
+	TestTimeField string
 }
 
 // Exported errors.
@@ -42,8 +86,13 @@ var (
 	ErrNotOneLine     = errors.New("is not one line")
 	ErrMarshalStdCols = errors.New("failed to marshal standard columns")
 	ErrMarshalIndex   = errors.New("failed to marshal index")
+	ErrStdColsVersion = errors.New("unsupported standard columns version")
 )
 
+// compressFlushSize is the number of bytes compressed between flushes of
+// the compressor that estimates the compressed size of a bundle.
+const compressFlushSize = 64 * 1024
+
 // Testing and debugging support.
 var verbose = func(fmt string, args ...interface{}) {}
 
@@ -53,28 +102,33 @@ func Verbose(v func(string, ...interface{})) {
 	verbose = v
 }
 
-// New returns a new instance of JSONLBundle.
+// New returns a new instance of JSONLBundle created at the given
+// timestamp (vars.Timestamp) for files in the given partition
+// (vars.Start).
 //
-// GCS object names of data bundles and index bundles follow the
-// following formats:
+// GCS object names of data bundles and index bundles are the given
+// templates expanded with the given variables under the given home
+// directory.  By default, they follow the following formats:
 //
-//	autoload/v1/<experiment>/<datatype>/<yyyy>/<mm>/<dd>/<timestamp>-<datatype>-<node>-<experiment>-data.jsonl
-//	|--------GCSConfig.DataDir--------|                                   |------GCSConfig.BaseID------|
-//	autoload/v1/<experiment>/index1/<yyyy>/<mm>/<dd>/<timestamp>-<datatype>-<node>-<experiment>-index1.jsonl
-//	|------GCSConfig.IndexDir-----|                                   |------GCSConfig.BaseID------|
-func New(bucket, gcsDataDir, gcsIndexDir, gcsBaseID, datatype string, date civil.Date) *JSONLBundle {
-	nowUTC := time.Now().UTC()
+//	autoload/v1/<experiment>/<datatype>/<yyyy>/<mm>/<dd>/<timestamp>-<datatype>-<machine>-<site>-<experiment>-data.jsonl.gz
+//	autoload/v1/<experiment>/index1/<yyyy>/<mm>/<dd>/<timestamp>-<datatype>-<machine>-<site>-<experiment>-index1.jsonl.gz
+//	|-gcsDataDir|
+func New(bucket, gcsDataDir string, dataTemplate, indexTemplate *naming.Template, vars naming.Vars) *JSONLBundle {
+	date := civil.DateOf(vars.Start)
+	dataObj := dataTemplate.Join(gcsDataDir, vars)
+	indexObj := indexTemplate.Join(gcsDataDir, vars)
 	return &JSONLBundle{
 		Lines:      []string{},
 		BadFiles:   []string{},
 		Index:      []api.IndexV1{},
-		Timestamp:  formatTimestamp(date, nowUTC),
-		Datatype:   datatype,
+		Timestamp:  formatTimestamp(date, vars.Timestamp),
+		Datatype:   vars.Datatype,
 		Date:       date,
-		BundleDir:  dirName(gcsDataDir, date),
-		BundleName: objectName(nowUTC, gcsBaseID, "data"),
-		IndexDir:   dirName(gcsIndexDir, date),
-		IndexName:  objectName(nowUTC, gcsBaseID, "index1"),
+		Start:      vars.Start,
+		BundleDir:  path.Dir(dataObj),
+		BundleName: path.Base(dataObj),
+		IndexDir:   path.Dir(indexObj),
+		IndexName:  path.Base(indexObj),
 		Size:       0,
 		bucket:     bucket,
 	}
@@ -105,34 +159,53 @@ func (jb *JSONLBundle) HasFile(fullPath string) bool {
 // the bundle by embedding it in the Raw field of M-Lab's standard columns.
 // It also adds an index describing the file to the bundle's index.
 func (jb *JSONLBundle) AddFile(fullPath, version, gitCommit string) error {
-	contents, err := readJSONFile(fullPath)
+	contents, fileSize, err := readJSONFile(fullPath)
 	if err != nil {
 		jb.BadFiles = append(jb.BadFiles, fullPath)
 		return err
 	}
-	stdCols := api.StandardColumnsV0{
-		Date: jb.Date,
-		Archiver: api.ArchiverV0{
-			Version:    version,
-			GitCommit:  gitCommit,
-			ArchiveURL: fmt.Sprintf("gs://%s/%s/%s", jb.bucket, jb.BundleDir, jb.BundleName),
-			Filename:   fullPath,
-		},
-		Raw: "", // placeholder for measurement data
+	nowUTC := time.Now().UTC()
+	stdCols, err := jb.standardColumns(fullPath, version, gitCommit, nowUTC)
+	if err != nil {
+		jb.BadFiles = append(jb.BadFiles, fullPath)
+		return err
+	}
+	promoted, err := jb.promotedColumns(fullPath, contents)
+	if err != nil {
+		jb.BadFiles = append(jb.BadFiles, fullPath)
+		return err
 	}
 	stdColsBytes, err := json.Marshal(stdCols)
 	if err != nil {
 		return fmt.Errorf("%v: %w", ErrMarshalStdCols, err)
 	}
-	// Replace the placeholder Raw with the actual measurement data.
-	line := strings.Replace(string(stdColsBytes), `"Raw":""`, `"Raw":`+contents, 1)
+	// Replace the placeholder Raw with the promoted columns (if any)
+	// and the actual measurement data.
+	stdColsStr := string(stdColsBytes)
+	idx := strings.Index(stdColsStr, `"Raw":""`)
+	before := stdColsStr[:idx]
+	if promoted != "" {
+		before += promoted + ","
+	}
+	before += `"Raw":`
+	line := before + contents + stdColsStr[idx+len(`"Raw":""`):]
+	// Lines are separated by newlines in the data bundle.
+	offset := int(jb.Size) + len(jb.Lines)
 	jb.Lines = append(jb.Lines, line)
+	if jb.EstimateCompressedSize {
+		jb.compress(line)
+	}
 
 	// Add the file to the bundle's index.
 	jb.Index = append(jb.Index, api.IndexV1{
 		Filename:  fullPath,
 		Size:      len(line),
-		TimeAdded: time.Now().UTC().Format("2006/01/02T150405.000000Z"),
+		TimeAdded: nowUTC.Format("2006/01/02T150405.000000Z"),
+		Line:      len(jb.Lines),
+		Offset:    offset,
+		RawOffset: len(before),
+		RawSize:   len(contents),
+		FileSize:  fileSize,
 	})
 
 	// Update bundle's size.
@@ -141,6 +214,85 @@ func (jb *JSONLBundle) AddFile(fullPath, version, gitCommit string) error {
 	return nil
 }
 
+// compress compresses the given line that was just added to the bundle
+// (together with the newline that separates it from the previous line)
+// and updates the bundle's estimated compressed size.  Lines that the
+// compressor may still be buffering count as uncompressed so the
+// estimate errs on the large side by at most compressFlushSize.
+func (jb *JSONLBundle) compress(line string) {
+	if jb.gzipWriter == nil {
+		jb.gzipCounter = &byteCounter{}
+		jb.gzipWriter = gzip.NewWriter(jb.gzipCounter)
+	} else {
+		line = "\n" + line
+	}
+	// Writing to a byteCounter never fails.
+	_, _ = jb.gzipWriter.Write([]byte(line))
+	jb.gzipUnflushed += uint(len(line))
+	if jb.gzipUnflushed >= compressFlushSize {
+		_ = jb.gzipWriter.Flush()
+		jb.gzipUnflushed = 0
+	}
+	jb.CompressedSize = jb.gzipCounter.n + jb.gzipUnflushed
+}
+
+// Seal releases the compressor that estimates the compressed size of
+// the bundle since no more files will be added to it.  CompressedSize
+// keeps its last estimate.
+func (jb *JSONLBundle) Seal() {
+	jb.gzipWriter = nil
+	jb.gzipCounter = nil
+	jb.gzipUnflushed = 0
+}
+
+// standardColumns returns the standard columns of the given file in the
+// version configured for the bundle with a placeholder Raw field.
+func (jb *JSONLBundle) standardColumns(fullPath, version, gitCommit string, nowUTC time.Time) (interface{}, error) {
+	archiveURL := fmt.Sprintf("gs://%s/%s/%s", jb.bucket, jb.BundleDir, jb.BundleName)
+	switch jb.StdCols.Version {
+	case "", api.StdColsV0:
+		return api.StandardColumnsV0{
+			Date: jb.Date,
+			Archiver: api.ArchiverV0{
+				Version:    version,
+				GitCommit:  gitCommit,
+				ArchiveURL: archiveURL,
+				Filename:   fullPath,
+			},
+			Raw: "", // placeholder for measurement data
+		}, nil
+	case api.StdColsV1:
+		fi, err := os.Stat(fullPath)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", err, ErrReadFile)
+		}
+		return api.StandardColumnsV1{
+			Date: jb.Date,
+			Archiver: api.ArchiverV1{
+				Version:    version,
+				GitCommit:  gitCommit,
+				ArchiveURL: archiveURL,
+				Filename:   fullPath,
+				Node:       nullString(jb.StdCols.Node),
+				Machine:    nullString(jb.StdCols.Machine),
+				Site:       nullString(jb.StdCols.Site),
+				Project:    nullString(jb.StdCols.Project),
+				Experiment: nullString(jb.StdCols.Experiment),
+				Datatype:   nullString(jb.Datatype),
+				FileMTime:  bigquery.NullTimestamp{Timestamp: fi.ModTime().UTC(), Valid: true},
+				BundleTime: bigquery.NullTimestamp{Timestamp: nowUTC, Valid: true},
+			},
+			Raw: "", // placeholder for measurement data
+		}, nil
+	}
+	return nil, fmt.Errorf("%v: %w", jb.StdCols.Version, ErrStdColsVersion)
+}
+
+// nullString returns a NULL string if s is empty.
+func nullString(s string) bigquery.NullString {
+	return bigquery.NullString{StringVal: s, Valid: s != ""}
+}
+
 // IndexFilenames returns all filenames in the index.
 func (jb *JSONLBundle) IndexFilenames() []string {
 	indexFilenames := make([]string, len(jb.Index))
@@ -181,24 +333,24 @@ func (jb *JSONLBundle) RemoveLocalFiles() {
 	}
 }
 
-// readJSONFile reads the specified file and returns its contents if it
-// is valid JSON.
-func readJSONFile(fullPath string) (string, error) {
+// readJSONFile reads the specified file and returns its contents
+// without the trailing newline (if any) and its size if it is valid JSON.
+func readJSONFile(fullPath string) (string, int, error) {
 	bytes, err := os.ReadFile(fullPath)
 	if err != nil {
-		return "", fmt.Errorf("%v: %w", err, ErrReadFile)
+		return "", 0, fmt.Errorf("%v: %w", err, ErrReadFile)
 	}
 	if len(bytes) == 0 {
-		return "", fmt.Errorf("%v: %w", fullPath, ErrEmptyFile)
+		return "", 0, fmt.Errorf("%v: %w", fullPath, ErrEmptyFile)
 	}
 	if !json.Valid(bytes) {
-		return "", fmt.Errorf("%v: %w", fullPath, ErrInvalidJSON)
+		return "", 0, fmt.Errorf("%v: %w", fullPath, ErrInvalidJSON)
 	}
 	contents := strings.TrimSuffix(string(bytes), "\n")
 	if strings.Count(contents, "\n") != 0 {
-		return "", fmt.Errorf("%v: %w", fullPath, ErrNotOneLine)
+		return "", 0, fmt.Errorf("%v: %w", fullPath, ErrNotOneLine)
 	}
-	return contents, nil
+	return contents, len(bytes), nil
 }
 
 // formatTimestamp returns a string of the form 2023/04/03/20230404T154435.729707Z,
@@ -207,13 +359,5 @@ func readJSONFile(fullPath string) (string, error) {
 // This is done to differentiate bundles created on the same day containing measurements
 // collected on different dates.
 func formatTimestamp(date civil.Date, now time.Time) string {
-	return fmt.Sprintf("%d/%02d/%02d/%s", date.Year, date.Month, date.Day, now.Format("20060102T150405.000000Z"))
-}
-
-func objectName(t time.Time, gcsBaseID, bundleType string) string {
-	return fmt.Sprintf("%s-%s-%s.jsonl.gz", t.Format("20060102T150405.000000Z"), gcsBaseID, bundleType)
-}
-
-func dirName(gcsDir string, date civil.Date) string {
-	return fmt.Sprintf("%s/%d/%02d/%02d", gcsDir, date.Year, date.Month, date.Day)
+	return fmt.Sprintf("%d/%02d/%02d/%s", date.Year, date.Month, date.Day, now.Format(naming.TimestampFormat))
 }
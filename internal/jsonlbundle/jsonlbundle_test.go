@@ -1,17 +1,21 @@
 package jsonlbundle
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
-	"reflect"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/civil"
 
 	"github.com/m-lab/jostler/api"
+	"github.com/m-lab/jostler/internal/naming"
 	"github.com/m-lab/jostler/internal/testhelper"
+	"github.com/m-lab/jostler/internal/testhelper/testfiles"
 )
 
 func TestVerbose(t *testing.T) {
@@ -20,34 +24,57 @@ func TestVerbose(t *testing.T) {
 
 func TestNew(t *testing.T) {
 	t.Parallel()
+	timestamp := time.Date(2022, time.November, 15, 1, 2, 3, 456789000, time.UTC)
 	tests := []struct {
-		gcsBucket   string
-		gcsDataDir  string
-		gcsIndexDir string
-		gcsBaseID   string
-		datatype    string
-		date        civil.Date
+		name          string
+		dataTemplate  string
+		indexTemplate string
+		vars          naming.Vars
+		wantBundle    string
+		wantIndex     string
 	}{
 		{
-			gcsBucket:   "some-bucket",
-			gcsDataDir:  "some/path/in/gcs",
-			gcsIndexDir: "some/path/in/gcs",
-			gcsBaseID:   "some-string",
-			datatype:    "some-datatype",
-			date:        civil.Date{Year: 2022, Month: time.November, Day: 14},
+			name:          "default templates",
+			dataTemplate:  naming.DefaultData,
+			indexTemplate: naming.DefaultIndex,
+			vars: naming.Vars{
+				Start:      time.Date(2022, time.November, 14, 0, 0, 0, 0, time.UTC),
+				Timestamp:  timestamp,
+				Machine:    "mlab1",
+				Site:       "lga01",
+				Experiment: "jostler",
+				Datatype:   "foo1",
+			},
+			wantBundle: "autoload/v1/jostler/foo1/2022/11/14/20221115T010203.456789Z-foo1-mlab1-lga01-jostler-data.jsonl.gz",
+			wantIndex:  "autoload/v1/jostler/index1/2022/11/14/20221115T010203.456789Z-foo1-mlab1-lga01-jostler-index1.jsonl.gz",
+		},
+		{
+			name:          "custom templates",
+			dataTemplate:  "{organization}/{datatype}/{yyyy}{mm}{dd}/{hh}/{node}-{experiment}-{timestamp}.jsonl.gz",
+			indexTemplate: "index/{organization}/{datatype}/{node}-{experiment}-{timestamp}.jsonl.gz",
+			vars: naming.Vars{
+				Start:        time.Date(2022, time.November, 14, 13, 0, 0, 0, time.UTC),
+				Timestamp:    timestamp,
+				Node:         "mlab1-lga01.mlab-sandbox.measurement-lab.org",
+				Experiment:   "jostler",
+				Datatype:     "foo1",
+				Organization: "someorg",
+			},
+			wantBundle: "autoload/v1/someorg/foo1/20221114/13/mlab1-lga01.mlab-sandbox.measurement-lab.org-jostler-20221115T010203.456789Z.jsonl.gz",
+			wantIndex:  "autoload/v1/index/someorg/foo1/mlab1-lga01.mlab-sandbox.measurement-lab.org-jostler-20221115T010203.456789Z.jsonl.gz",
 		},
 	}
 	for i, test := range tests {
-		test := test
-		t.Logf("%s>>> test %02d%s", testhelper.ANSIPurple, i, testhelper.ANSIEnd)
-		gotjb := New(test.gcsBucket, test.gcsDataDir, test.gcsIndexDir, test.gcsBaseID, test.datatype, test.date)
-		timestamp, err := time.Parse("2006/01/02/20060102T150405.000000Z", gotjb.Timestamp)
-		if err != nil {
-			t.Fatalf("time.Parse() = %v", err)
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		jb := New("some-bucket", "autoload/v1", naming.MustParse(test.dataTemplate), naming.MustParse(test.indexTemplate), test.vars)
+		if got := jb.BundleDir + "/" + jb.BundleName; got != test.wantBundle {
+			t.Fatalf("New() bundle = %v, want %v", got, test.wantBundle)
+		}
+		if got := jb.IndexDir + "/" + jb.IndexName; got != test.wantIndex {
+			t.Fatalf("New() index = %v, want %v", got, test.wantIndex)
 		}
-		wantjb := newJb(test.gcsBucket, test.gcsDataDir, test.gcsIndexDir, test.gcsBaseID, test.datatype, test.date, timestamp)
-		if !reflect.DeepEqual(gotjb, wantjb) {
-			t.Fatalf("New() = %+v, want %+v", gotjb, wantjb)
+		if jb.Timestamp != "2022/11/14/20221115T010203.456789Z" || jb.Datatype != test.vars.Datatype || jb.Date != civil.DateOf(test.vars.Start) {
+			t.Fatalf("New() = %+v, want timestamp, datatype, and date", jb)
 		}
 	}
 }
@@ -150,6 +177,142 @@ func TestAddFile(t *testing.T) {
 	}
 }
 
+func TestAddFileOffsets(t *testing.T) {
+	// A file without a trailing newline and with whitespace that
+	// should be preserved.
+	noNewline := filepath.Join(t.TempDir(), "foo1-no-newline.json")
+	if err := os.WriteFile(noNewline, []byte(` {"UUID":"5678",  "Result": 1} `), 0o666); err != nil {
+		t.Fatalf("os.WriteFile() = %v, want nil", err)
+	}
+	files := []string{"testdata/foo1-valid.json", noNewline, "testdata/foo1-valid.json"}
+	jb := newTestJb(time.Now().UTC())
+	jb.StdCols.IDField = "UUID"
+	for _, f := range files {
+		if err := jb.AddFile(f, "v0.1.2", "cafebabe"); err != nil {
+			t.Fatalf("jb.AddFile() = %v, want nil", err)
+		}
+	}
+	contents := strings.Join(jb.Lines, "\n")
+	for i, index := range jb.Index {
+		t.Logf("%s>>> test %02d %v %s", testhelper.ANSIPurple, i, index.Filename, testhelper.ANSIEnd)
+		if index.Line != i+1 {
+			t.Fatalf("index.Line = %v, want %v", index.Line, i+1)
+		}
+		line := contents[index.Offset : index.Offset+index.Size]
+		if line != jb.Lines[i] {
+			t.Fatalf("line at offset %v = %v, want %v", index.Offset, line, jb.Lines[i])
+		}
+		raw := line[index.RawOffset : index.RawOffset+index.RawSize]
+		if index.FileSize == index.RawSize+1 {
+			raw += "\n"
+		}
+		want, err := os.ReadFile(files[i])
+		if err != nil {
+			t.Fatalf("os.ReadFile() = %v, want nil", err)
+		}
+		if raw != string(want) || index.FileSize != len(want) {
+			t.Fatalf("raw = %q (file size %v), want %q", raw, index.FileSize, want)
+		}
+	}
+}
+
+func TestAddFileCompressedSize(t *testing.T) {
+	// The compressed size is not estimated unless asked for.
+	jb := newTestJb(time.Now().UTC())
+	if err := jb.AddFile("testdata/foo1-valid.json", "v0.1.2", "cafebabe"); err != nil {
+		t.Fatalf("jb.AddFile() = %v, want nil", err)
+	}
+	if jb.CompressedSize != 0 || jb.gzipWriter != nil {
+		t.Fatalf("jb.CompressedSize = %v, want 0 without a compressor", jb.CompressedSize)
+	}
+
+	jb = newTestJb(time.Now().UTC())
+	jb.EstimateCompressedSize = true
+	for i := 0; i < 1000; i++ {
+		if err := jb.AddFile("testdata/foo1-valid.json", "v0.1.2", "cafebabe"); err != nil {
+			t.Fatalf("jb.AddFile() = %v, want nil", err)
+		}
+	}
+	gzContents := testfiles.GzipBytes(t, []byte(strings.Join(jb.Lines, "\n")))
+	// Identical lines compress well but the estimate errs on the
+	// large side by up to compressFlushSize.
+	gzSize := uint(len(gzContents))
+	if jb.CompressedSize >= jb.Size/2 || jb.CompressedSize < gzSize || jb.CompressedSize > gzSize+compressFlushSize {
+		t.Fatalf("jb.CompressedSize = %v, want between %v and %v", jb.CompressedSize, gzSize, gzSize+compressFlushSize)
+	}
+	// Sealing the bundle releases the compressor but keeps the estimate.
+	compressedSize := jb.CompressedSize
+	jb.Seal()
+	if jb.gzipWriter != nil || jb.gzipCounter != nil || jb.CompressedSize != compressedSize {
+		t.Fatalf("jb.Seal() kept the compressor or changed jb.CompressedSize = %v, want %v", jb.CompressedSize, compressedSize)
+	}
+}
+
+func TestAddFileStdCols(t *testing.T) {
+	tests := []struct {
+		name     string
+		stdCols  StdColsConfig
+		wantErr  error
+		wantKeys []string // keys that should be in the archiver details
+		dontKeys []string // keys that should not be in the archiver details
+	}{
+		{
+			name:     "default version",
+			wantKeys: []string{"Version", "GitCommit", "ArchiveURL", "Filename"},
+			dontKeys: []string{"Node", "FileMTime"},
+		},
+		{
+			name: "version 1",
+			stdCols: StdColsConfig{
+				Version:    api.StdColsV1,
+				Node:       "mlab1-lga01.mlab-sandbox.measurement-lab.org",
+				Machine:    "mlab1",
+				Site:       "lga01",
+				Project:    "mlab-sandbox",
+				Experiment: "jostler",
+			},
+			wantKeys: []string{"Filename", "Node", "Machine", "Site", "Project", "Experiment", "Datatype", "FileMTime", "BundleTime"},
+		},
+		{
+			name:    "unsupported version",
+			stdCols: StdColsConfig{Version: "v99"},
+			wantErr: ErrStdColsVersion,
+		},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		jb := newTestJb(time.Now().UTC())
+		jb.StdCols = test.stdCols
+		gotErr := jb.AddFile("testdata/foo1-valid.json", "v0.1.2", "cafebabe")
+		if !errors.Is(gotErr, test.wantErr) {
+			t.Fatalf("jb.AddFile() = %v, want %v", gotErr, test.wantErr)
+		}
+		if test.wantErr != nil {
+			continue
+		}
+		var line struct {
+			Archiver map[string]interface{}
+			Raw      map[string]interface{}
+		}
+		if err := json.Unmarshal([]byte(jb.Lines[0]), &line); err != nil {
+			t.Fatalf("json.Unmarshal() = %v, want nil", err)
+		}
+		if line.Raw == nil {
+			t.Fatalf("jb.Lines[0] = %v, want raw data", jb.Lines[0])
+		}
+		for _, key := range test.wantKeys {
+			if v, ok := line.Archiver[key]; !ok || v == nil {
+				t.Fatalf("jb.Lines[0] = %v, want %v", jb.Lines[0], key)
+			}
+		}
+		for _, key := range test.dontKeys {
+			if _, ok := line.Archiver[key]; ok {
+				t.Fatalf("jb.Lines[0] = %v, don't want %v", jb.Lines[0], key)
+			}
+		}
+	}
+}
+
 func TestRemoveLocalFiles(t *testing.T) {
 	jb := newTestJb(time.Now().UTC())
 	fullPaths := []string{"testdata/fullpath1.json", "testdata/fullpath2.json"}
@@ -169,37 +332,13 @@ func TestRemoveLocalFiles(t *testing.T) {
 }
 
 func newTestJb(timestamp time.Time) *JSONLBundle {
-	gcsBucket := "some-bucket"
-	gcsDataDir := "some/path/in/gcs"
-	gcsIndexDir := "some/path/in/gcs"
-	gcsBaseID := "some-string"
-	datatype := "some-datatype"
-	date := civil.Date{Year: 2022, Month: time.November, Day: 14}
-	return newJb(gcsBucket, gcsDataDir, gcsIndexDir, gcsBaseID, datatype, date, timestamp)
-}
-
-func newJb(bucket, gcsDataDir, gcsIndexDir, gcsBaseID, datatype string, date civil.Date, timestamp time.Time) *JSONLBundle {
-	return &JSONLBundle{
-		Lines:      []string{},
-		BadFiles:   []string{},
-		Index:      []api.IndexV1{},
-		Timestamp:  formatTimestamp(date, timestamp),
-		Datatype:   datatype,
-		Date:       date,
-		BundleDir:  dirName(gcsDataDir, date),
-		BundleName: objectName(timestamp, gcsBaseID, "data"),
-		IndexDir:   dirName(gcsIndexDir, date),
-		IndexName:  objectName(timestamp, gcsBaseID, "index1"),
-		Size:       0,
-		bucket:     bucket,
-	}
-}
-
-func Test_dirName(t *testing.T) {
-	dir := "gs://bucket/autoload/v1/experiment/datatype"
-	date := civil.Date{Year: 2023, Month: 03, Day: 30}
-	want := dir + "/2023/03/30"
-	if got := dirName(dir, date); got != want {
-		t.Errorf("dirName() = %v, want %v", got, want)
+	vars := naming.Vars{
+		Start:      time.Date(2022, time.November, 14, 0, 0, 0, 0, time.UTC),
+		Timestamp:  timestamp,
+		Machine:    "mlab1",
+		Site:       "lga01",
+		Experiment: "jostler",
+		Datatype:   "some-datatype",
 	}
+	return New("some-bucket", "some/path/in/gcs", naming.MustParse(naming.DefaultData), naming.MustParse(naming.DefaultIndex), vars)
 }
@@ -0,0 +1,103 @@
+package jsonlbundle
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/civil"
+
+	"github.com/m-lab/jostler/api"
+)
+
+// ErrPromotedField means a field configured to be promoted to a standard
+// column (or to provide the date) is missing from the measurement data or
+// has the wrong type.
+var ErrPromotedField = errors.New("invalid promoted field")
+
+// promotedColumns returns the promoted columns of the given measurement
+// data in JSON format as a comma-separated list of JSON object members
+// (e.g., `"id":"1234","a":{"TestTime":"..."}`) or an empty string if the
+// bundle's datatype does not promote any columns.
+func (jb *JSONLBundle) promotedColumns(fullPath, contents string) (string, error) {
+	if jb.StdCols.IDField == "" && jb.StdCols.TestTimeField == "" {
+		return "", nil
+	}
+	var raw interface{}
+	if err := json.Unmarshal([]byte(contents), &raw); err != nil {
+		return "", fmt.Errorf("%v: %w", fullPath, ErrInvalidJSON)
+	}
+	promoted := api.PromotedColumns{}
+	if jb.StdCols.IDField != "" {
+		id, err := stringField(raw, jb.StdCols.IDField)
+		if err != nil {
+			return "", fmt.Errorf("%v: %w", fullPath, err)
+		}
+		promoted.ID = id
+	}
+	if jb.StdCols.TestTimeField != "" {
+		s, err := stringField(raw, jb.StdCols.TestTimeField)
+		if err != nil {
+			return "", fmt.Errorf("%v: %w", fullPath, err)
+		}
+		testTime, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return "", fmt.Errorf("%v: %v: not a timestamp: %w", fullPath, jb.StdCols.TestTimeField, ErrPromotedField)
+		}
+		promoted.A = &api.Summary{TestTime: testTime.UTC()}
+	}
+	promotedBytes, err := json.Marshal(promoted)
+	if err != nil {
+		return "", fmt.Errorf("%v: %w", ErrMarshalStdCols, err)
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(string(promotedBytes), "{"), "}"), nil
+}
+
+// stringField returns the non-empty string value of the given full field
+// name (e.g., "Meta.UUID") in the given JSON object.  Like BigQuery, it
+// matches field names case insensitively.
+func stringField(v interface{}, fullName string) (string, error) {
+	for _, name := range strings.Split(fullName, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("%v: missing: %w", fullName, ErrPromotedField)
+		}
+		v = nil
+		for key, value := range obj {
+			if strings.EqualFold(key, name) {
+				v = value
+				break
+			}
+		}
+	}
+	s, ok := v.(string)
+	if !ok || s == "" {
+		return "", fmt.Errorf("%v: missing or not a string: %w", fullName, ErrPromotedField)
+	}
+	return s, nil
+}
+
+// FieldTime returns the time of the given full field name (e.g.,
+// "Meta.StartTime") in the given measurement data in JSON format.  The
+// field's value should be an RFC 3339 timestamp, which is returned in
+// UTC, or a date (yyyy-mm-dd), whose midnight in UTC is returned.
+func FieldTime(contents []byte, fullName string) (time.Time, error) {
+	var raw interface{}
+	if err := json.Unmarshal(contents, &raw); err != nil {
+		return time.Time{}, fmt.Errorf("%v: %w", err, ErrInvalidJSON)
+	}
+	s, err := stringField(raw, fullName)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.UTC(), nil
+	}
+	date, err := civil.ParseDate(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%v: not a timestamp or date: %w", fullName, ErrPromotedField)
+	}
+	return date.In(time.UTC), nil
+}
@@ -0,0 +1,82 @@
+package jsonlbundle
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/jostler/internal/testhelper"
+)
+
+func TestPromotedColumns(t *testing.T) {
+	tests := []struct {
+		name          string
+		contents      string
+		idField       string
+		testTimeField string
+		wantErr       error
+		wantPromoted  string // promoted columns that should be in the line
+	}{
+		{
+			name:     "no promoted columns",
+			contents: `{"UUID":"1234"}`,
+		},
+		{
+			name:         "id",
+			contents:     `{"UUID":"1234"}`,
+			idField:      "UUID",
+			wantPromoted: `"id":"1234","Raw":`,
+		},
+		{
+			name:          "id and nested test time with different case",
+			contents:      `{"uuid":"1234","Meta":{"StartTime":"2023-01-02T03:04:05.5-05:00"}}`,
+			idField:       "UUID",
+			testTimeField: "meta.StartTime",
+			wantPromoted:  `"id":"1234","a":{"TestTime":"2023-01-02T08:04:05.5Z"},"Raw":`,
+		},
+		{
+			name:     "missing id",
+			contents: `{"Meta":{}}`,
+			idField:  "Meta.UUID",
+			wantErr:  ErrPromotedField,
+		},
+		{
+			name:     "id is not a string",
+			contents: `{"UUID":1234}`,
+			idField:  "UUID",
+			wantErr:  ErrPromotedField,
+		},
+		{
+			name:          "test time is not a timestamp",
+			contents:      `{"StartTime":"yesterday"}`,
+			testTimeField: "StartTime",
+			wantErr:       ErrPromotedField,
+		},
+	}
+	dir := t.TempDir()
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		file := filepath.Join(dir, "file.json")
+		if err := os.WriteFile(file, []byte(test.contents), 0o666); err != nil {
+			t.Fatalf("os.WriteFile() = %v, want nil", err)
+		}
+		jb := newTestJb(time.Now().UTC())
+		jb.StdCols = StdColsConfig{IDField: test.idField, TestTimeField: test.testTimeField}
+		gotErr := jb.AddFile(file, "v0.1.2", "cafebabe")
+		if !errors.Is(gotErr, test.wantErr) {
+			t.Fatalf("jb.AddFile() = %v, want %v", gotErr, test.wantErr)
+		}
+		if test.wantErr != nil {
+			if len(jb.BadFiles) != 1 {
+				t.Fatalf("jb.BadFiles = %v, want [%v]", jb.BadFiles, file)
+			}
+			continue
+		}
+		if !strings.Contains(jb.Lines[0], test.wantPromoted+test.contents) {
+			t.Fatalf("jb.Lines[0] = %v, want %v", jb.Lines[0], test.wantPromoted+test.contents)
+		}
+	}
+}
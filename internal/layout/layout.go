@@ -0,0 +1,149 @@
+// Package layout implements templates that describe the layout of
+// measurement data files under the local data directory of a datatype
+// (e.g., /var/spool/<experiment>/<datatype>).
+//
+// A template is a slash-separated relative pathname made of literal text
+// and the following placeholders:
+//
+//	{yyyy} four-digit year
+//	{mm}   two-digit month
+//	{dd}   two-digit day
+//	{hh}   two-digit hour (00-23)
+//	{name} filename (must be the last component)
+//
+// For example, "{yyyy}/{mm}/{dd}/{name}" (the default), "{yyyy}/{mm}/{dd}/{hh}/{name}",
+// "{yyyy}-{mm}-{dd}/{name}", and "{name}" (a flat directory).
+package layout
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/civil"
+)
+
+// Layout is a parsed layout template.
+type Layout struct {
+	template string         // template as specified
+	regex    *regexp.Regexp // regular expression that matches relative pathnames
+	hasDate  bool           // true if the template has {yyyy}, {mm}, and {dd}
+	hasHour  bool           // true if the template has {hh}
+}
+
+// DefaultTemplate is the layout template of M-Lab's conventions.
+const DefaultTemplate = "{yyyy}/{mm}/{dd}/{name}"
+
+// Exported errors.
+var (
+	ErrTemplate = errors.New("invalid layout template")
+	ErrNoMatch  = errors.New("does not match layout")
+)
+
+// placeholders maps placeholders to their regular expressions.
+var placeholders = map[string]string{
+	"{yyyy}": `(?P<yyyy>[0-9]{4})`,
+	"{mm}":   `(?P<mm>[0-9]{2})`,
+	"{dd}":   `(?P<dd>[0-9]{2})`,
+	"{hh}":   `(?P<hh>[0-9]{2})`,
+	"{name}": `(?P<name>[^/]+)`,
+}
+
+var placeholderRegex = regexp.MustCompile(`\{[a-z]*\}`)
+
+// Parse parses the given layout template.
+func Parse(template string) (*Layout, error) {
+	if template == "" || path.IsAbs(template) || path.Clean(template) != template {
+		return nil, fmt.Errorf("%q: must be a clean relative pathname: %w", template, ErrTemplate)
+	}
+	if !strings.HasSuffix(template, "/{name}") && template != "{name}" {
+		return nil, fmt.Errorf("%q: last component must be {name}: %w", template, ErrTemplate)
+	}
+	seen := map[string]bool{}
+	var expr strings.Builder
+	expr.WriteString("^")
+	prev := 0
+	for _, loc := range placeholderRegex.FindAllStringIndex(template, -1) {
+		placeholder := template[loc[0]:loc[1]]
+		re, ok := placeholders[placeholder]
+		if !ok {
+			return nil, fmt.Errorf("%q: unknown placeholder %v: %w", template, placeholder, ErrTemplate)
+		}
+		if seen[placeholder] {
+			return nil, fmt.Errorf("%q: duplicate placeholder %v: %w", template, placeholder, ErrTemplate)
+		}
+		seen[placeholder] = true
+		expr.WriteString(regexp.QuoteMeta(template[prev:loc[0]]))
+		expr.WriteString(re)
+		prev = loc[1]
+	}
+	expr.WriteString(regexp.QuoteMeta(template[prev:]))
+	expr.WriteString("$")
+	l := &Layout{
+		template: template,
+		regex:    regexp.MustCompile(expr.String()),
+		hasDate:  seen["{yyyy}"] && seen["{mm}"] && seen["{dd}"],
+		hasHour:  seen["{hh}"],
+	}
+	if !l.hasDate && (seen["{yyyy}"] || seen["{mm}"] || seen["{dd}"] || seen["{hh}"]) {
+		return nil, fmt.Errorf("%q: date placeholders must include all of {yyyy}, {mm}, and {dd}: %w", template, ErrTemplate)
+	}
+	return l, nil
+}
+
+// MustParse is like Parse but panics if the template cannot be parsed.
+func MustParse(template string) *Layout {
+	l, err := Parse(template)
+	if err != nil {
+		panic(err)
+	}
+	return l
+}
+
+// String returns the layout template.
+func (l *Layout) String() string {
+	return l.template
+}
+
+// HasDate returns true if pathnames in the layout include a date.
+func (l *Layout) HasDate() bool {
+	return l.hasDate
+}
+
+// HasHour returns true if pathnames in the layout include an hour.
+func (l *Layout) HasHour() bool {
+	return l.hasHour
+}
+
+// Match matches the given pathname relative to the data directory
+// against the layout and returns the time in UTC of the date and hour
+// in the pathname (if the layout has them).
+func (l *Layout) Match(relPath string) (time.Time, error) {
+	m := l.regex.FindStringSubmatch(relPath)
+	if m == nil {
+		return time.Time{}, fmt.Errorf("%v: %w %v", relPath, ErrNoMatch, l.template)
+	}
+	if !l.hasDate {
+		return time.Time{}, nil
+	}
+	group := func(name string) string {
+		return m[l.regex.SubexpIndex(name)]
+	}
+	date, err := civil.ParseDate(group("yyyy") + "-" + group("mm") + "-" + group("dd"))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%v: invalid date: %w %v", relPath, ErrNoMatch, l.template)
+	}
+	t := date.In(time.UTC)
+	if l.hasHour {
+		hh, _ := strconv.Atoi(group("hh"))
+		if hh > 23 {
+			return time.Time{}, fmt.Errorf("%v: invalid hour: %w %v", relPath, ErrNoMatch, l.template)
+		}
+		t = t.Add(time.Duration(hh) * time.Hour)
+	}
+	return t, nil
+}
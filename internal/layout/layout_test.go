@@ -0,0 +1,76 @@
+package layout_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/m-lab/jostler/internal/layout"
+	"github.com/m-lab/jostler/internal/testhelper"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		template string
+		wantErr  error
+		wantDate bool
+	}{
+		{template: layout.DefaultTemplate, wantDate: true},
+		{template: "{yyyy}/{mm}/{dd}/{hh}/{name}", wantDate: true},
+		{template: "{yyyy}-{mm}-{dd}/{name}", wantDate: true},
+		{template: "{name}", wantDate: false},
+		{template: "", wantErr: layout.ErrTemplate},
+		{template: "/{yyyy}/{mm}/{dd}/{name}", wantErr: layout.ErrTemplate},
+		{template: "{yyyy}/../{name}", wantErr: layout.ErrTemplate},
+		{template: "{yyyy}/{mm}/{dd}", wantErr: layout.ErrTemplate},
+		{template: "{name}/{yyyy}/{mm}/{dd}/{name}", wantErr: layout.ErrTemplate},
+		{template: "{yyyy}/{mm}/{day}/{name}", wantErr: layout.ErrTemplate},
+		{template: "{yyyy}/{mm}/{name}", wantErr: layout.ErrTemplate},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %q%s", testhelper.ANSIPurple, i, test.template, testhelper.ANSIEnd)
+		l, err := layout.Parse(test.template)
+		if !errors.Is(err, test.wantErr) {
+			t.Fatalf("layout.Parse() = %v, want %v", err, test.wantErr)
+		}
+		if err == nil && (l.HasDate() != test.wantDate || l.String() != test.template) {
+			t.Fatalf("layout.Parse() = %v, HasDate() = %v, want %v", l, l.HasDate(), test.wantDate)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	date := time.Date(2022, time.November, 9, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		template string
+		relPath  string
+		wantErr  error
+		wantTime time.Time
+	}{
+		{template: layout.DefaultTemplate, relPath: "2022/11/09/foo.json", wantTime: date},
+		{template: layout.DefaultTemplate, relPath: "2022/11/9/foo.json", wantErr: layout.ErrNoMatch},
+		{template: layout.DefaultTemplate, relPath: "2022/11/09/extra/foo.json", wantErr: layout.ErrNoMatch},
+		{template: layout.DefaultTemplate, relPath: "2022/13/09/foo.json", wantErr: layout.ErrNoMatch},
+		{template: "{yyyy}/{mm}/{dd}/{hh}/{name}", relPath: "2022/11/09/23/foo.json", wantTime: date.Add(23 * time.Hour)},
+		{template: "{yyyy}/{mm}/{dd}/{hh}/{name}", relPath: "2022/11/09/24/foo.json", wantErr: layout.ErrNoMatch},
+		{template: "{yyyy}-{mm}-{dd}/{name}", relPath: "2022-11-09/foo.json", wantTime: date},
+		{template: "{yyyy}-{mm}-{dd}/{name}", relPath: "2022/11/09/foo.json", wantErr: layout.ErrNoMatch},
+		{template: "data.{yyyy}{mm}{dd}/{name}", relPath: "data.20221109/foo.json", wantTime: date},
+		{template: "{name}", relPath: "foo.json"},
+		{template: "{name}", relPath: "2022/11/09/foo.json", wantErr: layout.ErrNoMatch},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %q %v%s", testhelper.ANSIPurple, i, test.template, test.relPath, testhelper.ANSIEnd)
+		l, err := layout.Parse(test.template)
+		if err != nil {
+			t.Fatalf("layout.Parse() = %v, want nil", err)
+		}
+		gotTime, err := l.Match(test.relPath)
+		if !errors.Is(err, test.wantErr) {
+			t.Fatalf("Match() = %v, want %v", err, test.wantErr)
+		}
+		if !gotTime.Equal(test.wantTime) {
+			t.Fatalf("Match() = %v, want %v", gotTime, test.wantTime)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+// Package naming implements templates of the GCS object names of data
+// bundles, index bundles, and table schemas.
+//
+// A template is a slash-separated pathname relative to the home directory
+// in the GCS bucket (e.g., autoload/v1) made of literal text and the
+// following variables:
+//
+//	{yyyy}         four-digit year of the bundle's files
+//	{mm}           two-digit month of the bundle's files
+//	{dd}           two-digit day of the bundle's files
+//	{hh}           two-digit hour of the bundle's files (00 for daily bundles)
+//	{min}          two-digit minute of the bundle's files (00 for daily and hourly bundles)
+//	{timestamp}    creation time of the bundle (e.g., 20230404T154435.729707Z)
+//	{node}         node name (e.g., mlab1-lga01.mlab-sandbox.measurement-lab.org)
+//	{machine}      machine part of node name (e.g., mlab1)
+//	{site}         site part of node name (e.g., lga01)
+//	{project}      project part of node name (e.g., mlab-sandbox)
+//	{experiment}   experiment name
+//	{datatype}     datatype name
+//	{organization} organization name (empty for autoload/v1 conventions)
+//
+// Empty path components (e.g., an empty {organization}) are removed.
+package naming
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/m-lab/go/host"
+)
+
+// Template is a parsed naming template.
+type Template struct {
+	template string          // template as specified
+	vars     map[string]bool // variables in the template
+}
+
+// Vars holds the values of template variables.
+type Vars struct {
+	Start        time.Time // start time of the partition of the bundle's files ({yyyy}, {mm}, {dd}, {hh}, {min})
+	Timestamp    time.Time // creation time of the bundle ({timestamp})
+	Node         string
+	Machine      string
+	Site         string
+	Project      string
+	Experiment   string
+	Datatype     string
+	Organization string
+}
+
+// Default templates follow M-Lab's conventions.
+const (
+	DefaultData   = "{organization}/{experiment}/{datatype}/{yyyy}/{mm}/{dd}/{timestamp}-{datatype}-{machine}-{site}-{experiment}-data.jsonl.gz"
+	DefaultIndex  = "{organization}/{experiment}/index1/{yyyy}/{mm}/{dd}/{timestamp}-{datatype}-{machine}-{site}-{experiment}-index1.jsonl.gz"
+	DefaultSchema = "tables/{experiment}/{datatype}.table.json"
+
+	// TimestampFormat is the format of {timestamp}.
+	TimestampFormat = "20060102T150405.000000Z"
+)
+
+// Exported errors.
+var (
+	ErrTemplate  = errors.New("invalid naming template")
+	ErrNotUnique = errors.New("naming template does not guarantee unique names")
+)
+
+var (
+	variableRegex = regexp.MustCompile(`\{[a-z]*\}`)
+	knownVars     = map[string]bool{
+		"{yyyy}": true, "{mm}": true, "{dd}": true, "{hh}": true, "{min}": true, "{timestamp}": true,
+		"{node}": true, "{machine}": true, "{site}": true, "{project}": true,
+		"{experiment}": true, "{datatype}": true, "{organization}": true,
+	}
+	// varPatterns are the regular expressions of the values of
+	// variables in object names.
+	varPatterns = map[string]string{
+		"{yyyy}": `\d{4}`, "{mm}": `\d{2}`, "{dd}": `\d{2}`, "{hh}": `\d{2}`, "{min}": `\d{2}`,
+		"{timestamp}": `\d{8}T\d{6}\.\d{6}Z`,
+	}
+)
+
+// Parse parses the given naming template.
+func Parse(template string) (*Template, error) {
+	if template == "" || strings.HasPrefix(template, "/") || strings.HasSuffix(template, "/") {
+		return nil, fmt.Errorf("%q: must be a relative object name: %w", template, ErrTemplate)
+	}
+	for _, component := range strings.Split(template, "/") {
+		if component == "." || component == ".." {
+			return nil, fmt.Errorf("%q: must not include %q: %w", template, component, ErrTemplate)
+		}
+	}
+	t := &Template{template: template, vars: map[string]bool{}}
+	for _, v := range variableRegex.FindAllString(template, -1) {
+		if !knownVars[v] {
+			return nil, fmt.Errorf("%q: unknown variable %v: %w", template, v, ErrTemplate)
+		}
+		t.vars[v] = true
+	}
+	return t, nil
+}
+
+// MustParse is like Parse but panics if the template cannot be parsed.
+func MustParse(template string) *Template {
+	t, err := Parse(template)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// String returns the template as specified.
+func (t *Template) String() string {
+	return t.template
+}
+
+// Resolution returns the shortest partition of bundles whose start
+// times the template can tell apart: a day if it has {yyyy}, {mm}, and
+// {dd}, an hour if it also has {hh}, and a minute if it also has {min}.
+// It returns zero if the template has no date.
+func (t *Template) Resolution() time.Duration {
+	switch {
+	case !t.vars["{yyyy}"] || !t.vars["{mm}"] || !t.vars["{dd}"]:
+		return 0
+	case t.vars["{hh}"] && t.vars["{min}"]:
+		return time.Minute
+	case t.vars["{hh}"]:
+		return time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// Expand returns the object name of the template with the given values
+// of its variables.
+func (t *Template) Expand(v Vars) string {
+	r := strings.NewReplacer(
+		"{yyyy}", v.Start.Format("2006"),
+		"{mm}", v.Start.Format("01"),
+		"{dd}", v.Start.Format("02"),
+		"{hh}", v.Start.Format("15"),
+		"{min}", v.Start.Format("04"),
+		"{timestamp}", v.Timestamp.Format(TimestampFormat),
+		"{node}", v.Node,
+		"{machine}", v.Machine,
+		"{site}", v.Site,
+		"{project}", v.Project,
+		"{experiment}", v.Experiment,
+		"{datatype}", v.Datatype,
+		"{organization}", v.Organization,
+	)
+	components := []string{}
+	for _, component := range strings.Split(r.Replace(t.template), "/") {
+		if component != "" {
+			components = append(components, component)
+		}
+	}
+	return strings.Join(components, "/")
+}
+
+// ValidateBundles validates that the given data and index templates
+// guarantee unique object names for every bundle of every node.  Both
+// templates must include {timestamp}, {experiment}, {datatype}, and the
+// node ({node} or both {machine} and {site}), and they must not expand
+// to the same object names.
+func ValidateBundles(data, index *Template) error {
+	for _, t := range []*Template{data, index} {
+		for _, v := range []string{"{timestamp}", "{experiment}", "{datatype}"} {
+			if !t.vars[v] {
+				return fmt.Errorf("%q: missing %v: %w", t, v, ErrNotUnique)
+			}
+		}
+		if !t.vars["{node}"] && !(t.vars["{machine}"] && t.vars["{site}"]) {
+			return fmt.Errorf("%q: missing {node} or {machine} and {site}: %w", t, ErrNotUnique)
+		}
+	}
+	v := Vars{Node: "node", Machine: "machine", Site: "site", Project: "project", Experiment: "experiment", Datatype: "datatype", Organization: "organization"}
+	if data.Expand(v) == index.Expand(v) {
+		return fmt.Errorf("%q and %q: data and index names are the same: %w", data, index, ErrNotUnique)
+	}
+	return nil
+}
+
+// ValidateSchema validates that the given table schema template
+// guarantees unique object names for every datatype.
+func ValidateSchema(schema *Template) error {
+	for _, v := range []string{"{experiment}", "{datatype}"} {
+		if !schema.vars[v] {
+			return fmt.Errorf("%q: missing %v: %w", schema, v, ErrNotUnique)
+		}
+	}
+	for v := range schema.vars {
+		switch v {
+		case "{experiment}", "{datatype}", "{organization}":
+		default:
+			return fmt.Errorf("%q: %v is not valid in table schema names: %w", schema, v, ErrTemplate)
+		}
+	}
+	return nil
+}
+
+// Join returns the object name of the template with the given values of
+// its variables under the given home directory.
+func (t *Template) Join(homeDir string, v Vars) string {
+	return path.Join(homeDir, t.Expand(v))
+}
+
+// Matcher matches object names against a template to recover the values
+// of its variables.
+type Matcher struct {
+	re     *regexp.Regexp
+	vars   []string // variable of each group of re
+	known  Vars
+	prefix string
+}
+
+// Matcher returns a matcher of the object names of the template under
+// the given home directory.  The node, machine, site, project,
+// experiment, and datatype variables that have values in known only
+// match these values.  {organization} always matches its value in known
+// and, as in Expand, a component that it leaves empty is removed.
+func (t *Template) Matcher(homeDir string, known Vars) *Matcher {
+	m := &Matcher{known: known}
+	var components []string
+	if homeDir = path.Clean(homeDir); homeDir != "." {
+		components = append(components, regexp.QuoteMeta(homeDir))
+	}
+	for _, component := range strings.Split(t.template, "/") {
+		var b strings.Builder
+		last := 0
+		for _, loc := range variableRegex.FindAllStringIndex(component, -1) {
+			b.WriteString(regexp.QuoteMeta(component[last:loc[0]]))
+			v := component[loc[0]:loc[1]]
+			if value, ok := known.value(v); ok {
+				b.WriteString(regexp.QuoteMeta(value))
+			} else {
+				pattern, ok := varPatterns[v]
+				if !ok {
+					pattern = `[^/]+`
+				}
+				b.WriteString("(" + pattern + ")")
+				m.vars = append(m.vars, v)
+			}
+			last = loc[1]
+		}
+		b.WriteString(regexp.QuoteMeta(component[last:]))
+		if b.Len() != 0 {
+			components = append(components, b.String())
+		}
+	}
+	expr := strings.Join(components, "/")
+	m.re = regexp.MustCompile("^" + expr + "$")
+	// Anchors hide the literal prefix of a regular expression.
+	m.prefix, _ = regexp.MustCompile(expr).LiteralPrefix()
+	return m
+}
+
+// value returns the value of the given variable if it is known.
+func (v Vars) value(name string) (string, bool) {
+	var value string
+	switch name {
+	case "{organization}":
+		return v.Organization, true
+	case "{node}":
+		value = v.Node
+	case "{machine}":
+		value = v.Machine
+	case "{site}":
+		value = v.Site
+	case "{project}":
+		value = v.Project
+	case "{experiment}":
+		value = v.Experiment
+	case "{datatype}":
+		value = v.Datatype
+	}
+	return value, value != ""
+}
+
+// Prefix returns the prefix of all object names that match (e.g., to
+// list them).
+func (m *Matcher) Prefix() string {
+	return m.prefix
+}
+
+// Match returns the values of the variables of the given object name
+// and true if it matches the template.  The start time is the earliest
+// time that the date variables in the name allow (e.g., midnight if the
+// template has no {hh}).  If {node} is in the name, the machine, site,
+// and project are also set from the node name when it can be parsed.
+func (m *Matcher) Match(objName string) (Vars, bool) {
+	groups := m.re.FindStringSubmatch(objName)
+	if groups == nil {
+		return Vars{}, false
+	}
+	values := make(map[string]string, len(m.vars))
+	for i, name := range m.vars {
+		if value, ok := values[name]; ok && value != groups[i+1] {
+			return Vars{}, false
+		}
+		values[name] = groups[i+1]
+	}
+	v := m.known
+	if yyyy, ok := values["{yyyy}"]; ok {
+		date := yyyy
+		for _, d := range []struct{ name, zero string }{{"{mm}", "01"}, {"{dd}", "01"}, {"{hh}", "00"}, {"{min}", "00"}} {
+			if value, ok := values[d.name]; ok {
+				date += value
+			} else {
+				date += d.zero
+			}
+		}
+		start, err := time.Parse("200601021504", date)
+		if err != nil {
+			return Vars{}, false
+		}
+		v.Start = start
+	}
+	if timestamp, ok := values["{timestamp}"]; ok {
+		ts, err := time.Parse(TimestampFormat, timestamp)
+		if err != nil {
+			return Vars{}, false
+		}
+		v.Timestamp = ts
+	}
+	for name, value := range values {
+		switch name {
+		case "{node}":
+			v.Node = value
+		case "{machine}":
+			v.Machine = value
+		case "{site}":
+			v.Site = value
+		case "{project}":
+			v.Project = value
+		case "{experiment}":
+			v.Experiment = value
+		case "{datatype}":
+			v.Datatype = value
+		}
+	}
+	if _, ok := values["{node}"]; ok {
+		if nameParts, err := host.Parse(v.Node); err == nil {
+			v.Machine, v.Site, v.Project = nameParts.Machine, nameParts.Site, nameParts.Project
+		}
+	}
+	return v, true
+}
@@ -0,0 +1,242 @@
+package naming_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/m-lab/jostler/internal/naming"
+	"github.com/m-lab/jostler/internal/testhelper"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		wantErr  error
+	}{
+		{name: "empty", template: "", wantErr: naming.ErrTemplate},
+		{name: "absolute", template: "/{experiment}/{timestamp}", wantErr: naming.ErrTemplate},
+		{name: "trailing slash", template: "{experiment}/{timestamp}/", wantErr: naming.ErrTemplate},
+		{name: "dot dot", template: "{experiment}/../{timestamp}", wantErr: naming.ErrTemplate},
+		{name: "unknown variable", template: "{experiment}/{date}/{timestamp}", wantErr: naming.ErrTemplate},
+		{name: "default data", template: naming.DefaultData},
+		{name: "default index", template: naming.DefaultIndex},
+		{name: "default schema", template: naming.DefaultSchema},
+		{name: "no variables", template: "some/object.json"},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		tmpl, err := naming.Parse(test.template)
+		if !errors.Is(err, test.wantErr) {
+			t.Fatalf("Parse() = %v, want %v", err, test.wantErr)
+		}
+		if err == nil && tmpl.String() != test.template {
+			t.Fatalf("Parse().String() = %v, want %v", tmpl, test.template)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	vars := naming.Vars{
+		Start:      time.Date(2023, time.April, 4, 13, 30, 0, 0, time.UTC),
+		Timestamp:  time.Date(2023, time.April, 5, 15, 44, 35, 729707000, time.UTC),
+		Node:       "mlab1-lga01.mlab-sandbox.measurement-lab.org",
+		Machine:    "mlab1",
+		Site:       "lga01",
+		Project:    "mlab-sandbox",
+		Experiment: "jostler",
+		Datatype:   "foo1",
+	}
+	tests := []struct {
+		name         string
+		template     string
+		organization string
+		want         string
+	}{
+		{
+			name:     "default data without organization",
+			template: naming.DefaultData,
+			want:     "jostler/foo1/2023/04/04/20230405T154435.729707Z-foo1-mlab1-lga01-jostler-data.jsonl.gz",
+		},
+		{
+			name:         "default index with organization",
+			template:     naming.DefaultIndex,
+			organization: "someorg",
+			want:         "someorg/jostler/index1/2023/04/04/20230405T154435.729707Z-foo1-mlab1-lga01-jostler-index1.jsonl.gz",
+		},
+		{
+			name:     "default schema",
+			template: naming.DefaultSchema,
+			want:     "tables/jostler/foo1.table.json",
+		},
+		{
+			name:     "minute",
+			template: "{datatype}/{yyyy}/{mm}/{dd}/{hh}{min}/{timestamp}.jsonl.gz",
+			want:     "foo1/2023/04/04/1330/20230405T154435.729707Z.jsonl.gz",
+		},
+		{
+			name:     "hour and project",
+			template: "{project}/{datatype}/{yyyy}{mm}{dd}T{hh}/{node}-{timestamp}.jsonl.gz",
+			want:     "mlab-sandbox/foo1/20230404T13/mlab1-lga01.mlab-sandbox.measurement-lab.org-20230405T154435.729707Z.jsonl.gz",
+		},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		v := vars
+		v.Organization = test.organization
+		if got := naming.MustParse(test.template).Expand(v); got != test.want {
+			t.Fatalf("Expand() = %v, want %v", got, test.want)
+		}
+	}
+	if got := naming.MustParse(naming.DefaultSchema).Join("autoload/v1", vars); got != "autoload/v1/tables/jostler/foo1.table.json" {
+		t.Fatalf("Join() = %v, want autoload/v1/tables/jostler/foo1.table.json", got)
+	}
+}
+
+func TestResolution(t *testing.T) {
+	tests := []struct {
+		template string
+		want     time.Duration
+	}{
+		{template: naming.DefaultData, want: 24 * time.Hour},
+		{template: "{experiment}/{datatype}/{yyyy}/{mm}/{dd}/{hh}/{timestamp}-{node}.jsonl.gz", want: time.Hour},
+		{template: "{experiment}/{datatype}/{yyyy}{mm}{dd}T{hh}{min}/{timestamp}-{node}.jsonl.gz", want: time.Minute},
+		{template: "{experiment}/{datatype}/{yyyy}/{mm}/{min}/{timestamp}-{node}.jsonl.gz", want: 0},
+		{template: "{experiment}/{datatype}/{timestamp}-{node}.jsonl.gz", want: 0},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.template, testhelper.ANSIEnd)
+		if got := naming.MustParse(test.template).Resolution(); got != test.want {
+			t.Fatalf("Resolution() = %v, want %v", got, test.want)
+		}
+	}
+}
+
+func TestValidateBundles(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		index   string
+		wantErr error
+	}{
+		{name: "defaults", data: naming.DefaultData, index: naming.DefaultIndex},
+		{name: "node", data: "{experiment}/{datatype}/{timestamp}-{node}-data.jsonl.gz", index: "{experiment}/{datatype}/{timestamp}-{node}-index.jsonl.gz"},
+		{name: "no timestamp", data: "{experiment}/{datatype}/{yyyy}/{mm}/{dd}/{node}.jsonl.gz", index: naming.DefaultIndex, wantErr: naming.ErrNotUnique},
+		{name: "no experiment", data: naming.DefaultData, index: "index1/{yyyy}/{mm}/{dd}/{timestamp}-{datatype}-{node}.jsonl.gz", wantErr: naming.ErrNotUnique},
+		{name: "no datatype", data: "{experiment}/{timestamp}-{node}.jsonl.gz", index: naming.DefaultIndex, wantErr: naming.ErrNotUnique},
+		{name: "machine without site", data: "{experiment}/{datatype}/{timestamp}-{machine}.jsonl.gz", index: naming.DefaultIndex, wantErr: naming.ErrNotUnique},
+		{name: "same names", data: naming.DefaultData, index: naming.DefaultData, wantErr: naming.ErrNotUnique},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		if err := naming.ValidateBundles(naming.MustParse(test.data), naming.MustParse(test.index)); !errors.Is(err, test.wantErr) {
+			t.Fatalf("ValidateBundles() = %v, want %v", err, test.wantErr)
+		}
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		wantErr  error
+	}{
+		{name: "default", template: naming.DefaultSchema},
+		{name: "organization", template: "{organization}/tables/{experiment}/{datatype}.table.json"},
+		{name: "no experiment", template: "tables/{datatype}.table.json", wantErr: naming.ErrNotUnique},
+		{name: "no datatype", template: "tables/{experiment}.table.json", wantErr: naming.ErrNotUnique},
+		{name: "node", template: "tables/{experiment}/{datatype}-{node}.table.json", wantErr: naming.ErrTemplate},
+		{name: "date", template: "tables/{yyyy}/{experiment}/{datatype}.table.json", wantErr: naming.ErrTemplate},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		if err := naming.ValidateSchema(naming.MustParse(test.template)); !errors.Is(err, test.wantErr) {
+			t.Fatalf("ValidateSchema() = %v, want %v", err, test.wantErr)
+		}
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	vars := naming.Vars{
+		Start:     time.Date(2023, time.April, 4, 0, 0, 0, 0, time.UTC),
+		Timestamp: time.Date(2023, time.April, 5, 15, 44, 35, 729707000, time.UTC),
+		Machine:   "mlab1",
+		Site:      "lga01",
+	}
+	tests := []struct {
+		name       string
+		template   string
+		known      naming.Vars
+		objName    string
+		wantPrefix string
+		wantMatch  bool
+	}{
+		{
+			name:       "default data",
+			template:   naming.DefaultData,
+			known:      naming.Vars{Experiment: "jostler", Datatype: "foo1"},
+			objName:    "autoload/v1/jostler/foo1/2023/04/04/20230405T154435.729707Z-foo1-mlab1-lga01-jostler-data.jsonl.gz",
+			wantPrefix: "autoload/v1/jostler/foo1/",
+			wantMatch:  true,
+		},
+		{
+			name:       "default index with organization",
+			template:   naming.DefaultIndex,
+			known:      naming.Vars{Experiment: "jostler", Organization: "someorg"},
+			objName:    "autoload/v1/someorg/jostler/index1/2023/04/04/20230405T154435.729707Z-foo1-mlab1-lga01-jostler-index1.jsonl.gz",
+			wantPrefix: "autoload/v1/someorg/jostler/index1/",
+			wantMatch:  true,
+		},
+		{
+			name:       "other datatype",
+			template:   naming.DefaultIndex,
+			known:      naming.Vars{Experiment: "jostler", Datatype: "foo2"},
+			objName:    "autoload/v1/jostler/index1/2023/04/04/20230405T154435.729707Z-foo1-mlab1-lga01-jostler-index1.jsonl.gz",
+			wantPrefix: "autoload/v1/jostler/index1/",
+		},
+		{
+			name:       "invalid date",
+			template:   naming.DefaultData,
+			known:      naming.Vars{Experiment: "jostler", Datatype: "foo1"},
+			objName:    "autoload/v1/jostler/foo1/2023/04/34/20230405T154435.729707Z-foo1-mlab1-lga01-jostler-data.jsonl.gz",
+			wantPrefix: "autoload/v1/jostler/foo1/",
+		},
+		{
+			name:       "inconsistent datatype",
+			template:   naming.DefaultData,
+			known:      naming.Vars{Experiment: "jostler"},
+			objName:    "autoload/v1/jostler/foo1/2023/04/04/20230405T154435.729707Z-foo2-mlab1-lga01-jostler-data.jsonl.gz",
+			wantPrefix: "autoload/v1/jostler/",
+		},
+		{
+			name:       "node",
+			template:   "{experiment}/{datatype}/{yyyy}{mm}{dd}/{node}-{timestamp}.jsonl.gz",
+			known:      naming.Vars{Experiment: "jostler", Datatype: "foo1"},
+			objName:    "autoload/v1/jostler/foo1/20230404/mlab1-lga01.mlab-sandbox.measurement-lab.org-20230405T154435.729707Z.jsonl.gz",
+			wantPrefix: "autoload/v1/jostler/foo1/",
+			wantMatch:  true,
+		},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		m := naming.MustParse(test.template).Matcher("autoload/v1", test.known)
+		if got := m.Prefix(); got != test.wantPrefix {
+			t.Fatalf("Prefix() = %v, want %v", got, test.wantPrefix)
+		}
+		got, ok := m.Match(test.objName)
+		if ok != test.wantMatch {
+			t.Fatalf("Match() = %v, want %v", ok, test.wantMatch)
+		}
+		if !ok {
+			continue
+		}
+		// The values of variables expand back to the object name.
+		if objName := naming.MustParse(test.template).Join("autoload/v1", got); objName != test.objName {
+			t.Fatalf("Join(Match()) = %v, want %v", objName, test.objName)
+		}
+		if !got.Start.Equal(vars.Start) || !got.Timestamp.Equal(vars.Timestamp) || got.Machine != vars.Machine || got.Site != vars.Site {
+			t.Fatalf("Match() = %+v, want %+v", got, vars)
+		}
+	}
+}
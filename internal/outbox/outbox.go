@@ -0,0 +1,516 @@
+// Package outbox implements a bounded queue of compressed bundles on the
+// local disk for when they cannot be uploaded to Google Cloud Storage
+// (GCS) (e.g., during a long network outage).
+//
+// Each entry of the outbox is a single file that holds all objects of a
+// bundle (i.e., the data bundle and its index bundle) so that the many
+// small files of a bundle in the spool directory are consolidated into
+// one.  Entries are uploaded (i.e., drained) in the order they were
+// added.  When adding an entry would exceed the maximum total size of
+// the outbox, either the oldest entries are evicted or the new entry is
+// refused, depending on the configured policy.
+//
+// An entry file has a header line in JSON format that describes its
+// objects followed by the contents of the objects:
+//
+//	{"objects":[{"name":"<object name>","datatype":"<datatype>","size":<size>},...]}
+//	<contents of the first object><contents of the second object>...
+package outbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Eviction policies of the outbox when it's full.
+const (
+	PolicyOldestFirst = "oldest-first" // evict the oldest entries to make room for the new entry
+	PolicyRefuseNew   = "refuse-new"   // refuse the new entry
+)
+
+// Exported errors.
+var (
+	ErrConfig  = errors.New("invalid configuration")
+	ErrFull    = errors.New("outbox is full")
+	ErrCorrupt = errors.New("corrupt outbox entry")
+	ErrWrite   = errors.New("failed to write outbox entry")
+)
+
+// Uploader interface.
+type Uploader interface {
+	Upload(context.Context, string, []byte) error
+}
+
+// Config defines outbox configuration options.
+type Config struct {
+	Dir           string        // directory of the outbox on local disk
+	SizeMax       int64         // maximum total size in bytes of the entries
+	Policy        string        // eviction policy when the outbox is full (PolicyOldestFirst or PolicyRefuseNew)
+	RetryInterval time.Duration // how long to wait after a failed upload before retrying
+}
+
+// Object is an object (e.g., a compressed data or index bundle) of an
+// outbox entry that is uploaded to GCS.
+type Object struct {
+	Name     string `json:"name"`     // GCS object name
+	Datatype string `json:"datatype"` // datatype of the object (e.g., scamper1 or index1)
+	Size     int    `json:"size"`     // size of the contents
+	Contents []byte `json:"-"`        // contents of the object
+}
+
+// Outbox is a bounded queue of bundles on the local disk.
+type Outbox struct {
+	conf   Config
+	client Uploader
+	wake   chan struct{} // notification of new entries for Drain
+
+	mu       sync.Mutex // protects the following fields
+	entries  []entry    // entries from oldest to newest
+	size     int64      // total size of the entries
+	lastSeq  int64      // sequence number of the newest entry
+	draining string     // name of the entry Drain is uploading (never evicted)
+}
+
+// entry is an entry of the outbox.
+type entry struct {
+	name     string // name of the entry file
+	seq      int64  // sequence number of the entry (i.e., its order)
+	size     int64  // size of the entry file
+	datatype string // datatype of the entry's first object
+}
+
+// header is the first line of an entry file.
+type header struct {
+	Objects []Object `json:"objects"`
+}
+
+var (
+	// Names of entry files are their sequence numbers which are
+	// derived from the time they were added.  Temporary files that
+	// are being written start with a dot.
+	entryRegexp = regexp.MustCompile(`^([0-9]{20})\.bundle$`)
+
+	jostlerOutboxBundles = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "jostler_outbox_bundles",
+			Help: "The number of bundles in the outbox waiting to be uploaded",
+		})
+	jostlerOutboxBytes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "jostler_outbox_bytes",
+			Help: "The total size of the bundles in the outbox waiting to be uploaded",
+		})
+	jostlerOutboxUploads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "jostler_outbox_uploads_total",
+			Help: "The number of bundles jostler has uploaded from the outbox",
+		},
+		[]string{"datatype"})
+	jostlerOutboxDiscarded = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "jostler_outbox_discarded_total",
+			Help: "The number of bundles jostler has discarded from or refused to add to the outbox by reason",
+		},
+		[]string{"datatype", "reason"})
+
+	// Testing and debugging support.
+	verbose = func(fmt string, args ...interface{}) {}
+	timeNow = time.Now
+)
+
+// Verbose provides a convenient way for the caller to enable verbose
+// printing and control its format (mostly for debugging).
+func Verbose(v func(string, ...interface{})) {
+	verbose = v
+}
+
+// New returns a new Outbox instance that uploads its entries via the
+// given client.  Entries that were left in the outbox directory by a
+// previous instance are loaded so that they will be uploaded too.
+func New(conf Config, client Uploader) (*Outbox, error) {
+	if client == nil {
+		return nil, fmt.Errorf("%w: nil upload client", ErrConfig)
+	}
+	if conf.Dir == "" {
+		return nil, fmt.Errorf("%w: empty directory", ErrConfig)
+	}
+	if conf.SizeMax <= 0 {
+		return nil, fmt.Errorf("%w: invalid maximum size: %v", ErrConfig, conf.SizeMax)
+	}
+	if conf.Policy != PolicyOldestFirst && conf.Policy != PolicyRefuseNew {
+		return nil, fmt.Errorf("%w: invalid policy: %v", ErrConfig, conf.Policy)
+	}
+	if conf.RetryInterval <= 0 {
+		return nil, fmt.Errorf("%w: invalid retry interval: %v", ErrConfig, conf.RetryInterval)
+	}
+	if err := os.MkdirAll(conf.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrConfig, err)
+	}
+	o := &Outbox{
+		conf:   conf,
+		client: client,
+		wake:   make(chan struct{}, 1),
+	}
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+	if len(o.entries) != 0 {
+		log.Printf("outbox %v has %d bundle(s) (%d bytes) to upload\n", conf.Dir, len(o.entries), o.size)
+	}
+	return o, nil
+}
+
+// load loads the entries in the outbox directory and removes the
+// temporary files of entries that were not completely written.
+func (o *Outbox) load() error {
+	dirEntries, err := os.ReadDir(o.conf.Dir)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrConfig, err)
+	}
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if strings.HasPrefix(name, ".") {
+			verbose("removing temporary file %v", name)
+			if err := os.Remove(filepath.Join(o.conf.Dir, name)); err != nil {
+				log.Printf("ERROR: failed to remove temporary outbox file: %v\n", err)
+			}
+			continue
+		}
+		m := entryRegexp.FindStringSubmatch(name)
+		if m == nil || !dirEntry.Type().IsRegular() {
+			continue
+		}
+		seq, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		fi, err := dirEntry.Info()
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrConfig, err)
+		}
+		e := entry{name: name, seq: seq, size: fi.Size()}
+		// A corrupt entry is loaded anyway so that it's discarded
+		// when it's drained.
+		if h, err := o.readHeader(name); err == nil && len(h.Objects) != 0 {
+			e.datatype = h.Objects[0].Datatype
+		}
+		o.entries = append(o.entries, e)
+		o.size += e.size
+	}
+	sort.Slice(o.entries, func(i, j int) bool {
+		return o.entries[i].seq < o.entries[j].seq
+	})
+	if len(o.entries) != 0 {
+		o.lastSeq = o.entries[len(o.entries)-1].seq
+	}
+	o.updateGauges()
+	return nil
+}
+
+// Pending returns true if the outbox has entries that have not been
+// uploaded yet.
+func (o *Outbox) Pending() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.entries) != 0
+}
+
+// Len returns the number of entries in the outbox and their total size.
+func (o *Outbox) Len() (int, int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.entries), o.size
+}
+
+// Add adds a new entry with the given objects to the outbox.  If the
+// outbox does not have room for the entry, the oldest entries are
+// evicted or ErrFull is returned, depending on the eviction policy.
+func (o *Outbox) Add(objs []Object) error {
+	if len(objs) == 0 {
+		return fmt.Errorf("%w: no objects", ErrWrite)
+	}
+	var h header
+	for _, obj := range objs {
+		obj.Size = len(obj.Contents)
+		h.Objects = append(h.Objects, obj)
+	}
+	hdr, err := json.Marshal(h)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrWrite, err)
+	}
+	size := int64(len(hdr) + 1)
+	for _, obj := range objs {
+		size += int64(len(obj.Contents))
+	}
+	datatype := objs[0].Datatype
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.makeRoom(datatype, size); err != nil {
+		return err
+	}
+	o.lastSeq++
+	if now := timeNow().UnixNano(); now > o.lastSeq {
+		o.lastSeq = now
+	}
+	e := entry{name: fmt.Sprintf("%020d.bundle", o.lastSeq), seq: o.lastSeq, size: size, datatype: datatype}
+	if err := o.writeEntry(e.name, hdr, objs); err != nil {
+		return err
+	}
+	verbose("added %v (%d bytes) to outbox", e.name, e.size)
+	o.entries = append(o.entries, e)
+	o.size += e.size
+	o.updateGauges()
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// makeRoom makes room for a new entry of the given datatype and size
+// according to the eviction policy.  The entry that is being drained is
+// not evicted because it may be uploaded already.  It should be called
+// with o.mu held.
+func (o *Outbox) makeRoom(datatype string, size int64) error {
+	if size > o.conf.SizeMax {
+		jostlerOutboxDiscarded.WithLabelValues(datatype, "too_big").Inc()
+		return fmt.Errorf("%w: entry of %d bytes is bigger than the outbox (%d bytes)", ErrFull, size, o.conf.SizeMax)
+	}
+	if o.size+size <= o.conf.SizeMax {
+		return nil
+	}
+	if o.conf.Policy == PolicyRefuseNew {
+		jostlerOutboxDiscarded.WithLabelValues(datatype, "refused").Inc()
+		return fmt.Errorf("%w: %d bytes in %d bundle(s)", ErrFull, o.size, len(o.entries))
+	}
+	var drainingSize int64
+	for _, e := range o.entries {
+		if e.name == o.draining {
+			drainingSize = e.size
+		}
+	}
+	if drainingSize+size > o.conf.SizeMax {
+		jostlerOutboxDiscarded.WithLabelValues(datatype, "refused").Inc()
+		return fmt.Errorf("%w: %d bytes are being uploaded", ErrFull, drainingSize)
+	}
+	for i := 0; i < len(o.entries) && o.size+size > o.conf.SizeMax; {
+		e := o.entries[i]
+		if e.name == o.draining {
+			i++
+			continue
+		}
+		log.Printf("WARNING: evicting %v (%v, %d bytes) from outbox\n", e.name, e.datatype, e.size)
+		if err := os.Remove(filepath.Join(o.conf.Dir, e.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("ERROR: failed to remove outbox entry: %v\n", err)
+		}
+		jostlerOutboxDiscarded.WithLabelValues(e.datatype, "evicted").Inc()
+		o.entries = append(o.entries[:i], o.entries[i+1:]...)
+		o.size -= e.size
+	}
+	return nil
+}
+
+// writeEntry writes the entry file with the given name atomically by
+// writing a temporary file first and renaming it.
+func (o *Outbox) writeEntry(name string, hdr []byte, objs []Object) error {
+	tmpPath := filepath.Join(o.conf.Dir, "."+name)
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrWrite, err)
+	}
+	w := bufio.NewWriter(f)
+	_, err = w.Write(append(hdr, '\n'))
+	for _, obj := range objs {
+		if err == nil {
+			_, err = w.Write(obj.Contents)
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filepath.Join(o.conf.Dir, name))
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("%w: %v", ErrWrite, err)
+	}
+	return nil
+}
+
+// Drain uploads the entries of the outbox in the order they were added
+// and removes them when they are uploaded.  After a failed upload, it
+// waits for the retry interval before retrying the same entry so that
+// entries stay in order.  It runs until the given context is canceled.
+func (o *Outbox) Drain(ctx context.Context) error {
+	for {
+		e, ok := o.oldest()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-o.wake:
+			}
+			continue
+		}
+		err := o.uploadEntry(ctx, e)
+		switch {
+		case err == nil:
+			verbose("uploaded %v from outbox", e.name)
+			jostlerOutboxUploads.WithLabelValues(e.datatype).Inc()
+			o.remove(e)
+		case errors.Is(err, ErrCorrupt):
+			log.Printf("ERROR: discarding %v: %v\n", e.name, err)
+			jostlerOutboxDiscarded.WithLabelValues(e.datatype, "corrupt").Inc()
+			o.remove(e)
+		default:
+			log.Printf("ERROR: failed to upload %v from outbox (retrying in %v): %v\n", e.name, o.conf.RetryInterval, err)
+			// The entry can be evicted while waiting to retry.
+			o.release()
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(o.conf.RetryInterval):
+			}
+		}
+	}
+}
+
+// oldest returns the oldest entry of the outbox and marks it as being
+// drained so that it's not evicted.  It returns false if the outbox is
+// empty.
+func (o *Outbox) oldest() (entry, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.entries) == 0 {
+		return entry{}, false
+	}
+	o.draining = o.entries[0].name
+	return o.entries[0], true
+}
+
+// release marks the entry that was being drained as no longer being
+// drained.
+func (o *Outbox) release() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.draining = ""
+}
+
+// remove removes the given entry from the outbox unless it was evicted
+// already.
+func (o *Outbox) remove(e entry) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.draining = ""
+	for i := range o.entries {
+		if o.entries[i].name != e.name {
+			continue
+		}
+		if err := os.Remove(filepath.Join(o.conf.Dir, e.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("ERROR: failed to remove outbox entry: %v\n", err)
+		}
+		o.entries = append(o.entries[:i], o.entries[i+1:]...)
+		o.size -= e.size
+		o.updateGauges()
+		return
+	}
+}
+
+// uploadEntry uploads the objects of the given entry in order.
+func (o *Outbox) uploadEntry(ctx context.Context, e entry) error {
+	contents, err := os.ReadFile(filepath.Join(o.conf.Dir, e.name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		return err
+	}
+	objs, err := parseEntry(contents)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objs {
+		verbose("uploading %v from outbox", obj.Name)
+		if err := o.client.Upload(ctx, obj.Name, obj.Contents); err != nil {
+			return fmt.Errorf("%v: %w", obj.Name, err)
+		}
+	}
+	return nil
+}
+
+// readHeader reads the header of the given entry file.
+func (o *Outbox) readHeader(name string) (*header, error) {
+	f, err := os.Open(filepath.Join(o.conf.Dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	var h header
+	if err := json.Unmarshal(line, &h); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return &h, nil
+}
+
+// parseEntry parses the contents of an entry file and returns its
+// objects.
+func parseEntry(contents []byte) ([]Object, error) {
+	i := bytes.IndexByte(contents, '\n')
+	if i < 0 {
+		return nil, fmt.Errorf("%w: no header", ErrCorrupt)
+	}
+	var h header
+	if err := json.Unmarshal(contents[:i], &h); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	r := bytes.NewReader(contents[i+1:])
+	for j := range h.Objects {
+		if h.Objects[j].Name == "" || h.Objects[j].Size < 0 || h.Objects[j].Size > r.Len() {
+			return nil, fmt.Errorf("%w: invalid object %d", ErrCorrupt, j)
+		}
+		h.Objects[j].Contents = make([]byte, h.Objects[j].Size)
+		if _, err := io.ReadFull(r, h.Objects[j].Contents); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+	}
+	if r.Len() != 0 || len(h.Objects) == 0 {
+		return nil, fmt.Errorf("%w: unexpected size", ErrCorrupt)
+	}
+	return h.Objects, nil
+}
+
+// updateGauges updates the metrics of the size of the outbox.  It
+// should be called with o.mu held.
+func (o *Outbox) updateGauges() {
+	jostlerOutboxBundles.Set(float64(len(o.entries)))
+	jostlerOutboxBytes.Set(float64(o.size))
+}
@@ -0,0 +1,322 @@
+package outbox_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/jostler/internal/outbox"
+	"github.com/m-lab/jostler/internal/testhelper"
+)
+
+var errUpload = errors.New("failed to upload")
+
+// uploader records the objects it uploads and fails while fail is set.
+// If block is not nil, each upload sends its object name on started
+// and waits for block to be closed first.
+type uploader struct {
+	block    chan struct{}
+	started  chan string
+	mu       sync.Mutex
+	fail     bool
+	uploaded []string
+}
+
+func (u *uploader) Upload(ctx context.Context, name string, contents []byte) error {
+	if u.block != nil {
+		u.started <- name
+		<-u.block
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.fail {
+		return errUpload
+	}
+	u.uploaded = append(u.uploaded, name+"="+string(contents))
+	return nil
+}
+
+func (u *uploader) setFail(fail bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.fail = fail
+}
+
+func (u *uploader) uploads() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.uploaded...)
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    outbox.Config
+		client  outbox.Uploader
+		wantErr error
+	}{
+		{name: "nil client", conf: outbox.Config{Dir: "dir", SizeMax: 1, Policy: outbox.PolicyOldestFirst, RetryInterval: time.Second}, wantErr: outbox.ErrConfig},
+		{name: "empty directory", conf: outbox.Config{SizeMax: 1, Policy: outbox.PolicyOldestFirst, RetryInterval: time.Second}, client: &uploader{}, wantErr: outbox.ErrConfig},
+		{name: "invalid size", conf: outbox.Config{Dir: "dir", Policy: outbox.PolicyOldestFirst, RetryInterval: time.Second}, client: &uploader{}, wantErr: outbox.ErrConfig},
+		{name: "invalid policy", conf: outbox.Config{Dir: "dir", SizeMax: 1, Policy: "newest-first", RetryInterval: time.Second}, client: &uploader{}, wantErr: outbox.ErrConfig},
+		{name: "invalid retry interval", conf: outbox.Config{Dir: "dir", SizeMax: 1, Policy: outbox.PolicyRefuseNew}, client: &uploader{}, wantErr: outbox.ErrConfig},
+		{name: "valid", conf: outbox.Config{Dir: "dir", SizeMax: 1, Policy: outbox.PolicyRefuseNew, RetryInterval: time.Second}, client: &uploader{}},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		if test.conf.Dir != "" {
+			test.conf.Dir = filepath.Join(t.TempDir(), test.conf.Dir)
+		}
+		_, err := outbox.New(test.conf, test.client)
+		if !errors.Is(err, test.wantErr) {
+			t.Fatalf("New() = %v, want %v", err, test.wantErr)
+		}
+	}
+}
+
+func TestAdd(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		sizeMax     int64
+		bundles     []string // contents of the data object of each bundle added
+		wantErrs    []error
+		wantBundles []string // contents of the data object of each bundle uploaded
+	}{
+		{
+			name:        "room",
+			policy:      outbox.PolicyRefuseNew,
+			sizeMax:     1024,
+			bundles:     []string{"a", "b", "c"},
+			wantErrs:    []error{nil, nil, nil},
+			wantBundles: []string{"a", "b", "c"},
+		},
+		{
+			name:        "oldest first",
+			policy:      outbox.PolicyOldestFirst,
+			sizeMax:     250,
+			bundles:     []string{"a", "b", "c"},
+			wantErrs:    []error{nil, nil, nil},
+			wantBundles: []string{"b", "c"},
+		},
+		{
+			name:        "refuse new",
+			policy:      outbox.PolicyRefuseNew,
+			sizeMax:     250,
+			bundles:     []string{"a", "b", "c"},
+			wantErrs:    []error{nil, nil, outbox.ErrFull},
+			wantBundles: []string{"a", "b"},
+		},
+		{
+			name:        "too big",
+			policy:      outbox.PolicyOldestFirst,
+			sizeMax:     250,
+			bundles:     []string{"a", strings.Repeat("b", 250)},
+			wantErrs:    []error{nil, outbox.ErrFull},
+			wantBundles: []string{"a"},
+		},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		client := &uploader{fail: true}
+		conf := outbox.Config{Dir: t.TempDir(), SizeMax: test.sizeMax, Policy: test.policy, RetryInterval: 10 * time.Millisecond}
+		ob, err := outbox.New(conf, client)
+		if err != nil {
+			t.Fatalf("New() = %v, want nil", err)
+		}
+		for j, b := range test.bundles {
+			if err := ob.Add(objects(j, b)); !errors.Is(err, test.wantErrs[j]) {
+				t.Fatalf("Add() = %v, want %v", err, test.wantErrs[j])
+			}
+		}
+		if n, _ := ob.Len(); n != len(test.wantBundles) {
+			t.Fatalf("Len() = %v, want %v", n, len(test.wantBundles))
+		}
+		// A new instance loads the entries that were left behind and
+		// uploads them in order once uploads succeed.
+		ob, err = outbox.New(conf, client)
+		if err != nil {
+			t.Fatalf("New() = %v, want nil", err)
+		}
+		client.setFail(false)
+		drain(t, ob)
+		var want []string
+		for _, b := range test.wantBundles {
+			want = append(want, "data-"+b+"="+b, "index-"+b+"=index")
+		}
+		if got := client.uploads(); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("uploaded %v, want %v", got, want)
+		}
+		if dirEntries, err := os.ReadDir(conf.Dir); err != nil || len(dirEntries) != 0 {
+			t.Fatalf("os.ReadDir() = %v, %v, want empty outbox", dirEntries, err)
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	client := &uploader{fail: true}
+	conf := outbox.Config{Dir: t.TempDir(), SizeMax: 1024, Policy: outbox.PolicyOldestFirst, RetryInterval: 10 * time.Millisecond}
+	// Temporary files of partially written entries and corrupt
+	// entries are discarded.
+	if err := os.WriteFile(filepath.Join(conf.Dir, ".00000000000000000001.bundle"), []byte("partial"), 0o644); err != nil {
+		t.Fatalf("os.WriteFile() = %v, want nil", err)
+	}
+	if err := os.WriteFile(filepath.Join(conf.Dir, "00000000000000000002.bundle"), []byte("{\"objects\":[]}\n"), 0o644); err != nil {
+		t.Fatalf("os.WriteFile() = %v, want nil", err)
+	}
+	ob, err := outbox.New(conf, client)
+	if err != nil {
+		t.Fatalf("New() = %v, want nil", err)
+	}
+	if !ob.Pending() {
+		t.Fatalf("Pending() = false, want true")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- ob.Drain(ctx)
+	}()
+	if err := ob.Add(objects(0, "a")); err != nil {
+		t.Fatalf("Add() = %v, want nil", err)
+	}
+	// Entries stay in the outbox while uploads fail.
+	time.Sleep(50 * time.Millisecond)
+	if n, size := ob.Len(); n != 1 || size == 0 {
+		t.Fatalf("Len() = %v, %v, want 1 entry", n, size)
+	}
+	client.setFail(false)
+	waitForEmpty(t, ob)
+	if got := client.uploads(); len(got) != 2 {
+		t.Fatalf("uploaded %v, want 2 objects", got)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Drain() = %v, want nil", err)
+	}
+	if dirEntries, err := os.ReadDir(conf.Dir); err != nil || len(dirEntries) != 0 {
+		t.Fatalf("os.ReadDir() = %v, %v, want empty outbox", dirEntries, err)
+	}
+}
+
+func TestEvictWhileDraining(t *testing.T) {
+	client := &uploader{block: make(chan struct{}), started: make(chan string, 10)}
+	entrySize := entrySize(t)
+	conf := outbox.Config{Dir: t.TempDir(), SizeMax: 2 * entrySize, Policy: outbox.PolicyOldestFirst, RetryInterval: 10 * time.Millisecond}
+	ob, err := outbox.New(conf, client)
+	if err != nil {
+		t.Fatalf("New() = %v, want nil", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = ob.Drain(ctx)
+	}()
+	if err := ob.Add(objects(0, "a")); err != nil {
+		t.Fatalf("Add() = %v, want nil", err)
+	}
+	if name := <-client.started; name != "data-a" {
+		t.Fatalf("uploading %v, want data-a", name)
+	}
+	// While "a" is being uploaded, "b" is evicted to make room for
+	// "c" instead of "a".
+	for _, data := range []string{"b", "c"} {
+		if err := ob.Add(objects(0, data)); err != nil {
+			t.Fatalf("Add() = %v, want nil", err)
+		}
+	}
+	if n, _ := ob.Len(); n != 2 {
+		t.Fatalf("Len() = %v, want 2 entries", n)
+	}
+	close(client.block)
+	waitForEmpty(t, ob)
+	want := "data-a=a,index-a=index,data-c=c,index-c=index"
+	if got := strings.Join(client.uploads(), ","); got != want {
+		t.Fatalf("uploaded %v, want %v", got, want)
+	}
+}
+
+func TestRefuseWhileDraining(t *testing.T) {
+	client := &uploader{block: make(chan struct{}), started: make(chan string, 10)}
+	entrySize := entrySize(t)
+	conf := outbox.Config{Dir: t.TempDir(), SizeMax: entrySize + entrySize/2, Policy: outbox.PolicyOldestFirst, RetryInterval: 10 * time.Millisecond}
+	ob, err := outbox.New(conf, client)
+	if err != nil {
+		t.Fatalf("New() = %v, want nil", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = ob.Drain(ctx)
+	}()
+	if err := ob.Add(objects(0, "a")); err != nil {
+		t.Fatalf("Add() = %v, want nil", err)
+	}
+	<-client.started
+	// The entry that is being uploaded is not evicted so there's no
+	// room for "b".
+	if err := ob.Add(objects(0, "b")); !errors.Is(err, outbox.ErrFull) {
+		t.Fatalf("Add() = %v, want %v", err, outbox.ErrFull)
+	}
+	close(client.block)
+	waitForEmpty(t, ob)
+	want := "data-a=a,index-a=index"
+	if got := strings.Join(client.uploads(), ","); got != want {
+		t.Fatalf("uploaded %v, want %v", got, want)
+	}
+}
+
+// entrySize returns the size of an entry of the objects of a bundle with
+// one byte of data.
+func entrySize(t *testing.T) int64 {
+	t.Helper()
+	ob, err := outbox.New(outbox.Config{Dir: t.TempDir(), SizeMax: 1024, Policy: outbox.PolicyOldestFirst, RetryInterval: time.Second}, &uploader{})
+	if err != nil {
+		t.Fatalf("New() = %v, want nil", err)
+	}
+	if err := ob.Add(objects(0, "a")); err != nil {
+		t.Fatalf("Add() = %v, want nil", err)
+	}
+	_, size := ob.Len()
+	return size
+}
+
+// objects returns the objects of a bundle with the given data.
+func objects(i int, data string) []outbox.Object {
+	name := data
+	if len(name) > 1 {
+		name = fmt.Sprintf("big%d", i)
+	}
+	return []outbox.Object{
+		{Name: "data-" + name, Datatype: "foo1", Contents: []byte(data)},
+		{Name: "index-" + name, Datatype: "index1", Contents: []byte("index")},
+	}
+}
+
+// drain drains the given outbox until it's empty.
+func drain(t *testing.T, ob *outbox.Outbox) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = ob.Drain(ctx)
+	}()
+	waitForEmpty(t, ob)
+}
+
+// waitForEmpty waits until the given outbox is empty.
+func waitForEmpty(t *testing.T, ob *outbox.Outbox) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if !ob.Pending() {
+			return
+		}
+	}
+	n, size := ob.Len()
+	t.Fatalf("Len() = %v, %v, want empty outbox", n, size)
+}
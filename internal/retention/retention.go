@@ -0,0 +1,269 @@
+// Package retention implements a directory on the local disk where
+// files that were uploaded are kept for a while (e.g., for debugging or
+// local reprocessing) instead of being deleted right away.
+//
+// Files are moved to the retention directory under the same pathnames
+// relative to the retention directory as they had relative to the spool
+// directory (i.e., the retention directory mirrors the layout of the
+// spool directory).  The modification time of a retained file is set to
+// when it was retained so that the retention directory can be pruned
+// by age and total size across restarts.
+package retention
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Exported errors.
+var (
+	ErrConfig     = errors.New("invalid configuration")
+	ErrNotInSpool = errors.New("is not in spool directory")
+	ErrRetain     = errors.New("failed to retain file")
+	ErrPrune      = errors.New("failed to prune retention directory")
+)
+
+// Config defines retention configuration options.
+type Config struct {
+	Dir      string        // retention directory
+	SpoolDir string        // spool directory whose layout is mirrored
+	AgeMax   time.Duration // files are pruned when they have been retained this long (no limit if zero)
+	SizeMax  int64         // oldest files are pruned when the total size of files exceeds this (no limit if zero)
+	Interval time.Duration // time interval between prunings
+}
+
+// Retention is a directory of retained files.
+type Retention struct {
+	conf Config
+}
+
+// retained is a file in the retention directory.
+type retained struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+var (
+	jostlerRetentionFiles = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "jostler_retention_files",
+			Help: "The number of uploaded files in the retention directory after the last pruning",
+		})
+	jostlerRetentionBytes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "jostler_retention_bytes",
+			Help: "The total size of uploaded files in the retention directory after the last pruning",
+		})
+	jostlerRetentionPruned = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "jostler_retention_pruned_total",
+			Help: "The number of files jostler has pruned from the retention directory",
+		})
+
+	// Testing and debugging support.
+	verbose = func(fmt string, args ...interface{}) {}
+	timeNow = time.Now
+)
+
+// Verbose provides a convenient way for the caller to enable verbose
+// printing and control its format (mostly for debugging).
+func Verbose(v func(string, ...interface{})) {
+	verbose = v
+}
+
+// New returns a new Retention instance and creates the retention
+// directory if it doesn't exist.
+func New(conf Config) (*Retention, error) {
+	if conf.Dir == "" || conf.SpoolDir == "" {
+		return nil, fmt.Errorf("%w: empty directory", ErrConfig)
+	}
+	if conf.AgeMax < 0 || conf.SizeMax < 0 {
+		return nil, fmt.Errorf("%w: negative maximum age or size", ErrConfig)
+	}
+	if conf.Interval <= 0 {
+		return nil, fmt.Errorf("%w: invalid interval: %v", ErrConfig, conf.Interval)
+	}
+	conf.Dir, conf.SpoolDir = filepath.Clean(conf.Dir), filepath.Clean(conf.SpoolDir)
+	if isUnder(conf.Dir, conf.SpoolDir) || isUnder(conf.SpoolDir, conf.Dir) {
+		return nil, fmt.Errorf("%w: retention directory %v and spool directory %v overlap", ErrConfig, conf.Dir, conf.SpoolDir)
+	}
+	if err := os.MkdirAll(conf.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrConfig, err)
+	}
+	return &Retention{conf: conf}, nil
+}
+
+// isUnder returns true if the given pathname is the given directory or
+// is under it.
+func isUnder(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Retain moves the given file from the spool directory to the same
+// relative pathname in the retention directory.
+func (r *Retention) Retain(fullPath string) error {
+	fullPath = filepath.Clean(fullPath)
+	rel, err := filepath.Rel(r.conf.SpoolDir, fullPath)
+	if err != nil || rel == "." || !isUnder(fullPath, r.conf.SpoolDir) {
+		return fmt.Errorf("%v: %w", fullPath, ErrNotInSpool)
+	}
+	dst := filepath.Join(r.conf.Dir, rel)
+	// Prune may remove the directory of dst if it's empty, in which
+	// case we try again once.
+	for attempt := 0; ; attempt++ {
+		if err = os.MkdirAll(filepath.Dir(dst), 0o755); err == nil {
+			err = move(fullPath, dst)
+		}
+		if err == nil || attempt == 1 || !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrRetain, err)
+	}
+	now := timeNow()
+	if err := os.Chtimes(dst, now, now); err != nil {
+		return fmt.Errorf("%w: %v", ErrRetain, err)
+	}
+	verbose("retained %v as %v", fullPath, dst)
+	return nil
+}
+
+// move renames the given file or copies and removes it if the
+// destination is on another filesystem.
+func move(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// Run prunes the retention directory right away and then every
+// interval until the given context is canceled.  Errors are logged.
+func (r *Retention) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.conf.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.Prune(); err != nil {
+			log.Printf("ERROR: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Prune removes the files that have been retained longer than the
+// maximum age and then the oldest files until their total size does
+// not exceed the maximum size.  Directories that become empty are
+// removed too.  It returns the number of files removed.
+func (r *Retention) Prune() (int, error) {
+	var files []retained
+	var total int64
+	dirs := map[string]bool{}
+	err := filepath.WalkDir(r.conf.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != r.conf.Dir {
+				dirs[path] = true
+			}
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		files = append(files, retained{path: path, size: fi.Size(), modTime: fi.ModTime()})
+		total += fi.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrPrune, err)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	removed := 0
+	cutoff := timeNow().Add(-r.conf.AgeMax)
+	for len(files) != 0 {
+		f := files[0]
+		tooOld := r.conf.AgeMax != 0 && f.modTime.Before(cutoff)
+		tooBig := r.conf.SizeMax != 0 && total > r.conf.SizeMax
+		if !tooOld && !tooBig {
+			break
+		}
+		verbose("pruning %v", f.path)
+		if err := os.Remove(f.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("ERROR: failed to prune retained file: %v\n", err)
+		} else {
+			removed++
+		}
+		files = files[1:]
+		total -= f.size
+	}
+	jostlerRetentionPruned.Add(float64(removed))
+	jostlerRetentionFiles.Set(float64(len(files)))
+	jostlerRetentionBytes.Set(float64(total))
+	if removed != 0 {
+		removeEmptyDirs(dirs)
+	}
+	return removed, nil
+}
+
+// removeEmptyDirs removes the given directories that are empty, deepest
+// first so that parents of removed directories can be removed too.
+func removeEmptyDirs(dirs map[string]bool) {
+	paths := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		paths = append(paths, dir)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return len(paths[i]) > len(paths[j])
+	})
+	for _, dir := range paths {
+		// Removing a directory that is not empty fails, which is
+		// what we want.
+		_ = os.Remove(dir)
+	}
+}
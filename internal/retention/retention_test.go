@@ -0,0 +1,149 @@
+package retention
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/jostler/internal/testhelper"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name     string
+		dir      string
+		spoolDir string
+		ageMax   time.Duration
+		interval time.Duration
+		wantErr  error
+	}{
+		{name: "empty directory", spoolDir: "spool", interval: time.Minute, wantErr: ErrConfig},
+		{name: "empty spool directory", dir: "retained", interval: time.Minute, wantErr: ErrConfig},
+		{name: "negative age", dir: "retained", spoolDir: "spool", ageMax: -time.Hour, interval: time.Minute, wantErr: ErrConfig},
+		{name: "invalid interval", dir: "retained", spoolDir: "spool", wantErr: ErrConfig},
+		{name: "under spool directory", dir: "spool/retained", spoolDir: "spool", interval: time.Minute, wantErr: ErrConfig},
+		{name: "spool directory under it", dir: "retained", spoolDir: "retained/spool", interval: time.Minute, wantErr: ErrConfig},
+		{name: "valid", dir: "retained", spoolDir: "spool", ageMax: time.Hour, interval: time.Minute},
+		{name: "sibling with common prefix", dir: "spool-retained", spoolDir: "spool", interval: time.Minute},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		tmpDir := t.TempDir()
+		conf := Config{AgeMax: test.ageMax, Interval: test.interval}
+		if test.dir != "" {
+			conf.Dir = filepath.Join(tmpDir, test.dir)
+		}
+		if test.spoolDir != "" {
+			conf.SpoolDir = filepath.Join(tmpDir, test.spoolDir)
+		}
+		if _, err := New(conf); !errors.Is(err, test.wantErr) {
+			t.Fatalf("New() = %v, want %v", err, test.wantErr)
+		}
+	}
+}
+
+func TestRetain(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf := Config{Dir: filepath.Join(tmpDir, "retained"), SpoolDir: filepath.Join(tmpDir, "spool"), Interval: time.Minute}
+	r, err := New(conf)
+	if err != nil {
+		t.Fatalf("New() = %v, want nil", err)
+	}
+	tests := []struct {
+		name    string
+		file    string // relative to the temporary directory
+		wantErr error
+	}{
+		{name: "mirrored", file: "spool/ndt/foo1/2022/11/09/file1.json"},
+		{name: "not in spool", file: "other/file2.json", wantErr: ErrNotInSpool},
+		{name: "spool directory", file: "spool", wantErr: ErrNotInSpool},
+		{name: "missing", file: "spool/ndt/foo1/2022/11/09/missing.json", wantErr: ErrRetain},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		src := filepath.Join(tmpDir, test.file)
+		if test.wantErr == nil {
+			writeFile(t, src, "{}", time.Now().Add(-24*time.Hour))
+		}
+		err := r.Retain(src)
+		if !errors.Is(err, test.wantErr) {
+			t.Fatalf("Retain() = %v, want %v", err, test.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(src); err == nil {
+			t.Fatalf("os.Stat(%v) = nil, want error", src)
+		}
+		dst := filepath.Join(conf.Dir, strings.TrimPrefix(test.file, "spool/"))
+		fi, err := os.Stat(dst)
+		if err != nil || time.Since(fi.ModTime()) > time.Minute {
+			t.Fatalf("os.Stat(%v) = %v, %v, want recently retained file", dst, fi, err)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		ageMax      time.Duration
+		sizeMax     int64
+		ages        []time.Duration // ages of 10-byte files
+		wantRemoved int
+	}{
+		{name: "no limits", ages: []time.Duration{time.Hour, 2 * time.Hour}, wantRemoved: 0},
+		{name: "age", ageMax: 90 * time.Minute, ages: []time.Duration{time.Hour, 2 * time.Hour, 3 * time.Hour}, wantRemoved: 2},
+		{name: "size", sizeMax: 25, ages: []time.Duration{time.Hour, 2 * time.Hour, 3 * time.Hour}, wantRemoved: 1},
+		{name: "age and size", ageMax: 150 * time.Minute, sizeMax: 15, ages: []time.Duration{time.Hour, 2 * time.Hour, 3 * time.Hour}, wantRemoved: 2},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		tmpDir := t.TempDir()
+		conf := Config{Dir: filepath.Join(tmpDir, "retained"), SpoolDir: filepath.Join(tmpDir, "spool"), AgeMax: test.ageMax, SizeMax: test.sizeMax, Interval: time.Minute}
+		r, err := New(conf)
+		if err != nil {
+			t.Fatalf("New() = %v, want nil", err)
+		}
+		var files []string
+		for j, age := range test.ages {
+			// Each file is in its own date directory.
+			f := filepath.Join(conf.Dir, "ndt/foo1/2022/11", string(rune('a'+j)), "file.json")
+			writeFile(t, f, "0123456789", now.Add(-age))
+			files = append(files, f)
+		}
+		removed, err := r.Prune()
+		if err != nil || removed != test.wantRemoved {
+			t.Fatalf("Prune() = %v, %v, want %v, nil", removed, err, test.wantRemoved)
+		}
+		// The oldest files (last in files) are removed along with
+		// their directories.
+		for j, f := range files {
+			_, err := os.Stat(filepath.Dir(f))
+			if exists, want := err == nil, j < len(files)-test.wantRemoved; exists != want {
+				t.Fatalf("%v exists = %v, want %v", filepath.Dir(f), exists, want)
+			}
+		}
+		if _, err := os.Stat(conf.Dir); err != nil {
+			t.Fatalf("os.Stat(%v) = %v, want nil", conf.Dir, err)
+		}
+	}
+}
+
+// writeFile writes the given file with the given contents and
+// modification time.
+func writeFile(t *testing.T, name, contents string, modTime time.Time) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatalf("os.MkdirAll() = %v, want nil", err)
+	}
+	if err := os.WriteFile(name, []byte(contents), 0o644); err != nil {
+		t.Fatalf("os.WriteFile() = %v, want nil", err)
+	}
+	if err := os.Chtimes(name, modTime, modTime); err != nil {
+		t.Fatalf("os.Chtimes() = %v, want nil", err)
+	}
+}
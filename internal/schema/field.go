@@ -0,0 +1,222 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Field defines a single field (column) of a table schema.
+//
+// There are two JSON conventions for BigQuery schemas.  BigQuery's own
+// convention (produced by "bq show" and bigquery.Schema.ToJSONFields())
+// uses lowercase keys such as "name", "type", "mode", and "fields".
+// Marshaling bigquery.Schema to JSON produces Go struct field names such
+// as "Name", "Type", "Required", "Repeated", and "Schema".  Field can be
+// unmarshaled from either convention and is always marshaled in BigQuery's
+// convention.  Keys that Field does not model (e.g., "maxLength") are
+// preserved so that a schema round-trips without loss.
+type Field struct {
+	Name        string
+	Type        string
+	Mode        string // empty if not specified, see FieldMode()
+	Description string
+	Fields      Fields // subfields of RECORD fields
+	extra       map[string]json.RawMessage
+}
+
+// Fields defines a list of fields which is a table schema at the top
+// level and the subfields of a RECORD field otherwise.
+type Fields []*Field
+
+// Aliases of field types in standard SQL that are equivalent to legacy
+// field types.
+var typeAliases = map[string]string{
+	"INT64":   "INTEGER",
+	"FLOAT64": "FLOAT",
+	"BOOL":    "BOOLEAN",
+	"STRUCT":  "RECORD",
+}
+
+// ParseFields parses the given table schema in either JSON convention.
+func ParseFields(schemaJSON []byte) (Fields, error) {
+	var fields Fields
+	if err := json.Unmarshal(schemaJSON, &fields); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnmarshal, err)
+	}
+	return fields, nil
+}
+
+// UnmarshalJSON unmarshals a list of fields and rejects null fields
+// (e.g., "[null]"), which would otherwise be nil.
+func (fields *Fields) UnmarshalJSON(b []byte) error {
+	var list []*Field
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	for i, f := range list {
+		if f == nil {
+			return fmt.Errorf("%w: field %d is null", ErrUnmarshal, i)
+		}
+	}
+	*fields = list
+	return nil
+}
+
+// FieldType returns the field's type with standard SQL aliases (e.g.,
+// INT64) replaced by their legacy equivalent (e.g., INTEGER) so types
+// can be compared.
+func (f *Field) FieldType() string {
+	t := strings.ToUpper(f.Type)
+	if legacy, ok := typeAliases[t]; ok {
+		return legacy
+	}
+	return t
+}
+
+// FieldMode returns the field's mode.  A field without a mode is
+// nullable.
+func (f *Field) FieldMode() string {
+	if f.Mode == "" {
+		return ModeNullable
+	}
+	return strings.ToUpper(f.Mode)
+}
+
+// IsRecord returns true if the field is a RECORD.
+func (f *Field) IsRecord() bool {
+	return f.FieldType() == "RECORD"
+}
+
+// UnmarshalJSON unmarshals a field in either JSON convention.
+func (f *Field) UnmarshalJSON(b []byte) error {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("%v: %w", ErrType, err)
+	}
+	*f = Field{}
+	var required, repeated bool
+	for k, v := range m {
+		var err error
+		switch k {
+		case "name", "Name":
+			err = json.Unmarshal(v, &f.Name)
+		case "type", "Type":
+			err = json.Unmarshal(v, &f.Type)
+		case "mode":
+			err = json.Unmarshal(v, &f.Mode)
+		case "description", "Description":
+			err = json.Unmarshal(v, &f.Description)
+		case "fields", "Schema":
+			err = json.Unmarshal(v, &f.Fields)
+		case "Required":
+			err = json.Unmarshal(v, &required)
+		case "Repeated":
+			err = json.Unmarshal(v, &repeated)
+		default:
+			f.addExtra(k, v)
+		}
+		if err != nil {
+			return fmt.Errorf("%v: %v: %w", k, err, ErrType)
+		}
+	}
+	if f.Mode == "" {
+		switch {
+		case repeated:
+			f.Mode = ModeRepeated
+		case required:
+			f.Mode = ModeRequired
+		}
+	}
+	return nil
+}
+
+// addExtra preserves the given key and value that Field does not model.
+// Keys in the Go struct convention are converted to BigQuery's convention
+// (e.g., "MaxLength" to "maxLength") and dropped if their values are zero
+// because marshaling bigquery.Schema includes all fields.
+func (f *Field) addExtra(k string, v json.RawMessage) {
+	if r, size := utf8.DecodeRuneInString(k); unicode.IsUpper(r) {
+		switch string(bytes.TrimSpace(v)) {
+		case "null", "0", `""`, "false", "[]", "{}":
+			return
+		}
+		k = string(unicode.ToLower(r)) + k[size:]
+	}
+	if f.extra == nil {
+		f.extra = make(map[string]json.RawMessage)
+	}
+	f.extra[k] = v
+}
+
+// MarshalJSON marshals a field in BigQuery's JSON convention.  Like
+// bigquery.Schema.ToJSONFields(), keys are sorted and empty mode and
+// description are omitted.
+func (f *Field) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, len(f.extra)+5)
+	for k, v := range f.extra {
+		m[k] = v
+	}
+	m["name"] = f.Name
+	m["type"] = f.Type
+	if f.Mode != "" {
+		m["mode"] = f.Mode
+	}
+	if f.Description != "" {
+		m["description"] = f.Description
+	}
+	if len(f.Fields) != 0 {
+		m["fields"] = f.Fields
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", ErrMarshal, err)
+	}
+	return b, nil
+}
+
+// Merge returns the fields followed by the fields that are only in the
+// given old fields.  Subfields of RECORD fields that are in both are
+// merged recursively.  Attributes of fields that are in both (e.g., type
+// and mode) are those of the fields and not the old fields.  Neither the
+// fields nor the old fields are modified.
+func (fields Fields) Merge(old Fields) Fields {
+	merged := make(Fields, 0, len(fields)+len(old))
+	byName := make(map[string]*Field, len(fields))
+	for _, f := range fields {
+		mf := *f
+		merged = append(merged, &mf)
+		byName[f.Name] = &mf
+	}
+	for _, of := range old {
+		mf, ok := byName[of.Name]
+		if !ok {
+			merged = append(merged, of)
+			continue
+		}
+		if mf.IsRecord() && of.IsRecord() {
+			mf.Fields = mf.Fields.Merge(of.Fields)
+		}
+	}
+	return merged
+}
+
+// Visit calls the given function for each field and, recursively, its
+// subfields.  The function is passed the field's full name (e.g.,
+// "raw.Field1") and the field.
+func (fields Fields) Visit(visit func(string, *Field)) {
+	fields.visit("", visit)
+}
+
+func (fields Fields) visit(prefix string, visit func(string, *Field)) {
+	for _, f := range fields {
+		fullName := prefix + f.Name
+		visit(fullName, f)
+		if f.IsRecord() {
+			f.Fields.visit(fullName+".", visit)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package schema_test
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/jostler/internal/schema"
+	"github.com/m-lab/jostler/internal/testhelper"
+)
+
+// A table schema in BigQuery's JSON convention whose descriptions include
+// the keys of the JSON convention and keys that Field does not model.
+const tblSchemaJSON = `[
+	{"name": "date", "type": "DATE", "mode": "REQUIRED"},
+	{"name": "raw", "type": "RECORD", "fields": [
+		{"name": "UUID", "type": "STRING", "description": "\"name\": is not a key", "maxLength": "36"},
+		{"name": "Samples", "type": "RECORD", "mode": "REPEATED", "description": "\"type\": neither", "fields": [
+			{"name": "RTT", "type": "FLOAT64"},
+			{"name": "Count", "type": "INT64", "mode": "NULLABLE"}
+		]}
+	]}
+]`
+
+func TestParseFieldsRoundTrip(t *testing.T) {
+	fields, err := schema.ParseFields([]byte(tblSchemaJSON))
+	if err != nil {
+		t.Fatalf("ParseFields() = %v, want nil", err)
+	}
+	gotJSON, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatalf("json.Marshal() = %v, want nil", err)
+	}
+	var got, want interface{}
+	if err := json.Unmarshal(gotJSON, &got); err != nil {
+		t.Fatalf("json.Unmarshal() = %v, want nil", err)
+	}
+	if err := json.Unmarshal([]byte(tblSchemaJSON), &want); err != nil {
+		t.Fatalf("json.Unmarshal() = %v, want nil", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("round trip = %s, want %s", gotJSON, tblSchemaJSON)
+	}
+}
+
+func TestParseFieldsConventions(t *testing.T) {
+	bqSchema, err := bigquery.SchemaFromJSON([]byte(tblSchemaJSON))
+	if err != nil {
+		t.Fatalf("bigquery.SchemaFromJSON() = %v, want nil", err)
+	}
+	goStructJSON, err := json.Marshal(bqSchema)
+	if err != nil {
+		t.Fatalf("json.Marshal() = %v, want nil", err)
+	}
+	bqJSON, err := bqSchema.ToJSONFields()
+	if err != nil {
+		t.Fatalf("ToJSONFields() = %v, want nil", err)
+	}
+	tests := []struct {
+		name       string
+		schemaJSON []byte
+	}{
+		{name: "BigQuery convention", schemaJSON: bqJSON},
+		{name: "Go struct convention", schemaJSON: goStructJSON},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		fields, err := schema.ParseFields(test.schemaJSON)
+		if err != nil {
+			t.Fatalf("ParseFields() = %v, want nil", err)
+		}
+		got := map[string]string{}
+		fields.Visit(func(fullName string, f *schema.Field) {
+			got[fullName] = f.FieldType() + " " + f.FieldMode() + " " + f.Description
+		})
+		want := map[string]string{
+			"date":              "DATE REQUIRED ",
+			"raw":               "RECORD NULLABLE ",
+			"raw.UUID":          `STRING NULLABLE "name": is not a key`,
+			"raw.Samples":       `RECORD REPEATED "type": neither`,
+			"raw.Samples.RTT":   "FLOAT NULLABLE ",
+			"raw.Samples.Count": "INTEGER NULLABLE ",
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("fields = %v, want %v", got, want)
+		}
+		// Both conventions should compare equal to the original.
+		diff, err := schema.CompareTableSchemas([]byte(tblSchemaJSON), test.schemaJSON)
+		if err != nil {
+			t.Fatalf("CompareTableSchemas() = %v, want nil", err)
+		}
+		if err := diff.Compatibility(); !errors.Is(err, schema.ErrSchemaMatch) {
+			t.Fatalf("Compatibility() = %v, want %v", err, schema.ErrSchemaMatch)
+		}
+	}
+}
+
+func TestParseFieldsInvalid(t *testing.T) {
+	for i, schemaJSON := range []string{
+		`{"name": "date"}`,
+		`[{"name": 1}]`,
+		`[{"name": "raw", "type": "RECORD", "fields": {}}]`,
+		`[null]`,
+		`[{"name": "date", "type": "DATE"}, null]`,
+		`[{"name": "raw", "type": "RECORD", "fields": [null]}]`,
+		`[{"Name": "raw", "Type": "RECORD", "Schema": [{"Name": "a", "Type": "RECORD", "Schema": [null]}]}]`,
+	} {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, schemaJSON, testhelper.ANSIEnd)
+		_, err := schema.ParseFields([]byte(schemaJSON))
+		if !errors.Is(err, schema.ErrUnmarshal) {
+			t.Fatalf("ParseFields() = %v, want %v", err, schema.ErrUnmarshal)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package schema
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Lister interface.
+type Lister interface {
+	List(context.Context, string) ([]string, error)
+}
+
+// DownloaderLister interface.
+type DownloaderLister interface {
+	Downloader
+	Lister
+}
+
+// SchemaVersion is a historical version of a table schema.  Every time
+// jostler uploads a table schema, it also archives a SchemaVersion in
+// the schema history of the datatype.
+type SchemaVersion struct {
+	Time      time.Time       `json:"time"`             // when the table schema was uploaded
+	Node      string          `json:"node"`             // node that uploaded the table schema
+	Version   string          `json:"version"`          // version of jostler that uploaded the table schema
+	GitCommit string          `json:"gitCommit"`        // git commit of jostler that uploaded the table schema
+	Summary   string          `json:"summary"`          // summary of differences from the previous table schema
+	Diff      *Diff           `json:"diff,omitempty"`   // differences from the previous table schema (if any)
+	Schema    json.RawMessage `json:"schema,omitempty"` // the uploaded table schema
+}
+
+// History errors.
+var (
+	ErrList           = errors.New("failed to list schema history")
+	ErrVersion        = errors.New("invalid schema version")
+	ErrVersionMissing = errors.New("schema version not found")
+)
+
+var (
+	// Node, Version, and GitCommit identify the jostler instance that
+	// uploads table schemas and are recorded in the schema history.
+	Node      string
+	Version   string
+	GitCommit string
+
+	// Format of timestamps in the object names of schema versions.
+	// Names sort in chronological order.
+	historyTimeFormat = "20060102T150405.000000Z"
+)
+
+// HistoryPath returns the GCS prefix under which historical versions of
+// the table schema for the given experiment and datatype are archived.
+// It is in a subdirectory of the directory of the table schema (as
+// expanded from TableTemplate) so the history is not mistaken for table
+// schemas.
+func HistoryPath(experiment, datatype string) string {
+	return path.Join(path.Dir(TablePath(experiment, datatype)), "history", datatype) + "/"
+}
+
+// Summary returns a short human-readable summary of the differences.
+func (d *Diff) Summary() string {
+	if d == nil {
+		return "new table schema"
+	}
+	var parts []string
+	for _, p := range []struct {
+		n    int
+		what string
+	}{
+		{len(d.Added), "added"},
+		{len(d.Removed), "removed"},
+		{len(d.TypeChanged), "type changed"},
+		{len(d.ModeChanged), "mode changed"},
+		{len(d.DescriptionChanged), "description changed"},
+	} {
+		if p.n != 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", p.n, p.what))
+		}
+	}
+	if len(parts) == 0 {
+		return "no differences"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// archiveTableSchema archives the given table schema that was just
+// uploaded together with its metadata in the schema history.
+func archiveTableSchema(gcsClient DownloaderUploader, bucket, experiment, datatype string, tblSchemaJSON []byte, diff *Diff) error {
+	now := time.Now().UTC()
+	sv := SchemaVersion{
+		Time:      now,
+		Node:      Node,
+		Version:   Version,
+		GitCommit: GitCommit,
+		Summary:   diff.Summary(),
+		Diff:      diff,
+		Schema:    tblSchemaJSON,
+	}
+	svJSON, err := json.Marshal(sv)
+	if err != nil {
+		return fmt.Errorf("%v: %w", ErrMarshal, err)
+	}
+	name := now.Format(historyTimeFormat)
+	if Node != "" {
+		name += "-" + Node
+	}
+	objPath := HistoryPath(experiment, datatype) + name + ".json"
+	verbosef("archiving '%v:%v'", bucket, objPath)
+	if err := gcsClient.Upload(context.Background(), objPath, svJSON); err != nil {
+		return fmt.Errorf("%v: %w", ErrUpload, err)
+	}
+	return nil
+}
+
+// ListHistory returns the versions of the table schema for the given
+// experiment and datatype in chronological order.  A version is the
+// base name of the GCS object without its extension.
+func ListHistory(gcsClient Lister, experiment, datatype string) ([]string, error) {
+	prefix := HistoryPath(experiment, datatype)
+	objPaths, err := gcsClient.List(context.Background(), prefix)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", ErrList, err)
+	}
+	versions := make([]string, 0, len(objPaths))
+	for _, objPath := range objPaths {
+		version := strings.TrimPrefix(objPath, prefix)
+		if strings.Contains(version, "/") || !strings.HasSuffix(version, ".json") {
+			continue
+		}
+		versions = append(versions, strings.TrimSuffix(version, ".json"))
+	}
+	sort.Strings(versions)
+	return versions, nil
+}
+
+// FetchHistory downloads and returns the given version of the table
+// schema for the given experiment and datatype.  The version "latest"
+// is the most recent version.
+func FetchHistory(gcsClient DownloaderLister, experiment, datatype, version string) (*SchemaVersion, error) {
+	if version == "" || strings.Contains(version, "/") {
+		return nil, fmt.Errorf("%q: %w", version, ErrVersion)
+	}
+	if version == "latest" {
+		versions, err := ListHistory(gcsClient, experiment, datatype)
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) == 0 {
+			return nil, fmt.Errorf("%v: %w", version, ErrVersionMissing)
+		}
+		version = versions[len(versions)-1]
+	}
+	objPath := HistoryPath(experiment, datatype) + version + ".json"
+	svJSON, err := gcsClient.Download(context.Background(), objPath)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v: %w", version, ErrDownload, err)
+	}
+	var sv SchemaVersion
+	if err := json.Unmarshal(svJSON, &sv); err != nil {
+		return nil, fmt.Errorf("%v: %v: %w", version, ErrUnmarshal, err)
+	}
+	return &sv, nil
+}
@@ -0,0 +1,108 @@
+package schema_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/jostler/internal/naming"
+	"github.com/m-lab/jostler/internal/schema"
+	"github.com/m-lab/jostler/internal/testhelper"
+)
+
+func TestHistoryPath(t *testing.T) {
+	saveGCSDataDir, saveTableTemplate, saveOrganization := schema.GCSDataDir, schema.TableTemplate, schema.Organization
+	defer func() {
+		schema.GCSDataDir, schema.TableTemplate, schema.Organization = saveGCSDataDir, saveTableTemplate, saveOrganization
+	}()
+	schema.GCSDataDir = "autoload/v1"
+	schema.Organization = "mlab"
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{name: "default template", template: naming.DefaultSchema, want: "autoload/v1/tables/jostler/history/foo1/"},
+		{name: "custom template", template: "schemas/{organization}/{experiment}-{datatype}.json", want: "autoload/v1/schemas/mlab/history/foo1/"},
+		{name: "top-level template", template: "{datatype}.json", want: "autoload/v1/history/foo1/"},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		schema.TableTemplate = naming.MustParse(test.template)
+		if got := schema.HistoryPath(testExperiment, testDatatype); got != test.want {
+			t.Fatalf("HistoryPath() = %v, want %v", got, test.want)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	saveGCSDataDir, saveNode := schema.GCSDataDir, schema.Node
+	defer func() {
+		schema.GCSDataDir, schema.Node = saveGCSDataDir, saveNode
+	}()
+	schema.GCSDataDir = t.TempDir()
+	schema.Node = "mlab1-lga01.mlab-sandbox.measurement-lab.org"
+	bucket := "newclient,download,upload,list"
+	stClient, err := testhelper.NewClient(context.Background(), bucket)
+	if err != nil {
+		t.Fatalf("testhelper.NewClient() = %v, want nil", err)
+	}
+
+	// There is no history before the first upload.
+	versions, err := schema.ListHistory(stClient, testExperiment, testDatatype)
+	if err != nil || len(versions) != 0 {
+		t.Fatalf("ListHistory() = %v, %v, want [], nil", versions, err)
+	}
+	if _, err = schema.FetchHistory(stClient, testExperiment, testDatatype, "latest"); !errors.Is(err, schema.ErrVersionMissing) {
+		t.Fatalf("FetchHistory() = %v, want %v", err, schema.ErrVersionMissing)
+	}
+
+	// Upload a new table schema, a matching one (which should not be
+	// uploaded), and a superset.
+	for _, dtSchemaFile := range []string{
+		"testdata/datatypes/foo1-valid.json",
+		"testdata/datatypes/foo1-valid.json",
+		"testdata/datatypes/foo1-valid-superset.json",
+	} {
+		if err = schema.ValidateAndUpload(stClient, bucket, testExperiment, testDatatype, dtSchemaFile, true); err != nil {
+			t.Fatalf("ValidateAndUpload() = %v, want nil", err)
+		}
+	}
+	versions, err = schema.ListHistory(stClient, testExperiment, testDatatype)
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("ListHistory() = %v, %v, want 2 versions, nil", versions, err)
+	}
+
+	tests := []struct {
+		name        string
+		version     string
+		wantErr     error
+		wantSummary string
+		wantSchema  string
+	}{
+		{name: "invalid version", version: "../foo1", wantErr: schema.ErrVersion},
+		{name: "non-existent version", version: "20000101T000000.000000Z", wantErr: schema.ErrDownload},
+		{name: "first version", version: versions[0], wantSummary: "new table schema", wantSchema: "Field1"},
+		{name: "latest version", version: "latest", wantSummary: "1 added", wantSchema: "Field3"},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		sv, err := schema.FetchHistory(stClient, testExperiment, testDatatype, test.version)
+		if test.wantErr != nil {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr.Error()) {
+				t.Fatalf("FetchHistory() = %v, want %v", err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("FetchHistory() = %v, want nil", err)
+		}
+		if sv.Summary != test.wantSummary || sv.Node != schema.Node {
+			t.Fatalf("FetchHistory() = %+v, want summary %q and node %q", sv, test.wantSummary, schema.Node)
+		}
+		if !strings.Contains(string(sv.Schema), test.wantSchema) {
+			t.Fatalf("FetchHistory() schema = %s, want %v", sv.Schema, test.wantSchema)
+		}
+	}
+}
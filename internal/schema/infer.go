@@ -0,0 +1,284 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Conflict describes a field whose type or mode could not be inferred
+// because sample files disagree or do not have enough information.
+type Conflict struct {
+	Name   string // full field name (e.g., "raw.Field1")
+	Reason string // human-readable reason of the conflict
+}
+
+// String implements the fmt.Stringer interface.
+func (c Conflict) String() string {
+	return c.Name + ": " + c.Reason
+}
+
+// node holds what has been observed about a single field (or the top
+// level object) across all sample files.
+type node struct {
+	nonNull  int               // number of non-null values observed
+	types    map[string]string // observed type -> first file it was observed in
+	arrays   int               // number of values that were arrays
+	children map[string]*node  // subfields of RECORD fields
+	objects  int               // number of objects (i.e., parents of children)
+}
+
+// Inference errors.
+var (
+	ErrSampleFile = errors.New("failed to read sample file")
+	ErrNotObject  = errors.New("sample is not a JSON object")
+	ErrNoSamples  = errors.New("no samples")
+)
+
+// Field types that can only be inferred and are not valid BigQuery types.
+const (
+	typeArray = "ARRAY" // an array in an array
+)
+
+// columnNameRegex matches valid BigQuery column names.
+var columnNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// InferFields infers a datatype schema from the given sample files.  Each
+// sample file contains one or more JSON objects, each of which is what
+// jostler adds to a bundle as the "raw" column.
+//
+// Field types are inferred from JSON values: booleans are BOOLEAN,
+// numbers are INTEGER or FLOAT, strings are TIMESTAMP, DATE, or STRING,
+// and objects are RECORD.  Arrays are REPEATED fields of the type of
+// their elements.  A field is REQUIRED if it is non-null in all objects
+// that contain it and NULLABLE otherwise.  When samples disagree in a
+// compatible way (e.g., INTEGER and FLOAT), the wider type is inferred.
+//
+// Fields that cannot be inferred are returned as conflicts and omitted
+// from the returned schema.
+func InferFields(sampleFiles []string) (Fields, []Conflict, error) {
+	if len(sampleFiles) == 0 {
+		return nil, nil, ErrNoSamples
+	}
+	root := &node{}
+	for _, sampleFile := range sampleFiles {
+		if err := root.inferFile(sampleFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	var conflicts []Conflict
+	fields := root.fields("", &conflicts)
+	return fields, conflicts, nil
+}
+
+// inferFile observes all JSON objects in the given sample file.
+func (n *node) inferFile(sampleFile string) error {
+	f, err := os.Open(sampleFile)
+	if err != nil {
+		return fmt.Errorf("%v: %w", ErrSampleFile, err)
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	for {
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("%v: %v: %w", sampleFile, ErrUnmarshal, err)
+		}
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%v: %w", sampleFile, ErrNotObject)
+		}
+		n.observeObject(obj, sampleFile)
+	}
+}
+
+// observe records the given value of the field.
+func (n *node) observe(v interface{}, sampleFile string) {
+	if v == nil {
+		return
+	}
+	n.nonNull++
+	if elems, ok := v.([]interface{}); ok {
+		n.arrays++
+		for _, elem := range elems {
+			switch elem := elem.(type) {
+			case nil:
+				// BigQuery does not allow nulls in arrays.
+			case []interface{}:
+				n.addType(typeArray, sampleFile)
+			default:
+				n.observeScalar(elem, sampleFile)
+			}
+		}
+		return
+	}
+	n.observeScalar(v, sampleFile)
+}
+
+// observeScalar records the type of the given non-array value.
+func (n *node) observeScalar(v interface{}, sampleFile string) {
+	switch v := v.(type) {
+	case bool:
+		n.addType("BOOLEAN", sampleFile)
+	case json.Number:
+		if strings.ContainsAny(string(v), ".eE") {
+			n.addType("FLOAT", sampleFile)
+		} else {
+			n.addType("INTEGER", sampleFile)
+		}
+	case string:
+		n.addType(stringType(v), sampleFile)
+	case map[string]interface{}:
+		n.addType("RECORD", sampleFile)
+		n.observeObject(v, sampleFile)
+	}
+}
+
+// observeObject records the fields of the given object.
+func (n *node) observeObject(obj map[string]interface{}, sampleFile string) {
+	n.objects++
+	if n.children == nil {
+		n.children = make(map[string]*node)
+	}
+	for name, v := range obj {
+		child, ok := n.children[name]
+		if !ok {
+			child = &node{}
+			n.children[name] = child
+		}
+		child.observe(v, sampleFile)
+	}
+}
+
+// addType records that the field had a value of the given type.
+func (n *node) addType(fieldType, sampleFile string) {
+	if n.types == nil {
+		n.types = make(map[string]string)
+	}
+	if _, ok := n.types[fieldType]; !ok {
+		n.types[fieldType] = sampleFile
+	}
+}
+
+// stringType returns the type of the given string value.
+func stringType(s string) string {
+	if _, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return "TIMESTAMP"
+	}
+	if _, err := time.Parse(time.DateOnly, s); err == nil {
+		return "DATE"
+	}
+	return "STRING"
+}
+
+// fields returns the subfields of the node sorted by name and appends
+// the fields that cannot be inferred to conflicts.
+func (n *node) fields(prefix string, conflicts *[]Conflict) Fields {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fields := Fields{}
+	lowerNames := make(map[string]string, len(names))
+	for _, name := range names {
+		fullName := prefix + name
+		// BigQuery column names are case insensitive.
+		lowerName := strings.ToLower(name)
+		if other, ok := lowerNames[lowerName]; ok {
+			*conflicts = append(*conflicts, Conflict{Name: fullName, Reason: fmt.Sprintf("same column name as %v%v", prefix, other)})
+			continue
+		}
+		lowerNames[lowerName] = name
+		if !columnNameRegex.MatchString(name) {
+			*conflicts = append(*conflicts, Conflict{Name: fullName, Reason: "invalid column name"})
+			continue
+		}
+		field, reason := n.children[name].field(name, n.objects)
+		if reason != "" {
+			*conflicts = append(*conflicts, Conflict{Name: fullName, Reason: reason})
+			continue
+		}
+		if field.IsRecord() {
+			field.Fields = n.children[name].fields(fullName+".", conflicts)
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// field returns the field inferred from the node or the reason it
+// cannot be inferred.  The parents argument is the number of objects
+// observed in the field's parent.
+func (n *node) field(name string, parents int) (*Field, string) {
+	if len(n.types) == 0 {
+		return nil, "no non-null values to infer type from"
+	}
+	if _, ok := n.types[typeArray]; ok {
+		return nil, fmt.Sprintf("arrays of arrays are not supported (%v)", n.types[typeArray])
+	}
+	if n.arrays != 0 && n.arrays != n.nonNull {
+		return nil, "both arrays and non-arrays"
+	}
+	fieldType, ok := widenTypes(n.types)
+	if !ok {
+		return nil, "incompatible types " + n.typesString()
+	}
+	field := &Field{Name: name, Type: fieldType}
+	switch {
+	case n.arrays != 0:
+		field.Mode = ModeRepeated
+	case n.nonNull == parents:
+		field.Mode = ModeRequired
+	default:
+		field.Mode = ModeNullable
+	}
+	return field, ""
+}
+
+// widenTypes returns the narrowest type that can hold values of all the
+// given types.
+func widenTypes(types map[string]string) (string, bool) {
+	if len(types) == 1 {
+		for t := range types {
+			return t, true
+		}
+	}
+	numeric, stringish := 0, 0
+	for t := range types {
+		switch t {
+		case "INTEGER", "FLOAT":
+			numeric++
+		case "STRING", "TIMESTAMP", "DATE":
+			stringish++
+		}
+	}
+	switch len(types) {
+	case numeric:
+		return "FLOAT", true
+	case stringish:
+		return "STRING", true
+	}
+	return "", false
+}
+
+// typesString returns the observed types and the first file each type
+// was observed in.
+func (n *node) typesString() string {
+	types := make([]string, 0, len(n.types))
+	for t, sampleFile := range n.types {
+		types = append(types, fmt.Sprintf("%v (%v)", t, sampleFile))
+	}
+	sort.Strings(types)
+	return strings.Join(types, ", ")
+}
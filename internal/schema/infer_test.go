@@ -0,0 +1,145 @@
+package schema_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/jostler/internal/schema"
+	"github.com/m-lab/jostler/internal/testhelper"
+)
+
+func TestInferFields(t *testing.T) {
+	tests := []struct {
+		name          string
+		samples       []string          // contents of sample files
+		wantErr       error             // expected error
+		wantFields    map[string]string // full field name -> "TYPE MODE"
+		wantConflicts []string          // full names of conflicting fields
+	}{
+		{
+			name:    "no samples",
+			wantErr: schema.ErrNoSamples,
+		},
+		{
+			name:    "invalid JSON",
+			samples: []string{`{"a": 1`},
+			wantErr: schema.ErrUnmarshal,
+		},
+		{
+			name:    "not an object",
+			samples: []string{`[1, 2]`},
+			wantErr: schema.ErrNotObject,
+		},
+		{
+			name: "scalar types and modes",
+			samples: []string{
+				`{"b": true, "i": 1, "f": 1.5, "s": "x", "t": "2023-01-02T03:04:05Z", "d": "2023-01-02", "n": 1}`,
+				`{"b": false, "i": 2, "f": 2, "s": "y", "t": "2023-01-02T03:04:05.123Z", "d": "2023-01-03", "n": null}`,
+			},
+			wantFields: map[string]string{
+				"b": "BOOLEAN REQUIRED",
+				"d": "DATE REQUIRED",
+				"f": "FLOAT REQUIRED",
+				"i": "INTEGER REQUIRED",
+				"n": "INTEGER NULLABLE",
+				"s": "STRING REQUIRED",
+				"t": "TIMESTAMP REQUIRED",
+			},
+		},
+		{
+			name: "nested and repeated fields in multiple objects per file",
+			samples: []string{
+				`{"r": {"a": 1, "b": "x"}, "rr": [{"a": 1}, {"a": 2, "b": 3}], "s": ["x"]}
+				 {"r": {"a": 2}, "rr": [], "s": []}`,
+				`{"o": "2023-01-02"}`,
+			},
+			wantFields: map[string]string{
+				"o":    "DATE NULLABLE",
+				"r":    "RECORD NULLABLE",
+				"r.a":  "INTEGER REQUIRED",
+				"r.b":  "STRING NULLABLE",
+				"rr":   "RECORD REPEATED",
+				"rr.a": "INTEGER REQUIRED",
+				"rr.b": "INTEGER NULLABLE",
+				"s":    "STRING REPEATED",
+			},
+		},
+		{
+			name: "widened types",
+			samples: []string{
+				`{"n": 1, "s": "2023-01-02"}`,
+				`{"n": 1e3, "s": "not a date"}`,
+			},
+			wantFields: map[string]string{
+				"n": "FLOAT REQUIRED",
+				"s": "STRING REQUIRED",
+			},
+		},
+		{
+			name: "conflicts",
+			samples: []string{
+				`{"ok": 1, "types": 1, "array": [1], "null": null, "nested": [[1]], "bad-name": 1, "Case": 1, "case": 1}`,
+				`{"ok": 2, "types": "x", "array": 1, "r": {"types": true}}`,
+				`{"r": {"types": {"a": 1}}}`,
+			},
+			wantFields: map[string]string{
+				"Case": "INTEGER NULLABLE",
+				"ok":   "INTEGER NULLABLE",
+				"r":    "RECORD NULLABLE",
+			},
+			wantConflicts: []string{"array", "bad-name", "case", "nested", "null", "r.types", "types"},
+		},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		dir := t.TempDir()
+		sampleFiles := []string{}
+		for j, sample := range test.samples {
+			sampleFile := filepath.Join(dir, strings.Repeat("s", j+1)+".json")
+			if err := os.WriteFile(sampleFile, []byte(sample), 0o666); err != nil {
+				t.Fatalf("os.WriteFile() = %v, want nil", err)
+			}
+			sampleFiles = append(sampleFiles, sampleFile)
+		}
+		fields, conflicts, err := schema.InferFields(sampleFiles)
+		if test.wantErr != nil {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr.Error()) {
+				t.Fatalf("InferFields() = %v, want %v", err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("InferFields() = %v, want nil", err)
+		}
+		gotFields := map[string]string{}
+		fields.Visit(func(fullName string, f *schema.Field) {
+			gotFields[fullName] = f.Type + " " + f.Mode
+		})
+		if !reflect.DeepEqual(gotFields, test.wantFields) {
+			t.Fatalf("InferFields() fields = %v, want %v", gotFields, test.wantFields)
+		}
+		gotConflicts := []string{}
+		for _, conflict := range conflicts {
+			gotConflicts = append(gotConflicts, conflict.Name)
+		}
+		if test.wantConflicts == nil {
+			test.wantConflicts = []string{}
+		}
+		if !reflect.DeepEqual(gotConflicts, test.wantConflicts) {
+			t.Fatalf("InferFields() conflicts = %v, want %v", conflicts, test.wantConflicts)
+		}
+		// The inferred schema should be a valid BigQuery schema.
+		dtSchemaJSON, err := json.Marshal(fields)
+		if err != nil {
+			t.Fatalf("json.Marshal() = %v, want nil", err)
+		}
+		if _, err := bigquery.SchemaFromJSON(dtSchemaJSON); err != nil {
+			t.Fatalf("bigquery.SchemaFromJSON() = %v, want nil", err)
+		}
+	}
+}
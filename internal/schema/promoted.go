@@ -0,0 +1,77 @@
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// ErrPromotedField means a field configured to be promoted to a standard
+// column is not in the datatype schema or has the wrong type or mode.
+var ErrPromotedField = errors.New("invalid promoted field")
+
+var (
+	// IDFields and TestTimeFields map datatypes to the full names of
+	// fields in their raw data (e.g., "UUID" or "Meta.StartTime") whose
+	// values are promoted to the id and a.TestTime standard columns.
+	IDFields       = map[string]string{}
+	TestTimeFields = map[string]string{}
+)
+
+// promotedColumns returns the schema of standard columns that are
+// promoted from the given datatype schema.  The columns are NULLABLE so
+// they can be added to existing tables.
+func promotedColumns(datatype string, dtSchema bigquery.Schema) (bigquery.Schema, error) {
+	var promoted bigquery.Schema
+	if fieldName, ok := IDFields[datatype]; ok {
+		if err := checkPromotedField(dtSchema, fieldName, bigquery.StringFieldType); err != nil {
+			return nil, err
+		}
+		promoted = append(promoted, &bigquery.FieldSchema{Name: "id", Type: bigquery.StringFieldType})
+	}
+	if fieldName, ok := TestTimeFields[datatype]; ok {
+		if err := checkPromotedField(dtSchema, fieldName, bigquery.TimestampFieldType); err != nil {
+			return nil, err
+		}
+		promoted = append(promoted, &bigquery.FieldSchema{
+			Name: "a",
+			Type: bigquery.RecordFieldType,
+			Schema: bigquery.Schema{
+				{Name: "TestTime", Type: bigquery.TimestampFieldType},
+			},
+		})
+	}
+	return promoted, nil
+}
+
+// checkPromotedField checks that the given full field name is a scalar
+// field of the given type in the given datatype schema.
+func checkPromotedField(dtSchema bigquery.Schema, fullName string, fieldType bigquery.FieldType) error {
+	schema := dtSchema
+	names := strings.Split(fullName, ".")
+	for i, name := range names {
+		var field *bigquery.FieldSchema
+		for _, f := range schema {
+			if strings.EqualFold(f.Name, name) {
+				field = f
+				break
+			}
+		}
+		if field == nil {
+			return fmt.Errorf("%v: not in datatype schema: %w", fullName, ErrPromotedField)
+		}
+		if field.Repeated {
+			return fmt.Errorf("%v: is repeated: %w", fullName, ErrPromotedField)
+		}
+		if i < len(names)-1 {
+			schema = field.Schema
+			continue
+		}
+		if field.Type != fieldType {
+			return fmt.Errorf("%v: type is %v, want %v: %w", fullName, field.Type, fieldType, ErrPromotedField)
+		}
+	}
+	return nil
+}
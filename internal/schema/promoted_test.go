@@ -0,0 +1,93 @@
+package schema_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/jostler/internal/schema"
+	"github.com/m-lab/jostler/internal/testhelper"
+)
+
+func TestPromotedColumns(t *testing.T) {
+	saveIDFields, saveTestTimeFields := schema.IDFields, schema.TestTimeFields
+	defer func() {
+		schema.IDFields, schema.TestTimeFields = saveIDFields, saveTestTimeFields
+	}()
+	dtSchemaFile := filepath.Join(t.TempDir(), "foo1.json")
+	dtSchema := `[
+		{"name": "UUID", "type": "STRING"},
+		{"name": "Tags", "type": "STRING", "mode": "REPEATED"},
+		{"name": "Meta", "type": "RECORD", "fields": [{"name": "StartTime", "type": "TIMESTAMP"}]}
+	]`
+	if err := os.WriteFile(dtSchemaFile, []byte(dtSchema), 0o666); err != nil {
+		t.Fatalf("os.WriteFile() = %v, want nil", err)
+	}
+	tests := []struct {
+		name          string
+		idField       string
+		testTimeField string
+		wantErr       error
+		wantFields    []string // fields that should be in the table schema
+	}{
+		{
+			name:       "no promoted columns",
+			wantFields: []string{"raw.UUID"},
+		},
+		{
+			name:          "id and test time",
+			idField:       "UUID",
+			testTimeField: "Meta.StartTime",
+			wantFields:    []string{"id", "a.TestTime", "raw.Meta.StartTime"},
+		},
+		{
+			name:    "missing field",
+			idField: "Meta.UUID",
+			wantErr: schema.ErrPromotedField,
+		},
+		{
+			name:          "wrong type",
+			testTimeField: "UUID",
+			wantErr:       schema.ErrPromotedField,
+		},
+		{
+			name:    "repeated field",
+			idField: "Tags",
+			wantErr: schema.ErrPromotedField,
+		},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		schema.IDFields, schema.TestTimeFields = map[string]string{}, map[string]string{}
+		if test.idField != "" {
+			schema.IDFields[testDatatype] = test.idField
+		}
+		if test.testTimeField != "" {
+			schema.TestTimeFields[testDatatype] = test.testTimeField
+		}
+		tblSchemaJSON, err := schema.CreateTableSchemaJSON(testDatatype, dtSchemaFile)
+		if test.wantErr != nil {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr.Error()) {
+				t.Fatalf("CreateTableSchemaJSON() = %v, want %v", err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("CreateTableSchemaJSON() = %v, want nil", err)
+		}
+		fields, err := schema.ParseFields(tblSchemaJSON)
+		if err != nil {
+			t.Fatalf("ParseFields() = %v, want nil", err)
+		}
+		gotFields := map[string]string{}
+		fields.Visit(func(fullName string, f *schema.Field) {
+			gotFields[fullName] = f.FieldMode()
+		})
+		for _, want := range test.wantFields {
+			if gotFields[want] != schema.ModeNullable {
+				t.Fatalf("CreateTableSchemaJSON() = %s, want NULLABLE %v", tblSchemaJSON, want)
+			}
+		}
+	}
+}
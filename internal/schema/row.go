@@ -0,0 +1,142 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrRow means a row (e.g., a line of a data bundle) does not conform to
+// its table schema.
+var ErrRow = errors.New("row does not conform to table schema")
+
+// ValidateRow validates that the given row, a JSON object, conforms to
+// the fields: every key is a field, every value has its field's type and
+// mode, and every required field has a value.  Like BigQuery, names are
+// compared case insensitively and strings are accepted for numbers and
+// booleans.
+func (fields Fields) ValidateRow(row []byte) error {
+	d := json.NewDecoder(bytes.NewReader(row))
+	d.UseNumber()
+	var obj map[string]interface{}
+	if err := d.Decode(&obj); err != nil {
+		return fmt.Errorf("%v: %w", err, ErrRow)
+	}
+	return fields.validateObject("", obj)
+}
+
+// validateObject validates the given object whose keys are the names of
+// the fields.  The prefix is the full name of the object's field (if any)
+// for error messages.
+func (fields Fields) validateObject(prefix string, obj map[string]interface{}) error {
+	byName := make(map[string]*Field, len(fields))
+	for _, f := range fields {
+		byName[strings.ToLower(f.Name)] = f
+	}
+	present := make(map[string]bool, len(obj))
+	for k, v := range obj {
+		f, ok := byName[strings.ToLower(k)]
+		if !ok {
+			return fmt.Errorf("%v%v: not in table schema: %w", prefix, k, ErrRow)
+		}
+		if err := f.validateValue(prefix+f.Name, v); err != nil {
+			return err
+		}
+		present[strings.ToLower(k)] = v != nil
+	}
+	for _, f := range fields {
+		if f.FieldMode() == ModeRequired && !present[strings.ToLower(f.Name)] {
+			return fmt.Errorf("%v%v: missing required field: %w", prefix, f.Name, ErrRow)
+		}
+	}
+	return nil
+}
+
+// validateValue validates the given value of the field.
+func (f *Field) validateValue(fullName string, v interface{}) error {
+	if v == nil {
+		if f.FieldMode() == ModeRequired {
+			return fmt.Errorf("%v: null in required field: %w", fullName, ErrRow)
+		}
+		return nil
+	}
+	if f.FieldMode() != ModeRepeated {
+		return f.validateScalar(fullName, v)
+	}
+	elems, ok := v.([]interface{})
+	if !ok {
+		return fmt.Errorf("%v: not an array in repeated field: %w", fullName, ErrRow)
+	}
+	for i, elem := range elems {
+		elemName := fmt.Sprintf("%v[%d]", fullName, i)
+		if elem == nil {
+			return fmt.Errorf("%v: null in array: %w", elemName, ErrRow)
+		}
+		if err := f.validateScalar(elemName, elem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateScalar validates the given non-null value of a single element
+// of the field.
+func (f *Field) validateScalar(fullName string, v interface{}) error {
+	valid := true
+	switch f.FieldType() {
+	case "RECORD":
+		obj, ok := v.(map[string]interface{})
+		if ok {
+			return f.Fields.validateObject(fullName+".", obj)
+		}
+		valid = false
+	case "INTEGER":
+		valid = isNumber(v, func(s string) bool {
+			_, err := strconv.ParseInt(s, 10, 64)
+			return err == nil
+		})
+	case "FLOAT", "NUMERIC", "BIGNUMERIC":
+		valid = isNumber(v, func(s string) bool {
+			_, err := strconv.ParseFloat(s, 64)
+			return err == nil
+		})
+	case "BOOLEAN":
+		switch v := v.(type) {
+		case bool:
+		case string:
+			_, err := strconv.ParseBool(v)
+			valid = err == nil
+		default:
+			valid = false
+		}
+	case "TIMESTAMP":
+		// Timestamps can also be seconds since the epoch.
+		switch v.(type) {
+		case string, json.Number:
+		default:
+			valid = false
+		}
+	case "JSON":
+	default:
+		_, valid = v.(string)
+	}
+	if !valid {
+		return fmt.Errorf("%v: %v is not %v: %w", fullName, v, f.FieldType(), ErrRow)
+	}
+	return nil
+}
+
+// isNumber returns true if the given value is a number or a string that
+// the given parse function accepts.
+func isNumber(v interface{}, parse func(string) bool) bool {
+	switch v := v.(type) {
+	case json.Number:
+		return parse(string(v))
+	case string:
+		return parse(v)
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package schema_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/m-lab/jostler/internal/schema"
+	"github.com/m-lab/jostler/internal/testhelper"
+)
+
+func TestValidateRow(t *testing.T) {
+	fields, err := schema.ParseFields([]byte(tblSchemaJSON))
+	if err != nil {
+		t.Fatalf("ParseFields() = %v, want nil", err)
+	}
+	tests := []struct {
+		name    string
+		row     string
+		wantErr error
+	}{
+		{name: "valid", row: `{"date": "2023-04-04", "raw": {"UUID": "x", "Samples": [{"RTT": 1.5, "Count": 3}, {"RTT": 2}]}}`},
+		{name: "case insensitive", row: `{"Date": "2023-04-04", "RAW": {"uuid": "x"}}`},
+		{name: "nulls", row: `{"date": "2023-04-04", "raw": {"UUID": null, "Samples": null}}`},
+		{name: "strings for numbers", row: `{"date": "2023-04-04", "raw": {"Samples": [{"RTT": "1.5", "Count": "3"}]}}`},
+		{name: "not an object", row: `[]`, wantErr: schema.ErrRow},
+		{name: "invalid JSON", row: `{"date": `, wantErr: schema.ErrRow},
+		{name: "missing required field", row: `{"raw": {"UUID": "x"}}`, wantErr: schema.ErrRow},
+		{name: "null required field", row: `{"date": null}`, wantErr: schema.ErrRow},
+		{name: "unknown field", row: `{"date": "2023-04-04", "raw": {"Unknown": 1}}`, wantErr: schema.ErrRow},
+		{name: "wrong type", row: `{"date": "2023-04-04", "raw": {"UUID": 1}}`, wantErr: schema.ErrRow},
+		{name: "float for integer", row: `{"date": "2023-04-04", "raw": {"Samples": [{"Count": 1.5}]}}`, wantErr: schema.ErrRow},
+		{name: "not an array", row: `{"date": "2023-04-04", "raw": {"Samples": {"RTT": 1.5}}}`, wantErr: schema.ErrRow},
+		{name: "null in array", row: `{"date": "2023-04-04", "raw": {"Samples": [null]}}`, wantErr: schema.ErrRow},
+		{name: "not a record", row: `{"date": "2023-04-04", "raw": "x"}`, wantErr: schema.ErrRow},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		if err := fields.ValidateRow([]byte(test.row)); !errors.Is(err, test.wantErr) {
+			t.Fatalf("ValidateRow() = %v, want %v", err, test.wantErr)
+		}
+	}
+}
@@ -6,30 +6,75 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"os"
-	"path"
 	"sort"
 	"strings"
 
 	"cloud.google.com/go/bigquery"
 	"cloud.google.com/go/storage"
 	"github.com/m-lab/jostler/api"
+	"github.com/m-lab/jostler/internal/gcs"
+	"github.com/m-lab/jostler/internal/naming"
 )
 
+// Downloader interface.
+type Downloader interface {
+	Download(context.Context, string) ([]byte, error)
+}
+
 // DownloaderUploader interface.
 type DownloaderUploader interface {
-	Download(context.Context, string) ([]byte, error)
+	Downloader
 	Upload(context.Context, string, []byte) error
+	DownloadWithGeneration(context.Context, string) ([]byte, int64, error)
+	UploadIfGeneration(context.Context, string, []byte, int64) error
 }
 
-type (
-	bqField   map[string]interface{}
-	visitFunc func([]string, bqField) error
-	mapDiff   struct {
-		nInOld int
-		nInNew int
-		nType  int
-	}
+// FieldDiff describes how a single field differs between the old and
+// the new table schemas.  Only the old or the new attributes are set
+// for fields that were removed or added respectively.
+type FieldDiff struct {
+	Name           string `json:"name"`                     // full field name (e.g., "raw.Field1")
+	OldType        string `json:"oldType,omitempty"`        // field type in the old schema
+	NewType        string `json:"newType,omitempty"`        // field type in the new schema
+	OldMode        string `json:"oldMode,omitempty"`        // field mode in the old schema
+	NewMode        string `json:"newMode,omitempty"`        // field mode in the new schema
+	OldDescription string `json:"oldDescription,omitempty"` // field description in the old schema
+	NewDescription string `json:"newDescription,omitempty"` // field description in the new schema
+}
+
+// Diff describes the differences between an old and a new table schema.
+// Fields in each slice are sorted by their full names.
+type Diff struct {
+	Added       []FieldDiff `json:"added"`       // fields only in the new schema
+	Removed     []FieldDiff `json:"removed"`     // fields only in the old schema
+	TypeChanged []FieldDiff `json:"typeChanged"` // fields whose types differ
+	ModeChanged []FieldDiff `json:"modeChanged"` // fields whose modes differ
+
+	DescriptionChanged []FieldDiff `json:"descriptionChanged"` // fields whose descriptions differ
+}
+
+// tableSchemas holds the old (i.e., in GCS) and the new table schemas of
+// a datatype when validating and uploading the new table schema.
+type tableSchemas struct {
+	oldJSON    []byte // old table schema (nil if it does not exist)
+	generation int64  // GCS generation of the old table schema (0 if it does not exist)
+	newJSON    []byte // new table schema
+	diff       *Diff  // differences between old and new (nil if old does not exist)
+}
+
+type fieldInfo struct {
+	Type        string
+	Mode        string
+	Description string
+}
+
+// BigQuery field modes.
+const (
+	ModeNullable = "NULLABLE"
+	ModeRequired = "REQUIRED"
+	ModeRepeated = "REPEATED"
 )
 
 // Exported errors.
@@ -48,8 +93,12 @@ var (
 	ErrDownload       = errors.New("failed to download schema")
 	ErrUpload         = errors.New("failed to upload schema")
 	ErrNewFields      = errors.New("difference(s) in schema new fields")
+	ErrModeMismatch   = errors.New("incompatible difference(s) in schema field modes")
+	ErrModeRelaxed    = errors.New("difference(s) in schema relaxed field modes")
+	ErrDescriptions   = errors.New("difference(s) in schema field descriptions")
 	ErrSchemaMatch    = errors.New("old and new schemas match")
 	ErrSchemaNotFound = errors.New("schema not found")
+	ErrStdColsVersion = errors.New("unsupported standard columns version")
 )
 
 var (
@@ -59,8 +108,22 @@ var (
 	GCSDataDir           = "autoload/v1"
 	dtSchemaPathTemplate = "/datatypes/<datatype>.json"
 
+	// TableTemplate is the template of GCS object names of table
+	// schemas relative to GCSDataDir and Organization is the value of
+	// its {organization} variable.
+	TableTemplate = naming.MustParse(naming.DefaultSchema)
+	Organization  string
+
+	// StdColsVersions maps datatypes to the versions of their standard
+	// columns.  Datatypes that are not in the map use api.StdColsV0.
+	StdColsVersions = map[string]string{}
+
 	// Testing and debugging support.
 	verbosef = func(fmt string, args ...interface{}) {}
+
+	// Maximum number of attempts to upload a table schema when other
+	// nodes upload it at the same time.
+	maxUploadAttempts = 5
 )
 
 // Verbose prints verbosef messages if initialized by the caller.
@@ -80,6 +143,15 @@ func PathForDatatype(datatype string, dtSchemaFiles []string) string {
 	return LocalDataDir + strings.Replace(dtSchemaPathTemplate, "<datatype>", datatype, 1)
 }
 
+// StdColsVersion returns the version of standard columns for the given
+// datatype.
+func StdColsVersion(datatype string) string {
+	if version, ok := StdColsVersions[datatype]; ok {
+		return version
+	}
+	return api.StdColsV0
+}
+
 // ValidateSchemaFile validates the specified schema file exists and is
 // well-formed JSON.
 //
@@ -116,15 +188,44 @@ func CreateTableSchemaJSON(datatype, dtSchemaFile string) ([]byte, error) {
 // schema for the given datatype and returns an error if they are not
 // compatibale. If the new table schema is a superset of the previous one, it
 // will be uploaded to GCS.
+//
+// Because many nodes may validate and upload the same table schema at the
+// same time, uploads are conditional on the previous table schema not
+// having changed since it was downloaded.  If it has changed, the new
+// table schema is validated against the changed one and the upload is
+// retried.
 func ValidateAndUpload(gcsClient DownloaderUploader, bucket, experiment, datatype, dtSchemaFile string, uploadSchema bool) error {
-	err := validate(gcsClient, bucket, experiment, datatype, dtSchemaFile)
-	if uploadSchema && (errors.Is(err, ErrSchemaNotFound) || errors.Is(err, ErrNewFields)) {
+	var err error
+	for attempt := 1; attempt <= maxUploadAttempts; attempt++ {
+		err = validateAndUpload(gcsClient, bucket, experiment, datatype, dtSchemaFile, uploadSchema)
+		if !errors.Is(err, gcs.ErrGenerationMismatch) {
+			break
+		}
+		verbosef("attempt %d to upload table schema for %v lost the race: %v", attempt, datatype, err)
+	}
+	return err
+}
+
+// validateAndUpload makes one attempt to validate and upload the given
+// table schema.
+func validateAndUpload(gcsClient DownloaderUploader, bucket, experiment, datatype, dtSchemaFile string, uploadSchema bool) error {
+	tblSchemas, err := validate(gcsClient, bucket, experiment, datatype, dtSchemaFile)
+	if uploadSchema && (errors.Is(err, ErrSchemaNotFound) || errors.Is(err, ErrNewFields) ||
+		errors.Is(err, ErrModeRelaxed) || errors.Is(err, ErrDescriptions)) {
 		// For autoload/v1 conventions and authoritative autoload/v2 configurations.
-		// Upload when the schema is not found or there are new local fields in the schema.
-		err = uploadTableSchema(gcsClient, bucket, experiment, datatype, dtSchemaFile)
-	} else if !uploadSchema && errors.Is(err, ErrOnlyInOld) {
+		// Upload when the schema is not found or there are new local fields,
+		// relaxed field modes, or new descriptions in the schema.
+		err = uploadTableSchema(gcsClient, bucket, experiment, datatype, tblSchemas)
+	} else if uploadSchema && errors.Is(err, ErrOnlyInOld) && tblSchemas.diff.onlyStdColsRemoved() {
+		// The table was created with a newer version of standard
+		// columns than this datatype uses (e.g., while nodes migrate
+		// to a new version).  Rows with older standard columns remain
+		// valid so allow the schema without uploading it.
+		err = nil
+	} else if !uploadSchema && (errors.Is(err, ErrOnlyInOld) || errors.Is(err, ErrDescriptions)) {
 		// For autoload/v2 conventions without local schema uploads.
-		// Allow backward compatible local schemas.
+		// Allow backward compatible local schemas and schemas whose
+		// only differences are field descriptions.
 		err = nil
 	}
 	// In all cases, allow matching schemas.
@@ -135,47 +236,139 @@ func ValidateAndUpload(gcsClient DownloaderUploader, bucket, experiment, datatyp
 }
 
 // validate checks the given table schema against the previous table schema for
-// various differences and returns a SchemaStatus corresponding to the
-// difference.
-func validate(gcsClient DownloaderUploader, bucket, experiment, datatype, dtSchemaFile string) error {
+// various differences and returns both table schemas and an error
+// corresponding to their differences.
+func validate(gcsClient DownloaderUploader, bucket, experiment, datatype, dtSchemaFile string) (*tableSchemas, error) {
 	if err := ValidateSchemaFile(dtSchemaFile); err != nil {
-		return fmt.Errorf("%v: %w", err, ErrInvalidSchema)
+		return nil, fmt.Errorf("%v: %w", err, ErrInvalidSchema)
 	}
-	diff, err := diffTableSchemas(gcsClient, bucket, experiment, datatype, dtSchemaFile)
+	// Fetch the old table schema and its generation if it exists.
+	objPath := TablePath(experiment, datatype)
+	verbosef("downloading '%v:%v'", bucket, objPath)
+	oldTblSchemaJSON, generation, err := gcsClient.DownloadWithGeneration(context.Background(), objPath)
 	if err != nil {
 		if !errors.Is(err, storage.ErrObjectNotExist) {
-			return fmt.Errorf("%v: %w", err, ErrCompare)
+			return nil, fmt.Errorf("%v: %v: %w", ErrDownload, err, ErrCompare)
 		}
 		// Scenario 1: old doesn't exist, should upload new.
-		return ErrSchemaNotFound
+		oldTblSchemaJSON = nil
+	} else {
+		verbosef("successfully downloaded '%v:%v' generation %v", bucket, objPath, generation)
 	}
-	if diff.nType != 0 {
+	tblSchemas := &tableSchemas{oldJSON: oldTblSchemaJSON, generation: generation}
+	tblSchemas.newJSON, tblSchemas.diff, err = compareTableSchema(oldTblSchemaJSON, datatype, dtSchemaFile)
+	return tblSchemas, err
+}
+
+// ValidateTableSchema validates the given datatype schema file and
+// compares the table schema created from it against the given old table
+// schema without uploading anything.  It returns their differences and
+// an error from Diff.Compatibility() or ErrSchemaNotFound if the old
+// table schema is nil.
+func ValidateTableSchema(oldTblSchemaJSON []byte, datatype, dtSchemaFile string) (*Diff, error) {
+	if err := ValidateSchemaFile(dtSchemaFile); err != nil {
+		return nil, fmt.Errorf("%v: %w", err, ErrInvalidSchema)
+	}
+	_, diff, err := compareTableSchema(oldTblSchemaJSON, datatype, dtSchemaFile)
+	return diff, err
+}
+
+// compareTableSchema creates a new table schema for the given datatype,
+// compares it against the given old table schema, and returns the new
+// table schema, their differences, and an error corresponding to the
+// differences.
+func compareTableSchema(oldTblSchemaJSON []byte, datatype, dtSchemaFile string) ([]byte, *Diff, error) {
+	newTblSchemaJSON, err := CreateTableSchemaJSON(datatype, dtSchemaFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v: %w", err, ErrCompare)
+	}
+	if oldTblSchemaJSON == nil {
+		return newTblSchemaJSON, nil, ErrSchemaNotFound
+	}
+	diff, err := CompareTableSchemas(oldTblSchemaJSON, newTblSchemaJSON)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v: %w", err, ErrCompare)
+	}
+	return newTblSchemaJSON, diff, diff.Compatibility()
+}
+
+// Compatibility returns an error that describes whether the new table
+// schema is compatible with the old one.  The returned error wraps one of
+// the following errors (in order of precedence):
+//
+//   - ErrTypeMismatch: a field's type changed (incompatible).
+//   - ErrModeMismatch: a field's mode changed in a way that is not
+//     backward compatible (e.g., NULLABLE to REQUIRED or REPEATED).
+//   - ErrNewFields: the new schema is a superset of the old one.
+//   - ErrModeRelaxed: a field's mode was relaxed (REQUIRED to NULLABLE).
+//   - ErrOnlyInOld: the new schema is a subset of the old one (backward
+//     compatible).
+//   - ErrDescriptions: only field descriptions changed.
+//   - ErrSchemaMatch: the schemas match.
+func (d *Diff) Compatibility() error {
+	if len(d.TypeChanged) != 0 {
 		// Scenario 4 - new incompatible with old due to field type mismatch, should not upload.
-		return fmt.Errorf("incompatible schema: %2d %w", diff.nType, ErrTypeMismatch)
+		return fmt.Errorf("incompatible schema: %2d %w", len(d.TypeChanged), ErrTypeMismatch)
 	}
-	if diff.nInNew != 0 {
+	nRelaxed := 0
+	for _, fd := range d.ModeChanged {
+		if !modeRelaxed(fd.OldMode, fd.NewMode) {
+			// Scenario 4 - new incompatible with old due to field mode mismatch, should not upload.
+			return fmt.Errorf("incompatible schema: %v %v -> %v: %w", fd.Name, fd.OldMode, fd.NewMode, ErrModeMismatch)
+		}
+		nRelaxed++
+	}
+	if len(d.Added) != 0 {
 		// Scenario 3 - new is a superset of old, should upload.
-		verbosef("%2d field(s) only in new schema", diff.nInNew)
-		return fmt.Errorf("schema differences: %2d %w", diff.nInNew, ErrNewFields)
+		verbosef("%2d field(s) only in new schema", len(d.Added))
+		return fmt.Errorf("schema differences: %2d %w", len(d.Added), ErrNewFields)
+	}
+	if nRelaxed != 0 {
+		// Scenario 3 - new accepts everything old accepts, should upload.
+		return fmt.Errorf("schema differences: %2d %w", nRelaxed, ErrModeRelaxed)
 	}
-	if diff.nInOld != 0 {
+	if len(d.Removed) != 0 {
 		// Scenario 4 - new incompatible with old due to missing fields in new, should not upload.
 		// But, the new schema remains backward compatible with the old schema, because types match and there are no new fields.
-		return fmt.Errorf("backward compatible schema: %2d %w", diff.nInOld, ErrOnlyInOld)
+		return fmt.Errorf("backward compatible schema: %2d %w", len(d.Removed), ErrOnlyInOld)
+	}
+	if len(d.DescriptionChanged) != 0 {
+		// Scenario 3 - only descriptions differ, should upload.
+		return fmt.Errorf("schema differences: %2d %w", len(d.DescriptionChanged), ErrDescriptions)
 	}
 	// Scenario 2 - old exists and matches new, should not upload.
 	return ErrSchemaMatch
 }
 
-// diffTableSchemas builds a new table schema for the given datatype,
+// onlyStdColsRemoved returns true if all fields that are only in the old
+// table schema are standard columns (i.e., not in the raw field).
+func (d *Diff) onlyStdColsRemoved() bool {
+	for _, fd := range d.Removed {
+		if fd.Name == "raw" || strings.HasPrefix(fd.Name, "raw.") {
+			return false
+		}
+	}
+	return true
+}
+
+// modeRelaxed returns true if changing a field's mode from the old mode
+// to the new mode is backward compatible.  The only such change is from
+// REQUIRED to NULLABLE because rows that were valid in the old schema
+// remain valid in the new one.  Changing a scalar field to REPEATED (or
+// vice versa) or making a NULLABLE field REQUIRED is not.
+func modeRelaxed(oldMode, newMode string) bool {
+	return oldMode == ModeRequired && newMode == ModeNullable
+}
+
+// DiffTableSchemas builds a new table schema for the given datatype,
 // compares it against the old table schema (if it exists), and returns
 // their differences.
-func diffTableSchemas(gcsClient DownloaderUploader, bucket, experiment, datatype, dtSchemaFile string) (*mapDiff, error) {
+func DiffTableSchemas(gcsClient Downloader, bucket, experiment, datatype, dtSchemaFile string) (*Diff, error) {
 	// Fetch the old table schema if it exists.  If it doesn't exist,
 	// there is nothing to validate for this datatype and the new table
 	// schema should be uploaded.
 	ctx := context.Background()
-	objPath := tblSchemaPath(experiment, datatype)
+	objPath := TablePath(experiment, datatype)
 	// Create a storage client for downloading.
 	verbosef("downloading '%v:%v'", bucket, objPath)
 	oldTblSchemaJSON, err := gcsClient.Download(ctx, objPath)
@@ -183,20 +376,6 @@ func diffTableSchemas(gcsClient DownloaderUploader, bucket, experiment, datatype
 		return nil, fmt.Errorf("%v: %w", ErrDownload, err)
 	}
 	verbosef("successfully downloaded '%v:%v'", bucket, objPath)
-	// We need a better way of handling the following changes.
-	s := string(oldTblSchemaJSON)
-	s = strings.ReplaceAll(s, `"name":`, `"Name":`)
-	s = strings.ReplaceAll(s, `"type":`, `"Type":`)
-	oldTblSchemaJSON = []byte(s)
-
-	// Old table schema exists.
-	oldFieldsMap, err := allFields(oldTblSchemaJSON)
-	if err != nil {
-		return nil, err
-	}
-	if len(oldFieldsMap) == 0 {
-		return nil, fmt.Errorf("%v: %w", ErrEmptySchema, err)
-	}
 
 	// Create the new table schema and marshal it to a JSON object
 	// to compare with the old one.
@@ -208,41 +387,87 @@ func diffTableSchemas(gcsClient DownloaderUploader, bucket, experiment, datatype
 	if err != nil {
 		return nil, fmt.Errorf("%v: %w", ErrMarshal, err)
 	}
+	return CompareTableSchemas(oldTblSchemaJSON, newTblSchemaJSON)
+}
+
+// CompareTableSchemas compares the given old and new table schemas in
+// JSON format and returns their differences.  Deleting old fields or
+// changing their types is a breaking change.
+func CompareTableSchemas(oldTblSchemaJSON, newTblSchemaJSON []byte) (*Diff, error) {
+	oldFieldsMap, err := allFields(oldTblSchemaJSON)
+	if err != nil {
+		return nil, err
+	}
+	if len(oldFieldsMap) == 0 {
+		return nil, fmt.Errorf("%v: %w", ErrEmptySchema, err)
+	}
 	newFieldsMap, err := allFields(newTblSchemaJSON)
 	if err != nil {
 		return nil, err
 	}
-
-	// Compare the old field with the new field.  Deleting old fields
-	// or changing their types is a breaking change.
 	return compareMaps(oldFieldsMap, newFieldsMap), nil
 }
 
-// tblSchemPath returns the GCS object name (aka path) for the given
-// experiment and datatype.
-func tblSchemaPath(experiment, datatype string) string {
-	schPath := path.Join("tables", experiment, datatype) + ".table.json"
-	return path.Join(GCSDataDir, schPath)
+// Len returns the total number of differences.
+func (d *Diff) Len() int {
+	return len(d.Added) + len(d.Removed) + len(d.TypeChanged) + len(d.ModeChanged) + len(d.DescriptionChanged)
+}
+
+// TablePath returns the GCS object name (aka path) of the table schema
+// for the given experiment and datatype.
+func TablePath(experiment, datatype string) string {
+	return TableTemplate.Join(GCSDataDir, naming.Vars{Experiment: experiment, Datatype: datatype, Organization: Organization})
 }
 
-// uploadTableSchema creates a table schema for the given datatype schema
-// and uploads it to GCS. uploadTableSchema does not validate the schema.
-func uploadTableSchema(gcsClient DownloaderUploader, bucket, experiment, datatype, dtSchemaFile string) error {
+// uploadTableSchema uploads the new table schema to GCS if the old table
+// schema has not changed since it was downloaded.  Fields that are only
+// in the old table schema are kept so an upload never removes fields.
+// The uploaded table schema is also archived in the schema history with
+// its differences from the old table schema.  Since the table schema has
+// already been uploaded by then, failing to archive it is logged rather
+// than returned.  uploadTableSchema does not validate the schema.
+func uploadTableSchema(gcsClient DownloaderUploader, bucket, experiment, datatype string, tblSchemas *tableSchemas) error {
 	ctx := context.Background()
-	tblSchemaJSON, err := CreateTableSchemaJSON(datatype, dtSchemaFile)
-	if err != nil {
-		return err
+	tblSchemaJSON, diff := tblSchemas.newJSON, tblSchemas.diff
+	if tblSchemas.oldJSON != nil {
+		var err error
+		if tblSchemaJSON, err = mergeTableSchemas(tblSchemas.oldJSON, tblSchemas.newJSON); err != nil {
+			return err
+		}
+		if diff, err = CompareTableSchemas(tblSchemas.oldJSON, tblSchemaJSON); err != nil {
+			return fmt.Errorf("%v: %w", err, ErrCompare)
+		}
 	}
-	objPath := tblSchemaPath(experiment, datatype)
-	// Create a storage client for uploading.
-	verbosef("uploading '%v:%v'", bucket, objPath)
-	if err := gcsClient.Upload(ctx, objPath, tblSchemaJSON); err != nil {
+	objPath := TablePath(experiment, datatype)
+	verbosef("uploading '%v:%v' if generation is %v", bucket, objPath, tblSchemas.generation)
+	if err := gcsClient.UploadIfGeneration(ctx, objPath, tblSchemaJSON, tblSchemas.generation); err != nil {
 		return fmt.Errorf("%v: %w", ErrUpload, err)
 	}
 	verbosef("successfully uploaded '%v:%v'", bucket, objPath)
+	if err := archiveTableSchema(gcsClient, bucket, experiment, datatype, tblSchemaJSON, diff); err != nil {
+		log.Printf("ERROR: failed to archive table schema: %v\n", err)
+	}
 	return nil
 }
 
+// mergeTableSchemas returns the new table schema with the fields that are
+// only in the old table schema added to it.
+func mergeTableSchemas(oldTblSchemaJSON, newTblSchemaJSON []byte) ([]byte, error) {
+	oldFields, err := ParseFields(oldTblSchemaJSON)
+	if err != nil {
+		return nil, err
+	}
+	newFields, err := ParseFields(newTblSchemaJSON)
+	if err != nil {
+		return nil, err
+	}
+	tblSchemaJSON, err := json.Marshal(newFields.Merge(oldFields))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", ErrMarshal, err)
+	}
+	return tblSchemaJSON, nil
+}
+
 // createTable creates a new table schema with the standard columns for
 // the given datatype and returns it.
 func createTable(datatype, dtSchemaFile string) (bigquery.Schema, error) {
@@ -250,69 +475,45 @@ func createTable(datatype, dtSchemaFile string) (bigquery.Schema, error) {
 	if err != nil {
 		return nil, err
 	}
-	stdColsSchema, err := bigquery.InferSchema(api.StandardColumnsV0{})
+	var stdCols interface{}
+	switch version := StdColsVersion(datatype); version {
+	case api.StdColsV0:
+		stdCols = api.StandardColumnsV0{}
+	case api.StdColsV1:
+		stdCols = api.StandardColumnsV1{}
+	default:
+		return nil, fmt.Errorf("%v: %v: %w", datatype, version, ErrStdColsVersion)
+	}
+	stdColsSchema, err := bigquery.InferSchema(stdCols)
 	if err != nil {
 		return nil, fmt.Errorf("failed to infer schema for %v: %w", datatype, err)
 	}
-	return replaceField("raw", stdColsSchema, dtSchema), nil
-}
-
-// allFields returns a map of all fields in the given schema.  The key
-// of each map entry is the full field name and its value is the field
-// type (e.g., ["archiver.Version"]: "STRING").
-func allFields(schemaJSON []byte) (map[string]string, error) {
-	var schema []interface{}
-	if err := json.Unmarshal(schemaJSON, &schema); err != nil {
-		return nil, fmt.Errorf("%v: %w", ErrUnmarshal, err)
-	}
-	fields := make(map[string]string)
-	err := visitAllFields(schema, func(fullFieldName []string, field bqField) error {
-		if key := strings.Join(fullFieldName, "."); key != "" {
-			fields[key] = fmt.Sprintf("%v", field["Type"])
-		}
-		return nil
-	})
+	promoted, err := promotedColumns(datatype, dtSchema)
 	if err != nil {
 		return nil, err
 	}
-	return fields, nil
-}
-
-// visitAllFields calls the given visit function for each field in the
-// given schema.
-func visitAllFields(schema []interface{}, visit visitFunc) error {
-	return visitAllFieldsRecursive(schema, visit, []string{})
+	// Like other M-Lab tables, promoted columns are the first columns.
+	return append(promoted, replaceField("raw", stdColsSchema, dtSchema)...), nil
 }
 
-// visitAllFieldsRecursive visits all fields in the given schema, calling
-// itself recursively for RECORD field types.
-func visitAllFieldsRecursive(schema []interface{}, visit visitFunc, fullFieldName []string) error {
-	for _, field := range schema {
-		var f bqField
-		f, ok := field.(map[string]interface{})
-		if !ok {
-			return fmt.Errorf("%T: %w", field, ErrType)
-		}
-		ffn := fullFieldName
-		ffn = append(ffn, fmt.Sprintf("%v", f["Name"]))
-		if err := visit(ffn, f); err != nil {
-			return err
-		}
-		if f["Type"] != "RECORD" {
-			continue
-		}
-		record, ok := f["Schema"].([]interface{})
-		if !ok {
-			record, ok = f["fields"].([]interface{})
-			if !ok {
-				return fmt.Errorf("%T: %w", f["fields"], ErrType)
-			}
-		}
-		if err := visitAllFieldsRecursive(record, visit, ffn); err != nil {
-			return err
-		}
+// allFields returns a map of all fields in the given schema which can
+// be in either JSON convention (see Field).  The key of each map entry
+// is the full field name and its value is the field type, mode, and
+// description (e.g., ["archiver.Version"]: {"STRING", "NULLABLE", ""}).
+func allFields(schemaJSON []byte) (map[string]fieldInfo, error) {
+	schema, err := ParseFields(schemaJSON)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	fields := make(map[string]fieldInfo)
+	schema.Visit(func(fullName string, field *Field) {
+		fields[fullName] = fieldInfo{
+			Type:        field.FieldType(),
+			Mode:        field.FieldMode(),
+			Description: field.Description,
+		}
+	})
+	return fields, nil
 }
 
 // fromJSON returns a BigQuery schema from the specified file which is
@@ -349,39 +550,62 @@ func replaceField(fieldName string, origSchema, replacingSchema bigquery.Schema)
 	return schema
 }
 
-// compareMaps compares the given maps and returns their differences
-// as three integers that are the number of (1) keys only in the new map,
-// (2) keys only in the old map, and (3) different values.  It also logs
-// the comparison results in verbosef mode.
-func compareMaps(oldMap, newMap map[string]string) *mapDiff {
-	diff := &mapDiff{}
+// compareMaps compares the given maps and returns their differences:
+// keys only in the new map, keys only in the old map, and keys whose
+// types, modes, or descriptions differ.  It also logs the comparison results in verbosef
+// mode.
+func compareMaps(oldMap, newMap map[string]fieldInfo) *Diff {
+	diff := &Diff{
+		Added:              []FieldDiff{},
+		Removed:            []FieldDiff{},
+		TypeChanged:        []FieldDiff{},
+		ModeChanged:        []FieldDiff{},
+		DescriptionChanged: []FieldDiff{},
+	}
 	newKeys := sortMapKeys(newMap)
 	for _, n := range newKeys {
-		if _, ok := oldMap[n]; !ok {
-			verbosef("%-10s %v:%v", "only in new:", n, newMap[n])
-			diff.nInNew++
+		o, ok := oldMap[n]
+		if !ok {
+			verbosef("%-10s %v:%v", "only in new:", n, newMap[n].Type)
+			diff.Added = append(diff.Added, FieldDiff{Name: n, NewType: newMap[n].Type, NewMode: newMap[n].Mode})
 			continue
 		}
 		// The key exists in both schemas; compare their values.
-		if newMap[n] != oldMap[n] {
-			verbosef("%-10v %v:%v in new, %v:%v in old", "mismatch:", n, newMap[n], n, oldMap[n])
-			diff.nType++
+		fd := FieldDiff{Name: n, OldType: o.Type, NewType: newMap[n].Type, OldMode: o.Mode, NewMode: newMap[n].Mode}
+		if newMap[n].Type != o.Type {
+			verbosef("%-10v %v:%v in new, %v:%v in old", "mismatch:", n, newMap[n].Type, n, o.Type)
+			diff.TypeChanged = append(diff.TypeChanged, fd)
 			continue
 		}
-		verbosef("%-10s %v:%v", "in both:", n, newMap[n])
+		// A field's mode and description can both change.
+		same := true
+		if newMap[n].Mode != o.Mode {
+			verbosef("%-10v %v:%v in new, %v:%v in old", "mismatch:", n, newMap[n].Mode, n, o.Mode)
+			diff.ModeChanged = append(diff.ModeChanged, fd)
+			same = false
+		}
+		if newMap[n].Description != o.Description {
+			verbosef("%-10v %v description %q in new, %q in old", "mismatch:", n, newMap[n].Description, o.Description)
+			fd.OldDescription, fd.NewDescription = o.Description, newMap[n].Description
+			diff.DescriptionChanged = append(diff.DescriptionChanged, fd)
+			same = false
+		}
+		if same {
+			verbosef("%-10s %v:%v", "in both:", n, newMap[n].Type)
+		}
 	}
 	oldKeys := sortMapKeys(oldMap)
 	for _, o := range oldKeys {
 		if _, ok := newMap[o]; !ok {
-			verbosef("%-10s %v:%v", "only in old:", o, oldMap[o])
-			diff.nInOld++
+			verbosef("%-10s %v:%v", "only in old:", o, oldMap[o].Type)
+			diff.Removed = append(diff.Removed, FieldDiff{Name: o, OldType: oldMap[o].Type, OldMode: oldMap[o].Mode})
 		}
 	}
 	return diff
 }
 
 // sortMapKeys returns a sorted slice of all keys in the given map.
-func sortMapKeys(fields map[string]string) []string {
+func sortMapKeys(fields map[string]fieldInfo) []string {
 	keys := make([]string, 0, len(fields))
 	for key := range fields {
 		keys = append(keys, key)
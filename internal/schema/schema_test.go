@@ -3,11 +3,18 @@ package schema_test
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 	"testing"
 
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/jostler/api"
+	"github.com/m-lab/jostler/internal/gcs"
 	"github.com/m-lab/jostler/internal/schema"
 	"github.com/m-lab/jostler/internal/testhelper"
 )
@@ -246,3 +253,341 @@ func TestValidateAndUpload(t *testing.T) {
 		}
 	}
 }
+
+// racingClient mimics other nodes that upload their table schemas just
+// before each conditional upload.
+type racingClient struct {
+	*testhelper.StorageClient
+	winners [][]byte // table schemas uploaded by other nodes
+}
+
+func (r *racingClient) UploadIfGeneration(ctx context.Context, objPath string, contents []byte, generation int64) error {
+	if len(r.winners) != 0 {
+		if err := r.Upload(ctx, objPath, r.winners[0]); err != nil {
+			return err
+		}
+		r.winners = r.winners[1:]
+	}
+	return r.StorageClient.UploadIfGeneration(ctx, objPath, contents, generation)
+}
+
+func TestValidateAndUploadRace(t *testing.T) {
+	saveGCSDataDir := schema.GCSDataDir
+	defer func() {
+		schema.GCSDataDir = saveGCSDataDir
+	}()
+	// Create datatype schemas and their table schemas.
+	dir := t.TempDir()
+	dtSchemaFiles := map[string]string{}
+	tblSchemas := map[string][]byte{}
+	for name, fields := range map[string]string{
+		"old":       `"Field1"`,
+		"new":       `"Field1", "Field2"`,
+		"newer":     `"Field1", "Field2", "Field3"`,
+		"sidegrade": `"Field1", "Field4"`,
+	} {
+		var dtSchema []string
+		for _, field := range strings.Split(fields, ", ") {
+			dtSchema = append(dtSchema, `{"name": `+field+`, "type": "STRING"}`)
+		}
+		dtSchemaFiles[name] = filepath.Join(dir, name+".json")
+		if err := os.WriteFile(dtSchemaFiles[name], []byte("["+strings.Join(dtSchema, ", ")+"]"), 0o666); err != nil {
+			t.Fatalf("os.WriteFile() = %v, want nil", err)
+		}
+		tblSchema, err := schema.CreateTableSchemaJSON(testDatatype, dtSchemaFiles[name])
+		if err != nil {
+			t.Fatalf("CreateTableSchemaJSON() = %v, want nil", err)
+		}
+		tblSchemas[name] = tblSchema
+	}
+
+	bucket := "newclient,download,upload"
+	tests := []struct {
+		name       string
+		stored     string   // table schema in GCS before the test
+		local      string   // local datatype schema
+		winners    []string // table schemas uploaded by other nodes
+		wantErr    error
+		wantFields []string // fields expected in GCS after the test
+	}{
+		{
+			name:       "superset without race",
+			stored:     "old",
+			local:      "new",
+			wantFields: []string{"raw.Field1", "raw.Field2"},
+		},
+		{
+			name:       "upload never removes fields",
+			stored:     "new",
+			local:      "sidegrade",
+			wantFields: []string{"raw.Field1", "raw.Field2", "raw.Field4"},
+		},
+		{
+			name:       "lose race to the same schema",
+			stored:     "old",
+			local:      "new",
+			winners:    []string{"new"},
+			wantFields: []string{"raw.Field1", "raw.Field2"},
+		},
+		{
+			name:       "lose race to a newer schema",
+			stored:     "old",
+			local:      "new",
+			winners:    []string{"newer"},
+			wantErr:    schema.ErrOnlyInOld,
+			wantFields: []string{"raw.Field1", "raw.Field2", "raw.Field3"},
+		},
+		{
+			name:       "lose race to a sidegrade and merge",
+			stored:     "old",
+			local:      "new",
+			winners:    []string{"sidegrade"},
+			wantFields: []string{"raw.Field1", "raw.Field2", "raw.Field4"},
+		},
+		{
+			name:       "lose all races",
+			stored:     "old",
+			local:      "new",
+			winners:    []string{"old", "old", "old", "old", "old"},
+			wantErr:    gcs.ErrGenerationMismatch,
+			wantFields: []string{"raw.Field1"},
+		},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		schema.GCSDataDir = t.TempDir()
+		stClient, err := testhelper.NewClient(context.Background(), bucket)
+		if err != nil {
+			t.Fatalf("testhelper.NewClient() = %v, want nil", err)
+		}
+		objPath := schema.TablePath(testExperiment, testDatatype)
+		if err = stClient.Upload(context.Background(), objPath, tblSchemas[test.stored]); err != nil {
+			t.Fatalf("Upload() = %v, want nil", err)
+		}
+		client := &racingClient{StorageClient: stClient}
+		for _, winner := range test.winners {
+			client.winners = append(client.winners, tblSchemas[winner])
+		}
+		err = schema.ValidateAndUpload(client, bucket, testExperiment, testDatatype, dtSchemaFiles[test.local], true)
+		if !errors.Is(err, test.wantErr) {
+			t.Fatalf("ValidateAndUpload() = %v, want %v", err, test.wantErr)
+		}
+		stored, err := stClient.Download(context.Background(), objPath)
+		if err != nil {
+			t.Fatalf("Download() = %v, want nil", err)
+		}
+		fields, err := schema.ParseFields(stored)
+		if err != nil {
+			t.Fatalf("ParseFields() = %v, want nil", err)
+		}
+		gotFields := []string{}
+		fields.Visit(func(fullName string, f *schema.Field) {
+			if strings.HasPrefix(fullName, "raw.") {
+				gotFields = append(gotFields, fullName)
+			}
+		})
+		sort.Strings(gotFields)
+		if !reflect.DeepEqual(gotFields, test.wantFields) {
+			t.Fatalf("fields in GCS = %v, want %v", gotFields, test.wantFields)
+		}
+	}
+}
+
+func TestStdColsMigration(t *testing.T) {
+	saveGCSDataDir, saveStdColsVersions := schema.GCSDataDir, schema.StdColsVersions
+	defer func() {
+		schema.GCSDataDir, schema.StdColsVersions = saveGCSDataDir, saveStdColsVersions
+	}()
+	schema.GCSDataDir = t.TempDir()
+	bucket := "newclient,download,upload"
+	stClient, err := testhelper.NewClient(context.Background(), bucket)
+	if err != nil {
+		t.Fatalf("testhelper.NewClient() = %v, want nil", err)
+	}
+	tests := []struct {
+		name         string
+		version      string
+		dtSchemaFile string
+		wantErr      error
+		wantField    string // field that should be in the table schema in GCS
+	}{
+		{
+			name:         "version 0 creates the table",
+			version:      api.StdColsV0,
+			dtSchemaFile: "testdata/datatypes/foo1-valid.json",
+			wantField:    "archiver.Filename",
+		},
+		{
+			name:         "version 1 adds fields",
+			version:      api.StdColsV1,
+			dtSchemaFile: "testdata/datatypes/foo1-valid.json",
+			wantField:    "archiver.Site",
+		},
+		{
+			name:         "version 0 is allowed during migration",
+			version:      api.StdColsV0,
+			dtSchemaFile: "testdata/datatypes/foo1-valid.json",
+			wantField:    "archiver.Site",
+		},
+		{
+			name:         "version 0 superset keeps version 1 fields",
+			version:      api.StdColsV0,
+			dtSchemaFile: "testdata/datatypes/foo1-valid-superset.json",
+			wantField:    "archiver.Site",
+		},
+		{
+			name:         "unsupported version",
+			version:      "v99",
+			dtSchemaFile: "testdata/datatypes/foo1-valid.json",
+			wantErr:      schema.ErrStdColsVersion,
+		},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		schema.StdColsVersions = map[string]string{testDatatype: test.version}
+		gotErr := schema.ValidateAndUpload(stClient, bucket, testExperiment, testDatatype, test.dtSchemaFile, true)
+		if test.wantErr != nil {
+			if gotErr == nil || !strings.Contains(gotErr.Error(), test.wantErr.Error()) {
+				t.Fatalf("ValidateAndUpload() = %v, want %v", gotErr, test.wantErr)
+			}
+			continue
+		}
+		if gotErr != nil {
+			t.Fatalf("ValidateAndUpload() = %v, want nil", gotErr)
+		}
+		tblSchemaJSON, err := stClient.Download(context.Background(), schema.TablePath(testExperiment, testDatatype))
+		if err != nil {
+			t.Fatalf("Download() = %v, want nil", err)
+		}
+		fields, err := schema.ParseFields(tblSchemaJSON)
+		if err != nil {
+			t.Fatalf("ParseFields() = %v, want nil", err)
+		}
+		found := false
+		fields.Visit(func(fullName string, f *schema.Field) {
+			found = found || fullName == test.wantField
+		})
+		if !found {
+			t.Fatalf("table schema = %s, want field %v", tblSchemaJSON, test.wantField)
+		}
+	}
+}
+
+func TestCompatibility(t *testing.T) {
+	// The old table schema of all tests has a nested RECORD field.
+	oldSchema := `[
+		{"name": "date", "type": "DATE", "mode": "REQUIRED"},
+		{"name": "raw", "type": "RECORD", "mode": "NULLABLE", "fields": [
+			{"name": "UUID", "type": "STRING", "mode": "REQUIRED", "description": "unique id"},
+			{"name": "Samples", "type": "RECORD", "mode": "REPEATED", "fields": [
+				{"name": "RTT", "type": "FLOAT", "mode": "NULLABLE"},
+				{"name": "Count", "type": "INTEGER", "mode": "REQUIRED"}
+			]},
+			{"name": "Server", "type": "RECORD", "mode": "NULLABLE", "fields": [
+				{"name": "IP", "type": "STRING", "mode": "NULLABLE"}
+			]}
+		]}
+	]`
+	tests := []struct {
+		name             string
+		newSchema        string
+		wantErr          error
+		wantDescriptions int // number of fields whose descriptions changed
+	}{
+		{
+			name:      "match",
+			newSchema: oldSchema,
+			wantErr:   schema.ErrSchemaMatch,
+		},
+		{
+			name: "nested type change",
+			newSchema: strings.Replace(oldSchema,
+				`{"name": "RTT", "type": "FLOAT"`, `{"name": "RTT", "type": "STRING"`, 1),
+			wantErr: schema.ErrTypeMismatch,
+		},
+		{
+			name: "nested NULLABLE to REQUIRED",
+			newSchema: strings.Replace(oldSchema,
+				`{"name": "IP", "type": "STRING", "mode": "NULLABLE"}`, `{"name": "IP", "type": "STRING", "mode": "REQUIRED"}`, 1),
+			wantErr: schema.ErrModeMismatch,
+		},
+		{
+			name: "nested scalar to REPEATED",
+			newSchema: strings.Replace(oldSchema,
+				`{"name": "RTT", "type": "FLOAT", "mode": "NULLABLE"}`, `{"name": "RTT", "type": "FLOAT", "mode": "REPEATED"}`, 1),
+			wantErr: schema.ErrModeMismatch,
+		},
+		{
+			name: "RECORD scalar to REPEATED",
+			newSchema: strings.Replace(oldSchema,
+				`{"name": "Server", "type": "RECORD", "mode": "NULLABLE"`, `{"name": "Server", "type": "RECORD", "mode": "REPEATED"`, 1),
+			wantErr: schema.ErrModeMismatch,
+		},
+		{
+			name: "RECORD REPEATED to scalar",
+			newSchema: strings.Replace(oldSchema,
+				`{"name": "Samples", "type": "RECORD", "mode": "REPEATED"`, `{"name": "Samples", "type": "RECORD", "mode": "NULLABLE"`, 1),
+			wantErr: schema.ErrModeMismatch,
+		},
+		{
+			name: "nested REQUIRED to NULLABLE",
+			newSchema: strings.Replace(oldSchema,
+				`{"name": "Count", "type": "INTEGER", "mode": "REQUIRED"}`, `{"name": "Count", "type": "INTEGER", "mode": "NULLABLE"}`, 1),
+			wantErr: schema.ErrModeRelaxed,
+		},
+		{
+			name: "REQUIRED to missing mode",
+			newSchema: strings.Replace(oldSchema,
+				`{"name": "Count", "type": "INTEGER", "mode": "REQUIRED"}`, `{"name": "Count", "type": "INTEGER"}`, 1),
+			wantErr: schema.ErrModeRelaxed,
+		},
+		{
+			name: "nested new field",
+			newSchema: strings.Replace(oldSchema,
+				`{"name": "IP", "type": "STRING", "mode": "NULLABLE"}`, `{"name": "IP", "type": "STRING", "mode": "NULLABLE"}, {"name": "Port", "type": "INTEGER"}`, 1),
+			wantErr: schema.ErrNewFields,
+		},
+		{
+			name: "nested missing field",
+			newSchema: strings.Replace(oldSchema,
+				`{"name": "RTT", "type": "FLOAT", "mode": "NULLABLE"},`, ``, 1),
+			wantErr: schema.ErrOnlyInOld,
+		},
+		{
+			name: "description change",
+			newSchema: strings.Replace(oldSchema,
+				`"description": "unique id"`, `"description": "unique measurement id"`, 1),
+			wantErr:          schema.ErrDescriptions,
+			wantDescriptions: 1,
+		},
+		{
+			name: "relaxed mode and description change",
+			newSchema: strings.Replace(oldSchema,
+				`"mode": "REQUIRED", "description": "unique id"`, `"mode": "NULLABLE", "description": "unique measurement id"`, 1),
+			wantErr:          schema.ErrModeRelaxed,
+			wantDescriptions: 1,
+		},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		// New table schemas are created from bigquery.Schema.
+		newSchema, err := bigquery.SchemaFromJSON([]byte(test.newSchema))
+		if err != nil {
+			t.Fatalf("bigquery.SchemaFromJSON() = %v, want nil", err)
+		}
+		newSchemaJSON, err := json.Marshal(newSchema)
+		if err != nil {
+			t.Fatalf("json.Marshal() = %v, want nil", err)
+		}
+		diff, err := schema.CompareTableSchemas([]byte(oldSchema), newSchemaJSON)
+		if err != nil {
+			t.Fatalf("CompareTableSchemas() = %v, want nil", err)
+		}
+		if gotErr := diff.Compatibility(); !errors.Is(gotErr, test.wantErr) {
+			t.Fatalf("Compatibility() = %v, want %v", gotErr, test.wantErr)
+		}
+		if len(diff.DescriptionChanged) != test.wantDescriptions {
+			t.Fatalf("len(DescriptionChanged) = %v, want %v", len(diff.DescriptionChanged), test.wantDescriptions)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Package spoollock implements an exclusive lock on the spool directory
+// of a datatype so that only one process (e.g., the jostler daemon or
+// "jostler backfill") bundles and uploads its files at a time.
+//
+// The lock is an advisory lock (see flock(2)) on a hidden file in the
+// directory.  It is released when it's unlocked or when the process
+// that holds it exits, so a lock file left behind by a process that
+// crashed does not need to be removed.
+package spoollock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Name is the name of the lock file in the locked directory.
+const Name = ".jostler.lock"
+
+// Exported errors.
+var (
+	ErrLocked = errors.New("is locked by another process")
+	ErrLock   = errors.New("failed to lock directory")
+)
+
+// Lock is an exclusive lock on a directory.
+type Lock struct {
+	file *os.File
+}
+
+// New locks the given directory and returns the lock.  It fails with
+// ErrLocked right away if another process holds the lock.
+func New(dir string) (*Lock, error) {
+	path := filepath.Join(dir, Name)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrLock, err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%v: %w", dir, ErrLocked)
+		}
+		return nil, fmt.Errorf("%w: %v: %v", ErrLock, dir, err)
+	}
+	// The process ID is only informational (e.g., for debugging).
+	if err := file.Truncate(0); err == nil {
+		_, _ = fmt.Fprintf(file, "%d\n", os.Getpid())
+	}
+	return &Lock{file: file}, nil
+}
+
+// Unlock releases the lock.  The lock file is kept.
+func (l *Lock) Unlock() error {
+	return l.file.Close()
+}
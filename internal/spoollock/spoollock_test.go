@@ -0,0 +1,40 @@
+package spoollock_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/m-lab/jostler/internal/spoollock"
+)
+
+func TestLock(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := spoollock.New(dir)
+	if err != nil {
+		t.Fatalf("New() = %v, want nil", err)
+	}
+	// The lock is exclusive.
+	if _, err = spoollock.New(dir); !errors.Is(err, spoollock.ErrLocked) {
+		t.Fatalf("New() = %v, want %v", err, spoollock.ErrLocked)
+	}
+	// Once unlocked, the directory can be locked again even though
+	// the lock file is kept.
+	if err = lock.Unlock(); err != nil {
+		t.Fatalf("Unlock() = %v, want nil", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, spoollock.Name)); err != nil {
+		t.Fatalf("os.Stat() = %v, want nil", err)
+	}
+	lock, err = spoollock.New(dir)
+	if err != nil {
+		t.Fatalf("New() = %v, want nil", err)
+	}
+	_ = lock.Unlock()
+
+	// A directory that doesn't exist cannot be locked.
+	if _, err = spoollock.New(filepath.Join(dir, "missing")); !errors.Is(err, spoollock.ErrLock) {
+		t.Fatalf("New() = %v, want %v", err, spoollock.ErrLock)
+	}
+}
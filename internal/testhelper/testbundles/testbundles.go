@@ -0,0 +1,108 @@
+// Package testbundles implements a factory of data bundles and their
+// index bundles for tests.  Bundles are built by the jsonlbundle package
+// from files that are created on the local disk so they are exactly
+// what jostler uploads, and they are written where
+// testhelper.StorageClient expects them.
+package testbundles
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/jostler/internal/jsonlbundle"
+	"github.com/m-lab/jostler/internal/naming"
+	"github.com/m-lab/jostler/internal/testhelper/testfiles"
+)
+
+// Config defines where bundles and their files are created.
+type Config struct {
+	Bucket        string           // GCS bucket in archiver.ArchiveURL of rows
+	HomeDir       string           // home directory of object names
+	DataTemplate  *naming.Template // template of object names of data bundles
+	IndexTemplate *naming.Template // template of object names of index bundles
+	Vars          naming.Vars      // experiment and datatype of the bundles
+	SpoolDir      string           // directory of the files of the bundles
+}
+
+// Bundle defines a data bundle and its index bundle.
+type Bundle struct {
+	Timestamp string   // timestamp of the bundle in its object names
+	Date      string   // date of the bundle's partition (yyyy/mm/dd, the timestamp's date if empty)
+	Machine   string   // machine in the object names (mlab1 if empty)
+	Files     []string // names of the files in the spool directory of the date
+	Contents  []string // contents of each file ({"Field1": 1} if nil)
+}
+
+// New creates the files of the given bundle in the spool directory and
+// returns the bundle that jsonlbundle builds from them.  Tests can change
+// the bundle's lines or index before writing it.
+func New(t *testing.T, conf Config, b Bundle) *jsonlbundle.JSONLBundle {
+	t.Helper()
+	ts, err := time.Parse(naming.TimestampFormat, b.Timestamp)
+	if err != nil {
+		t.Fatalf("time.Parse() = %v, want nil", err)
+	}
+	date := b.Date
+	if date == "" {
+		date = ts.Format("2006/01/02")
+	}
+	start, err := time.Parse("2006/01/02", date)
+	if err != nil {
+		t.Fatalf("time.Parse() = %v, want nil", err)
+	}
+	vars := conf.Vars
+	vars.Start, vars.Timestamp, vars.Machine, vars.Site = start, ts, b.Machine, "lga01"
+	if vars.Machine == "" {
+		vars.Machine = "mlab1"
+	}
+	jb := jsonlbundle.New(conf.Bucket, conf.HomeDir, conf.DataTemplate, conf.IndexTemplate, vars)
+	for i, name := range b.Files {
+		contents := `{"Field1": 1}`
+		if b.Contents != nil {
+			contents = b.Contents[i]
+		}
+		f := filepath.Join(conf.SpoolDir, date, name)
+		testfiles.WriteFile(t, f, []byte(contents))
+		if err := jb.AddFile(f, "v1.0.0", "abcdef"); err != nil {
+			t.Fatalf("jb.AddFile() = %v, want nil", err)
+		}
+	}
+	return jb
+}
+
+// DataObject returns the object name of the data bundle of the given
+// bundle.
+func DataObject(jb *jsonlbundle.JSONLBundle) string {
+	return filepath.Join(jb.BundleDir, jb.BundleName)
+}
+
+// IndexObject returns the object name of the index bundle of the given
+// bundle.
+func IndexObject(jb *jsonlbundle.JSONLBundle) string {
+	return filepath.Join(jb.IndexDir, jb.IndexName)
+}
+
+// Write writes the data and index bundles of the given bundle.
+func Write(t *testing.T, jb *jsonlbundle.JSONLBundle) {
+	t.Helper()
+	WriteData(t, jb)
+	WriteIndex(t, jb)
+}
+
+// WriteData writes the data bundle of the given bundle.
+func WriteData(t *testing.T, jb *jsonlbundle.JSONLBundle) {
+	t.Helper()
+	testfiles.WriteGzip(t, DataObject(jb), []byte(strings.Join(jb.Lines, "\n")))
+}
+
+// WriteIndex writes the index bundle of the given bundle.
+func WriteIndex(t *testing.T, jb *jsonlbundle.JSONLBundle) {
+	t.Helper()
+	index, err := jb.MarshalIndex()
+	if err != nil {
+		t.Fatalf("jb.MarshalIndex() = %v, want nil", err)
+	}
+	testfiles.WriteGzip(t, IndexObject(jb), index)
+}
@@ -0,0 +1,46 @@
+// Package testfiles implements helpers that write the (compressed) files
+// that tests need (e.g., bundles where testhelper.StorageClient expects
+// them).  It is separate from the testhelper package because it depends
+// on the testing package which binaries should not link.
+package testfiles
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// GzipBytes returns the gzip-compressed form of the given contents.
+func GzipBytes(t *testing.T, contents []byte) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(contents); err != nil {
+		t.Fatalf("gzip.Write() = %v, want nil", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("gzip.Close() = %v, want nil", err)
+	}
+	return b.Bytes()
+}
+
+// WriteFile writes the given contents to the given file, creating its
+// directory if needed.
+func WriteFile(t *testing.T, name string, contents []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatalf("os.MkdirAll() = %v, want nil", err)
+	}
+	if err := os.WriteFile(name, contents, 0o666); err != nil {
+		t.Fatalf("os.WriteFile() = %v, want nil", err)
+	}
+}
+
+// WriteGzip writes the gzip-compressed form of the given contents to
+// the given file like WriteFile.
+func WriteGzip(t *testing.T, name string, contents []byte) {
+	t.Helper()
+	WriteFile(t, name, GzipBytes(t, contents))
+}
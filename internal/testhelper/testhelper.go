@@ -13,8 +13,11 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/m-lab/jostler/internal/gcs"
 	"github.com/m-lab/jostler/internal/schema"
 	"github.com/m-lab/jostler/internal/watchdir"
 )
@@ -30,6 +33,10 @@ const (
 	ANSIEnd = "\033[0m"
 )
 
+// ErrDelete is returned by StorageClient.Delete when deletes are set to
+// fail.
+var ErrDelete = errors.New("failed to delete")
+
 // VLogf logs messages in verbose mode (mostly for debugging).  Messages
 // are prefixed by "filename:line-number function()" printed in green and
 // the message printed in blue for easier visual inspection.
@@ -67,6 +74,10 @@ type StorageClient struct {
 	bucket string
 }
 
+// generationMu makes checking and changing the generation of files atomic
+// across all storage clients.
+var generationMu sync.Mutex
+
 // NewClient creates and returns a new client that mimics the upload
 // method of a cloud storage client on the local disk.
 func NewClient(ctx context.Context, bucket string) (*StorageClient, error) {
@@ -118,7 +129,108 @@ func (d *StorageClient) Upload(ctx context.Context, objPath string, contents []b
 			panic("Upload(): MkdirAll")
 		}
 	}
-	return os.WriteFile(objPath, contents, 0o666)
+	prev, _ := fileGeneration(objPath)
+	if err := os.WriteFile(objPath, contents, 0o666); err != nil {
+		return err
+	}
+	// The granularity of modification times may be coarser than
+	// nanoseconds so make sure every upload changes the generation.
+	mtime := time.Now()
+	if mtime.UnixNano() <= prev {
+		mtime = time.Unix(0, prev+1)
+	}
+	return os.Chtimes(objPath, mtime, mtime)
+}
+
+// DownloadWithGeneration mimics downloading from GCS with the object's
+// generation.  The generation of a file is its modification time.
+func (d *StorageClient) DownloadWithGeneration(ctx context.Context, objPath string) ([]byte, int64, error) {
+	generationMu.Lock()
+	defer generationMu.Unlock()
+	contents, err := d.Download(ctx, objPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	generation, err := fileGeneration(objPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	return contents, generation, nil
+}
+
+// UploadIfGeneration mimics conditional uploads to GCS.  The upload
+// fails with gcs.ErrGenerationMismatch if the file's generation does not
+// match the specified generation.  A generation of 0 means the file must
+// not exist.
+func (d *StorageClient) UploadIfGeneration(ctx context.Context, objPath string, contents []byte, generation int64) error {
+	generationMu.Lock()
+	defer generationMu.Unlock()
+	current, err := fileGeneration(objPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if current != generation {
+		return fmt.Errorf("%v: %w", objPath, gcs.ErrGenerationMismatch)
+	}
+	return d.Upload(ctx, objPath, contents)
+}
+
+// fileGeneration returns the generation of the specified file which is
+// its modification time in nanoseconds.
+func fileGeneration(path string) (int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return fi.ModTime().UnixNano(), nil
+}
+
+// List mimics listing objects in GCS.  Objects are regular files under
+// the directory of the prefix whose pathnames begin with the prefix.
+func (d *StorageClient) List(ctx context.Context, prefix string) ([]string, error) {
+	fmt.Printf("StorageClient.List(): d.bucket=%v prefix=%v\n", d.bucket, prefix)
+	if !strings.Contains(d.bucket, "list") {
+		panic("unexpected call to List()")
+	}
+	if strings.Contains(d.bucket, "faillist") {
+		return nil, schema.ErrList
+	}
+	dir := prefix
+	if !strings.HasSuffix(prefix, "/") {
+		dir = filepath.Dir(prefix)
+	}
+	var objPaths []string
+	err := filepath.WalkDir(dir, func(path string, de os.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil // like GCS, a non-existent prefix has no objects
+			}
+			return err
+		}
+		if de.Type().IsRegular() && strings.HasPrefix(path, prefix) {
+			objPaths = append(objPaths, path)
+		}
+		return nil
+	})
+	return objPaths, err
+}
+
+// Delete mimics deleting objects in GCS.
+func (d *StorageClient) Delete(ctx context.Context, objPath string) error {
+	fmt.Printf("StorageClient.Delete(): d.bucket=%v objPath=%v\n", d.bucket, objPath)
+	if !strings.Contains(d.bucket, "delete") {
+		panic("unexpected call to Delete()")
+	}
+	if strings.Contains(d.bucket, "faildelete") {
+		return ErrDelete
+	}
+	if err := os.Remove(objPath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return storage.ErrObjectNotExist
+		}
+		return err
+	}
+	return nil
 }
 
 // WatchDir implements a directory watcher that mimics the watchdir
@@ -0,0 +1,80 @@
+package uploadbundle
+
+import (
+	"context"
+)
+
+// BackfillSummary summarizes the outcome of a backfill.
+type BackfillSummary struct {
+	Datatype string   `json:"datatype"`
+	Files    int      `json:"files"`            // files that were added to bundles
+	BadFiles int      `json:"badFiles"`         // files that could not be added to bundles (e.g., invalid JSON)
+	Skipped  int      `json:"skipped"`          // files that were ignored (e.g., too big or empty)
+	Bundles  int      `json:"bundles"`          // bundles that were created
+	Uploaded int      `json:"uploaded"`         // bundles that were uploaded
+	Failed   int      `json:"failed"`           // bundles that failed to upload
+	Errors   []string `json:"errors,omitempty"` // why bundles failed to upload
+}
+
+// OK returns true if all files were bundled and all bundles were
+// uploaded.
+func (s BackfillSummary) OK() bool {
+	return s.BadFiles == 0 && s.Skipped == 0 && s.Failed == 0
+}
+
+// Backfill bundles the given files through the same path as files that
+// the directory watcher notifies us about, uploads all bundles
+// (regardless of their limits), and waits for the uploads to finish.
+// Because the directory watcher did not notify us about the files,
+// they are not acknowledged with it.
+//
+// Backfill runs its own BundleAndUpload loop until the uploads finish
+// so it should not be called while BundleAndUpload is running or
+// concurrently with another Backfill.
+func (ub *UploadBundle) Backfill(ctx context.Context, fullPaths []string) BackfillSummary {
+	summary := BackfillSummary{Datatype: ub.bundleConf.Datatype}
+	ub.mu.Lock()
+	ub.backfilled = []*bundle{}
+	ub.mu.Unlock()
+	defer func() {
+		ub.mu.Lock()
+		ub.backfilled = nil
+		ub.mu.Unlock()
+	}()
+
+	// Bundles that reach their maximum age are uploaded by
+	// BundleAndUpload as usual.
+	loopCtx, loopCancel := context.WithCancel(ctx)
+	loopDone := make(chan struct{})
+	go func() {
+		_ = ub.BundleAndUpload(loopCtx)
+		close(loopDone)
+	}()
+
+	for _, fullPath := range fullPaths {
+		if !ub.bundleFile(ctx, fullPath) {
+			summary.Skipped++
+		}
+	}
+	ub.flushActiveBundles(ctx, triggerFlush)
+	ub.uploads.Wait()
+	loopCancel()
+	<-loopDone
+
+	ub.mu.Lock()
+	defer ub.mu.Unlock()
+	for _, b := range ub.backfilled {
+		summary.Bundles++
+		info := ub.bundleInfo(b)
+		summary.Files += info.Files
+		summary.BadFiles += info.BadFiles
+		switch b.state {
+		case StateUploaded:
+			summary.Uploaded++
+		case StateFailed:
+			summary.Failed++
+			summary.Errors = append(summary.Errors, b.err.Error())
+		}
+	}
+	return summary
+}
@@ -0,0 +1,76 @@
+package uploadbundle
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/jostler/internal/testhelper"
+)
+
+func TestBackfill(t *testing.T) {
+	tests := []struct {
+		name        string
+		bucket      string
+		wantSummary BackfillSummary
+		wantOK      bool
+		wantRemoved bool
+	}{
+		{
+			name:        "uploaded",
+			bucket:      "newclient,upload",
+			wantSummary: BackfillSummary{Datatype: "foo1", Files: 3, BadFiles: 1, Skipped: 1, Bundles: 2, Uploaded: 2},
+			wantRemoved: true,
+		},
+		{
+			name:        "failed",
+			bucket:      "newclient,failupload",
+			wantSummary: BackfillSummary{Datatype: "foo1", Files: 3, BadFiles: 1, Skipped: 1, Bundles: 2, Failed: 2},
+		},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		ub, wdClient := newLifecycleUB(t, test.bucket, 2, time.Hour)
+		dateDir := filepath.Join(ub.bundleConf.SpoolDir, "2022/11/09")
+		var fullPaths []string
+		for name, contents := range map[string]string{
+			"1.json":     `{"Field1": 1}`,
+			"2.json":     `{"Field1": 2}`,
+			"3.json":     `{"Field1": 3}`,
+			"bad.json":   `{"Field1": `,
+			"empty.json": ``,
+		} {
+			f := filepath.Join(dateDir, name)
+			if err := os.WriteFile(f, []byte(contents), 0o644); err != nil {
+				t.Fatalf("os.WriteFile() = %v, want nil", err)
+			}
+			fullPaths = append(fullPaths, f)
+		}
+		summary := ub.Backfill(context.Background(), fullPaths)
+		errs := summary.Errors
+		summary.Errors = nil
+		if summary.Datatype != test.wantSummary.Datatype || summary.Files != test.wantSummary.Files ||
+			summary.BadFiles != test.wantSummary.BadFiles || summary.Skipped != test.wantSummary.Skipped ||
+			summary.Bundles != test.wantSummary.Bundles || summary.Uploaded != test.wantSummary.Uploaded || summary.Failed != test.wantSummary.Failed {
+			t.Fatalf("Backfill() = %+v, want %+v", summary, test.wantSummary)
+		}
+		if len(errs) != summary.Failed || summary.OK() {
+			t.Fatalf("Backfill() errors = %v, OK() = %v, want %v errors and false", errs, summary.OK(), summary.Failed)
+		}
+		if _, err := os.Stat(filepath.Join(dateDir, "1.json")); os.IsNotExist(err) != test.wantRemoved {
+			t.Fatalf("os.Stat() = %v, want removed %v", err, test.wantRemoved)
+		}
+		// Backfilled files are not acknowledged with the directory
+		// watcher and nothing is left in flight.
+		if n := len(wdClient.WatchAckChan()); n != 0 {
+			t.Fatalf("%v acknowledgements, want 0", n)
+		}
+		for _, info := range ub.Bundles() {
+			if info.State != StateUploaded && info.State != StateFailed {
+				t.Fatalf("Bundles() = %+v, want uploaded or failed", info)
+			}
+		}
+	}
+}
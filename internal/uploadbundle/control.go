@@ -0,0 +1,115 @@
+package uploadbundle
+
+import (
+	"context"
+	"log"
+	"sort"
+)
+
+// Flush asks BundleAndUpload to seal and upload all active bundles
+// regardless of their limits.
+func (ub *UploadBundle) Flush() {
+	// A pending request covers this one too.
+	select {
+	case ub.flushChan <- struct{}{}:
+	default:
+	}
+}
+
+// Pause stops the uploads of sealed bundles until Resume is called.
+// Uploads that are in flight are not affected.  Files keep being added
+// to active bundles, which are sealed as usual when they reach a limit.
+func (ub *UploadBundle) Pause() {
+	ub.mu.Lock()
+	defer ub.mu.Unlock()
+	if !ub.paused {
+		log.Printf("paused uploads of %v bundles\n", ub.bundleConf.Datatype)
+	}
+	ub.paused = true
+}
+
+// Resume resumes uploading bundles as soon as they are sealed and asks
+// BundleAndUpload to upload the bundles that were sealed while uploads
+// were paused.
+func (ub *UploadBundle) Resume() {
+	ub.mu.Lock()
+	defer ub.mu.Unlock()
+	if ub.paused {
+		log.Printf("resumed uploads of %v bundles\n", ub.bundleConf.Datatype)
+	}
+	ub.paused = false
+	select {
+	case ub.resumeChan <- struct{}{}:
+	default:
+	}
+}
+
+// Paused returns true if uploads are paused.
+func (ub *UploadBundle) Paused() bool {
+	ub.mu.Lock()
+	defer ub.mu.Unlock()
+	return ub.paused
+}
+
+// SetPressure tells the uploader whether the spool filesystem is under
+// pressure (see the diskpressure package).  When the pressure starts,
+// BundleAndUpload is asked to seal and upload all active bundles and,
+// until the pressure ends, bundles are uploaded as soon as they reach
+// BundleConfig.PressureSizeMax or BundleConfig.PressureAgeMax.
+func (ub *UploadBundle) SetPressure(pressure bool) {
+	ub.mu.Lock()
+	defer ub.mu.Unlock()
+	if pressure == ub.pressure {
+		return
+	}
+	ub.pressure = pressure
+	if !pressure {
+		log.Printf("disk pressure ended for %v bundles\n", ub.bundleConf.Datatype)
+		return
+	}
+	log.Printf("disk pressure started for %v bundles, flushing active bundles\n", ub.bundleConf.Datatype)
+	select {
+	case ub.pressureChan <- struct{}{}:
+	default:
+	}
+}
+
+// Pressure returns true if the spool filesystem is under pressure.
+func (ub *UploadBundle) Pressure() bool {
+	ub.mu.Lock()
+	defer ub.mu.Unlock()
+	return ub.pressure
+}
+
+// flushActiveBundles seals and uploads all active bundles because of
+// the given trigger.
+func (ub *UploadBundle) flushActiveBundles(ctx context.Context, trigger string) {
+	ub.mu.Lock()
+	defer ub.mu.Unlock()
+	verbose("flushing %v active bundles", len(ub.activeBundles))
+	for _, b := range ub.activeBundles {
+		ub.uploadBundle(ctx, b, trigger)
+	}
+}
+
+// uploadHeldBundles uploads the bundles that were sealed while uploads
+// were paused one after another in the order they were created, unless
+// uploads were paused again in the meantime.
+func (ub *UploadBundle) uploadHeldBundles(ctx context.Context) {
+	ub.mu.Lock()
+	defer ub.mu.Unlock()
+	if ub.paused || len(ub.held) == 0 {
+		return
+	}
+	held := ub.held
+	ub.held = nil
+	sort.Slice(held, func(i, j int) bool {
+		return held[i].created.Before(held[j].created)
+	})
+	ub.uploads.Add(len(held))
+	go func() {
+		for _, b := range held {
+			ub.uploadInBackground(ctx, b)
+		}
+	}()
+}
@@ -0,0 +1,118 @@
+package uploadbundle
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/jostler/internal/watchdir"
+)
+
+func TestPauseResumeFlush(t *testing.T) {
+	ub, wdClient := newLifecycleUB(t, "newclient,upload", 2, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = ub.BundleAndUpload(ctx)
+	}()
+	addFiles := func(first, n int) {
+		for j := first; j < first+n; j++ {
+			f := filepath.Join(ub.bundleConf.SpoolDir, "2022/11/09", fmt.Sprintf("%d.json", j))
+			if err := os.WriteFile(f, []byte(`{"Field1": 1}`), 0o644); err != nil {
+				t.Fatalf("os.WriteFile() = %v, want nil", err)
+			}
+			wdClient.WatchChan() <- watchdir.WatchEvent{Path: f, Missed: false}
+		}
+	}
+
+	// While paused, bundles that reach their limit stay sealed.
+	ub.Pause()
+	if !ub.Paused() {
+		t.Fatalf("Paused() = false, want true")
+	}
+	addFiles(0, 4)
+	waitForState(t, ub, StateSealed, 2)
+
+	// Resuming uploads the sealed bundles one after another in the
+	// order they were created.
+	ub.Resume()
+	if ub.Paused() {
+		t.Fatalf("Paused() = true, want false")
+	}
+	infos := waitForState(t, ub, StateUploaded, 2)
+	if infos[1].Updated.Before(infos[0].Updated) {
+		t.Fatalf("Bundles() = %+v, want bundles uploaded in order", infos)
+	}
+
+	// Flushing uploads the active bundle before it reaches its limit.
+	addFiles(4, 1)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if infos := ub.Bundles(); len(infos) == 3 && infos[2].Files == 1 {
+			break
+		}
+	}
+	ub.Flush()
+	infos = waitForState(t, ub, StateUploaded, 3)
+	if infos[2].Trigger != triggerFlush || infos[2].Files != 1 {
+		t.Fatalf("Bundles() = %+v, want 1 file flushed", infos[2])
+	}
+}
+
+func TestPressure(t *testing.T) {
+	ub, wdClient := newLifecycleUB(t, "newclient,upload", 0, time.Hour)
+	ub.bundleConf.PressureSizeMax = 400
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = ub.BundleAndUpload(ctx)
+	}()
+	addFile := func(j int) {
+		f := filepath.Join(ub.bundleConf.SpoolDir, "2022/11/09", fmt.Sprintf("%d.json", j))
+		if err := os.WriteFile(f, []byte(`{"Field1": 1}`), 0o644); err != nil {
+			t.Fatalf("os.WriteFile() = %v, want nil", err)
+		}
+		wdClient.WatchChan() <- watchdir.WatchEvent{Path: f, Missed: false}
+	}
+
+	// Without pressure, the bundle stays active.
+	addFile(0)
+	waitForState(t, ub, StateActive, 1)
+
+	// When the pressure starts, the active bundle is flushed.
+	ub.SetPressure(true)
+	if !ub.Pressure() {
+		t.Fatalf("Pressure() = false, want true")
+	}
+	infos := waitForState(t, ub, StateUploaded, 1)
+	if infos[0].Trigger != triggerPressure {
+		t.Fatalf("Bundles() = %+v, want trigger %v", infos[0], triggerPressure)
+	}
+
+	// Under pressure, bundles are uploaded when they reach the
+	// smaller maximum size.
+	addFile(1)
+	addFile(2)
+	infos = waitForState(t, ub, StateUploaded, 2)
+	if infos[1].Trigger != triggerPressure || infos[1].Files != 2 {
+		t.Fatalf("Bundles() = %+v, want 2 files and trigger %v", infos[1], triggerPressure)
+	}
+
+	// When the pressure ends, bundles stay active again.
+	ub.SetPressure(false)
+	if ub.Pressure() {
+		t.Fatalf("Pressure() = true, want false")
+	}
+	addFile(3)
+	addFile(4)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if infos = ub.Bundles(); len(infos) == 3 && infos[2].Files == 2 {
+			break
+		}
+	}
+	if len(infos) != 3 || infos[2].State != StateActive || infos[2].Files != 2 {
+		t.Fatalf("Bundles() = %+v, want an active bundle with 2 files", infos)
+	}
+}
@@ -0,0 +1,222 @@
+package uploadbundle
+
+import (
+	"log"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/m-lab/jostler/internal/jsonlbundle"
+)
+
+// State is the state of a bundle in its lifecycle.  A bundle is created
+// active, is sealed when it reaches one of its limits, and is then
+// uploaded in the background (or queued in the outbox to be uploaded
+// later):
+//
+//	active -> sealed -> uploading -> uploaded
+//	                              -> queued
+//	                              -> failed
+type State string
+
+// Bundle states.
+const (
+	StateActive    State = "active"    // files are being added to the bundle
+	StateSealed    State = "sealed"    // no more files can be added and the bundle is waiting to be uploaded
+	StateUploading State = "uploading" // the bundle and its index are being uploaded
+	StateUploaded  State = "uploaded"  // the bundle and its index were uploaded
+	StateQueued    State = "queued"    // the bundle and its index were queued in the outbox to be uploaded later
+	StateFailed    State = "failed"    // the bundle or its index failed to upload
+)
+
+// BundleInfo describes a bundle and its state.
+type BundleInfo struct {
+	Datatype       string    `json:"datatype"`
+	Timestamp      string    `json:"timestamp"`         // bundle's identifier
+	Start          time.Time `json:"start"`             // start of the partition of the bundle's files
+	Created        time.Time `json:"created"`           // when the bundle was created
+	State          State     `json:"state"`             // current state of the bundle
+	Updated        time.Time `json:"updated"`           // when the bundle entered its current state
+	Trigger        string    `json:"trigger,omitempty"` // limit that sealed the bundle
+	Files          int       `json:"files"`             // number of files (i.e., rows) in the bundle
+	BadFiles       int       `json:"badFiles"`          // number of files that could not be added
+	Size           uint      `json:"size"`              // size of the bundle
+	CompressedSize uint      `json:"compressedSize"`    // estimated compressed size of the bundle (zero without a compressed size limit)
+	Bucket         string    `json:"bucket"`            // GCS bucket of the bundle and its index
+	DataObject     string    `json:"dataObject"`        // GCS object name of the bundle
+	IndexObject    string    `json:"indexObject"`       // GCS object name of the bundle's index
+	Error          string    `json:"error,omitempty"`   // why the bundle failed to upload
+}
+
+// UploadSummary summarizes the outcomes of bundle uploads.
+type UploadSummary struct {
+	LastUploaded time.Time `json:"lastUploaded"`        // when a bundle was last uploaded (zero if never)
+	LastQueued   time.Time `json:"lastQueued"`          // when a bundle was last queued in the outbox (zero if never)
+	LastFailed   time.Time `json:"lastFailed"`          // when a bundle last failed to upload (zero if never)
+	LastError    string    `json:"lastError,omitempty"` // why the bundle last failed to upload
+}
+
+// bundle tracks a JSONL bundle through its lifecycle.  Once the bundle
+// is uploaded, queued, or failed, only a snapshot of its information and
+// the pathnames of its files are kept (see finish) so that the contents
+// of the most recently finished bundles are not kept in memory.
+type bundle struct {
+	jb       *jsonlbundle.JSONLBundle // nil once the bundle is finished
+	info     *BundleInfo              // snapshot taken when the bundle finished
+	files    []string                 // pathnames of files and bad files of the finished bundle
+	created  time.Time
+	state    State
+	updated  time.Time
+	trigger  string
+	timer    *time.Timer // age timer (stopped when the bundle is sealed and released when it's finished)
+	err      error
+	backfill bool // whether the bundle was created during a backfill
+}
+
+var (
+	// transitions maps each state to the states that a bundle can
+	// move to from it.
+	transitions = map[State][]State{
+		StateActive:    {StateSealed},
+		StateSealed:    {StateUploading},
+		StateUploading: {StateUploaded, StateQueued, StateFailed},
+	}
+
+	// finishedMax is the maximum number of uploaded, queued, and
+	// failed bundles that are kept for introspection.
+	finishedMax = 100
+)
+
+// setState moves the given bundle to the given state and updates the
+// bookkeeping of bundles.  It should be called with ub.mu held.
+func (ub *UploadBundle) setState(b *bundle, state State, err error) {
+	valid := false
+	for _, next := range transitions[b.state] {
+		if next == state {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		log.Printf("INTERNAL ERROR: %v: invalid transition from %v to %v", b.jb.Description(), b.state, state)
+	}
+	verbose("%v: %v -> %v", b.jb.Description(), b.state, state)
+	b.state, b.updated, b.err = state, time.Now().UTC(), err
+	switch state {
+	case StateSealed:
+		b.timer.Stop()
+		delete(ub.activeBundles, b.jb.Start)
+	case StateUploaded, StateQueued, StateFailed:
+		switch state {
+		case StateUploaded:
+			ub.summary.LastUploaded = b.updated
+		case StateQueued:
+			ub.summary.LastQueued = b.updated
+		default:
+			ub.summary.LastFailed = b.updated
+			ub.summary.LastError = err.Error()
+		}
+		ub.finish(b)
+		if len(ub.finished) > finishedMax {
+			delete(ub.bundles, ub.finished[0])
+			ub.finished = ub.finished[1:]
+		}
+	}
+}
+
+// finish replaces the JSONL bundle of the given bundle, which just
+// reached a terminal state, with a snapshot of its information and the
+// pathnames of its files and adds it to the finished bundles.  The age
+// timer is released too since its function refers to the JSONL bundle.
+// It should be called with ub.mu held.
+func (ub *UploadBundle) finish(b *bundle) {
+	info := ub.bundleInfo(b)
+	b.info = &info
+	b.files = append(b.jb.IndexFilenames(), b.jb.BadFiles...)
+	b.jb, b.timer = nil, nil
+	ub.finished = append(ub.finished, info.Timestamp)
+}
+
+// hasFile returns true if the given bundle has the given file.
+func (b *bundle) hasFile(fullPath string) bool {
+	if b.jb != nil {
+		return b.jb.HasFile(fullPath)
+	}
+	for _, f := range b.files {
+		if f == fullPath {
+			return true
+		}
+	}
+	return false
+}
+
+// Bundles returns information about active bundles, bundles that are
+// waiting to be uploaded or are being uploaded, and the most recently
+// uploaded, queued, or failed bundles in the order they were created.
+func (ub *UploadBundle) Bundles() []BundleInfo {
+	ub.mu.Lock()
+	defer ub.mu.Unlock()
+	infos := make([]BundleInfo, 0, len(ub.bundles))
+	for _, b := range ub.bundles {
+		infos = append(infos, ub.bundleInfo(b))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Created.Before(infos[j].Created)
+	})
+	return infos
+}
+
+// FindFile returns information about the most recently created bundle
+// that has the given file.  It returns false if no bundle that is
+// tracked (see Bundles) has the file.
+func (ub *UploadBundle) FindFile(fullPath string) (BundleInfo, bool) {
+	fullPath = filepath.Clean(fullPath)
+	ub.mu.Lock()
+	defer ub.mu.Unlock()
+	var found *bundle
+	for _, b := range ub.bundles {
+		if (found == nil || b.created.After(found.created)) && b.hasFile(fullPath) {
+			found = b
+		}
+	}
+	if found == nil {
+		return BundleInfo{}, false
+	}
+	return ub.bundleInfo(found), true
+}
+
+// Uploads returns the summary of bundle uploads.
+func (ub *UploadBundle) Uploads() UploadSummary {
+	ub.mu.Lock()
+	defer ub.mu.Unlock()
+	return ub.summary
+}
+
+// bundleInfo returns information about the given bundle.  It should be
+// called with ub.mu held.
+func (ub *UploadBundle) bundleInfo(b *bundle) BundleInfo {
+	if b.info != nil {
+		return *b.info
+	}
+	info := BundleInfo{
+		Datatype:       b.jb.Datatype,
+		Timestamp:      b.jb.Timestamp,
+		Start:          b.jb.Start,
+		Created:        b.created,
+		State:          b.state,
+		Updated:        b.updated,
+		Trigger:        b.trigger,
+		Files:          len(b.jb.Index),
+		BadFiles:       len(b.jb.BadFiles),
+		Size:           b.jb.Size,
+		CompressedSize: b.jb.CompressedSize,
+		Bucket:         ub.gcsConf.Bucket,
+		DataObject:     path.Join(b.jb.BundleDir, b.jb.BundleName),
+		IndexObject:    path.Join(b.jb.IndexDir, b.jb.IndexName),
+	}
+	if b.err != nil {
+		info.Error = b.err.Error()
+	}
+	return info
+}
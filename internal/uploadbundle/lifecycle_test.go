@@ -0,0 +1,296 @@
+package uploadbundle
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/jostler/internal/jsonlbundle"
+	"github.com/m-lab/jostler/internal/naming"
+	"github.com/m-lab/jostler/internal/outbox"
+	"github.com/m-lab/jostler/internal/retention"
+	"github.com/m-lab/jostler/internal/testhelper"
+	"github.com/m-lab/jostler/internal/watchdir"
+)
+
+func TestLifecycle(t *testing.T) {
+	saveFinishedMax := finishedMax
+	defer func() { finishedMax = saveFinishedMax }()
+	finishedMax = 2
+
+	tests := []struct {
+		name        string
+		bucket      string
+		rowsMax     uint
+		ageMax      time.Duration
+		files       int
+		wantBundles int
+		wantState   State
+		wantTrigger string
+	}{
+		{name: "active", bucket: "newclient,upload", ageMax: time.Hour, files: 3, wantBundles: 1, wantState: StateActive},
+		{name: "uploaded and bounded", bucket: "newclient,upload", rowsMax: 1, ageMax: time.Hour, files: 4, wantBundles: 2, wantState: StateUploaded, wantTrigger: triggerRows},
+		{name: "failed", bucket: "newclient,failupload", rowsMax: 1, ageMax: time.Hour, files: 1, wantBundles: 1, wantState: StateFailed, wantTrigger: triggerRows},
+		{name: "aged", bucket: "newclient,upload", ageMax: 100 * time.Millisecond, files: 2, wantBundles: 1, wantState: StateUploaded, wantTrigger: triggerPartition},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		ub, wdClient := newLifecycleUB(t, test.bucket, test.rowsMax, test.ageMax)
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			_ = ub.BundleAndUpload(ctx)
+		}()
+		dateDir := filepath.Join(ub.bundleConf.SpoolDir, "2022/11/09")
+		for j := 0; j < test.files; j++ {
+			f := filepath.Join(dateDir, fmt.Sprintf("%d.json", j))
+			if err := os.WriteFile(f, []byte(`{"Field1": 1}`), 0o644); err != nil {
+				t.Fatalf("os.WriteFile() = %v, want nil", err)
+			}
+			wdClient.WatchChan() <- watchdir.WatchEvent{Path: f, Missed: false}
+		}
+		infos := waitForState(t, ub, test.wantState, test.wantBundles)
+		cancel()
+		for _, info := range infos {
+			if info.Trigger != test.wantTrigger || info.DataObject == "" || info.IndexObject == "" {
+				t.Fatalf("Bundles() = %+v, want trigger %q and object names", info, test.wantTrigger)
+			}
+			if (info.State == StateFailed) != (info.Error != "") {
+				t.Fatalf("Bundles() = %+v, want error only if failed", info)
+			}
+		}
+		// Finished bundles don't keep their JSONL bundles.
+		ub.mu.Lock()
+		for _, b := range ub.bundles {
+			if finished := b.state == StateUploaded || b.state == StateFailed; (b.jb == nil) != finished {
+				ub.mu.Unlock()
+				t.Fatalf("bundle in state %v has JSONL bundle %v, want %v", b.state, b.jb != nil, !finished)
+			}
+		}
+		ub.mu.Unlock()
+		// Only files of bundles that are still tracked can be found.
+		wantFound, found := 0, 0
+		for _, info := range infos {
+			wantFound += info.Files
+		}
+		for j := 0; j < test.files; j++ {
+			info, ok := ub.FindFile(filepath.Join(dateDir, fmt.Sprintf("%d.json", j)))
+			if !ok {
+				continue
+			}
+			if info.State != test.wantState || info.Bucket != test.bucket {
+				t.Fatalf("FindFile() = %+v, want bundle in state %v", info, test.wantState)
+			}
+			found++
+		}
+		if found != wantFound {
+			t.Fatalf("FindFile() found %v files, want %v", found, wantFound)
+		}
+		if info, ok := ub.FindFile(filepath.Join(dateDir, "missing.json")); ok {
+			t.Fatalf("FindFile() = %+v, %v, want false", info, ok)
+		}
+		summary := ub.Uploads()
+		if (test.wantState == StateUploaded) == summary.LastUploaded.IsZero() || (test.wantState == StateFailed) == (summary.LastError == "") {
+			t.Fatalf("Uploads() = %+v, want uploads in state %v", summary, test.wantState)
+		}
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	tests := []struct {
+		name      string
+		bucket    string
+		policy    string
+		sizeMax   int64
+		pending   bool // whether the outbox has a bundle already
+		files     int
+		wantState State
+	}{
+		{name: "queued", bucket: "newclient,failupload", policy: outbox.PolicyOldestFirst, sizeMax: 1024 * 1024, files: 2, wantState: StateQueued},
+		{name: "queued behind outbox", bucket: "newclient,upload", policy: outbox.PolicyOldestFirst, sizeMax: 1024 * 1024, pending: true, files: 2, wantState: StateQueued},
+		{name: "refused", bucket: "newclient,failupload", policy: outbox.PolicyRefuseNew, sizeMax: 10, files: 2, wantState: StateFailed},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		ub, _ := newLifecycleUB(t, test.bucket, 1, time.Hour)
+		obClient, err := testhelper.NewClient(context.Background(), "newclient")
+		if err != nil {
+			t.Fatalf("testhelper.NewClient() = %v, wanted nil", err)
+		}
+		ob, err := outbox.New(outbox.Config{Dir: t.TempDir(), SizeMax: test.sizeMax, Policy: test.policy, RetryInterval: time.Hour}, obClient)
+		if err != nil {
+			t.Fatalf("outbox.New() = %v, want nil", err)
+		}
+		wantQueued := 0
+		if test.pending {
+			if err := ob.Add([]outbox.Object{{Name: "pending", Datatype: "foo1", Contents: []byte("pending")}}); err != nil {
+				t.Fatalf("Add() = %v, want nil", err)
+			}
+			wantQueued++
+		}
+		ub.gcsConf.Outbox = ob
+		var files []string
+		for j := 0; j < test.files; j++ {
+			f := filepath.Join(ub.bundleConf.SpoolDir, "2022/11/09", fmt.Sprintf("%d.json", j))
+			if err := os.WriteFile(f, []byte(`{"Field1": 1}`), 0o644); err != nil {
+				t.Fatalf("os.WriteFile() = %v, want nil", err)
+			}
+			ub.bundleFile(context.Background(), f)
+			files = append(files, f)
+		}
+		waitForState(t, ub, test.wantState, test.files)
+		ub.uploads.Wait()
+		if test.wantState == StateQueued {
+			wantQueued += test.files
+		}
+		if n, _ := ob.Len(); n != wantQueued {
+			t.Fatalf("Len() = %v, want %v", n, wantQueued)
+		}
+		// Files of queued bundles are removed from the spool and
+		// files of failed bundles are kept.
+		for _, f := range files {
+			_, err := os.Stat(f)
+			if removed := err != nil; removed != (test.wantState == StateQueued) {
+				t.Fatalf("%v removed = %v, want %v", f, removed, test.wantState == StateQueued)
+			}
+		}
+		if summary := ub.Uploads(); (test.wantState == StateQueued) == summary.LastQueued.IsZero() {
+			t.Fatalf("Uploads() = %+v, want bundles in state %v", summary, test.wantState)
+		}
+	}
+}
+
+// failingRetainer fails to retain files.
+type failingRetainer struct{}
+
+func (failingRetainer) Retain(fullPath string) error {
+	return fmt.Errorf("%v: failed to retain", fullPath)
+}
+
+func TestRetainer(t *testing.T) {
+	tests := []struct {
+		name         string
+		failing      bool
+		wantRetained bool
+	}{
+		{name: "retained", wantRetained: true},
+		{name: "retain fails", failing: true},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		ub, _ := newLifecycleUB(t, "newclient,upload", 1, time.Hour)
+		retentionDir := t.TempDir()
+		if test.failing {
+			ub.bundleConf.Retainer = failingRetainer{}
+		} else {
+			r, err := retention.New(retention.Config{Dir: retentionDir, SpoolDir: ub.bundleConf.SpoolDir, Interval: time.Hour})
+			if err != nil {
+				t.Fatalf("retention.New() = %v, want nil", err)
+			}
+			ub.bundleConf.Retainer = r
+		}
+		f := filepath.Join(ub.bundleConf.SpoolDir, "2022/11/09/retained.json")
+		if err := os.WriteFile(f, []byte(`{"Field1": 1}`), 0o644); err != nil {
+			t.Fatalf("os.WriteFile() = %v, want nil", err)
+		}
+		ub.bundleFile(context.Background(), f)
+		waitForState(t, ub, StateUploaded, 1)
+		ub.uploads.Wait()
+		// Uploaded files are removed from the spool either way.
+		if _, err := os.Stat(f); err == nil {
+			t.Fatalf("os.Stat(%v) = nil, want error", f)
+		}
+		_, err := os.Stat(filepath.Join(retentionDir, "2022/11/09/retained.json"))
+		if retained := err == nil; retained != test.wantRetained {
+			t.Fatalf("retained = %v, want %v", retained, test.wantRetained)
+		}
+	}
+}
+
+func TestLateAgeTimer(t *testing.T) {
+	ub, _ := newLifecycleUB(t, "newclient,upload", 1, time.Hour)
+	f := filepath.Join(ub.bundleConf.SpoolDir, "2022/11/09/late.json")
+	if err := os.WriteFile(f, []byte(`{"Field1": 1}`), 0o644); err != nil {
+		t.Fatalf("os.WriteFile() = %v, want nil", err)
+	}
+	ub.bundleFile(context.Background(), f)
+	infos := waitForState(t, ub, StateUploaded, 1)
+
+	// The age timer was stopped when the bundle was sealed and released
+	// when it was uploaded but it may have already gone off, which
+	// should not change anything.
+	ub.mu.Lock()
+	b := ub.bundles[infos[0].Timestamp]
+	released := b.jb == nil && b.timer == nil
+	ub.mu.Unlock()
+	if !released {
+		t.Fatalf("JSONL bundle or age timer of %v was not released", infos[0].Timestamp)
+	}
+	ub.uploadAgedBundle(context.Background(), &jsonlbundle.JSONLBundle{Timestamp: infos[0].Timestamp})
+	if got := ub.Bundles(); len(got) != 1 || got[0] != infos[0] {
+		t.Fatalf("Bundles() = %+v, want %+v", got, infos)
+	}
+}
+
+// newLifecycleUB returns a new UploadBundle whose spool directory has
+// a date subdirectory and its directory watcher.
+func newLifecycleUB(t *testing.T, bucket string, rowsMax uint, ageMax time.Duration) (*UploadBundle, *testhelper.WatchDir) {
+	t.Helper()
+	spoolDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(spoolDir, "2022/11/09"), 0o755); err != nil {
+		t.Fatalf("os.MkdirAll() = %v, want nil", err)
+	}
+	wdClient, err := testhelper.WatchDirNew(spoolDir)
+	if err != nil {
+		t.Fatalf("testhelper.WatchDirNew() = %v, want nil", err)
+	}
+	stClient, err := testhelper.NewClient(context.Background(), bucket)
+	if err != nil {
+		t.Fatalf("testhelper.NewClient() = %v, wanted nil", err)
+	}
+	gcsConf := GCSConfig{
+		GCSClient:     stClient,
+		Bucket:        bucket,
+		DataDir:       "testdata/autoload/v1",
+		DataTemplate:  naming.MustParse(naming.DefaultData),
+		IndexTemplate: naming.MustParse(naming.DefaultIndex),
+	}
+	bundleConf := BundleConfig{
+		Datatype: "foo1",
+		SpoolDir: spoolDir,
+		SizeMax:  1024 * 1024,
+		AgeMax:   ageMax,
+		RowsMax:  rowsMax,
+	}
+	ub, err := New(context.Background(), wdClient, gcsConf, bundleConf)
+	if err != nil {
+		t.Fatalf("New() = %v, want nil", err)
+	}
+	return ub, wdClient
+}
+
+// waitForState waits until the given number of bundles are tracked and
+// all are in the given state and returns them.
+func waitForState(t *testing.T, ub *UploadBundle, state State, n int) []BundleInfo {
+	t.Helper()
+	var infos []BundleInfo
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		infos = ub.Bundles()
+		if len(infos) != n {
+			continue
+		}
+		done := true
+		for _, info := range infos {
+			if info.State != state {
+				done = false
+			}
+		}
+		if done {
+			return infos
+		}
+	}
+	t.Fatalf("Bundles() = %+v, want %v bundles in state %v", infos, n, state)
+	return nil
+}
@@ -4,20 +4,31 @@
 //
 // The local files should:
 //
-//  1. Be in date subdirectories (<yyyy>/<mm>/<dd>) of a data directory
-//     configured via BundleConfig.DataDir.
+//  1. Be in the layout (by default, date subdirectories <yyyy>/<mm>/<dd>)
+//     of a data directory configured via BundleConfig.SpoolDir (see
+//     BundleConfig.Layout and BundleConfig.DateSource).
 //  2. Have basenames conforming to regexp ^[a-zA-Z0-9][a-zA-Z0-9:._-]*.json
 //     and not have consecutive dots.
 //  3. In proper JSON format with ".json" extension.
 //  4. Be smaller than the maximum size of a bundle (BundleConfig.SizeMax).
 //
 // GCS object names of JSONL bundles and their corresponding indices
-// have the following format:
+// are GCSConfig.DataTemplate and GCSConfig.IndexTemplate expanded under
+// GCSConfig.DataDir (see the naming package).  By default, they have
+// the following format:
 //
-//	autoload/v1/<experiment>/<datatype>/<yyyy>/<mm>/<dd>/<timestamp>-<datatype>-<node>-<experiment>.jsonl.gz
-//	|--------GCSConfig.DataDir--------|                                   |-------GCSConfig.BaseID-----|
-//	autoload/v1/<experiment>/index1/<yyyy>/<mm>/<dd>/<timestamp>-<datatype>-<node>-<experiment>.index.gz
-//	|------GCSConfig.IndexDir-----|                                   |-------GCSConfig.BaseID-----|
+//	autoload/v1/<experiment>/<datatype>/<yyyy>/<mm>/<dd>/<timestamp>-<datatype>-<machine>-<site>-<experiment>-data.jsonl.gz
+//	autoload/v1/<experiment>/index1/<yyyy>/<mm>/<dd>/<timestamp>-<datatype>-<machine>-<site>-<experiment>-index1.jsonl.gz
+//	|GCSConfig.DataDir|
+//
+// If GCSConfig.Outbox is set, bundles that fail to upload are queued in
+// the outbox to be uploaded later and their files are removed from the
+// local filesystem.  While the outbox has bundles, new bundles are
+// queued behind them so that bundles are uploaded in order.
+//
+// If BundleConfig.Retainer is set, the files of uploaded (or queued)
+// bundles are handed to it (e.g., to be moved to a retention directory)
+// instead of being removed.
 package uploadbundle
 
 import (
@@ -32,10 +43,13 @@ import (
 	"reflect"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
-	"cloud.google.com/go/civil"
 	"github.com/m-lab/jostler/internal/jsonlbundle"
+	"github.com/m-lab/jostler/internal/layout"
+	"github.com/m-lab/jostler/internal/naming"
+	"github.com/m-lab/jostler/internal/outbox"
 	"github.com/m-lab/jostler/internal/watchdir"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -51,12 +65,25 @@ type DirWatcher interface {
 // UploadBundle defines configuration options and other fields that are
 // common to all instances of JSONL bundles (see jsonlBundle).
 type UploadBundle struct {
-	wdClient      DirWatcher                              // directory watcher that notifies us
-	gcsConf       GCSConfig                               // GCS configuration
-	bundleConf    BundleConfig                            // bundle configuration
-	ageChan       chan *jsonlbundle.JSONLBundle           // notification channel for when bundle reaches maximum age
-	activeBundles map[civil.Date]*jsonlbundle.JSONLBundle // bundles that are active
-	uploadBundles map[string]struct{}                     // bundles that are being uploaded or were uploaded
+	wdClient      DirWatcher                    // directory watcher that notifies us
+	gcsConf       GCSConfig                     // GCS configuration
+	bundleConf    BundleConfig                  // bundle configuration
+	ageChan       chan *jsonlbundle.JSONLBundle // notification channel for when bundle reaches maximum age or its partition closes
+	lastTimestamp time.Time                     // creation time of the last bundle
+	flushChan     chan struct{}                 // requests to flush active bundles (see Flush)
+	resumeChan    chan struct{}                 // requests to upload bundles held while uploads were paused (see Resume)
+	pressureChan  chan struct{}                 // requests to flush active bundles because of disk pressure (see SetPressure)
+	uploads       sync.WaitGroup                // uploads in the background
+
+	mu            sync.Mutex            // protects the following fields and the contents of bundles
+	activeBundles map[time.Time]*bundle // bundles that are active keyed by the start of their partition
+	bundles       map[string]*bundle    // bundles that are tracked (see Bundles) keyed by their timestamps
+	finished      []string              // timestamps of uploaded, queued, and failed bundles from oldest to newest
+	paused        bool                  // whether uploads of sealed bundles are paused (see Pause)
+	held          []*bundle             // bundles that were sealed while uploads were paused
+	pressure      bool                  // whether the spool filesystem is under pressure (see SetPressure)
+	summary       UploadSummary         // outcomes of uploads (see Uploads)
+	backfilled    []*bundle             // bundles created during a backfill (nil if not backfilling)
 }
 
 // Uploader interface.
@@ -64,15 +91,31 @@ type Uploader interface {
 	Upload(context.Context, string, []byte) error
 }
 
+// Retainer defines the interface of what keeps files of uploaded
+// bundles for a while instead of removing them (see the retention
+// package).
+type Retainer interface {
+	Retain(string) error
+}
+
+// Outbox defines the interface of the outbox where bundles that cannot
+// be uploaded are queued (see the outbox package).
+type Outbox interface {
+	Pending() bool
+	Add([]outbox.Object) error
+}
+
 // GCSConfig defines GCS configuration options.
 // Note that while slashes ("/") in GCS object names create the illusion
 // of a directory hierarchy, GCS has a flat namesapce.
 type GCSConfig struct {
-	GCSClient Uploader
-	Bucket    string // GCS bucket name
-	DataDir   string // see the comment at the top of this file
-	IndexDir  string // see the comment at the top of this file
-	BaseID    string // see the comment at the top of this file
+	GCSClient     Uploader
+	Bucket        string           // GCS bucket name
+	DataDir       string           // home directory in GCS bucket (e.g., autoload/v1)
+	DataTemplate  *naming.Template // template of data bundle object names
+	IndexTemplate *naming.Template // template of index bundle object names
+	Vars          naming.Vars      // node, experiment, and organization variables of templates
+	Outbox        Outbox           // outbox of bundles that cannot be uploaded (nil if none)
 }
 
 // BundleConfig defines bundle configuration options.
@@ -81,10 +124,71 @@ type BundleConfig struct {
 	GitCommit string        // git commit SHA1 of this program (e.g., 2abe77f)
 	Datatype  string        // datatype (e.g., scamper1)
 	SpoolDir  string        // path to datatype subdirectory on local disk (e.g., /var/spool/<experiment>/<datatype>)
-	SizeMax   uint          // bundle will be uploaded when it reaches this size
+	SizeMax   uint          // bundle will be uploaded when it reaches this (uncompressed) size
 	AgeMax    time.Duration // bundle will be uploaded when it reaches this age
+
+	RowsMax           uint // bundle will be uploaded when it reaches this number of rows (no limit if zero)
+	CompressedSizeMax uint // bundle will be uploaded when its estimated compressed size reaches this size (no limit if zero)
+
+	StdCols jsonlbundle.StdColsConfig // standard columns of lines in bundles
+
+	// The date of a file determines which bundle it's added to, the
+	// date standard column, and the GCS object names of the bundle.
+	DateSource string // source of the date of files (DateFromDir if empty)
+	DateField  string // full name of the field in measurement data if DateSource is DateFromField
+
+	// Layout of files in SpoolDir.  If nil, files should be in date
+	// subdirectories if DateSource is DateFromDir and can be anywhere
+	// otherwise.
+	Layout *layout.Layout
+
+	// Files are bundled by partitions of time (i.e., windows) of this
+	// length, which must be whole minutes that evenly divide a day
+	// (PartitionDay if zero).  The bundle of a partition is uploaded
+	// FlushDelay after its window closes unless it reaches its
+	// maximum age or size first.
+	Partition  time.Duration
+	FlushDelay time.Duration // DefaultFlushDelay if zero
+
+	// While the spool filesystem is under pressure (see SetPressure),
+	// bundles are uploaded as soon as they reach these smaller limits
+	// (no change to the size or age limit if zero).
+	PressureSizeMax uint
+	PressureAgeMax  time.Duration
+
+	// Retainer keeps the files of uploaded bundles instead of
+	// removing them (nil if none).
+	Retainer Retainer
 }
 
+// Common partitions.
+const (
+	PartitionDay  = 24 * time.Hour
+	PartitionHour = time.Hour
+)
+
+// Triggers of bundle uploads (i.e., the limit that was reached).
+const (
+	triggerSize           = "size"
+	triggerRows           = "rows"
+	triggerCompressedSize = "compressed_size"
+	triggerAge            = "age"
+	triggerPartition      = "partition"
+	triggerFlush          = "flush"
+	triggerPressure       = "pressure"
+)
+
+// DefaultFlushDelay is how long after its window closes the bundle of a
+// partition is uploaded so files that are written late can make it.
+const DefaultFlushDelay = time.Minute
+
+// Sources of the date of files.
+const (
+	DateFromDir   = "dir"   // date in the file's pathname (see BundleConfig.Layout)
+	DateFromMTime = "mtime" // modification time of the file in UTC
+	DateFromField = "field" // timestamp or date field in the file's measurement data
+)
+
 // Exported errors.
 var (
 	ErrConfig       = errors.New("invalid configuration")
@@ -92,7 +196,6 @@ var (
 	ErrTooShort     = errors.New("is too short")
 	ErrInvalidChars = errors.New("has invalid characters")
 	ErrDotDot       = errors.New("includes '..'")
-	ErrDateDir      = errors.New("is not in .../yyyy/mm/dd/... format")
 	ErrDotFile      = errors.New("starts with '.'")
 	ErrNotRegular   = errors.New("is not a regular file")
 	ErrEmpty        = errors.New("is empty")
@@ -101,8 +204,9 @@ var (
 )
 
 var (
-	weekDays   = 7   // entries in the map
-	numUploads = 100 // concurrent uploads
+	defaultLayout = layout.MustParse(layout.DefaultTemplate)
+
+	weekDays = 7 // entries in the map
 
 	jostlerBytesPerBundle = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
@@ -111,6 +215,12 @@ var (
 			Buckets: []float64{1e2, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8},
 		},
 		[]string{"datatype"})
+	jostlerBundleUploads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "jostler_bundle_uploads_total",
+			Help: "The number of JSONL bundles jostler has started to upload by the limit that triggered the upload",
+		},
+		[]string{"datatype", "trigger"})
 
 	// Testing and debugging support.
 	verbose = func(fmt string, args ...interface{}) {}
@@ -128,26 +238,79 @@ func New(ctx context.Context, wdClient DirWatcher, gcsConf GCSConfig, bundleConf
 	if wdClient == nil || reflect.ValueOf(wdClient).IsNil() {
 		return nil, fmt.Errorf("%w: nil watchdir client", ErrConfig)
 	}
-	if gcsConf.GCSClient == nil || gcsConf.Bucket == "" || gcsConf.DataDir == "" || gcsConf.BaseID == "" || bundleConf.SpoolDir == "" {
+	if gcsConf.GCSClient == nil || gcsConf.Bucket == "" || gcsConf.DataDir == "" || bundleConf.SpoolDir == "" {
 		return nil, fmt.Errorf("%w: nil or empty string in GCS configuration", ErrConfig)
 	}
+	if gcsConf.DataTemplate == nil || gcsConf.IndexTemplate == nil {
+		return nil, fmt.Errorf("%w: nil naming template", ErrConfig)
+	}
+	switch bundleConf.DateSource {
+	case "", DateFromDir:
+		bundleConf.DateSource = DateFromDir
+		if bundleConf.Layout == nil {
+			bundleConf.Layout = defaultLayout
+		}
+		if !bundleConf.Layout.HasDate() {
+			return nil, fmt.Errorf("%w: layout %v has no date", ErrConfig, bundleConf.Layout)
+		}
+	case DateFromMTime:
+	case DateFromField:
+		if bundleConf.DateField == "" {
+			return nil, fmt.Errorf("%w: empty date field", ErrConfig)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %v: invalid date source", ErrConfig, bundleConf.DateSource)
+	}
+	if err := validatePartition(gcsConf, &bundleConf); err != nil {
+		return nil, err
+	}
 	ub := &UploadBundle{
 		wdClient:      wdClient,
 		gcsConf:       gcsConf,
 		bundleConf:    bundleConf,
 		ageChan:       make(chan *jsonlbundle.JSONLBundle),
-		activeBundles: make(map[civil.Date]*jsonlbundle.JSONLBundle, weekDays),
-		uploadBundles: make(map[string]struct{}, numUploads),
+		flushChan:     make(chan struct{}, 1),
+		resumeChan:    make(chan struct{}, 1),
+		pressureChan:  make(chan struct{}, 1),
+		activeBundles: make(map[time.Time]*bundle, weekDays),
+		bundles:       make(map[string]*bundle, weekDays+finishedMax),
 	}
 	ub.bundleConf.SpoolDir = filepath.Clean(ub.bundleConf.SpoolDir)
 	return ub, nil
 }
 
-// BundleAndUpload continuously reads from two channels until its context
+// validatePartition validates the partition of the given bundle
+// configuration (setting its defaults) against how the start of the
+// partition of each file is known and how it appears in object names.
+func validatePartition(gcsConf GCSConfig, bundleConf *BundleConfig) error {
+	if bundleConf.Partition == 0 {
+		bundleConf.Partition = PartitionDay
+	}
+	if bundleConf.FlushDelay == 0 {
+		bundleConf.FlushDelay = DefaultFlushDelay
+	}
+	p := bundleConf.Partition
+	if p < time.Minute || p%time.Minute != 0 || PartitionDay%p != 0 {
+		return fmt.Errorf("%w: %v: partition must be whole minutes that evenly divide a day", ErrConfig, p)
+	}
+	if bundleConf.DateSource == DateFromDir && p < PartitionDay && (!bundleConf.Layout.HasHour() || p < PartitionHour) {
+		return fmt.Errorf("%w: layout %v cannot tell %v partitions apart", ErrConfig, bundleConf.Layout, p)
+	}
+	for _, t := range []*naming.Template{gcsConf.DataTemplate, gcsConf.IndexTemplate} {
+		if t.Resolution() > p {
+			return fmt.Errorf("%w: naming template %v cannot tell %v partitions apart", ErrConfig, t, p)
+		}
+	}
+	return nil
+}
+
+// BundleAndUpload continuously reads from its channels until its context
 // is canceled.  One channel provides pathnames to new or potentially
-// missed files that should be added to the bundle.  The other channel
+// missed files that should be added to the bundle.  Another channel
 // provides timer notifications for in-memory bundles that have reached
-// their maximum age and should be uploaded to GCS.
+// their maximum age and should be uploaded to GCS.  The remaining
+// channels provide requests to flush active bundles and to upload the
+// bundles that were sealed while uploads were paused.
 func (ub *UploadBundle) BundleAndUpload(ctx context.Context) error {
 	verbose("bundling and uploading files in %v", ub.bundleConf.SpoolDir)
 	done := false
@@ -172,208 +335,395 @@ func (ub *UploadBundle) BundleAndUpload(ctx context.Context) error {
 			}
 			// A bundle reached its maximum age.
 			ub.uploadAgedBundle(ctx, jb)
+		case <-ub.flushChan:
+			ub.flushActiveBundles(ctx, triggerFlush)
+		case <-ub.pressureChan:
+			ub.flushActiveBundles(ctx, triggerPressure)
+		case <-ub.resumeChan:
+			ub.uploadHeldBundles(ctx)
 		}
 	}
 	return nil
 }
 
 // bundleFile adds the given file to a bundle if it's a valid JSON file and
-// is has not been bundled before.
-func (ub *UploadBundle) bundleFile(ctx context.Context, fullPath string) {
-	// Validate the file's pathname and get its date subdirectory
-	// and size.
-	date, fileSize, err := ub.fileDetails(fullPath)
+// is has not been bundled before.  It returns false if the file was
+// ignored.
+func (ub *UploadBundle) bundleFile(ctx context.Context, fullPath string) bool {
+	// Validate the file's pathname and get its time and size.
+	fileTime, fileSize, err := ub.fileDetails(fullPath)
 	if err != nil {
 		verbose("WARNING: ignoring %v: %v", fullPath, err)
-		return
+		return false
 	}
 	verbose("%v %v bytes", fullPath, fileSize)
 
-	// Is there an active bundle that this file belongs to?
-	jb := ub.activeBundles[date]
-	if jb != nil {
+	ub.mu.Lock()
+	defer ub.mu.Unlock()
+	// Is there an active bundle for the partition that this file
+	// belongs to?  Partitions evenly divide days in UTC so truncating
+	// the file's time gives the start of its partition.
+	start := fileTime.Truncate(ub.bundleConf.Partition)
+	b := ub.activeBundles[start]
+	if b != nil {
 		// Sanity check.
-		if jb.HasFile(fullPath) {
-			log.Printf("INTERNAL ERROR: %v already in active %v", fullPath, jb.Description())
+		if b.jb.HasFile(fullPath) {
+			log.Printf("INTERNAL ERROR: %v already in active %v", fullPath, b.jb.Description())
 		}
 		// Check if there's enough room for this file in the active
 		// bundle.  If not, upload this bundle and instantiate a
 		// new one.
-		if jb.Size+uint(fileSize) > ub.bundleConf.SizeMax {
-			verbose("not enough room in active %v for %v", jb.Description(), fullPath)
-			ub.uploadBundle(ctx, jb)
-			jb = nil
+		if b.jb.Size+uint(fileSize) > ub.bundleConf.SizeMax {
+			verbose("not enough room in active %v for %v", b.jb.Description(), fullPath)
+			ub.uploadBundle(ctx, b, triggerSize)
+			b = nil
 		}
 	}
-	if jb == nil {
-		jb = ub.newJSONLBundle(date)
+	if b == nil {
+		b = ub.newJSONLBundle(start)
 	}
 	// Add the contents of this file to the bundle.
+	jb := b.jb
 	if err := jb.AddFile(fullPath, ub.bundleConf.Version, ub.bundleConf.GitCommit); err != nil {
 		log.Printf("ERROR: failed to add file to active bundle: %v\n", err)
 	} else {
 		verbose("active %v has %v bytes", jb.Description(), jb.Size)
 	}
+	// Upload the bundle right away if it reached its maximum number
+	// of rows or compressed size or, while the spool filesystem is
+	// under pressure, its smaller maximum size.
+	switch {
+	case ub.bundleConf.RowsMax != 0 && uint(len(jb.Lines)) >= ub.bundleConf.RowsMax:
+		verbose("active %v reached %v rows", jb.Description(), len(jb.Lines))
+		ub.uploadBundle(ctx, b, triggerRows)
+	case ub.bundleConf.CompressedSizeMax != 0 && jb.CompressedSize >= ub.bundleConf.CompressedSizeMax:
+		verbose("active %v reached %v compressed bytes", jb.Description(), jb.CompressedSize)
+		ub.uploadBundle(ctx, b, triggerCompressedSize)
+	case ub.pressure && ub.bundleConf.PressureSizeMax != 0 && jb.Size >= ub.bundleConf.PressureSizeMax:
+		verbose("active %v reached %v bytes under disk pressure", jb.Description(), jb.Size)
+		ub.uploadBundle(ctx, b, triggerPressure)
+	}
+	return true
 }
 
-// fileDetails first verifies fullPath follows M-Lab's conventions
-// /cache/data/<experiment>/<datatype>/<yyyy>/<mm>/<dd>/<filename>
+// fileDetails first verifies fullPath follows the configured layout
+// (by default, M-Lab's conventions
+// /cache/data/<experiment>/<datatype>/<yyyy>/<mm>/<dd>/<filename>)
 // and is a regular file.  Then it makes sure it's not too big.
-// If all is OK, it returns the date component of the file's pathname
-// ("yyyy/mm/dd") as a civil.Date with the file size.
-func (ub *UploadBundle) fileDetails(fullPath string) (civil.Date, int64, error) {
+// If all is OK, it returns the time of the file in UTC with the file
+// size.
+//
+// The time of the file comes from the configured date source.
+func (ub *UploadBundle) fileDetails(fullPath string) (time.Time, int64, error) {
 	cleanFilePath := filepath.Clean(fullPath)
 	dataDir := ub.bundleConf.SpoolDir
 	if !strings.HasPrefix(cleanFilePath, dataDir) {
-		return civil.Date{}, 0, fmt.Errorf("%v: %w", cleanFilePath, ErrNotInDataDir)
+		return time.Time{}, 0, fmt.Errorf("%v: %w", cleanFilePath, ErrNotInDataDir)
 	}
 	if len(cleanFilePath) <= len(dataDir) {
-		return civil.Date{}, 0, fmt.Errorf("%v: %w", cleanFilePath, ErrTooShort)
+		return time.Time{}, 0, fmt.Errorf("%v: %w", cleanFilePath, ErrTooShort)
 	}
 	pathName := regexp.MustCompile(`[^a-zA-Z0-9/:._-]`)
 	if pathName.MatchString(cleanFilePath) {
-		return civil.Date{}, 0, fmt.Errorf("%v: %w", cleanFilePath, ErrInvalidChars)
+		return time.Time{}, 0, fmt.Errorf("%v: %w", cleanFilePath, ErrInvalidChars)
 	}
 	if strings.Contains(cleanFilePath, "..") {
-		return civil.Date{}, 0, fmt.Errorf("%v: %w", cleanFilePath, ErrDotDot)
+		return time.Time{}, 0, fmt.Errorf("%v: %w", cleanFilePath, ErrDotDot)
 	}
-	dateSubdir, filename := filepath.Split(cleanFilePath[len(dataDir):])
-	yyyymmdd := regexp.MustCompile(`/20[0-9][0-9]/[0-9]{2}/[0-9]{2}/`)
-	if len(dateSubdir) != 12 || !yyyymmdd.MatchString(dateSubdir) {
-		return civil.Date{}, 0, fmt.Errorf("%v: %w", cleanFilePath, ErrDateDir)
+	relPath := strings.TrimPrefix(cleanFilePath[len(dataDir):], "/")
+	var dirTime time.Time
+	if ub.bundleConf.Layout != nil {
+		var err error
+		if dirTime, err = ub.bundleConf.Layout.Match(relPath); err != nil {
+			return time.Time{}, 0, err
+		}
 	}
+	filename := filepath.Base(relPath)
 	if strings.HasPrefix(filename, ".") {
-		return civil.Date{}, 0, fmt.Errorf("%v: %w", filename, ErrDotFile)
+		return time.Time{}, 0, fmt.Errorf("%v: %w", filename, ErrDotFile)
 	}
 	fi, err := os.Stat(fullPath)
 	if err != nil {
-		return civil.Date{}, 0, fmt.Errorf("failed to stat: %w", err)
+		return time.Time{}, 0, fmt.Errorf("failed to stat: %w", err)
 	}
 	if !fi.Mode().IsRegular() {
-		return civil.Date{}, 0, fmt.Errorf("%v: %w", filename, ErrNotRegular)
+		return time.Time{}, 0, fmt.Errorf("%v: %w", filename, ErrNotRegular)
 	}
 	if uint(fi.Size()) == 0 {
-		return civil.Date{}, 0, fmt.Errorf("%v: %w", filename, ErrEmpty)
+		return time.Time{}, 0, fmt.Errorf("%v: %w", filename, ErrEmpty)
 	}
 	if uint(fi.Size()) > ub.bundleConf.SizeMax {
-		return civil.Date{}, 0, fmt.Errorf("%v: %w", filename, ErrTooBig)
+		return time.Time{}, 0, fmt.Errorf("%v: %w", filename, ErrTooBig)
 	}
-	date, err := civil.ParseDate(strings.ReplaceAll(dateSubdir[1:11], "/", "-"))
+	fileTime, err := ub.fileTime(fullPath, dirTime, fi)
 	if err != nil {
-		return civil.Date{}, 0, fmt.Errorf("%v: %w", filename, ErrDateParse)
+		return time.Time{}, 0, fmt.Errorf("%v: %v: %w", filename, err, ErrDateParse)
+	}
+	return fileTime, fi.Size(), nil
+}
+
+// fileTime returns the time of the given file in UTC from the configured
+// date source.
+func (ub *UploadBundle) fileTime(fullPath string, dirTime time.Time, fi os.FileInfo) (time.Time, error) {
+	switch ub.bundleConf.DateSource {
+	case DateFromMTime:
+		return fi.ModTime().UTC(), nil
+	case DateFromField:
+		contents, err := os.ReadFile(fullPath)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return jsonlbundle.FieldTime(contents, ub.bundleConf.DateField)
 	}
-	return date, fi.Size(), nil
+	return dirTime, nil
 }
 
-// newJSONLBundle creates and returns a new active bundle instance.
-func (ub *UploadBundle) newJSONLBundle(date civil.Date) *jsonlbundle.JSONLBundle {
+// newJSONLBundle creates and returns a new active bundle instance for
+// the partition that starts at the given time.  It should be called
+// with ub.mu held.
+func (ub *UploadBundle) newJSONLBundle(start time.Time) *bundle {
 	// Sanity check: make sure we don't already have a bundle for
-	// the given date.
-	if jb, ok := ub.activeBundles[date]; ok {
-		if date == jb.Date {
-			log.Printf("INTERNAL ERROR: an active %v already exists", jb.Description())
+	// the given partition.
+	if b, ok := ub.activeBundles[start]; ok {
+		if start.Equal(b.jb.Start) {
+			log.Printf("INTERNAL ERROR: an active %v already exists", b.jb.Description())
 		}
-		log.Printf("INTERNAL ERROR: key %s returned active %v", date, jb.Description())
+		log.Printf("INTERNAL ERROR: key %s returned active %v", start, b.jb.Description())
 	}
 
-	jb := jsonlbundle.New(ub.gcsConf.Bucket, ub.gcsConf.DataDir, ub.gcsConf.IndexDir, ub.gcsConf.BaseID, ub.bundleConf.Datatype, date)
-	ub.activeBundles[date] = jb
+	vars := ub.gcsConf.Vars
+	vars.Datatype = ub.bundleConf.Datatype
+	vars.Start = start
+	vars.Timestamp = ub.newTimestamp()
+	jb := jsonlbundle.New(ub.gcsConf.Bucket, ub.gcsConf.DataDir, ub.gcsConf.DataTemplate, ub.gcsConf.IndexTemplate, vars)
+	jb.StdCols = ub.bundleConf.StdCols
+	jb.EstimateCompressedSize = ub.bundleConf.CompressedSizeMax != 0
+	b := &bundle{jb: jb, created: vars.Timestamp, state: StateActive, updated: vars.Timestamp}
+	if ub.backfilled != nil {
+		b.backfill = true
+		ub.backfilled = append(ub.backfilled, b)
+	}
+	ub.activeBundles[start] = b
+	ub.bundles[jb.Timestamp] = b
 	verbose("created active %v", jb.Description())
-	time.AfterFunc(ub.bundleConf.AgeMax, func() {
+	delay := ub.ageTimerDelay(start)
+	b.timer = time.AfterFunc(delay, func() {
 		ub.ageChan <- jb
 	})
-	log.Printf("started age timer to go off in %v for active %v\n", ub.bundleConf.AgeMax, jb.Description())
-	return jb
+	log.Printf("started age timer to go off in %v for active %v\n", delay, jb.Description())
+	return b
+}
+
+// ageTimerDelay returns when the age timer of a new bundle for the
+// partition that starts at the given time should go off: when it
+// reaches its maximum age (its smaller maximum age while the spool
+// filesystem is under pressure) or FlushDelay after its partition
+// closes, whichever comes first.  It should be called with ub.mu held.
+func (ub *UploadBundle) ageTimerDelay(start time.Time) time.Duration {
+	flush := ub.bundleConf.FlushDelay
+	if untilEnd := time.Until(start.Add(ub.bundleConf.Partition)); untilEnd > 0 {
+		flush += untilEnd
+	}
+	ageMax := ub.bundleConf.AgeMax
+	if ub.pressure && ub.bundleConf.PressureAgeMax != 0 && ub.bundleConf.PressureAgeMax < ageMax {
+		ageMax = ub.bundleConf.PressureAgeMax
+	}
+	if flush < ageMax {
+		return flush
+	}
+	return ageMax
+}
+
+// newTimestamp returns the creation time of a new bundle.  Timestamps
+// are in microseconds (see naming.TimestampFormat) and strictly
+// increasing so bundles of the same datatype never have the same name.
+func (ub *UploadBundle) newTimestamp() time.Time {
+	timestamp := time.Now().UTC().Truncate(time.Microsecond)
+	if !timestamp.After(ub.lastTimestamp) {
+		timestamp = ub.lastTimestamp.Add(time.Microsecond)
+	}
+	ub.lastTimestamp = timestamp
+	return timestamp
 }
 
 // uploadAgedBundle uploads the given bundle if it is still active.
-// Otherwise, we should delete it from the upload bundles map because
-// we received its age timer.
+// Otherwise, its age timer went off after it was sealed and there is
+// nothing to do.
 func (ub *UploadBundle) uploadAgedBundle(ctx context.Context, jb *jsonlbundle.JSONLBundle) {
 	verbose("age timer went off for %v", jb.Description())
-	if _, ok := ub.uploadBundles[jb.Timestamp]; ok {
-		verbose("%v is already uploaded or being uploaded now", jb.Description())
-		delete(ub.uploadBundles, jb.Timestamp)
+	ub.mu.Lock()
+	defer ub.mu.Unlock()
+	b, ok := ub.bundles[jb.Timestamp]
+	if !ok || b.state != StateActive {
+		verbose("%v is no longer active", jb.Description())
 		return
 	}
-	ub.uploadBundle(ctx, jb)
+	trigger := triggerAge
+	if !time.Now().Before(jb.Start.Add(ub.bundleConf.Partition)) {
+		trigger = triggerPartition
+	}
+	ub.uploadBundle(ctx, b, trigger)
 }
 
-// uploadBundle adds the given bundle (which should be active) to the
-// upload bundles map, deletes it from the active bundles map, and start
-// the uploads process to GCS in the background.
-func (ub *UploadBundle) uploadBundle(ctx context.Context, jb *jsonlbundle.JSONLBundle) {
+// uploadBundle seals the given bundle (which should be active) and
+// starts the upload process to GCS in the background.  The trigger is
+// the limit that the bundle reached.  It should be called with ub.mu
+// held.
+func (ub *UploadBundle) uploadBundle(ctx context.Context, b *bundle, trigger string) {
 	// Sanity check.
-	if _, ok := ub.activeBundles[jb.Date]; !ok {
-		log.Printf("INTERNAL ERROR: %v not in active bundles map", jb.Description())
-	}
-	if len(jb.Lines) != len(jb.Index)+len(jb.BadFiles) {
-		log.Printf("INTERNAL ERROR: %v != %v + %v", len(jb.Lines), len(jb.Index), len(jb.BadFiles))
+	if len(b.jb.Lines) != len(b.jb.Index)+len(b.jb.BadFiles) {
+		log.Printf("INTERNAL ERROR: %v != %v + %v", len(b.jb.Lines), len(b.jb.Index), len(b.jb.BadFiles))
 	}
 
-	// Add the bundle to upload bundles map.
-	ub.uploadBundles[jb.Timestamp] = struct{}{}
-	// Delete the bundle from active bundles map.
-	delete(ub.activeBundles, jb.Date)
+	jostlerBundleUploads.WithLabelValues(ub.bundleConf.Datatype, trigger).Inc()
+	b.trigger = trigger
+	b.jb.Seal()
+	ub.setState(b, StateSealed, nil)
 
 	// Start the upload process in the background and acknowledge
-	// the files of this bundle with the directory watcher.
-	go ub.uploadInBackground(ctx, jb, true)
+	// the files of this bundle with the directory watcher.  If uploads
+	// are paused, the bundle stays sealed until they are resumed.
+	if ub.paused {
+		verbose("uploads paused, %v stays sealed", b.jb.Description())
+		ub.held = append(ub.held, b)
+		return
+	}
+	ub.uploads.Add(1)
+	go ub.uploadInBackground(ctx, b)
 }
 
-// uploadInBackground starts the process of uploading the specified
-// measurement data (JSONL bundle) and its associated index in the
-// background.
-func (ub *UploadBundle) uploadInBackground(ctx context.Context, jb *jsonlbundle.JSONLBundle, ack bool) {
-	go func(jb *jsonlbundle.JSONLBundle) {
-		var err error
-		// Upload data bundle.
-		objPath := filepath.Join(jb.BundleDir, jb.BundleName)
-		contents := []byte(strings.Join(jb.Lines, "\n"))
-		if err = gzipAndUpload(ctx, ub.gcsConf.GCSClient, objPath, jb.Datatype, contents); err != nil {
-			log.Printf("ERROR: data bundle %v: %v\n", jb.Description(), err)
-			return
-		}
+// uploadInBackground uploads the specified measurement data (JSONL
+// bundle) and its associated index or queues them in the outbox.  If
+// successful, it removes the files of the bundle and acknowledges them
+// with the directory watcher (unless the bundle was backfilled).
+func (ub *UploadBundle) uploadInBackground(ctx context.Context, b *bundle) {
+	defer ub.uploads.Done()
+	ub.mu.Lock()
+	ub.setState(b, StateUploading, nil)
+	ub.mu.Unlock()
 
-		// Upload index bundle.
-		objPath = filepath.Join(jb.IndexDir, jb.IndexName)
-		contents, err = jb.MarshalIndex()
-		if err != nil {
-			log.Printf("ERROR: failed to marshal index for bundle %v: %v\n", jb.Description(), err)
-			return
-		}
-		if err = gzipAndUpload(ctx, ub.gcsConf.GCSClient, objPath, "index1", contents); err != nil {
-			log.Printf("ERROR: index bundle %v: %v\n", jb.Description(), err)
-			return
-		}
+	jb := b.jb
+	state, err := ub.uploadJSONLBundle(ctx, b)
+	ub.mu.Lock()
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+	}
+	ub.setState(b, state, err)
+	ub.mu.Unlock()
+	if err != nil {
+		return
+	}
 
-		// Remove uploaded files from the local filesystem.
+	// Remove uploaded (or queued) files from the local filesystem or
+	// retain them.
+	if ub.bundleConf.Retainer != nil {
+		ub.retainLocalFiles(jb)
+	} else {
 		jb.RemoveLocalFiles()
+	}
+
+	// Tell directory watcher we're done with these files.
+	if !b.backfill {
+		ub.wdClient.WatchAckChan() <- append(jb.IndexFilenames(), jb.BadFiles...)
+	}
+}
 
-		// Tell directory watcher we're done with these files.
-		if ack {
-			ub.wdClient.WatchAckChan() <- append(jb.IndexFilenames(), jb.BadFiles...)
+// retainLocalFiles hands the files of the given bundle to the retainer.
+// Files that cannot be retained and bad files, which were not uploaded,
+// are removed.
+func (ub *UploadBundle) retainLocalFiles(jb *jsonlbundle.JSONLBundle) {
+	for _, index := range jb.Index {
+		err := ub.bundleConf.Retainer.Retain(index.Filename)
+		if err == nil {
+			continue
+		}
+		log.Printf("ERROR: %v\n", err)
+		if err := os.Remove(index.Filename); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("ERROR: failed to remove uploaded data file: %v\n", err)
+		}
+	}
+	for _, fullPath := range jb.BadFiles {
+		verbose("removing bad data file %v", fullPath)
+		if err := os.Remove(fullPath); err != nil {
+			log.Printf("ERROR: failed to remove bad data file: %v\n", err)
 		}
-	}(jb)
+	}
 }
 
-// gzipAndUpload compresses the specified contents and uploads it via
-// the specified upload client.
-func gzipAndUpload(ctx context.Context, gcsClient Uploader, objPath, datatype string, contents []byte) error {
+// uploadJSONLBundle uploads the given bundle and its index and returns
+// the state the bundle should move to.  Unless the bundle was
+// backfilled, it's queued in the outbox (if configured) when the upload
+// fails or when the outbox already has bundles.
+func (ub *UploadBundle) uploadJSONLBundle(ctx context.Context, b *bundle) (State, error) {
+	objs, err := bundleObjects(b.jb)
+	if err != nil {
+		return StateFailed, err
+	}
+	ob := ub.gcsConf.Outbox
+	if ob == nil || b.backfill {
+		if err := uploadObjects(ctx, ub.gcsConf.GCSClient, objs); err != nil {
+			return StateFailed, fmt.Errorf("bundle %v: %w", b.jb.Description(), err)
+		}
+		return StateUploaded, nil
+	}
+	if ob.Pending() {
+		verbose("outbox has bundles, queuing %v", b.jb.Description())
+	} else {
+		err := uploadObjects(ctx, ub.gcsConf.GCSClient, objs)
+		if err == nil {
+			return StateUploaded, nil
+		}
+		log.Printf("ERROR: bundle %v: %v (queuing in outbox)\n", b.jb.Description(), err)
+	}
+	if err := ob.Add(objs); err != nil {
+		return StateFailed, fmt.Errorf("bundle %v: failed to queue in outbox: %w", b.jb.Description(), err)
+	}
+	return StateQueued, nil
+}
+
+// bundleObjects returns the compressed data bundle and index bundle of
+// the given bundle as GCS objects.
+func bundleObjects(jb *jsonlbundle.JSONLBundle) ([]outbox.Object, error) {
+	data, err := gzipContents([]byte(strings.Join(jb.Lines, "\n")))
+	if err != nil {
+		return nil, fmt.Errorf("data bundle %v: %w", jb.Description(), err)
+	}
+	contents, err := jb.MarshalIndex()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal index for bundle %v: %w", jb.Description(), err)
+	}
+	index, err := gzipContents(contents)
+	if err != nil {
+		return nil, fmt.Errorf("index bundle %v: %w", jb.Description(), err)
+	}
+	return []outbox.Object{
+		{Name: filepath.Join(jb.BundleDir, jb.BundleName), Datatype: jb.Datatype, Contents: data},
+		{Name: filepath.Join(jb.IndexDir, jb.IndexName), Datatype: "index1", Contents: index},
+	}, nil
+}
+
+// gzipContents compresses the specified contents.
+func gzipContents(contents []byte) ([]byte, error) {
 	var gzContents bytes.Buffer
 	gzipWriter := gzip.NewWriter(&gzContents)
 	if _, err := gzipWriter.Write(contents); err != nil {
-		return fmt.Errorf("failed to gzip: %w", err)
+		return nil, fmt.Errorf("failed to gzip: %w", err)
 	}
 	if err := gzipWriter.Close(); err != nil {
-		return fmt.Errorf("failed to close gzip writer: %w", err)
+		return nil, fmt.Errorf("failed to close gzip writer: %w", err)
 	}
+	return gzContents.Bytes(), nil
+}
 
-	verbose("uploading %v", objPath)
-	gzBytes := gzContents.Bytes()
-	if err := gcsClient.Upload(ctx, objPath, gzBytes); err != nil {
-		return fmt.Errorf("failed to upload: %w", err)
+// uploadObjects uploads the specified objects in order via the
+// specified upload client.
+func uploadObjects(ctx context.Context, gcsClient Uploader, objs []outbox.Object) error {
+	for _, obj := range objs {
+		verbose("uploading %v", obj.Name)
+		if err := gcsClient.Upload(ctx, obj.Name, obj.Contents); err != nil {
+			return fmt.Errorf("failed to upload %v: %w", obj.Name, err)
+		}
+		jostlerBytesPerBundle.WithLabelValues(obj.Datatype).Observe(float64(len(obj.Contents)))
 	}
-	jostlerBytesPerBundle.WithLabelValues(datatype).Observe(float64(len(gzBytes)))
 	return nil
 }
@@ -3,13 +3,17 @@ package uploadbundle
 import (
 	"context"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/m-lab/jostler/internal/layout"
+	"github.com/m-lab/jostler/internal/naming"
 	"github.com/m-lab/jostler/internal/testhelper"
 	"github.com/m-lab/jostler/internal/watchdir"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestVerbose(t *testing.T) {
@@ -21,12 +25,13 @@ func TestNew(t *testing.T) {
 	if err != nil {
 		t.Fatalf("testhelper.WatchDirNew() = %v, want nil", err)
 	}
+	dataTemplate := naming.MustParse(naming.DefaultData)
 	tests := []struct {
 		name          string
 		wdClient      *testhelper.WatchDir
 		gcsBucket     string
 		gcsDataDir    string
-		gcsDataBaseID string
+		dataTemplate  *naming.Template
 		bundleDataDir string
 		wantErr       error
 	}{
@@ -35,7 +40,7 @@ func TestNew(t *testing.T) {
 			wdClient:      nil,
 			gcsBucket:     "some-bucket",
 			gcsDataDir:    "some/path/in/gcs",
-			gcsDataBaseID: "some-string",
+			dataTemplate:  dataTemplate,
 			bundleDataDir: "/some/path",
 			wantErr:       ErrConfig,
 		},
@@ -44,7 +49,7 @@ func TestNew(t *testing.T) {
 			wdClient:      wdClient,
 			gcsBucket:     "",
 			gcsDataDir:    "some/path/in/gcs",
-			gcsDataBaseID: "some-string",
+			dataTemplate:  dataTemplate,
 			bundleDataDir: "/some/path",
 			wantErr:       ErrConfig,
 		},
@@ -53,16 +58,16 @@ func TestNew(t *testing.T) {
 			wdClient:      wdClient,
 			gcsBucket:     "some-bucket",
 			gcsDataDir:    "",
-			gcsDataBaseID: "some-string",
+			dataTemplate:  dataTemplate,
 			bundleDataDir: "/some/path",
 			wantErr:       ErrConfig,
 		},
 		{
-			name:          "empty string gcsDataBaseID",
+			name:          "nil dataTemplate",
 			wdClient:      wdClient,
 			gcsBucket:     "some-bucket",
 			gcsDataDir:    "some/path/in/gcs",
-			gcsDataBaseID: "",
+			dataTemplate:  nil,
 			bundleDataDir: "/some/path",
 			wantErr:       ErrConfig,
 		},
@@ -71,7 +76,7 @@ func TestNew(t *testing.T) {
 			wdClient:      wdClient,
 			gcsBucket:     "some-bucket",
 			gcsDataDir:    "some/path/in/gcs",
-			gcsDataBaseID: "some-string",
+			dataTemplate:  dataTemplate,
 			bundleDataDir: "",
 			wantErr:       ErrConfig,
 		},
@@ -80,7 +85,7 @@ func TestNew(t *testing.T) {
 			wdClient:      wdClient,
 			gcsBucket:     "newclient",
 			gcsDataDir:    "some/path/in/gcs",
-			gcsDataBaseID: "some-string",
+			dataTemplate:  dataTemplate,
 			bundleDataDir: "/some/path",
 			wantErr:       nil,
 		},
@@ -91,10 +96,11 @@ func TestNew(t *testing.T) {
 	}
 	for i, test := range tests {
 		gcsConf := GCSConfig{
-			GCSClient: stClient,
-			Bucket:    test.gcsBucket,
-			DataDir:   test.gcsDataDir,
-			BaseID:    test.gcsDataBaseID,
+			GCSClient:     stClient,
+			Bucket:        test.gcsBucket,
+			DataDir:       test.gcsDataDir,
+			DataTemplate:  test.dataTemplate,
+			IndexTemplate: naming.MustParse(naming.DefaultIndex),
 		}
 		bundleConf := BundleConfig{
 			Datatype: "foo1",
@@ -121,6 +127,258 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestFileDetailsDateSourceAndLayout(t *testing.T) {
+	wdClient, err := testhelper.WatchDirNew("/some/path")
+	if err != nil {
+		t.Fatalf("testhelper.WatchDirNew() = %v, want nil", err)
+	}
+	stClient, err := testhelper.NewClient(context.Background(), "newclient,upload")
+	if err != nil {
+		t.Fatalf("testhelper.NewClient() = %v, wanted nil", err)
+	}
+	spoolDir := t.TempDir()
+	mtime := time.Date(2023, time.March, 4, 23, 59, 0, 0, time.UTC)
+	for _, file := range []struct {
+		name     string
+		contents string
+	}{
+		{name: "2022/11/09/dated.json", contents: `{"StartTime": "2023-01-02T03:04:05Z"}`},
+		{name: "flat.json", contents: `{"StartTime": "2023-01-02T23:04:05-05:00"}`},
+		{name: "date.json", contents: `{"Meta": {"Date": "2023-02-03"}}`},
+		{name: "no-date.json", contents: `{"Field1": 1}`},
+		{name: "2022-11-10/12/hourly.json", contents: `{"Field1": 1}`},
+	} {
+		f := filepath.Join(spoolDir, file.name)
+		if err := os.MkdirAll(filepath.Dir(f), 0o755); err != nil {
+			t.Fatalf("os.MkdirAll() = %v, want nil", err)
+		}
+		if err := os.WriteFile(f, []byte(file.contents), 0o644); err != nil {
+			t.Fatalf("os.WriteFile() = %v, want nil", err)
+		}
+		if err := os.Chtimes(f, mtime, mtime); err != nil {
+			t.Fatalf("os.Chtimes() = %v, want nil", err)
+		}
+	}
+	tests := []struct {
+		name       string
+		dateSource string
+		dateField  string
+		template   string
+		file       string
+		wantErr    error
+		wantTime   time.Time
+	}{
+		{name: "directory", file: "2022/11/09/dated.json", wantTime: time.Date(2022, time.November, 9, 0, 0, 0, 0, time.UTC)},
+		{name: "directory of flat file", file: "flat.json", wantErr: layout.ErrNoMatch},
+		{name: "hourly layout", template: "{yyyy}-{mm}-{dd}/{hh}/{name}", file: "2022-11-10/12/hourly.json", wantTime: time.Date(2022, time.November, 10, 12, 0, 0, 0, time.UTC)},
+		{name: "hourly layout of daily file", template: "{yyyy}-{mm}-{dd}/{hh}/{name}", file: "2022/11/09/dated.json", wantErr: layout.ErrNoMatch},
+		{name: "directory of flat layout", template: "{name}", wantErr: ErrConfig},
+		{name: "mtime of flat layout", dateSource: DateFromMTime, template: "{name}", file: "flat.json", wantTime: mtime},
+		{name: "mtime of file not in flat layout", dateSource: DateFromMTime, template: "{name}", file: "2022/11/09/dated.json", wantErr: layout.ErrNoMatch},
+		{name: "mtime", dateSource: DateFromMTime, file: "flat.json", wantTime: mtime},
+		{name: "timestamp field in UTC", dateSource: DateFromField, dateField: "StartTime", file: "flat.json", wantTime: time.Date(2023, time.January, 3, 4, 4, 5, 0, time.UTC)},
+		{name: "date field", dateSource: DateFromField, dateField: "Meta.Date", file: "date.json", wantTime: time.Date(2023, time.February, 3, 0, 0, 0, 0, time.UTC)},
+		{name: "missing field", dateSource: DateFromField, dateField: "StartTime", file: "no-date.json", wantErr: ErrDateParse},
+		{name: "no field", dateSource: DateFromField, wantErr: ErrConfig},
+		{name: "invalid date source", dateSource: "ctime", wantErr: ErrConfig},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		gcsConf := GCSConfig{
+			GCSClient:     stClient,
+			Bucket:        "newclient,upload",
+			DataDir:       "some/path/in/gcs",
+			DataTemplate:  naming.MustParse(naming.DefaultData),
+			IndexTemplate: naming.MustParse(naming.DefaultIndex),
+		}
+		bundleConf := BundleConfig{
+			Datatype:   "foo1",
+			SpoolDir:   spoolDir,
+			SizeMax:    20 * 1024 * 1024,
+			AgeMax:     1 * time.Hour,
+			DateSource: test.dateSource,
+			DateField:  test.dateField,
+		}
+		if test.template != "" {
+			if bundleConf.Layout, err = layout.Parse(test.template); err != nil {
+				t.Fatalf("layout.Parse() = %v, want nil", err)
+			}
+		}
+		ub, gotErr := New(context.Background(), wdClient, gcsConf, bundleConf)
+		if gotErr == nil {
+			var fileTime time.Time
+			fileTime, _, gotErr = ub.fileDetails(filepath.Join(spoolDir, test.file))
+			if gotErr == nil && !fileTime.Equal(test.wantTime) {
+				t.Fatalf("ub.fileDetails() = %v, want %v", fileTime, test.wantTime)
+			}
+		}
+		if !errors.Is(gotErr, test.wantErr) {
+			t.Fatalf("New() or ub.fileDetails() = %v, want %v", gotErr, test.wantErr)
+		}
+	}
+}
+
+func TestPartition(t *testing.T) {
+	wdClient, err := testhelper.WatchDirNew("/some/path")
+	if err != nil {
+		t.Fatalf("testhelper.WatchDirNew() = %v, want nil", err)
+	}
+	stClient, err := testhelper.NewClient(context.Background(), "newclient,upload")
+	if err != nil {
+		t.Fatalf("testhelper.NewClient() = %v, wanted nil", err)
+	}
+	hourlyData := "{experiment}/{datatype}/{yyyy}/{mm}/{dd}/{hh}/{timestamp}-{node}-data.jsonl.gz"
+	hourlyIndex := "{experiment}/index1/{yyyy}/{mm}/{dd}/{hh}/{timestamp}-{datatype}-{node}-index1.jsonl.gz"
+	minuteData := "{experiment}/{datatype}/{yyyy}/{mm}/{dd}/{hh}{min}/{timestamp}-{node}-data.jsonl.gz"
+	minuteIndex := "{experiment}/index1/{yyyy}/{mm}/{dd}/{hh}{min}/{timestamp}-{datatype}-{node}-index1.jsonl.gz"
+	tests := []struct {
+		name          string
+		partition     time.Duration
+		dateSource    string
+		layout        string
+		dataTemplate  string
+		indexTemplate string
+		wantErr       error
+	}{
+		{name: "default daily partition", dataTemplate: naming.DefaultData, indexTemplate: naming.DefaultIndex},
+		{name: "not whole minutes", partition: 90 * time.Second, dateSource: DateFromMTime, dataTemplate: minuteData, indexTemplate: minuteIndex, wantErr: ErrConfig},
+		{name: "does not divide a day", partition: 7 * time.Hour, dateSource: DateFromMTime, dataTemplate: hourlyData, indexTemplate: hourlyIndex, wantErr: ErrConfig},
+		{name: "hourly with daily layout", partition: PartitionHour, dataTemplate: hourlyData, indexTemplate: hourlyIndex, wantErr: ErrConfig},
+		{name: "hourly with hourly layout", partition: PartitionHour, layout: "{yyyy}/{mm}/{dd}/{hh}/{name}", dataTemplate: hourlyData, indexTemplate: hourlyIndex},
+		{name: "15 minutes with hourly layout", partition: 15 * time.Minute, layout: "{yyyy}/{mm}/{dd}/{hh}/{name}", dataTemplate: minuteData, indexTemplate: minuteIndex, wantErr: ErrConfig},
+		{name: "hourly with daily names", partition: PartitionHour, dateSource: DateFromMTime, dataTemplate: naming.DefaultData, indexTemplate: naming.DefaultIndex, wantErr: ErrConfig},
+		{name: "15 minutes with hourly index names", partition: 15 * time.Minute, dateSource: DateFromMTime, dataTemplate: minuteData, indexTemplate: hourlyIndex, wantErr: ErrConfig},
+		{name: "15 minutes", partition: 15 * time.Minute, dateSource: DateFromMTime, dataTemplate: minuteData, indexTemplate: minuteIndex},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		gcsConf := GCSConfig{
+			GCSClient:     stClient,
+			Bucket:        "newclient,upload",
+			DataDir:       "some/path/in/gcs",
+			DataTemplate:  naming.MustParse(test.dataTemplate),
+			IndexTemplate: naming.MustParse(test.indexTemplate),
+		}
+		bundleConf := BundleConfig{
+			Datatype:   "foo1",
+			SpoolDir:   "/some/path",
+			SizeMax:    20 * 1024 * 1024,
+			AgeMax:     1 * time.Hour,
+			DateSource: test.dateSource,
+			Partition:  test.partition,
+		}
+		if test.layout != "" {
+			bundleConf.Layout = layout.MustParse(test.layout)
+		}
+		if _, err := New(context.Background(), wdClient, gcsConf, bundleConf); !errors.Is(err, test.wantErr) {
+			t.Fatalf("New() = %v, want %v", err, test.wantErr)
+		}
+	}
+}
+
+func TestAgeTimerDelay(t *testing.T) {
+	ub := &UploadBundle{bundleConf: BundleConfig{AgeMax: time.Hour, Partition: 15 * time.Minute, FlushDelay: time.Minute, PressureAgeMax: 30 * time.Second}}
+	now := time.Now().UTC()
+	tests := []struct {
+		name     string
+		start    time.Time
+		pressure bool
+		min      time.Duration
+		max      time.Duration
+	}{
+		{name: "closed partition", start: now.Add(-24 * time.Hour).Truncate(15 * time.Minute), min: time.Minute, max: time.Minute},
+		{name: "open partition", start: now.Truncate(15 * time.Minute), min: time.Minute, max: 16 * time.Minute},
+		{name: "partition that closes after maximum age", start: now.Add(2 * time.Hour).Truncate(15 * time.Minute), min: time.Hour, max: time.Hour},
+		{name: "under disk pressure", start: now.Truncate(15 * time.Minute), pressure: true, min: 30 * time.Second, max: 30 * time.Second},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		ub.pressure = test.pressure
+		if got := ub.ageTimerDelay(test.start); got < test.min || got > test.max {
+			t.Fatalf("ageTimerDelay() = %v, want between %v and %v", got, test.min, test.max)
+		}
+	}
+}
+
+func TestBundleLimits(t *testing.T) {
+	wdClient, err := testhelper.WatchDirNew("/some/path")
+	if err != nil {
+		t.Fatalf("testhelper.WatchDirNew() = %v, want nil", err)
+	}
+	stClient, err := testhelper.NewClient(context.Background(), "newclient,upload")
+	if err != nil {
+		t.Fatalf("testhelper.NewClient() = %v, wanted nil", err)
+	}
+	contents := `{"Field1": 1, "Field2": 0.1, "NMSVersion": "v1.0.0"}`
+	tests := []struct {
+		name              string
+		sizeMax           uint
+		rowsMax           uint
+		compressedSizeMax uint
+		wantUploads       map[string]int
+		wantActive        int
+	}{
+		{name: "no limit reached", sizeMax: 1024 * 1024, wantUploads: map[string]int{}, wantActive: 5},
+		{name: "size", sizeMax: uint(len(contents)), wantUploads: map[string]int{triggerSize: 4}, wantActive: 1},
+		{name: "rows", sizeMax: 1024 * 1024, rowsMax: 2, wantUploads: map[string]int{triggerRows: 2}, wantActive: 1},
+		{name: "compressed size", sizeMax: 1024 * 1024, compressedSizeMax: 1, wantUploads: map[string]int{triggerCompressedSize: 5}},
+		{name: "rows before size", sizeMax: uint(len(contents)), rowsMax: 1, wantUploads: map[string]int{triggerRows: 5}},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		spoolDir := t.TempDir()
+		dateDir := filepath.Join(spoolDir, "2022/11/09")
+		if err := os.MkdirAll(dateDir, 0o755); err != nil {
+			t.Fatalf("os.MkdirAll() = %v, want nil", err)
+		}
+		gcsConf := GCSConfig{
+			GCSClient:     stClient,
+			Bucket:        "newclient,upload",
+			DataDir:       "testdata/autoload/v1",
+			DataTemplate:  naming.MustParse(naming.DefaultData),
+			IndexTemplate: naming.MustParse(naming.DefaultIndex),
+		}
+		bundleConf := BundleConfig{
+			Datatype:          "foo1",
+			SpoolDir:          spoolDir,
+			SizeMax:           test.sizeMax,
+			AgeMax:            1 * time.Hour,
+			RowsMax:           test.rowsMax,
+			CompressedSizeMax: test.compressedSizeMax,
+		}
+		ub, err := New(context.Background(), wdClient, gcsConf, bundleConf)
+		if err != nil {
+			t.Fatalf("New() = %v, want nil", err)
+		}
+		before := map[string]float64{}
+		for _, trigger := range []string{triggerSize, triggerRows, triggerCompressedSize} {
+			before[trigger] = testutil.ToFloat64(jostlerBundleUploads.WithLabelValues("foo1", trigger))
+		}
+		for j := 0; j < 5; j++ {
+			f := filepath.Join(dateDir, fmt.Sprintf("%d.json", j))
+			if err := os.WriteFile(f, []byte(contents), 0o644); err != nil {
+				t.Fatalf("os.WriteFile() = %v, want nil", err)
+			}
+			ub.bundleFile(context.Background(), f)
+		}
+		for trigger, n := range before {
+			got := testutil.ToFloat64(jostlerBundleUploads.WithLabelValues("foo1", trigger)) - n
+			if got != float64(test.wantUploads[trigger]) {
+				t.Fatalf("%v uploads = %v, want %v", trigger, got, test.wantUploads[trigger])
+			}
+		}
+		active := 0
+		for _, info := range ub.Bundles() {
+			if info.State == StateActive {
+				active += info.Files
+			}
+		}
+		if active != test.wantActive {
+			t.Fatalf("active lines = %v, want %v", active, test.wantActive)
+		}
+	}
+}
+
 func TestBundleAndUploadCtx(t *testing.T) {
 	Verbose(testhelper.VLogf)
 
@@ -215,11 +473,12 @@ func setupClients(t *testing.T, sizeMax uint, ageMax time.Duration) (*testhelper
 		t.Fatalf("testhelper.NewClient() = %v, wanted nil", err)
 	}
 	gcsConf := GCSConfig{
-		GCSClient: stClient,
-		Bucket:    "newclient,upload",
-		DataDir:   "testdata/autoload/v1/experiment/datatype",
-		IndexDir:  "testdata/autoload/v1/experiment/index1",
-		BaseID:    "some-string",
+		GCSClient:     stClient,
+		Bucket:        "newclient,upload",
+		DataDir:       "testdata/autoload/v1",
+		DataTemplate:  naming.MustParse(naming.DefaultData),
+		IndexTemplate: naming.MustParse(naming.DefaultIndex),
+		Vars:          naming.Vars{Machine: "mlab1", Site: "lga01", Experiment: "jostler"},
 	}
 	bundleConf := BundleConfig{
 		Datatype: "foo1",
@@ -0,0 +1,268 @@
+// Package verify implements audits of the data and index bundles that
+// jostler uploaded to GCS.  For the bundles of a datatype in a date
+// range, it verifies that:
+//
+//  1. For every data bundle there is an index bundle and vice versa.
+//  2. Both bundles can be decompressed and every line is valid JSON.
+//  3. The files in the index and data bundles are the same, appear in
+//     the same order, and have the sizes the index says.
+//  4. Every row of the data bundle conforms to the table schema and to
+//     the invariants of version 0 of the standard columns.
+//
+// Problems are collected in a report instead of stopping the audit.
+package verify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/civil"
+
+	"github.com/m-lab/jostler/api"
+	"github.com/m-lab/jostler/internal/bundleio"
+	"github.com/m-lab/jostler/internal/naming"
+	"github.com/m-lab/jostler/internal/schema"
+)
+
+// Kinds of problems.
+const (
+	ProblemOrphanedData  = "orphaned-data"  // data bundle without an index bundle
+	ProblemOrphanedIndex = "orphaned-index" // index bundle without a data bundle
+	ProblemCorrupt       = "corrupt"        // bundle cannot be decompressed or a line is not valid JSON
+	ProblemMismatch      = "mismatch"       // index and data bundles do not list the same files
+	ProblemInvalidRow    = "invalid-row"    // row does not conform to the table schema or standard columns
+)
+
+// Config defines which bundles to verify and how.
+type Config struct {
+	Bucket        string           // GCS bucket of the bundles
+	HomeDir       string           // home directory in the bucket (e.g., autoload/v1)
+	DataTemplate  *naming.Template // template of object names of data bundles
+	IndexTemplate *naming.Template // template of object names of index bundles
+	Vars          naming.Vars      // experiment, datatype, organization (and node, if any) of the bundles
+	From          civil.Date       // date of the first partition to verify
+	To            civil.Date       // date of the last partition to verify
+	Fields        schema.Fields    // table schema (nil to skip validating rows)
+}
+
+// Problem describes a problem with a bundle.
+type Problem struct {
+	Kind   string `json:"kind"`
+	Object string `json:"object"`         // object name of the bundle
+	Line   int    `json:"line,omitempty"` // line number in the bundle starting at 1 (if any)
+	Detail string `json:"detail"`
+}
+
+// Report is the outcome of verifying the bundles of a datatype.
+type Report struct {
+	Datatype     string    `json:"datatype"`
+	DataBundles  int       `json:"dataBundles"`
+	IndexBundles int       `json:"indexBundles"`
+	Rows         int       `json:"rows"`
+	Problems     []Problem `json:"problems"`
+}
+
+// OK returns true if no problems were found.
+func (r *Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Exported errors.
+var (
+	ErrList     = errors.New("failed to list bundles")
+	ErrDownload = bundleio.ErrDownload
+	ErrName     = errors.New("object name does not match data object template")
+)
+
+// maxRowProblems is the maximum number of invalid rows that are reported
+// per bundle so a bundle with a systematic problem does not flood the
+// report.
+var maxRowProblems = 10
+
+// Verify verifies the bundles that the given configuration defines and
+// returns a report of the problems it found.  It returns an error if the
+// bundles cannot be listed or downloaded, in which case the bundles
+// were not fully verified.
+func Verify(ctx context.Context, client schema.DownloaderLister, conf Config) (*Report, error) {
+	report := &Report{Datatype: conf.Vars.Datatype, Problems: []Problem{}}
+	dataObjs, err := bundleio.List(ctx, client, conf.DataTemplate.Matcher(conf.HomeDir, conf.Vars), conf.From, conf.To)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrList, err)
+	}
+	indexObjs, err := bundleio.List(ctx, client, conf.IndexTemplate.Matcher(conf.HomeDir, conf.Vars), conf.From, conf.To)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrList, err)
+	}
+	report.DataBundles, report.IndexBundles = len(dataObjs), len(indexObjs)
+
+	unpaired := make(map[string]bool, len(indexObjs))
+	for _, indexObj := range indexObjs {
+		unpaired[indexObj.Name] = true
+	}
+	for _, dataObj := range dataObjs {
+		indexObj := conf.IndexTemplate.Join(conf.HomeDir, dataObj.Vars)
+		if !unpaired[indexObj] {
+			report.addProblem(ProblemOrphanedData, dataObj.Name, 0, "no index bundle "+indexObj)
+			continue
+		}
+		delete(unpaired, indexObj)
+		if err := verifyPair(ctx, client, conf, report, dataObj.Name, indexObj, dataObj.Vars); err != nil {
+			return nil, err
+		}
+	}
+	for _, indexObj := range indexObjs {
+		if unpaired[indexObj.Name] {
+			report.addProblem(ProblemOrphanedIndex, indexObj.Name, 0, "no data bundle")
+		}
+	}
+	return report, nil
+}
+
+// Bundle verifies the given data bundle and its index bundle and returns
+// a report of the problems it found.  Unlike Verify, it does not list
+// bundles so the configured date range is not used.
+func Bundle(ctx context.Context, client schema.Downloader, conf Config, dataObj string) (*Report, error) {
+	vars, ok := conf.DataTemplate.Matcher(conf.HomeDir, conf.Vars).Match(dataObj)
+	if !ok {
+		return nil, fmt.Errorf("%v: %w", dataObj, ErrName)
+	}
+	report := &Report{Datatype: vars.Datatype, DataBundles: 1, IndexBundles: 1, Problems: []Problem{}}
+	indexObj := conf.IndexTemplate.Join(conf.HomeDir, vars)
+	if err := verifyPair(ctx, client, conf, report, dataObj, indexObj, vars); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// addProblem adds a problem to the report.
+func (r *Report) addProblem(kind, object string, line int, detail string) {
+	r.Problems = append(r.Problems, Problem{Kind: kind, Object: object, Line: line, Detail: detail})
+}
+
+// dataRow defines the fields of version 0 of the standard columns in a
+// line of a data bundle.  Later versions are supersets of version 0.
+type dataRow struct {
+	Date     string
+	Archiver api.ArchiverV0
+	Raw      json.RawMessage
+}
+
+// verifyPair verifies the given data bundle and its index bundle.
+func verifyPair(ctx context.Context, client schema.Downloader, conf Config, report *Report, dataObj, indexObj string, vars naming.Vars) error {
+	dataLines, err := bundleio.ReadLines(ctx, client, dataObj)
+	if err != nil {
+		if errors.Is(err, ErrDownload) {
+			return err
+		}
+		report.addProblem(ProblemCorrupt, dataObj, 0, err.Error())
+		return nil
+	}
+	indexLines, err := bundleio.ReadLines(ctx, client, indexObj)
+	if err != nil {
+		if errors.Is(err, ErrDownload) {
+			return err
+		}
+		report.addProblem(ProblemCorrupt, indexObj, 0, err.Error())
+		return nil
+	}
+	index := make([]api.IndexV1, len(indexLines))
+	for i, line := range indexLines {
+		if err := json.Unmarshal([]byte(line), &index[i]); err != nil || index[i].Filename == "" {
+			report.addProblem(ProblemCorrupt, indexObj, i+1, fmt.Sprintf("invalid index entry: %v", line))
+			return nil
+		}
+	}
+	rows := make([]dataRow, len(dataLines))
+	for i, line := range dataLines {
+		if err := json.Unmarshal([]byte(line), &rows[i]); err != nil {
+			report.addProblem(ProblemCorrupt, dataObj, i+1, fmt.Sprintf("invalid JSON: %v", err))
+			return nil
+		}
+	}
+	report.Rows += len(rows)
+
+	// The index and data bundles should list the same files in the
+	// same order.  Only the first difference is reported because all
+	// files after a missing file are out of order.
+	if len(index) != len(rows) {
+		report.addProblem(ProblemMismatch, dataObj, 0, fmt.Sprintf("%d row(s) but %d file(s) in index bundle %v", len(rows), len(index), indexObj))
+	}
+	offset := 0
+	for i := 0; i < len(index) && i < len(rows); i++ {
+		if detail := checkIndex(index[i], i+1, offset, dataLines[i], rows[i]); detail != "" {
+			report.addProblem(ProblemMismatch, dataObj, i+1, detail)
+			break
+		}
+		offset += len(dataLines[i]) + 1
+	}
+
+	rowProblems := 0
+	for i, row := range rows {
+		if rowProblems == maxRowProblems {
+			break
+		}
+		detail := checkStdCols(conf, dataObj, vars, row)
+		if detail == "" && conf.Fields != nil {
+			if err := conf.Fields.ValidateRow([]byte(dataLines[i])); err != nil {
+				detail = err.Error()
+			}
+		}
+		if detail != "" {
+			report.addProblem(ProblemInvalidRow, dataObj, i+1, detail)
+			rowProblems++
+		}
+	}
+	return nil
+}
+
+// checkIndex checks that the given index entry describes the given row
+// at the given line number and offset of its data bundle and returns
+// what is wrong (if anything).  Index entries created before the
+// locations of files were recorded only have their filenames and sizes
+// checked.
+func checkIndex(entry api.IndexV1, lineNum, offset int, line string, row dataRow) string {
+	if row.Archiver.Filename != entry.Filename {
+		return fmt.Sprintf("file %v but %v in index bundle", row.Archiver.Filename, entry.Filename)
+	}
+	if len(line) != entry.Size {
+		return fmt.Sprintf("%d bytes but %d in index bundle", len(line), entry.Size)
+	}
+	if entry.Line == 0 {
+		return ""
+	}
+	if entry.Line != lineNum || entry.Offset != offset {
+		return fmt.Sprintf("line %d at offset %d but line %d at offset %d in index bundle", lineNum, offset, entry.Line, entry.Offset)
+	}
+	if entry.RawOffset < 0 || entry.RawSize < 0 || entry.RawOffset+entry.RawSize > len(line) || string(row.Raw) != strings.TrimSpace(line[entry.RawOffset:entry.RawOffset+entry.RawSize]) {
+		return fmt.Sprintf("raw is not at offset %d in index bundle", entry.RawOffset)
+	}
+	return ""
+}
+
+// checkStdCols checks the invariants of version 0 of the standard
+// columns of the given row of the given data bundle and returns what is
+// wrong (if anything).
+func checkStdCols(conf Config, dataObj string, vars naming.Vars, row dataRow) string {
+	if row.Archiver.Filename == "" {
+		return "missing archiver.Filename"
+	}
+	if want := fmt.Sprintf("gs://%v/%v", conf.Bucket, dataObj); row.Archiver.ArchiveURL != want {
+		return fmt.Sprintf("archiver.ArchiveURL %v is not %v", row.Archiver.ArchiveURL, want)
+	}
+	date, err := civil.ParseDate(row.Date)
+	if err != nil {
+		return fmt.Sprintf("invalid date %q", row.Date)
+	}
+	// Partitions evenly divide days so all files of a bundle are in
+	// the date of its partition.
+	if !vars.Start.IsZero() && date != civil.DateOf(vars.Start) {
+		return fmt.Sprintf("date %v is not the date of the bundle %v", date, civil.DateOf(vars.Start))
+	}
+	if len(row.Raw) == 0 || string(row.Raw) == "null" {
+		return "missing raw"
+	}
+	return ""
+}
@@ -0,0 +1,244 @@
+package verify_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/civil"
+
+	"github.com/m-lab/jostler/internal/naming"
+	"github.com/m-lab/jostler/internal/schema"
+	"github.com/m-lab/jostler/internal/testhelper"
+	"github.com/m-lab/jostler/internal/testhelper/testbundles"
+	"github.com/m-lab/jostler/internal/testhelper/testfiles"
+	"github.com/m-lab/jostler/internal/verify"
+)
+
+const tblSchemaJSON = `[
+	{"name": "date", "type": "DATE", "mode": "REQUIRED"},
+	{"name": "archiver", "type": "RECORD", "fields": [
+		{"name": "Version", "type": "STRING"},
+		{"name": "GitCommit", "type": "STRING"},
+		{"name": "ArchiveURL", "type": "STRING"},
+		{"name": "Filename", "type": "STRING"}
+	]},
+	{"name": "raw", "type": "RECORD", "fields": [
+		{"name": "Field1", "type": "INTEGER"}
+	]}
+]`
+
+// bundle defines a data bundle and its index bundle to create for tests.
+type bundle struct {
+	timestamp string   // timestamp of the bundle in its object names
+	date      string   // date of the bundle's partition in its object names
+	files     []string // files in the data bundle
+	index     []int    // indexes of the files in the index bundle (all files in order if nil)
+	noData    bool     // if true, the data bundle is not created
+	noIndex   bool     // if true, the index bundle is not created
+	raw       string   // raw of every row (a valid raw if empty)
+	bucket    string   // bucket in archiver.ArchiveURL of every row (the verified bucket if empty)
+	corrupt   bool     // if true, the data bundle is not compressed
+}
+
+func TestVerify(t *testing.T) {
+	fields, err := schema.ParseFields([]byte(tblSchemaJSON))
+	if err != nil {
+		t.Fatalf("ParseFields() = %v, want nil", err)
+	}
+	tests := []struct {
+		name         string
+		bucket       string
+		bundles      []bundle
+		wantErr      error
+		wantData     int
+		wantIndex    int
+		wantRows     int
+		wantProblems []string // kinds of problems
+	}{
+		{
+			name:   "ok",
+			bucket: "newclient,download,list",
+			bundles: []bundle{
+				{timestamp: "20230404T101010.000000Z", date: "2023/04/04", files: []string{"1.json", "2.json"}},
+				{timestamp: "20230405T101010.000000Z", date: "2023/04/05", files: []string{"3.json"}},
+			},
+			wantData:     2,
+			wantIndex:    2,
+			wantRows:     3,
+			wantProblems: []string{},
+		},
+		{
+			name:   "out of date range",
+			bucket: "newclient,download,list",
+			bundles: []bundle{
+				{timestamp: "20230403T101010.000000Z", date: "2023/04/03", files: []string{"1.json"}, noIndex: true},
+				{timestamp: "20230406T101010.000000Z", date: "2023/04/06", files: []string{"1.json"}, noData: true},
+			},
+			wantProblems: []string{},
+		},
+		{
+			name:   "orphaned",
+			bucket: "newclient,download,list",
+			bundles: []bundle{
+				{timestamp: "20230404T101010.000000Z", date: "2023/04/04", files: []string{"1.json"}, noIndex: true},
+				{timestamp: "20230404T111111.000000Z", date: "2023/04/04", files: []string{"2.json"}, noData: true},
+			},
+			wantData:     1,
+			wantIndex:    1,
+			wantProblems: []string{verify.ProblemOrphanedData, verify.ProblemOrphanedIndex},
+		},
+		{
+			name:   "corrupt",
+			bucket: "newclient,download,list",
+			bundles: []bundle{
+				{timestamp: "20230404T101010.000000Z", date: "2023/04/04", files: []string{"1.json"}, corrupt: true},
+			},
+			wantData:     1,
+			wantIndex:    1,
+			wantProblems: []string{verify.ProblemCorrupt},
+		},
+		{
+			name:   "mismatch",
+			bucket: "newclient,download,list",
+			bundles: []bundle{
+				{timestamp: "20230404T101010.000000Z", date: "2023/04/04", files: []string{"1.json", "2.json"}, index: []int{1, 0}},
+				{timestamp: "20230404T111111.000000Z", date: "2023/04/04", files: []string{"1.json", "2.json"}, index: []int{0}},
+			},
+			wantData:     2,
+			wantIndex:    2,
+			wantRows:     4,
+			wantProblems: []string{verify.ProblemMismatch, verify.ProblemMismatch},
+		},
+		{
+			name:   "invalid rows",
+			bucket: "newclient,download,list",
+			bundles: []bundle{
+				{timestamp: "20230404T101010.000000Z", date: "2023/04/04", files: []string{"1.json", "2.json"}, raw: `{"Field1": "x"}`},
+				{timestamp: "20230404T111111.000000Z", date: "2023/04/04", files: []string{"3.json"}, bucket: "other"},
+			},
+			wantData:     2,
+			wantIndex:    2,
+			wantRows:     3,
+			wantProblems: []string{verify.ProblemInvalidRow, verify.ProblemInvalidRow, verify.ProblemInvalidRow},
+		},
+		{
+			name:    "list fails",
+			bucket:  "newclient,faillist",
+			wantErr: verify.ErrList,
+		},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d: %v%s", testhelper.ANSIPurple, i, test.name, testhelper.ANSIEnd)
+		homeDir := filepath.Join(t.TempDir(), "autoload/v1")
+		conf := verify.Config{
+			Bucket:        "bucket",
+			HomeDir:       homeDir,
+			DataTemplate:  naming.MustParse(naming.DefaultData),
+			IndexTemplate: naming.MustParse(naming.DefaultIndex),
+			Vars:          naming.Vars{Experiment: "jostler", Datatype: "foo1"},
+			From:          civil.Date{Year: 2023, Month: time.April, Day: 4},
+			To:            civil.Date{Year: 2023, Month: time.April, Day: 5},
+			Fields:        fields,
+		}
+		for _, b := range test.bundles {
+			writeBundle(t, conf, b)
+		}
+		client, err := testhelper.NewClient(context.Background(), test.bucket)
+		if err != nil {
+			t.Fatalf("testhelper.NewClient() = %v, want nil", err)
+		}
+		report, err := verify.Verify(context.Background(), client, conf)
+		if !errors.Is(err, test.wantErr) {
+			t.Fatalf("Verify() = %v, want %v", err, test.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		if report.DataBundles != test.wantData || report.IndexBundles != test.wantIndex || report.Rows != test.wantRows {
+			t.Fatalf("Verify() = %+v, want %v data bundles, %v index bundles, %v rows", report, test.wantData, test.wantIndex, test.wantRows)
+		}
+		gotProblems := []string{}
+		for _, p := range report.Problems {
+			gotProblems = append(gotProblems, p.Kind)
+		}
+		if strings.Join(gotProblems, ",") != strings.Join(test.wantProblems, ",") {
+			t.Fatalf("Verify() problems = %+v, want %v", report.Problems, test.wantProblems)
+		}
+		if report.OK() != (len(test.wantProblems) == 0) {
+			t.Fatalf("OK() = %v, want %v", report.OK(), len(test.wantProblems) == 0)
+		}
+	}
+}
+
+func TestBundle(t *testing.T) {
+	conf := verify.Config{
+		Bucket:        "bucket",
+		HomeDir:       filepath.Join(t.TempDir(), "autoload/v1"),
+		DataTemplate:  naming.MustParse(naming.DefaultData),
+		IndexTemplate: naming.MustParse(naming.DefaultIndex),
+		Vars:          naming.Vars{Experiment: "jostler", Datatype: "foo1"},
+	}
+	writeBundle(t, conf, bundle{timestamp: "20230404T101010.000000Z", date: "2023/04/04", files: []string{"1.json", "2.json"}})
+	writeBundle(t, conf, bundle{timestamp: "20230404T111111.000000Z", date: "2023/04/04", files: []string{"1.json"}, noIndex: true})
+	client, err := testhelper.NewClient(context.Background(), "newclient,download")
+	if err != nil {
+		t.Fatalf("testhelper.NewClient() = %v, want nil", err)
+	}
+	dataObj := filepath.Join(conf.HomeDir, "jostler/foo1/2023/04/04/20230404T101010.000000Z-foo1-mlab1-lga01-jostler-data.jsonl.gz")
+	report, err := verify.Bundle(context.Background(), client, conf, dataObj)
+	if err != nil || !report.OK() || report.Rows != 2 {
+		t.Fatalf("Bundle() = %+v, %v, want 2 rows and no problems", report, err)
+	}
+	if _, err := verify.Bundle(context.Background(), client, conf, filepath.Join(conf.HomeDir, "jostler/foo1/other.jsonl.gz")); !errors.Is(err, verify.ErrName) {
+		t.Fatalf("Bundle() = %v, want %v", err, verify.ErrName)
+	}
+	dataObj = filepath.Join(conf.HomeDir, "jostler/foo1/2023/04/04/20230404T111111.000000Z-foo1-mlab1-lga01-jostler-data.jsonl.gz")
+	if _, err := verify.Bundle(context.Background(), client, conf, dataObj); !errors.Is(err, verify.ErrDownload) {
+		t.Fatalf("Bundle() = %v, want %v", err, verify.ErrDownload)
+	}
+}
+
+// writeBundle writes the given data and index bundles where the local
+// disk storage client expects them.
+func writeBundle(t *testing.T, conf verify.Config, b bundle) {
+	t.Helper()
+	bucket := b.bucket
+	if bucket == "" {
+		bucket = conf.Bucket
+	}
+	tb := testbundles.Bundle{Timestamp: b.timestamp, Date: b.date, Files: b.files}
+	if b.raw != "" {
+		for range b.files {
+			tb.Contents = append(tb.Contents, b.raw)
+		}
+	}
+	jb := testbundles.New(t, testbundles.Config{
+		Bucket:        bucket,
+		HomeDir:       conf.HomeDir,
+		DataTemplate:  conf.DataTemplate,
+		IndexTemplate: conf.IndexTemplate,
+		Vars:          conf.Vars,
+		SpoolDir:      t.TempDir(),
+	}, tb)
+	if b.index != nil {
+		index := jb.Index
+		jb.Index = nil
+		for _, i := range b.index {
+			jb.Index = append(jb.Index, index[i])
+		}
+	}
+	if !b.noData {
+		if b.corrupt {
+			testfiles.WriteFile(t, testbundles.DataObject(jb), []byte(strings.Join(jb.Lines, "\n")))
+		} else {
+			testbundles.WriteData(t, jb)
+		}
+	}
+	if !b.noIndex {
+		testbundles.WriteIndex(t, jb)
+	}
+}
@@ -13,6 +13,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/m-lab/jostler/internal/layout"
+	"github.com/m-lab/jostler/internal/spoollock"
 	"github.com/rjeczalik/notify"
 )
 
@@ -27,11 +29,13 @@ type WatchEvent struct {
 type WatchDir struct {
 	watchDir          string              // directory to watch
 	watchExtensions   map[string]struct{} // filename extensions to watch (empty means everything)
+	watchLayout       *layout.Layout      // layout of files to watch (nil means everything)
 	watchEvents       []notify.Event      // events to watch for
 	watchChan         chan WatchEvent     // channel to send watch events through
 	watchAckChan      chan []string       // channel for client to acknowledge events received
 	missedAge         time.Duration       // a file's minimum age before it's considered missed
 	missedInterval    time.Duration       // internval for scanning filesystem for missed files
+	scanChan          chan struct{}       // requests to scan filesystem for missed files right away
 	notifiedFiles     map[string]struct{} // files for which notification was sent
 	notifiedFilesLock sync.Mutex          // lock for notifiedFiles
 }
@@ -82,8 +86,9 @@ func verbose(fmt string, args ...interface{}) {
 	vFuncLock.Unlock()
 }
 
-// New returns a new instance of WatchDir.
-func New(watchDir string, watchExtensions []string, watchEvents []notify.Event, missedAge, missedInterval time.Duration) (*WatchDir, error) {
+// New returns a new instance of WatchDir.  If watchLayout is not nil,
+// only files whose pathnames relative to watchDir match it are watched.
+func New(watchDir string, watchExtensions []string, watchLayout *layout.Layout, watchEvents []notify.Event, missedAge, missedInterval time.Duration) (*WatchDir, error) {
 	// If watchEvents is empty, it means all watch events; otherwise,
 	// it's a list of specific watch events and we should validate it.
 	if len(watchEvents) == 0 {
@@ -96,11 +101,13 @@ func New(watchDir string, watchExtensions []string, watchEvents []notify.Event,
 	wd := &WatchDir{
 		watchDir:          filepath.Clean(watchDir),
 		watchExtensions:   make(map[string]struct{}),
+		watchLayout:       watchLayout,
 		watchEvents:       watchEvents,
 		watchChan:         make(chan WatchEvent, watchChanSize),
 		watchAckChan:      make(chan []string, watchChanSize),
 		missedAge:         missedAge,
 		missedInterval:    missedInterval,
+		scanChan:          make(chan struct{}, 1),
 		notifiedFiles:     make(map[string]struct{}, notifiedFilesSize),
 		notifiedFilesLock: sync.Mutex{},
 	}
@@ -123,6 +130,33 @@ func (wd *WatchDir) WatchAckChan() chan<- []string {
 	return wd.watchAckChan
 }
 
+// Scan asks WatchAndNotify to scan the filesystem for missed files right
+// away instead of waiting for the next scan interval.
+func (wd *WatchDir) Scan() {
+	// A pending request covers this one too.
+	select {
+	case wd.scanChan <- struct{}{}:
+	default:
+	}
+}
+
+// Pending returns the number of files for which notification was sent
+// but not acknowledged yet.
+func (wd *WatchDir) Pending() int {
+	wd.notifiedFilesLock.Lock()
+	defer wd.notifiedFilesLock.Unlock()
+	return len(wd.notifiedFiles)
+}
+
+// IsPending returns true if notification was sent for the given file
+// but not acknowledged yet.
+func (wd *WatchDir) IsPending(fullPath string) bool {
+	wd.notifiedFilesLock.Lock()
+	defer wd.notifiedFilesLock.Unlock()
+	_, ok := wd.notifiedFiles[filepath.Clean(fullPath)]
+	return ok
+}
+
 // WatchAndNotify watches a directory (and possibly all its subdirectories)
 // for the configured events and sends the pathnames of the events it received
 // through the configured channel.
@@ -214,6 +248,8 @@ func (wd *WatchDir) findMissedAndNotify(ctx context.Context) {
 			return
 		case <-time.After(wd.missedInterval):
 			verbose("'scanning %v", wd.watchDir)
+		case <-wd.scanChan:
+			verbose("'scanning %v on request", wd.watchDir)
 		}
 
 		lastMod := time.Now().Add(-wd.missedAge)
@@ -241,6 +277,33 @@ func (wd *WatchDir) findMissedAndNotify(ctx context.Context) {
 	}
 }
 
+// Files returns the pathnames of all files in the watched directory and
+// its subdirectories that would be watched, regardless of their age.
+// It does not send notifications.
+func (wd *WatchDir) Files() ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(wd.watchDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to access path: %w", err)
+		}
+		if d.IsDir() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return fmt.Errorf("failed to get file info: %w", err)
+		}
+		if wd.validPath(path, fi) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk directory %v: %w", wd.watchDir, err)
+	}
+	return files, nil
+}
+
 // checkAndNotify checks if this file is already in the notifiedFiles map.
 // If it is, there's nothing to do.  Otherwise, add to the notifiedFiles
 // map and send notificatio.
@@ -257,14 +320,29 @@ func (wd *WatchDir) checkAndNotify(we WatchEvent) {
 	verbose("notification sent for %v", we)
 }
 
-// validPath returns true if the given path has a valid extension and
-// is a regular file.
+// validPath returns true if the given path has a valid extension,
+// matches the layout, and is a regular file other than the lock file
+// of the directory (see the spoollock package).
 func (wd *WatchDir) validPath(path string, fi os.FileInfo) bool {
+	if filepath.Base(path) == spoollock.Name {
+		return false
+	}
 	if len(wd.watchExtensions) > 0 {
 		if _, ok := wd.watchExtensions[filepath.Ext(path)]; !ok {
 			return false
 		}
 	}
+	if wd.watchLayout != nil {
+		relPath, err := filepath.Rel(wd.watchDir, path)
+		if err != nil {
+			log.Printf("WARNING: %v\n", err)
+			return false
+		}
+		if _, err := wd.watchLayout.Match(relPath); err != nil {
+			log.Printf("WARNING: ignoring %v: %v\n", path, err)
+			return false
+		}
+	}
 	if fi == nil {
 		var err error
 		fi, err = os.Stat(path)
@@ -13,6 +13,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/m-lab/jostler/internal/layout"
 	"github.com/rjeczalik/notify"
 )
 
@@ -60,7 +61,7 @@ func TestNew(t *testing.T) {
 	}
 	for i, test := range tests {
 		t.Logf("%s>>> test %02d %s%s", ANSIPurple, i, test.name, ANSIEnd)
-		_, err := New(test.watchDir, test.watchExtensions, test.watchEvents, test.missedAge, test.missedInterval)
+		_, err := New(test.watchDir, test.watchExtensions, nil, test.watchEvents, test.missedAge, test.missedInterval)
 		if !errors.Is(err, test.wantErr) {
 			t.Fatalf("New() = %v, want: %v", err, test.wantErr)
 		}
@@ -161,7 +162,7 @@ func TestWatchAndNotify(t *testing.T) {
 	for i, test := range tests {
 		t.Logf("%s>>> test %02d %s%s", ANSIPurple, i, test.name, ANSIEnd)
 		testFile := prepareFile(t, cwd, test.file, test.watchDir, test.missed, test.missedAge)
-		wd, err := New(filepath.Join(cwd, test.watchDir), test.watchExtensions, test.watchEvents, test.missedAge, test.missedInterval)
+		wd, err := New(filepath.Join(cwd, test.watchDir), test.watchExtensions, nil, test.watchEvents, test.missedAge, test.missedInterval)
 		if err != nil {
 			t.Fatalf("New() = %v, want: nil", err)
 		}
@@ -183,6 +184,108 @@ func TestWatchAndNotify(t *testing.T) {
 	}
 }
 
+func TestValidPathLayout(t *testing.T) {
+	watchDir := t.TempDir()
+	for _, file := range []string{"2022/11/09/j.json", "2022/11/09/j.txt", "j.json"} {
+		f := filepath.Join(watchDir, file)
+		if err := os.MkdirAll(filepath.Dir(f), 0o755); err != nil {
+			t.Fatalf("os.MkdirAll() = %v, want: nil", err)
+		}
+		if err := os.WriteFile(f, []byte{}, 0o666); err != nil {
+			t.Fatalf("os.WriteFile() = %v, want: nil", err)
+		}
+	}
+	tests := []struct {
+		template string
+		file     string
+		want     bool
+	}{
+		{template: "", file: "j.json", want: true},
+		{template: layout.DefaultTemplate, file: "2022/11/09/j.json", want: true},
+		{template: layout.DefaultTemplate, file: "2022/11/09/j.txt", want: false},
+		{template: layout.DefaultTemplate, file: "j.json", want: false},
+		{template: layout.DefaultTemplate, file: "2022/11/09", want: false},
+		{template: "{name}", file: "j.json", want: true},
+		{template: "{name}", file: "2022/11/09/j.json", want: false},
+	}
+	for i, test := range tests {
+		t.Logf("%s>>> test %02d %q %v%s", ANSIPurple, i, test.template, test.file, ANSIEnd)
+		var watchLayout *layout.Layout
+		if test.template != "" {
+			watchLayout = layout.MustParse(test.template)
+		}
+		wd, err := New(watchDir, []string{".json"}, watchLayout, nil, time.Hour, time.Hour)
+		if err != nil {
+			t.Fatalf("New() = %v, want: nil", err)
+		}
+		if got := wd.validPath(filepath.Join(watchDir, test.file), nil); got != test.want {
+			t.Fatalf("validPath() = %v, want: %v", got, test.want)
+		}
+	}
+}
+
+func TestFiles(t *testing.T) {
+	watchDir := t.TempDir()
+	for _, file := range []string{"2022/11/09/j.json", "2022/11/09/j.txt", "2022/11/10/k.json", "j.json"} {
+		f := filepath.Join(watchDir, file)
+		if err := os.MkdirAll(filepath.Dir(f), 0o755); err != nil {
+			t.Fatalf("os.MkdirAll() = %v, want: nil", err)
+		}
+		if err := os.WriteFile(f, []byte{}, 0o666); err != nil {
+			t.Fatalf("os.WriteFile() = %v, want: nil", err)
+		}
+	}
+	wd, err := New(watchDir, []string{".json"}, layout.MustParse(layout.DefaultTemplate), nil, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("New() = %v, want: nil", err)
+	}
+	files, err := wd.Files()
+	want := []string{filepath.Join(watchDir, "2022/11/09/j.json"), filepath.Join(watchDir, "2022/11/10/k.json")}
+	if err != nil || strings.Join(files, ",") != strings.Join(want, ",") {
+		t.Fatalf("Files() = %v, %v, want: %v, nil", files, err, want)
+	}
+
+	wd, err = New(filepath.Join(watchDir, "non-existent"), nil, nil, nil, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("New() = %v, want: nil", err)
+	}
+	if _, err = wd.Files(); err == nil {
+		t.Fatalf("Files() = nil, want: error")
+	}
+}
+
+func TestScan(t *testing.T) {
+	watchDir := t.TempDir()
+	testFile := filepath.Join(watchDir, "j.json")
+	if err := os.WriteFile(testFile, []byte{}, 0o666); err != nil {
+		t.Fatalf("os.WriteFile() = %v, want: nil", err)
+	}
+	// The scan interval is long enough that only a requested scan
+	// can find the missed file.
+	wd, err := New(watchDir, []string{".json"}, nil, nil, 0, time.Hour)
+	if err != nil {
+		t.Fatalf("New() = %v, want: nil", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = wd.WatchAndNotify(ctx)
+	}()
+	wd.Scan()
+	wd.Scan() // should not block
+	select {
+	case watchEvent := <-wd.WatchChan():
+		if watchEvent.Path != testFile || !watchEvent.Missed {
+			t.Fatalf("wd.WatchChan() = %v, want: missed %v", watchEvent, testFile)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no watch event after Scan()")
+	}
+	if wd.Pending() != 1 || !wd.IsPending(testFile) {
+		t.Fatalf("Pending() = %v, IsPending() = %v, want: 1, true", wd.Pending(), wd.IsPending(testFile))
+	}
+}
+
 func prepareFile(t *testing.T, cwd, file, watchDir string, missed bool, missedAge time.Duration) string {
 	t.Helper()
 	if file == "" {
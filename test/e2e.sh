@@ -29,13 +29,13 @@ main() {
 		cmd=container_run
 	else
 		readonly LOCAL_DATA_DIR="$PWD/$SPOOL_DIR"
-		readonly GCS_DATA_DIR="$PWD/GCS_DIR"
+		readonly GCS_DATA_DIR="$PWD/$GCS_DIR"
 		cmd=native_run
 	fi
 	readonly JOSTLER_FLAGS=(
 			"-gcs-local-disk"
 			"-mlab-node-name"       "$EXPERIMENT-mlab1-lga01.mlab-sandbox.measurement-lab.org"
-			"-gcs-bucket"           "newclient,download,upload"
+			"-gcs-bucket"           "newclient,download,upload,list"
 			"-gcs-data-dir"         "$GCS_DATA_DIR"
 			"-local-data-dir"       "$LOCAL_DATA_DIR"
 			"-experiment"           "$EXPERIMENT"